@@ -191,6 +191,8 @@ type Rec struct {
 	Features Feature `json:"features,omitempty"`
 	// Tags generated by this authentication record.
 	Tags []string `json:"tags,omitempty"`
+	// Chain of refresh tokens this record was obtained from, if any.
+	Chain string `json:"-"`
 
 	// Authenticator may request the server to create a new account.
 	// These are the account parameters which can be used for creating the account.
@@ -0,0 +1,194 @@
+package refresh
+
+// Authentication by single-use refresh tokens. A refresh token is exchanged for a new access token
+// and a new refresh token. Used tokens are kept server-side so that a reuse of a token can be detected.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Length of the refresh token in bytes.
+	tokenLength = 32
+	// Length of the chain ID in bytes.
+	chainLength = 16
+
+	// How often to delete expired tokens.
+	cleanupPeriod = time.Hour
+)
+
+// authenticator is a singleton instance of the authenticator.
+type authenticator struct {
+	name     string
+	lifetime time.Duration
+}
+
+// Init initializes the authenticator: parses the config and starts the cleanup of expired tokens.
+func (ra *authenticator) Init(jsonconf, name string) error {
+	if ra.name != "" {
+		return errors.New("auth_refresh: already initialized as " + ra.name + "; " + name)
+	}
+
+	type configType struct {
+		// Refresh token expiration time in seconds.
+		ExpireIn int `json:"expire_in"`
+	}
+	var config configType
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return errors.New("auth_refresh: failed to parse config: " + err.Error() + "(" + jsonconf + ")")
+	}
+
+	if config.ExpireIn <= 0 {
+		return errors.New("auth_refresh: invalid expiration value")
+	}
+
+	ra.name = name
+	ra.lifetime = time.Duration(config.ExpireIn) * time.Second
+
+	go func() {
+		for range time.Tick(cleanupPeriod) {
+			if err := store.RefreshTokens.DeleteExpired(time.Now()); err != nil {
+				log.Println("auth_refresh: failed to delete expired tokens:", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// AddRecord is not supprted, will produce an error.
+func (authenticator) AddRecord(rec *auth.Rec, secret []byte) (*auth.Rec, error) {
+	return nil, types.ErrUnsupported
+}
+
+// UpdateRecord is not supported, will produce an error.
+func (authenticator) UpdateRecord(rec *auth.Rec, secret []byte) (*auth.Rec, error) {
+	return nil, types.ErrUnsupported
+}
+
+// Authenticate checks validity of the refresh token and marks it as used.
+// If the token has been used before, the entire chain of tokens is revoked.
+func (ra *authenticator) Authenticate(token []byte) (*auth.Rec, []byte, error) {
+	if ra.name == "" {
+		return nil, nil, types.ErrUnsupported
+	}
+
+	if len(token) != tokenLength {
+		return nil, nil, types.ErrMalformed
+	}
+
+	id := tokenId(token)
+	rt, err := store.RefreshTokens.Get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rt == nil {
+		return nil, nil, types.ErrFailed
+	}
+
+	ok := false
+	if !rt.Used {
+		if ok, err = store.RefreshTokens.Use(id); err != nil {
+			return nil, nil, err
+		}
+	}
+	if !ok {
+		// The token was used before: either the legitimate client or an attacker has a copy of it.
+		// There is no way to tell which one is which, revoke all tokens in the chain.
+		log.Println("auth_refresh: token reuse detected, revoking chain for", rt.User)
+		if err = store.RefreshTokens.RevokeChain(rt.Chain); err != nil {
+			log.Println("auth_refresh: failed to revoke chain", err)
+		}
+		return nil, nil, types.ErrFailed
+	}
+
+	if rt.Expires.Before(time.Now()) {
+		return nil, nil, types.ErrExpired
+	}
+
+	return &auth.Rec{
+		Uid:       types.ParseUid(rt.User),
+		AuthLevel: auth.Level(rt.AuthLvl),
+		Features:  auth.Feature(rt.Features),
+		Chain:     rt.Chain}, nil, nil
+}
+
+// GenSecret generates a new refresh token. If the record was obtained from a refresh token,
+// the new token is added to the same chain.
+func (ra *authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
+	if ra.name == "" {
+		return nil, time.Time{}, types.ErrUnsupported
+	}
+
+	if rec.Features&auth.FeatureNoLogin != 0 {
+		// Restricted tokens cannot be refreshed.
+		return nil, time.Time{}, types.ErrPolicy
+	}
+
+	chain := rec.Chain
+	if chain == "" {
+		buf := make([]byte, chainLength)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, time.Time{}, err
+		}
+		chain = base64.RawURLEncoding.EncodeToString(buf)
+	}
+
+	token := make([]byte, tokenLength)
+	if _, err := rand.Read(token); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	expires := time.Now().Add(ra.lifetime).UTC().Round(time.Millisecond)
+	if err := store.RefreshTokens.Add(&types.RefreshToken{
+		Id:       tokenId(token),
+		Chain:    chain,
+		User:     rec.Uid.String(),
+		AuthLvl:  int(rec.AuthLevel),
+		Features: int(rec.Features),
+		Expires:  expires,
+	}); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return token, expires, nil
+}
+
+// IsUnique is not supported, will produce an error.
+func (authenticator) IsUnique(token []byte) (bool, error) {
+	return false, types.ErrUnsupported
+}
+
+// DelRecords revokes all refresh tokens of the given user.
+func (ra *authenticator) DelRecords(uid types.Uid) error {
+	if ra.name == "" {
+		return nil
+	}
+	return store.RefreshTokens.RevokeAll(uid)
+}
+
+// RestrictedTags returns tag namespaces restricted by this authenticator (none for refresh).
+func (authenticator) RestrictedTags() ([]string, error) {
+	return nil, nil
+}
+
+// tokenId converts the token to the ID of the server-side record. Tokens are not stored in plain text.
+func tokenId(token []byte) string {
+	hash := sha256.Sum256(token)
+	return hex.EncodeToString(hash[:])
+}
+
+func init() {
+	store.RegisterAuthScheme("refresh", &authenticator{})
+}
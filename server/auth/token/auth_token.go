@@ -141,7 +141,11 @@ func (ta *authenticator) Authenticate(token []byte) (*auth.Rec, []byte, error) {
 
 	// Check if the user is disabled.
 	if _, disabled := disabledUserIDs.Load(types.Uid(tl.Uid)); disabled {
-		return nil, nil, types.ErrFailed
+		// Account deleted with a recovery period could have been restored since.
+		if user, err := store.Users.Get(types.Uid(tl.Uid)); err != nil || user == nil {
+			return nil, nil, types.ErrFailed
+		}
+		disabledUserIDs.Delete(types.Uid(tl.Uid))
 	}
 
 	return &auth.Rec{
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/msgpack"
 	"github.com/tinode/chat/server/push"
 	rh "github.com/tinode/chat/server/ringhash"
 	"github.com/tinode/chat/server/store/types"
@@ -134,6 +135,27 @@ type ClusterResp struct {
 	FromSID string
 }
 
+// ClusterRateLimitReq is a request to consume tokens from the user's rate limit bucket
+// kept at the user's master node.
+type ClusterRateLimitReq struct {
+	// Name of the node sending this request
+	Node string
+	// User being rate limited.
+	UserId types.Uid
+	// Type of the message, i.e. "pub".
+	What string
+	// Maximum number of tokens to consume.
+	Count int
+}
+
+// ClusterRateLimitResp is a response to ClusterRateLimitReq.
+type ClusterRateLimitResp struct {
+	// Number of tokens consumed.
+	Granted int
+	// Time to wait until a token becomes available if none were consumed.
+	RetryAfter time.Duration
+}
+
 // ClusterPresExt encapsulates externally unroutable parameters of {pres} message which have to be sent intra-cluster.
 type ClusterPresExt struct {
 	// Flag to break the reply loop
@@ -393,7 +415,17 @@ func (Cluster) Proxy(msg *ClusterResp, unused *bool) error {
 	// This cluster member received a response from topic owner to be forwarded to a session
 	// Find appropriate session, send the message to it
 	if sess := globals.sessionStore.Get(msg.FromSID); sess != nil {
-		if !sess.queueOutBytes(msg.Msg) {
+		var data interface{} = msg.Msg
+		if sess.isMsgpack() {
+			// Master serializes messages as JSON.
+			packed, err := msgpack.FromJSON(msg.Msg)
+			if err != nil {
+				log.Println("cluster.Proxy: failed to convert message", err)
+				return nil
+			}
+			data = msgpackFrame(packed)
+		}
+		if !sess.queueOutBytes(data) {
 			log.Println("cluster.Proxy: timeout")
 		}
 	} else {
@@ -428,6 +460,48 @@ func (c *Cluster) UserCacheUpdate(msg *UserCacheReq, rejected *bool) error {
 	return nil
 }
 
+// UserEvict endpoint terminates all local sessions of the given user.
+func (c *Cluster) UserEvict(uid *types.Uid, unused *bool) error {
+	log.Printf("cluster: node '%s' received eviction request for user '%s'", c.thisNodeName, uid.UserId())
+	globals.sessionStore.EvictUser(*uid, "")
+	return nil
+}
+
+// Sends request to terminate user's sessions to all other cluster nodes.
+func (c *Cluster) evictUser(uid types.Uid) {
+	if c == nil {
+		// Cluster not initialized, nothing to do.
+		return
+	}
+	for _, n := range c.nodes {
+		var unused bool
+		if err := n.call("Cluster.UserEvict", &uid, &unused); err != nil {
+			log.Println("cluster: failed to evict user at node", n.name, err)
+		}
+	}
+}
+
+// RateLimit endpoint consumes up to the requested number of tokens from the user's rate limit bucket.
+// The proxy node uses the granted tokens for subsequent requests without asking the master.
+func (c *Cluster) RateLimit(msg *ClusterRateLimitReq, resp *ClusterRateLimitResp) error {
+	// Don't route the request further even if this node does not consider itself to be the user's master.
+	resp.Granted, resp.RetryAfter = rateLimitUserLocal(msg.UserId, msg.What, msg.Count, time.Now())
+	return nil
+}
+
+// Sends user's rate limit request to user's Master node where the token buckets reside.
+// Returns the number of granted tokens and the time to wait if none were granted.
+func (c *Cluster) routeRateLimit(uid types.Uid, what string, count int) (int, time.Duration, error) {
+	n := c.nodeForTopic(uid.UserId())
+	if n == nil {
+		return 0, 0, errors.New("attempt to rate limit user at a non-existent node")
+	}
+	var resp ClusterRateLimitResp
+	err := n.call("Cluster.RateLimit",
+		&ClusterRateLimitReq{Node: c.thisNodeName, UserId: uid, What: what, Count: count}, &resp)
+	return resp.Granted, resp.RetryAfter, err
+}
+
 // Sends user cache update to user's Master node where the cache actually resides.
 // The request is extected to contain users who reside at remote nodes only.
 func (c *Cluster) routeUserReq(req *UserCacheReq) error {
@@ -12,6 +12,8 @@ import (
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/tinode/chat/server/store/types"
 )
 
 // MsgGetOpts defines Get query parameters.
@@ -51,6 +53,25 @@ type MsgSetSub struct {
 
 	// Access mode change, either Given or Want depending on context
 	Mode string `json:"mode,omitempty"`
+
+	// Mute push notifications from the topic. Applies to the current user's own subscription only.
+	Mute *MsgMute `json:"mute,omitempty"`
+}
+
+// MsgMute is the state of push notifications of a subscription.
+type MsgMute struct {
+	// Push notifications are muted.
+	Muted bool `json:"muted"`
+	// Optional time when notifications are automatically unmuted.
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// MsgStorage is the storage used by the user's uploaded files.
+type MsgStorage struct {
+	// Total size of uploaded files in bytes.
+	Used int64 `json:"used"`
+	// Maximum total size of uploaded files in bytes, 0 if unlimited.
+	Quota int64 `json:"quota,omitempty"`
 }
 
 // MsgSetDesc is a C2S in set.what == "desc", acc, sub message
@@ -58,6 +79,8 @@ type MsgSetDesc struct {
 	DefaultAcs *MsgDefaultAcsMode `json:"defacs,omitempty"` // default access mode
 	Public     interface{}        `json:"public,omitempty"`
 	Private    interface{}        `json:"private,omitempty"` // Per-subscription private data
+	// 'me' topic only: push notification settings. Replaces current settings, empty object clears them.
+	Notify *types.NotifySettings `json:"notify,omitempty"`
 }
 
 // MsgCredClient is an account credential such as email or phone number.
@@ -107,6 +130,10 @@ type MsgClientHi struct {
 	Lang string `json:"lang,omitempty"`
 	// Platform code: ios, android, web.
 	Platform string `json:"platf,omitempty"`
+	// Push service which issued the device ID: fcm (default), apns, webpush.
+	Push string `json:"push,omitempty"`
+	// Wire encoding of messages: json (default) or msgpack. Websocket only.
+	Encoding string `json:"enc,omitempty"`
 }
 
 // MsgClientAcc is an {acc} message for creating or updating a user account.
@@ -355,6 +382,8 @@ type MsgTopicDesc struct {
 
 	// If the group topic is online.
 	Online bool `json:"online,omitempty"`
+	// P2P topics only: state of the other user's account, "susp" if suspended.
+	State string `json:"state,omitempty"`
 
 	DefaultAcs *MsgDefaultAcsMode `json:"defacs,omitempty"`
 	// Actual access mode
@@ -368,6 +397,12 @@ type MsgTopicDesc struct {
 	Public interface{} `json:"public,omitempty"`
 	// Per-subscription private data
 	Private interface{} `json:"private,omitempty"`
+	// State of push notifications of the subscription, if muted.
+	Mute *MsgMute `json:"mute,omitempty"`
+	// 'me' topic only: user's push notification settings.
+	Notify *types.NotifySettings `json:"notify,omitempty"`
+	// 'me' topic only: storage used by user's uploads.
+	Storage *MsgStorage `json:"storage,omitempty"`
 }
 
 // MsgTopicSub is topic subscription details, sent in Meta message.
@@ -381,6 +416,8 @@ type MsgTopicSub struct {
 
 	// If the subscriber/topic is online
 	Online bool `json:"online,omitempty"`
+	// P2P topics only: state of the other user's account, "susp" if suspended.
+	State string `json:"state,omitempty"`
 
 	// Access mode. Topic admins receive the full info, non-admins receive just the cumulative mode
 	// Acs.Mode = want & given. The field is not a pointer because at least one value is always assigned.
@@ -393,6 +430,8 @@ type MsgTopicSub struct {
 	Public interface{} `json:"public,omitempty"`
 	// User's own private data per topic
 	Private interface{} `json:"private,omitempty"`
+	// State of push notifications of user's own subscription, if muted.
+	Mute *MsgMute `json:"mute,omitempty"`
 
 	// Response to non-'me' topic
 
@@ -830,6 +869,17 @@ func ErrAlreadyExists(id, topic string, ts time.Time) *ServerComMessage {
 		Timestamp: ts}}
 }
 
+// ErrConflict request conflicts with the current state of the object, e.g. wrong offset of
+// the uploaded chunk (409).
+func ErrConflict(id, topic string, ts time.Time) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusConflict, // 409
+		Text:      "conflict",
+		Topic:     topic,
+		Timestamp: ts}}
+}
+
 // ErrCommandOutOfSequence invalid sequence of comments, i.e. attempt to {sub} before {hi} (409).
 func ErrCommandOutOfSequence(id, unused string, ts time.Time) *ServerComMessage {
 	return &ServerComMessage{Ctrl: &MsgServerCtrl{
@@ -839,6 +889,17 @@ func ErrCommandOutOfSequence(id, unused string, ts time.Time) *ServerComMessage
 		Timestamp: ts}}
 }
 
+// ErrQuotaExceeded upload rejected because the storage quota is exceeded (403).
+func ErrQuotaExceeded(id, topic string, ts time.Time, used, quota int64) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusForbidden, // 403
+		Text:      "quota exceeded",
+		Topic:     topic,
+		Params:    map[string]int64{"used": used, "quota": quota},
+		Timestamp: ts}}
+}
+
 // ErrGone topic deleted or user banned (410).
 func ErrGone(id, topic string, ts time.Time) *ServerComMessage {
 	return &ServerComMessage{Ctrl: &MsgServerCtrl{
@@ -869,6 +930,16 @@ func ErrPolicy(id, topic string, ts time.Time) *ServerComMessage {
 		Timestamp: ts}}
 }
 
+// ErrInfected uploaded file rejected because malware was detected (422).
+func ErrInfected(id, topic string, ts time.Time) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusUnprocessableEntity, // 422
+		Text:      "malware detected",
+		Topic:     topic,
+		Timestamp: ts}}
+}
+
 // ErrLocked operation rejected because the topic is being deleted (423).
 func ErrLocked(id, topic string, ts time.Time) *ServerComMessage {
 	return &ServerComMessage{Ctrl: &MsgServerCtrl{
@@ -879,6 +950,18 @@ func ErrLocked(id, topic string, ts time.Time) *ServerComMessage {
 		Timestamp: ts}}
 }
 
+// ErrTooManyRequests request rejected because the rate limit is exceeded (429).
+// The client may retry the request after retryAfter.
+func ErrTooManyRequests(id, topic string, ts time.Time, retryAfter time.Duration) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusTooManyRequests, // 429
+		Text:      "too many requests",
+		Topic:     topic,
+		Params:    map[string]interface{}{"retry_after": int64((retryAfter + time.Millisecond - 1) / time.Millisecond)},
+		Timestamp: ts}}
+}
+
 // ErrUnknown database or other server error (500).
 func ErrUnknown(id, topic string, ts time.Time) *ServerComMessage {
 	return &ServerComMessage{Ctrl: &MsgServerCtrl{
@@ -45,8 +45,17 @@ type Adapter interface {
 	UserGetAll(ids ...t.Uid) ([]t.User, error)
 	// UserDelete deletes user record
 	UserDelete(uid t.Uid, hard bool) error
+	// UserDeleteDeferred marks user as pending deletion and disables user's subscriptions and topics.
+	UserDeleteDeferred(uid t.Uid) error
 	// UserGetDisabled returns IDs of users which were soft-deleted since given time.
 	UserGetDisabled(since time.Time) ([]t.Uid, error)
+	// UserGetSuspended returns IDs of suspended users whose suspension expired before the given time.
+	UserGetSuspended(expired time.Time) ([]t.Uid, error)
+	// UserGetDeleted returns IDs of users pending deletion which were deleted before the given time.
+	UserGetDeleted(expired time.Time) ([]t.Uid, error)
+	// UserUndelete restores user pending deletion, deleted since the given time, together with
+	// subscriptions and topics disabled at the same time.
+	UserUndelete(uid t.Uid, since time.Time) error
 	// UserUpdate updates user record
 	UserUpdate(uid t.Uid, update map[string]interface{}) error
 	// UserUpdateTags adds, removes, or resets user's tags
@@ -88,6 +97,21 @@ type Adapter interface {
 	// AuthUpdRecord modifies an authentication record.
 	AuthUpdRecord(user t.Uid, scheme, unique string, authLvl auth.Level, secret []byte, expires time.Time) error
 
+	// Refresh tokens for renewing short-lived access tokens
+
+	// RefreshTokenAdd saves a new refresh token record.
+	RefreshTokenAdd(rt *t.RefreshToken) error
+	// RefreshTokenGet returns a refresh token record by its ID.
+	RefreshTokenGet(id string) (*t.RefreshToken, error)
+	// RefreshTokenUse marks the token as used. Returns false if the token has been used already.
+	RefreshTokenUse(id string) (bool, error)
+	// RefreshTokenDelChain deletes all tokens in the given chain.
+	RefreshTokenDelChain(chain string) error
+	// RefreshTokenDelAll deletes all refresh tokens of the given user.
+	RefreshTokenDelAll(uid t.Uid) error
+	// RefreshTokenDelExpired deletes tokens which expired before the given time.
+	RefreshTokenDelExpired(before time.Time) error
+
 	// Topic management
 
 	// TopicCreate creates a topic
@@ -163,12 +187,32 @@ type Adapter interface {
 
 	// FileStartUpload initializes a file upload
 	FileStartUpload(fd *t.FileDef) error
+	// FileStartDuplicate saves the record of a completed upload which shares the content with the
+	// record dup. The dup record is protected from concurrent FileDeleteUnused. Returns false if
+	// dup no longer exists.
+	FileStartDuplicate(fd *t.FileDef, dup string) (bool, error)
 	// FileFinishUpload marks file upload as completed, successfully or otherwise.
 	FileFinishUpload(fid string, status int, size int64) (*t.FileDef, error)
 	// FileGet fetches a record of a specific file
 	FileGet(fid string) (*t.FileDef, error)
+	// FileGetByHash fetches a record of any successfully completed upload with the given content hash.
+	FileGetByHash(hash string) (*t.FileDef, error)
+	// FileGetAll fetches up to limit file records with IDs greater than after, ordered by ID.
+	// Used for iterating over all file records.
+	FileGetAll(after string, limit int) ([]t.FileDef, error)
 	// FileDeleteUnused deletes records where UseCount is zero. If olderThan is non-zero, deletes
 	// unused records with UpdatedAt before olderThan.
 	// Returns array of FileDef.Location of deleted filerecords so actual files can be deleted too.
+	// Locations still referenced by the remaining records (deduplicated uploads) are not returned.
 	FileDeleteUnused(olderThan time.Time, limit int) ([]string, error)
+	// FileUpdate updates fields of a file record, such as progress of a resumable upload.
+	FileUpdate(fid string, update map[string]interface{}) error
+	// FileUpdateProgress updates the record of a resumable upload in progress if the number of
+	// received bytes is still equal to received. Returns false if the record was not updated.
+	FileUpdateProgress(fid string, received int64, update map[string]interface{}) (bool, error)
+	// FileLinkedTopics returns names of topics with messages which reference the file.
+	FileLinkedTopics(fid string) ([]string, error)
+	// FileGetUsage returns the total size of files uploaded by the user, or to the topic if the
+	// user is zero. Failed uploads are not counted.
+	FileGetUsage(user t.Uid, topic string) (int64, error)
 }
@@ -35,7 +35,7 @@ const (
 	defaultHost     = "localhost:27017"
 	defaultDatabase = "tinode"
 
-	adpVersion  = 110
+	adpVersion  = 115
 	adapterName = "mongodb"
 
 	defaultMaxResults = 1024
@@ -230,6 +230,11 @@ func (a *adapter) CreateDb(reset bool) error {
 			Collection: "users",
 			Field:      "tags",
 		},
+		// Index on 'user.suspenduntil' for finding users with expired suspensions
+		{
+			Collection: "users",
+			Field:      "suspenduntil",
+		},
 		// Index for 'user.devices.deviceid' to ensure Device ID uniqueness across users.
 		// Partial filter set to avoid unique constraint for null values (when user object have no devices).
 		{
@@ -249,6 +254,23 @@ func (a *adapter) CreateDb(reset bool) error {
 			Field:      "userid",
 		},
 
+		// Refresh tokens {_id, chain, user, expires...}. See types.RefreshToken.
+		// Index on 'refreshtokens.chain' to be able to revoke the whole chain at once.
+		{
+			Collection: "refreshtokens",
+			Field:      "chain",
+		},
+		// Index on 'refreshtokens.user' to be able to delete all tokens of a user.
+		{
+			Collection: "refreshtokens",
+			Field:      "user",
+		},
+		// Index on 'refreshtokens.expires' to be able to delete expired tokens.
+		{
+			Collection: "refreshtokens",
+			Field:      "expires",
+		},
+
 		// Subscription to a topic. The primary key is a topic:user string
 		{
 			Collection: "subscriptions",
@@ -283,6 +305,11 @@ func (a *adapter) CreateDb(reset bool) error {
 			Collection: "messages",
 			IndexOpts:  mdb.IndexModel{Keys: b.M{"topic": 1, "delid": 1}},
 		},
+		// Multi-index of files attached to messages to find topics which reference the file.
+		{
+			Collection: "messages",
+			Field:      "attachments",
+		},
 		// Compound multi-index of soft-deleted messages: each message gets multiple compound index entries like
 		// 		 [topic, user1, delid1], [topic, user2, delid2],...
 		{
@@ -316,6 +343,16 @@ func (a *adapter) CreateDb(reset bool) error {
 			Collection: "fileuploads",
 			Field:      "usecount",
 		},
+		// Index on 'fileuploads.hash' to be able to find duplicate uploads.
+		{
+			Collection: "fileuploads",
+			Field:      "hash",
+		},
+		// Index on 'fileuploads.topic' to be able to calculate storage used by the topic.
+		{
+			Collection: "fileuploads",
+			Field:      "topic",
+		},
 	}
 
 	var err error
@@ -345,8 +382,100 @@ func (a *adapter) CreateDb(reset bool) error {
 	return nil
 }
 
-// TODO: UpgradeDb upgrades database to the current adapter version.
+func (a *adapter) updateDbVersion(v int) error {
+	a.version = -1
+	_, err := a.db.Collection("kvmeta").UpdateOne(a.ctx,
+		b.M{"_id": "version"},
+		b.M{"$set": b.M{"value": v}})
+	return err
+}
+
+// UpgradeDb upgrades database to the current adapter version.
 func (a *adapter) UpgradeDb() error {
+	bumpVersion := func(a *adapter, x int) error {
+		if err := a.updateDbVersion(x); err != nil {
+			return err
+		}
+		_, err := a.GetDbVersion()
+		return err
+	}
+
+	if _, err := a.GetDbVersion(); err != nil {
+		return err
+	}
+
+	if a.version == 110 {
+		// Perform database upgrade from version 110 to version 111.
+
+		// Collection 'refreshtokens' is created on first write, only indexes are needed.
+		for _, field := range []string{"chain", "user", "expires"} {
+			if _, err := a.db.Collection("refreshtokens").Indexes().CreateOne(a.ctx,
+				mdb.IndexModel{Keys: b.M{field: 1}}); err != nil {
+				return err
+			}
+		}
+
+		if err := bumpVersion(a, 111); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 111 {
+		// Perform database upgrade from version 111 to version 112.
+
+		if _, err := a.db.Collection("users").Indexes().CreateOne(a.ctx,
+			mdb.IndexModel{Keys: b.M{"suspenduntil": 1}}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 112); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 112 {
+		// Perform database upgrade from version 112 to version 113.
+
+		if _, err := a.db.Collection("fileuploads").Indexes().CreateOne(a.ctx,
+			mdb.IndexModel{Keys: b.M{"hash": 1}}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 113); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 113 {
+		// Perform database upgrade from version 113 to version 114.
+
+		if _, err := a.db.Collection("fileuploads").Indexes().CreateOne(a.ctx,
+			mdb.IndexModel{Keys: b.M{"topic": 1}}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 114); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 114 {
+		// Perform database upgrade from version 114 to version 115.
+
+		if _, err := a.db.Collection("messages").Indexes().CreateOne(a.ctx,
+			mdb.IndexModel{Keys: b.M{"attachments": 1}}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 115); err != nil {
+			return err
+		}
+	}
+
+	if a.version != adpVersion {
+		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
+			". DB is still at " + strconv.Itoa(a.version))
+	}
 	return nil
 }
 
@@ -512,26 +641,8 @@ func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
 			if _, err = a.db.Collection("users").DeleteOne(sc, b.M{"_id": uid.String()}); err != nil {
 				return err
 			}
-		} else {
-			// Disable user's subscriptions.
-			if err = a.subsDel(sc, b.M{"user": uid.String()}, false); err != nil {
-				return err
-			}
-
-			// Disable subscriptions for topics where the user is the owner.
-			// Disable topics where the user is the owner.
-			now := t.TimeNow()
-			disable := b.M{"$set": b.M{"deletedat": now, "updatedat": now}}
-
-			if _, err = a.db.Collection("subscriptions").UpdateMany(sc, topicFilter, disable); err != nil {
-				return err
-			}
-			if _, err = a.db.Collection("topics").UpdateMany(sc, b.M{"_id": b.M{"$in": topicIds}}, disable); err != nil {
-				return err
-			}
-			if _, err = a.db.Collection("users").UpdateMany(sc, b.M{"_id": uid.String()}, disable); err != nil {
-				return err
-			}
+		} else if err = a.userDisable(sc, uid, topicIds, false); err != nil {
+			return err
 		}
 
 		// Finally commit all changes
@@ -543,6 +654,76 @@ func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
 	return err
 }
 
+// UserDeleteDeferred marks user as pending deletion and disables user's subscriptions and topics.
+func (a *adapter) UserDeleteDeferred(uid t.Uid) error {
+	topicIds, err := a.db.Collection("topics").Distinct(a.ctx, "_id", b.M{"owner": uid.String()})
+	if err != nil {
+		return err
+	}
+
+	var sess mdb.Session
+	if sess, err = a.conn.StartSession(); err != nil {
+		return err
+	}
+	defer sess.EndSession(a.ctx)
+
+	if err = a.maybeStartTransaction(sess); err != nil {
+		return err
+	}
+	return mdb.WithSession(a.ctx, sess, func(sc mdb.SessionContext) error {
+		if err := a.userDisable(sc, uid, topicIds, true); err != nil {
+			return err
+		}
+		return a.maybeCommitTransaction(sc, sess)
+	})
+}
+
+// userDisable soft-deletes the user, user's subscriptions, topics owned by the user and subscriptions to them.
+// All records are marked with the same timestamp so they can be restored together. Records which are
+// already soft-deleted are left unchanged. The user is updated first and user's deletion time is reused
+// if the user is already soft-deleted: if the operation is interrupted without a transaction, it can be
+// safely repeated.
+func (a *adapter) userDisable(ctx context.Context, uid t.Uid, topicIds []interface{}, pending bool) error {
+	var user t.User
+	if err := a.db.Collection("users").FindOne(ctx, b.M{"_id": uid.String()}).Decode(&user); err != nil {
+		if err == mdb.ErrNoDocuments {
+			return t.ErrNotFound
+		}
+		return err
+	}
+
+	now := t.TimeNow()
+	deletedAt := now
+	if user.DeletedAt != nil {
+		deletedAt = *user.DeletedAt
+	}
+
+	// Disable user.
+	update := b.M{"deletedat": deletedAt, "updatedat": now}
+	if pending {
+		update["state"] = t.UserStateDeleted
+	}
+	if _, err := a.db.Collection("users").UpdateOne(ctx, b.M{"_id": uid.String()}, b.M{"$set": update}); err != nil {
+		return err
+	}
+
+	disable := b.M{"$set": b.M{"deletedat": deletedAt, "updatedat": now}}
+	// Disable user's subscriptions and subscriptions for topics where the user is the owner.
+	if _, err := a.db.Collection("subscriptions").UpdateMany(ctx, b.M{
+		"$or":       b.A{b.M{"user": uid.String()}, b.M{"topic": b.M{"$in": topicIds}}},
+		"deletedat": b.M{"$exists": false},
+	}, disable); err != nil {
+		return err
+	}
+
+	// Disable topics where the user is the owner.
+	_, err := a.db.Collection("topics").UpdateMany(ctx, b.M{
+		"_id":       b.M{"$in": topicIds},
+		"deletedat": b.M{"$exists": false},
+	}, disable)
+	return err
+}
+
 // UserGetDisabled returns IDs of users which were soft-deleted since given time.
 func (a *adapter) UserGetDisabled(since time.Time) ([]t.Uid, error) {
 	filter := b.M{"deletedat": b.M{"$gte": since}}
@@ -564,6 +745,109 @@ func (a *adapter) UserGetDisabled(since time.Time) ([]t.Uid, error) {
 	return uids, nil
 }
 
+// UserGetSuspended returns IDs of suspended users whose suspension expired before the given time.
+func (a *adapter) UserGetSuspended(expired time.Time) ([]t.Uid, error) {
+	filter := b.M{
+		"state":        t.UserStateSuspended,
+		"suspenduntil": b.M{"$lt": expired},
+		"deletedat":    b.M{"$exists": false},
+	}
+	findOpts := mdbopts.FindOptions{Projection: b.M{"_id": 1}}
+	cur, err := a.db.Collection("users").Find(a.ctx, filter, &findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var uids []t.Uid
+	var userId map[string]string
+	for cur.Next(a.ctx) {
+		if err := cur.Decode(&userId); err != nil {
+			return nil, err
+		}
+		uids = append(uids, t.ParseUid(userId["_id"]))
+	}
+	return uids, nil
+}
+
+// UserGetDeleted returns IDs of users pending deletion which were deleted before the given time.
+func (a *adapter) UserGetDeleted(expired time.Time) ([]t.Uid, error) {
+	filter := b.M{
+		"state":     t.UserStateDeleted,
+		"deletedat": b.M{"$lt": expired},
+	}
+	findOpts := mdbopts.FindOptions{Projection: b.M{"_id": 1}}
+	cur, err := a.db.Collection("users").Find(a.ctx, filter, &findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var uids []t.Uid
+	var userId map[string]string
+	for cur.Next(a.ctx) {
+		if err := cur.Decode(&userId); err != nil {
+			return nil, err
+		}
+		uids = append(uids, t.ParseUid(userId["_id"]))
+	}
+	return uids, nil
+}
+
+// UserUndelete restores user pending deletion together with subscriptions and topics disabled at the same time.
+func (a *adapter) UserUndelete(uid t.Uid, since time.Time) error {
+	var user t.User
+	if err := a.db.Collection("users").FindOne(a.ctx, b.M{
+		"_id":       uid.String(),
+		"state":     t.UserStateDeleted,
+		"deletedat": b.M{"$gte": since},
+	}).Decode(&user); err != nil {
+		if err == mdb.ErrNoDocuments {
+			return t.ErrNotFound
+		}
+		return err
+	}
+
+	topicIds, err := a.db.Collection("topics").Distinct(a.ctx, "_id",
+		b.M{"owner": uid.String(), "deletedat": *user.DeletedAt})
+	if err != nil {
+		return err
+	}
+
+	var sess mdb.Session
+	if sess, err = a.conn.StartSession(); err != nil {
+		return err
+	}
+	defer sess.EndSession(a.ctx)
+
+	if err = a.maybeStartTransaction(sess); err != nil {
+		return err
+	}
+	return mdb.WithSession(a.ctx, sess, func(sc mdb.SessionContext) error {
+		now := t.TimeNow()
+		enable := b.M{"$unset": b.M{"deletedat": ""}, "$set": b.M{"updatedat": now}}
+
+		// Restore user's subscriptions and subscriptions to topics where the user is the owner.
+		if _, err = a.db.Collection("subscriptions").UpdateMany(sc, b.M{
+			"$or":       b.A{b.M{"user": uid.String()}, b.M{"topic": b.M{"$in": topicIds}}},
+			"deletedat": *user.DeletedAt,
+		}, enable); err != nil {
+			return err
+		}
+		// Restore topics where the user is the owner.
+		if _, err = a.db.Collection("topics").UpdateMany(sc, b.M{"_id": b.M{"$in": topicIds}}, enable); err != nil {
+			return err
+		}
+		// Restore user.
+		if _, err = a.db.Collection("users").UpdateOne(sc, b.M{"_id": uid.String()},
+			b.M{"$unset": b.M{"deletedat": ""}, "$set": b.M{"updatedat": now, "state": t.UserStateNormal}}); err != nil {
+			return err
+		}
+
+		return a.maybeCommitTransaction(sc, sess)
+	})
+}
+
 // UserUpdate updates user record
 func (a *adapter) UserUpdate(uid t.Uid, update map[string]interface{}) error {
 	// to get round the hardcoded "UpdatedAt" key in store.Users.Update()
@@ -985,6 +1269,58 @@ func (a *adapter) AuthUpdRecord(uid t.Uid, scheme, unique string,
 	return err
 }
 
+// RefreshTokenAdd saves a new refresh token record.
+func (a *adapter) RefreshTokenAdd(rt *t.RefreshToken) error {
+	_, err := a.db.Collection("refreshtokens").InsertOne(a.ctx, rt)
+	if isDuplicateErr(err) {
+		return t.ErrDuplicate
+	}
+	return err
+}
+
+// RefreshTokenGet returns a refresh token record by its ID.
+func (a *adapter) RefreshTokenGet(id string) (*t.RefreshToken, error) {
+	var rt t.RefreshToken
+	err := a.db.Collection("refreshtokens").FindOne(a.ctx, b.M{"_id": id}).Decode(&rt)
+	if err != nil {
+		if err == mdb.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &rt, nil
+}
+
+// RefreshTokenUse marks the token as used. Returns false if the token has been used already.
+func (a *adapter) RefreshTokenUse(id string) (bool, error) {
+	res, err := a.db.Collection("refreshtokens").UpdateOne(a.ctx,
+		b.M{"_id": id, "used": false},
+		b.M{"$set": b.M{"used": true}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+// RefreshTokenDelChain deletes all tokens in the given chain.
+func (a *adapter) RefreshTokenDelChain(chain string) error {
+	_, err := a.db.Collection("refreshtokens").DeleteMany(a.ctx, b.M{"chain": chain})
+	return err
+}
+
+// RefreshTokenDelAll deletes all refresh tokens of the given user.
+func (a *adapter) RefreshTokenDelAll(uid t.Uid) error {
+	_, err := a.db.Collection("refreshtokens").DeleteMany(a.ctx, b.M{"user": uid.String()})
+	return err
+}
+
+// RefreshTokenDelExpired deletes tokens which expired before the given time.
+func (a *adapter) RefreshTokenDelExpired(before time.Time) error {
+	_, err := a.db.Collection("refreshtokens").DeleteMany(a.ctx, b.M{"expires": b.M{"$lt": before}})
+	return err
+}
+
 // Topic management
 
 func (a *adapter) undeleteSubscription(sub *t.Subscription) error {
@@ -1171,6 +1507,7 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 				sub.SetWith(uid2.UserId())
 				sub.SetDefaultAccess(usr.Access.Auth, usr.Access.Anon)
 				sub.SetLastSeenAndUA(usr.LastSeen, usr.UserAgent)
+				sub.SetState(usr.State)
 				subs = append(subs, sub)
 			}
 		}
@@ -1542,6 +1879,8 @@ func (a *adapter) getFindPipeline(req, opt []string) (map[string]struct{}, b.A)
 		b.M{"$match": b.M{
 			"tags":      b.M{"$in": allTags},
 			"deletedat": b.M{"$exists": false},
+			// Suspended users cannot be found. Topics have no state and always match.
+			"state": b.M{"$ne": t.UserStateSuspended},
 		}},
 
 		b.M{"$project": b.M{"_id": 1, "access": 1, "createdat": 1, "updatedat": 1, "public": 1, "tags": 1}},
@@ -1983,6 +2322,21 @@ func (a *adapter) FileStartUpload(fd *t.FileDef) error {
 	return err
 }
 
+// FileStartDuplicate saves the record of a completed upload which shares the content with dup.
+// The dup record is touched first: FileDeleteUnused does not delete recently updated records, so
+// either dup is deleted before it's touched or it survives and keeps the content in use.
+func (a *adapter) FileStartDuplicate(fd *t.FileDef, dup string) (bool, error) {
+	res, err := a.db.Collection("fileuploads").UpdateOne(a.ctx, b.M{"_id": dup},
+		b.M{"$set": b.M{"updatedat": t.TimeNow()}})
+	if err != nil {
+		return false, err
+	}
+	if res.MatchedCount == 0 {
+		return false, nil
+	}
+	return true, a.FileStartUpload(fd)
+}
+
 // FileFinishUpload marks file upload as completed, successfully or otherwise.
 func (a *adapter) FileFinishUpload(fid string, status int, size int64) (*t.FileDef, error) {
 	if _, err := a.db.Collection("fileuploads").UpdateOne(a.ctx,
@@ -2012,6 +2366,102 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 	return &fd, nil
 }
 
+// FileGetAll fetches up to limit file records with IDs greater than after, ordered by ID.
+func (a *adapter) FileGetAll(after string, limit int) ([]t.FileDef, error) {
+	findOpts := mdbopts.Find().SetSort(b.M{"_id": 1}).SetLimit(int64(limit))
+	cur, err := a.db.Collection("fileuploads").Find(a.ctx, b.M{"_id": b.M{"$gt": after}}, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var fds []t.FileDef
+	if err = cur.All(a.ctx, &fds); err != nil {
+		return nil, err
+	}
+	return fds, nil
+}
+
+// FileGetByHash fetches a record of a completed upload with the given content hash.
+func (a *adapter) FileGetByHash(hash string) (*t.FileDef, error) {
+	var fd t.FileDef
+	err := a.db.Collection("fileuploads").FindOne(a.ctx,
+		b.M{"hash": hash, "status": t.UploadCompleted}).Decode(&fd)
+	if err != nil {
+		if err == mdb.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &fd, nil
+}
+
+// FileUpdate updates fields of the file record.
+func (a *adapter) FileUpdate(fid string, update map[string]interface{}) error {
+	_, err := a.db.Collection("fileuploads").UpdateOne(a.ctx,
+		b.M{"_id": fid},
+		b.M{"$set": normalizeUpdateMap(update)})
+	return err
+}
+
+// FileUpdateProgress updates the record of a resumable upload in progress if the number of
+// received bytes is still equal to received.
+func (a *adapter) FileUpdateProgress(fid string, received int64, update map[string]interface{}) (bool, error) {
+	res, err := a.db.Collection("fileuploads").UpdateOne(a.ctx,
+		b.M{"_id": fid, "status": t.UploadStarted, "received": received},
+		b.M{"$set": normalizeUpdateMap(update)})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// FileLinkedTopics returns names of topics with messages which reference the file.
+func (a *adapter) FileLinkedTopics(fid string) ([]string, error) {
+	result, err := a.db.Collection("messages").Distinct(a.ctx, "topic", b.M{"attachments": fid})
+	if err != nil {
+		return nil, err
+	}
+
+	var topics []string
+	for _, topic := range result {
+		if str, ok := topic.(string); ok {
+			topics = append(topics, str)
+		}
+	}
+	return topics, nil
+}
+
+// FileGetUsage returns the total size of files uploaded by the user or to the topic.
+func (a *adapter) FileGetUsage(user t.Uid, topic string) (int64, error) {
+	match := b.M{"status": b.M{"$ne": t.UploadFailed}}
+	if !user.IsZero() {
+		match["user"] = user.String()
+	} else {
+		match["topic"] = topic
+	}
+
+	cur, err := a.db.Collection("fileuploads").Aggregate(a.ctx, b.A{
+		b.M{"$match": match},
+		b.M{"$group": b.M{"_id": nil, "total": b.M{"$sum": "$size"}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(a.ctx)
+
+	var result struct {
+		Total int64 `bson:"total"`
+	}
+	if cur.Next(a.ctx) {
+		if err = cur.Decode(&result); err != nil {
+			return 0, err
+		}
+	}
+	return result.Total, cur.Err()
+}
+
 // FileDeleteUnused deletes records where UseCount is zero. If olderThan is non-zero, deletes
 // unused records with UpdatedAt before olderThan.
 // Returns array of FileDef.Location of deleted filerecords so actual files can be deleted too.
@@ -2027,24 +2477,66 @@ func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, er
 		findOpts.SetLimit(int64(limit))
 	}
 
-	findOpts.SetProjection(b.M{"location": 1, "_id": 0})
+	findOpts.SetProjection(b.M{"_id": 1, "location": 1, "variants": 1, "hash": 1})
 	cur, err := a.db.Collection("fileuploads").Find(a.ctx, filter, findOpts)
 	if err != nil {
 		return nil, err
 	}
 	defer cur.Close(a.ctx)
 
-	var result map[string]string
-	var locations []string
+	var deleted []t.FileDef
+	var ids, hashes b.A
 	for cur.Next(a.ctx) {
+		var result t.FileDef
 		if err := cur.Decode(&result); err != nil {
 			return nil, err
 		}
-		locations = append(locations, result["location"])
+		deleted = append(deleted, result)
+		ids = append(ids, result.Id)
+		if result.Hash != "" {
+			hashes = append(hashes, result.Hash)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// Delete by IDs: the limit does not apply to DeleteMany. The filter is checked again in case
+	// the record was touched by FileStartDuplicate in the meantime. Such records remain and keep
+	// the shared content in use.
+	filter["_id"] = b.M{"$in": ids}
+	if _, err = a.db.Collection("fileuploads").DeleteMany(a.ctx, filter); err != nil {
+		return nil, err
+	}
+
+	// Deduplicated uploads share the content. Find the content still used by the remaining records.
+	inUse := make(map[string]bool)
+	if len(hashes) > 0 {
+		remaining, err := a.db.Collection("fileuploads").Distinct(a.ctx, "location", b.M{"hash": b.M{"$in": hashes}})
+		if err != nil {
+			return nil, err
+		}
+		for _, loc := range remaining {
+			if str, ok := loc.(string); ok {
+				inUse[str] = true
+			}
+		}
 	}
 
-	_, err = a.db.Collection("fileuploads").DeleteMany(a.ctx, filter)
-	return locations, err
+	var locations []string
+	for i := range deleted {
+		fd := &deleted[i]
+		if inUse[fd.Location] {
+			continue
+		}
+		// Don't delete the same shared content twice.
+		inUse[fd.Location] = true
+		locations = append(locations, fd.Location)
+		// Resized copies are deleted together with the original.
+		locations = append(locations, fd.Variants.Locations()...)
+	}
+	return locations, nil
 }
 
 // Given a filter query against 'messages' collection, decrement corresponding use counter in 'fileuploads' table.
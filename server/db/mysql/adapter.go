@@ -33,7 +33,7 @@ const (
 	defaultDSN      = "root:@tcp(localhost:3306)/tinode?parseTime=true"
 	defaultDatabase = "tinode"
 
-	adpVersion = 110
+	adpVersion = 117
 
 	adapterName = "mysql"
 
@@ -219,13 +219,18 @@ func (a *adapter) CreateDb(reset bool) error {
 			updatedat DATETIME(3) NOT NULL,
 			deletedat DATETIME(3),
 			state     INT DEFAULT 0,
+			suspendreason VARCHAR(255) DEFAULT '',
+			suspenduntil  DATETIME(3),
 			access    JSON,
 			lastseen  DATETIME,
 			useragent VARCHAR(255) DEFAULT '',
 			public    JSON,
 			tags      JSON,
+			notify    JSON,
+			uploadquota BIGINT NOT NULL DEFAULT 0,
 			PRIMARY KEY(id),
-			INDEX users_deletedat(deletedat)
+			INDEX users_deletedat(deletedat),
+			INDEX users_state_suspenduntil(state, suspenduntil)
 		)`); err != nil {
 		return err
 	}
@@ -279,6 +284,26 @@ func (a *adapter) CreateDb(reset bool) error {
 		return err
 	}
 
+	// Refresh tokens for renewing access tokens.
+	// Don't add FOREIGN KEY on userid. Tokens are removed separately when the user is deleted.
+	if _, err = tx.Exec(
+		`CREATE TABLE refreshtokens(
+			id        CHAR(64) NOT NULL,
+			createdat DATETIME(3) NOT NULL,
+			chain     VARCHAR(64) NOT NULL,
+			userid    BIGINT NOT NULL,
+			authlvl   INT NOT NULL,
+			features  INT NOT NULL DEFAULT 0,
+			expires   DATETIME(3) NOT NULL,
+			used      TINYINT NOT NULL DEFAULT 0,
+			PRIMARY KEY(id),
+			INDEX refreshtokens_chain(chain),
+			INDEX refreshtokens_userid(userid),
+			INDEX refreshtokens_expires(expires)
+		)`); err != nil {
+		return err
+	}
+
 	// Topics
 	if _, err = tx.Exec(
 		`CREATE TABLE topics(
@@ -336,6 +361,8 @@ func (a *adapter) CreateDb(reset bool) error {
 			modewant   CHAR(8),
 			modegiven  CHAR(8),
 			private    JSON,
+			muted      BOOLEAN DEFAULT FALSE,
+			muteuntil  DATETIME(3),
 			PRIMARY KEY(id),
 			FOREIGN KEY(userid) REFERENCES users(id),
 			UNIQUE INDEX subscriptions_topic_userid(topic, userid),
@@ -415,7 +442,15 @@ func (a *adapter) CreateDb(reset bool) error {
 			mimetype  VARCHAR(255) NOT NULL,
 			size      BIGINT NOT NULL,
 			location  VARCHAR(2048) NOT NULL,
-			PRIMARY KEY(id)
+			variants  JSON,
+			received  BIGINT NOT NULL DEFAULT 0,
+			uploadstate TEXT,
+			hash      CHAR(64) NOT NULL DEFAULT '',
+			topic     CHAR(25) NOT NULL DEFAULT '',
+			PRIMARY KEY(id),
+			INDEX fileuploads_hash(hash),
+			INDEX fileuploads_userid(userid),
+			INDEX fileuploads_topic(topic)
 		)`); err != nil {
 		return err
 	}
@@ -527,6 +562,117 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 110 {
+		// Perform database upgrade from version 110 to version 111.
+		if _, err := a.db.Exec(
+			`CREATE TABLE refreshtokens(
+				id        CHAR(64) NOT NULL,
+				createdat DATETIME(3) NOT NULL,
+				chain     VARCHAR(64) NOT NULL,
+				userid    BIGINT NOT NULL,
+				authlvl   INT NOT NULL,
+				features  INT NOT NULL DEFAULT 0,
+				expires   DATETIME(3) NOT NULL,
+				used      TINYINT NOT NULL DEFAULT 0,
+				PRIMARY KEY(id),
+				INDEX refreshtokens_chain(chain),
+				INDEX refreshtokens_userid(userid),
+				INDEX refreshtokens_expires(expires)
+			)`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 111); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 111 {
+		// Perform database upgrade from version 111 to version 112.
+		if _, err := a.db.Exec(`ALTER TABLE users 
+			ADD suspendreason VARCHAR(255) DEFAULT '' AFTER state,
+			ADD suspenduntil DATETIME(3) AFTER suspendreason,
+			ADD INDEX users_state_suspenduntil(state, suspenduntil)`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 112); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 112 {
+		// Perform database upgrade from version 112 to version 113.
+		if _, err := a.db.Exec("ALTER TABLE users ADD notify JSON AFTER tags"); err != nil {
+			return err
+		}
+
+		if _, err := a.db.Exec(`ALTER TABLE subscriptions
+			ADD muted BOOLEAN DEFAULT FALSE AFTER private,
+			ADD muteuntil DATETIME(3) AFTER muted`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 113); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 113 {
+		// Perform database upgrade from version 113 to version 114.
+		if _, err := a.db.Exec("ALTER TABLE fileuploads ADD variants JSON AFTER location"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 114); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 114 {
+		// Perform database upgrade from version 114 to version 115.
+		if _, err := a.db.Exec(`ALTER TABLE fileuploads
+			ADD received BIGINT NOT NULL DEFAULT 0 AFTER variants,
+			ADD uploadstate TEXT AFTER received`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 115); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 115 {
+		// Perform database upgrade from version 115 to version 116.
+		if _, err := a.db.Exec(`ALTER TABLE fileuploads
+			ADD hash CHAR(64) NOT NULL DEFAULT '' AFTER uploadstate,
+			ADD INDEX fileuploads_hash(hash)`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 116); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 116 {
+		// Perform database upgrade from version 116 to version 117.
+		if _, err := a.db.Exec("ALTER TABLE users ADD uploadquota BIGINT NOT NULL DEFAULT 0 AFTER notify"); err != nil {
+			return err
+		}
+
+		if _, err := a.db.Exec(`ALTER TABLE fileuploads
+			ADD topic CHAR(25) NOT NULL DEFAULT '' AFTER hash,
+			ADD INDEX fileuploads_userid(userid),
+			ADD INDEX fileuploads_topic(topic)`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 117); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -725,6 +871,62 @@ func (a *adapter) AuthGetUniqueRecord(unique string) (t.Uid, auth.Level, []byte,
 	return store.EncodeUid(record.Userid), record.Authlvl, record.Secret, expires, nil
 }
 
+// RefreshTokenAdd saves a new refresh token record.
+func (a *adapter) RefreshTokenAdd(rt *t.RefreshToken) error {
+	_, err := a.db.Exec("INSERT INTO refreshtokens(id,createdat,chain,userid,authlvl,features,expires,used)"+
+		" VALUES(?,?,?,?,?,?,?,?)",
+		rt.Id, rt.CreatedAt, rt.Chain, store.DecodeUid(t.ParseUid(rt.User)), rt.AuthLvl, rt.Features, rt.Expires, rt.Used)
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
+	return err
+}
+
+// RefreshTokenGet returns a refresh token record by its ID.
+func (a *adapter) RefreshTokenGet(id string) (*t.RefreshToken, error) {
+	var rt t.RefreshToken
+	err := a.db.Get(&rt, "SELECT id,createdat,chain,userid AS user,authlvl,features,expires,used "+
+		"FROM refreshtokens WHERE id=?", id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rt.User = encodeUidString(rt.User).String()
+
+	return &rt, nil
+}
+
+// RefreshTokenUse marks the token as used. Returns false if the token has been used already.
+func (a *adapter) RefreshTokenUse(id string) (bool, error) {
+	res, err := a.db.Exec("UPDATE refreshtokens SET used=1 WHERE id=? AND used=0", id)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+// RefreshTokenDelChain deletes all tokens in the given chain.
+func (a *adapter) RefreshTokenDelChain(chain string) error {
+	_, err := a.db.Exec("DELETE FROM refreshtokens WHERE chain=?", chain)
+	return err
+}
+
+// RefreshTokenDelAll deletes all refresh tokens of the given user.
+func (a *adapter) RefreshTokenDelAll(uid t.Uid) error {
+	_, err := a.db.Exec("DELETE FROM refreshtokens WHERE userid=?", store.DecodeUid(uid))
+	return err
+}
+
+// RefreshTokenDelExpired deletes tokens which expired before the given time.
+func (a *adapter) RefreshTokenDelExpired(before time.Time) error {
+	_, err := a.db.Exec("DELETE FROM refreshtokens WHERE expires<?", before)
+	return err
+}
+
 // UserGet fetches a single user by user id. If user is not found it returns (nil, nil)
 func (a *adapter) UserGet(uid t.Uid) (*t.User, error) {
 	var user t.User
@@ -860,34 +1062,80 @@ func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
 		if _, err = tx.Exec("DELETE FROM users WHERE id=?", decoded_uid); err != nil {
 			return err
 		}
-	} else {
-		now := t.TimeNow()
-		// Disable all user's subscriptions. That includes p2p subscriptions. No need to delete them.
-		if err = subsDelForUser(tx, uid, false); err != nil {
-			return err
-		}
+	} else if err = userDisable(tx, decoded_uid, false); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
 
-		// TODO: Disable all p2p subscriptions with the user.
+// UserDeleteDeferred marks user as pending deletion and disables user's subscriptions and topics.
+func (a *adapter) UserDeleteDeferred(uid t.Uid) error {
+	tx, err := a.db.Beginx()
+	if err != nil {
+		return err
+	}
 
-		// Disable all subscriptions to topics where the user is the owner.
-		if _, err = tx.Exec("UPDATE subscriptions LEFT JOIN topics ON subscriptions.topic=topics.name "+
-			"SET subscriptions.updatedAt=?, subscriptions.deletedAt=? WHERE topics.owner=?",
-			now, now, decoded_uid); err != nil {
-			return err
+	defer func() {
+		if err != nil {
+			tx.Rollback()
 		}
-		// Disable all topics where the user is the owner.
-		if _, err = tx.Exec("UPDATE topics SET updatedAt=?, deletedAt=? WHERE owner=?",
-			now, now, decoded_uid); err != nil {
-			return err
+	}()
+
+	if err = userDisable(tx, store.DecodeUid(uid), true); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// userDisable soft-deletes the user, user's subscriptions, topics owned by the user and subscriptions to them.
+// All records are marked with the same timestamp so they can be restored together. Records which are
+// already soft-deleted are left unchanged. If the user is already soft-deleted, user's deletion time is reused.
+func userDisable(tx *sqlx.Tx, decoded_uid int64, pending bool) error {
+	var deletedAt *time.Time
+	if err := tx.Get(&deletedAt, "SELECT deletedat FROM users WHERE id=? FOR UPDATE", decoded_uid); err != nil {
+		if err == sql.ErrNoRows {
+			err = t.ErrNotFound
 		}
+		return err
+	}
 
-		// Disable user.
-		if _, err = tx.Exec("UPDATE users SET updatedAt=?, deletedAt=? WHERE id=?", now, now, decoded_uid); err != nil {
+	now := t.TimeNow()
+	if deletedAt == nil {
+		deletedAt = &now
+	}
+
+	// Disable user.
+	if pending {
+		if _, err := tx.Exec("UPDATE users SET updatedat=?, deletedat=?, state=? WHERE id=?",
+			now, *deletedAt, t.UserStateDeleted, decoded_uid); err != nil {
 			return err
 		}
+	} else if _, err := tx.Exec("UPDATE users SET updatedat=?, deletedat=? WHERE id=?",
+		now, *deletedAt, decoded_uid); err != nil {
+		return err
 	}
 
-	return tx.Commit()
+	// Disable all user's subscriptions. That includes p2p subscriptions. No need to delete them.
+	if _, err := tx.Exec("UPDATE subscriptions SET updatedat=?, deletedat=? WHERE userid=? AND deletedat IS NULL",
+		now, *deletedAt, decoded_uid); err != nil {
+		return err
+	}
+
+	// TODO: Disable all p2p subscriptions with the user.
+
+	// Disable all subscriptions to topics where the user is the owner.
+	if _, err := tx.Exec("UPDATE subscriptions LEFT JOIN topics ON subscriptions.topic=topics.name "+
+		"SET subscriptions.updatedat=?, subscriptions.deletedat=? WHERE topics.owner=? AND subscriptions.deletedat IS NULL",
+		now, *deletedAt, decoded_uid); err != nil {
+		return err
+	}
+
+	// Disable all topics where the user is the owner.
+	_, err := tx.Exec("UPDATE topics SET updatedat=?, deletedat=? WHERE owner=? AND deletedat IS NULL",
+		now, *deletedAt, decoded_uid)
+	return err
 }
 
 func (a *adapter) UserGetDisabled(since time.Time) ([]t.Uid, error) {
@@ -910,6 +1158,98 @@ func (a *adapter) UserGetDisabled(since time.Time) ([]t.Uid, error) {
 	return uids, err
 }
 
+// UserGetSuspended returns IDs of suspended users whose suspension expired before the given time.
+func (a *adapter) UserGetSuspended(expired time.Time) ([]t.Uid, error) {
+	rows, err := a.db.Queryx("SELECT id FROM users WHERE state=? AND suspenduntil<? AND deletedat IS NULL",
+		t.UserStateSuspended, expired)
+	if err != nil {
+		return nil, err
+	}
+
+	var uids []t.Uid
+	for rows.Next() {
+		var userId int64
+		if err = rows.Scan(&userId); err != nil {
+			uids = nil
+			break
+		}
+		uids = append(uids, store.EncodeUid(userId))
+	}
+	rows.Close()
+
+	return uids, err
+}
+
+// UserGetDeleted returns IDs of users pending deletion which were deleted before the given time.
+func (a *adapter) UserGetDeleted(expired time.Time) ([]t.Uid, error) {
+	rows, err := a.db.Queryx("SELECT id FROM users WHERE state=? AND deletedat<?", t.UserStateDeleted, expired)
+	if err != nil {
+		return nil, err
+	}
+
+	var uids []t.Uid
+	for rows.Next() {
+		var userId int64
+		if err = rows.Scan(&userId); err != nil {
+			uids = nil
+			break
+		}
+		uids = append(uids, store.EncodeUid(userId))
+	}
+	rows.Close()
+
+	return uids, err
+}
+
+// UserUndelete restores user pending deletion together with subscriptions and topics disabled at the same time.
+func (a *adapter) UserUndelete(uid t.Uid, since time.Time) error {
+	tx, err := a.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	decoded_uid := store.DecodeUid(uid)
+
+	var deletedAt time.Time
+	if err = tx.Get(&deletedAt, "SELECT deletedat FROM users WHERE id=? AND state=? AND deletedat>=? FOR UPDATE",
+		decoded_uid, t.UserStateDeleted, since); err != nil {
+		if err == sql.ErrNoRows {
+			err = t.ErrNotFound
+		}
+		return err
+	}
+
+	now := t.TimeNow()
+	// Restore user's subscriptions and subscriptions to topics where the user is the owner.
+	if _, err = tx.Exec("UPDATE subscriptions SET updatedat=?, deletedat=NULL WHERE userid=? AND deletedat=?",
+		now, decoded_uid, deletedAt); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("UPDATE subscriptions LEFT JOIN topics ON subscriptions.topic=topics.name "+
+		"SET subscriptions.updatedat=?, subscriptions.deletedat=NULL WHERE topics.owner=? AND subscriptions.deletedat=?",
+		now, decoded_uid, deletedAt); err != nil {
+		return err
+	}
+	// Restore topics where the user is the owner.
+	if _, err = tx.Exec("UPDATE topics SET updatedat=?, deletedat=NULL WHERE owner=? AND deletedat=?",
+		now, decoded_uid, deletedAt); err != nil {
+		return err
+	}
+	// Restore user.
+	if _, err = tx.Exec("UPDATE users SET updatedat=?, deletedat=NULL, state=? WHERE id=?",
+		now, t.UserStateNormal, decoded_uid); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 // UserUpdate updates user object.
 func (a *adapter) UserUpdate(uid t.Uid, update map[string]interface{}) error {
 	tx, err := a.db.Beginx()
@@ -1158,7 +1498,7 @@ func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
 func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
 	// Fetch user's subscriptions
 	q := `SELECT createdat,updatedat,deletedat,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE userid=?`
+		readseqid,modewant,modegiven,private,muted,muteuntil FROM subscriptions WHERE userid=?`
 	args := []interface{}{store.DecodeUid(uid)}
 	if !keepDeleted {
 		// Filter out rows with defined DeletedAt
@@ -1294,6 +1634,7 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 				sub.SetWith(uid2.UserId())
 				sub.SetDefaultAccess(usr.Access.Auth, usr.Access.Anon)
 				sub.SetLastSeenAndUA(usr.LastSeen, usr.UserAgent)
+				sub.SetState(usr.State)
 				subs = append(subs, sub)
 			}
 		}
@@ -1310,7 +1651,7 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 
 	// Fetch all subscribed users. The number of users is not large
 	q := `SELECT s.createdat,s.updatedat,s.deletedat,s.userid,s.topic,s.delid,s.recvseqid,
-		s.readseqid,s.modewant,s.modegiven,u.public,s.private
+		s.readseqid,s.modewant,s.modegiven,u.public,s.private,s.muted,s.muteuntil
 		FROM subscriptions AS s JOIN users AS u ON s.userid=u.id 
 		WHERE s.topic=?`
 	args := []interface{}{topic}
@@ -1361,7 +1702,7 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 			&sub.CreatedAt, &sub.UpdatedAt, &sub.DeletedAt,
 			&sub.User, &sub.Topic, &sub.DelId, &sub.RecvSeqId,
 			&sub.ReadSeqId, &sub.ModeWant, &sub.ModeGiven,
-			&public, &sub.Private); err != nil {
+			&public, &sub.Private, &sub.Muted, &sub.MuteUntil); err != nil {
 			break
 		}
 
@@ -1533,7 +1874,7 @@ func (a *adapter) TopicOwnerChange(topic string, newOwner t.Uid) error {
 func (a *adapter) SubscriptionGet(topic string, user t.Uid) (*t.Subscription, error) {
 	var sub t.Subscription
 	err := a.db.Get(&sub, `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE topic=? AND userid=?`,
+		readseqid,modewant,modegiven,private,muted,muteuntil FROM subscriptions WHERE topic=? AND userid=?`,
 		topic, store.DecodeUid(user))
 
 	if err != nil {
@@ -1565,7 +1906,7 @@ func (a *adapter) SubsLastSeen(topic string, user t.Uid, lastSeen map[string]tim
 // TODO: this is used only for presence notifications, no need to load Private either.
 func (a *adapter) SubsForUser(forUser t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
 	q := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE userid=?`
+		readseqid,modewant,modegiven,private,muted,muteuntil FROM subscriptions WHERE userid=?`
 	args := []interface{}{store.DecodeUid(forUser)}
 
 	if !keepDeleted {
@@ -1613,7 +1954,7 @@ func (a *adapter) SubsForUser(forUser t.Uid, keepDeleted bool, opts *t.QueryOpt)
 // the latter does not.
 func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
 	q := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE topic=?`
+		readseqid,modewant,modegiven,private,muted,muteuntil FROM subscriptions WHERE topic=?`
 	args := []interface{}{topic}
 
 	if !keepDeleted {
@@ -1762,6 +2103,7 @@ func (a *adapter) FindUsers(uid t.Uid, req, opt []string) ([]t.Subscription, err
 	query := "SELECT u.id,u.createdat,u.updatedat,u.access,u.public,u.tags,COUNT(*) AS matches " +
 		"FROM users AS u LEFT JOIN usertags AS t ON t.userid=u.id " +
 		"WHERE t.tag IN (?" + strings.Repeat(",?", len(req)+len(opt)-1) + ") AND u.deletedat IS NULL " +
+		"AND u.state<>" + strconv.Itoa(t.UserStateSuspended) + " " +
 		"GROUP BY u.id,u.createdat,u.updatedat,u.public,u.tags "
 	if len(req) > 0 {
 		query += "HAVING COUNT(t.tag IN (?" + strings.Repeat(",?", len(req)-1) + ") OR NULL)>=? "
@@ -2463,13 +2805,53 @@ func (a *adapter) CredGetAll(uid t.Uid, method string, validatedOnly bool) ([]t.
 
 // FileStartUpload initializes a file upload
 func (a *adapter) FileStartUpload(fd *t.FileDef) error {
-	_, err := a.db.Exec("INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,location)"+
-		" VALUES(?,?,?,?,?,?,?,?)",
+	return fileInsert(a.db, fd)
+}
+
+func fileInsert(db sqlx.Execer, fd *t.FileDef) error {
+	_, err := db.Exec("INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,location,variants,"+
+		"received,uploadstate,hash,topic) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?)",
 		store.DecodeUid(fd.Uid()), fd.CreatedAt, fd.UpdatedAt,
-		store.DecodeUid(t.ParseUid(fd.User)), fd.Status, fd.MimeType, fd.Size, fd.Location)
+		store.DecodeUid(t.ParseUid(fd.User)), fd.Status, fd.MimeType, fd.Size, fd.Location, fd.Variants,
+		fd.Received, fd.UploadState, fd.Hash, fd.Topic)
 	return err
 }
 
+// FileStartDuplicate saves the record of a completed upload which shares the content with dup.
+// The dup record is locked until the new record is saved: FileDeleteUnused either waits and then
+// sees the new record or deletes dup first.
+func (a *adapter) FileStartDuplicate(fd *t.FileDef, dup string) (bool, error) {
+	id := t.ParseUid(dup)
+	if id.IsZero() {
+		return false, t.ErrMalformed
+	}
+
+	tx, err := a.db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var found int
+	err = tx.Get(&found, "SELECT 1 FROM fileuploads WHERE id=? FOR UPDATE", store.DecodeUid(id))
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err = fileInsert(tx, fd); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
 // FileFinishUpload marks file upload as completed, successfully or otherwise
 func (a *adapter) FileFinishUpload(fid string, status int, size int64) (*t.FileDef, error) {
 	id := t.ParseUid(fid)
@@ -2504,9 +2886,36 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 		return nil, t.ErrMalformed
 	}
 
+	return a.fileGet("id=?", store.DecodeUid(id))
+}
+
+// FileGetByHash fetches a record of a completed upload with the given content hash.
+func (a *adapter) FileGetByHash(hash string) (*t.FileDef, error) {
+	return a.fileGet("hash=? AND status=? LIMIT 1", hash, t.UploadCompleted)
+}
+
+// FileGetAll fetches up to limit file records with IDs greater than after, ordered by ID.
+func (a *adapter) FileGetAll(after string, limit int) ([]t.FileDef, error) {
+	var fds []t.FileDef
+	err := a.db.Select(&fds, fileSelect+"FROM fileuploads WHERE id>? ORDER BY id LIMIT ?",
+		store.DecodeUid(t.ParseUid(after)), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range fds {
+		fds[i].Id = encodeUidString(fds[i].Id).String()
+		fds[i].User = encodeUidString(fds[i].User).String()
+	}
+	return fds, nil
+}
+
+const fileSelect = "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,location,variants," +
+	"received,COALESCE(uploadstate,'') AS uploadstate,hash,topic "
+
+func (a *adapter) fileGet(where string, args ...interface{}) (*t.FileDef, error) {
 	var fd t.FileDef
-	err := a.db.Get(&fd, "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,location "+
-		"FROM fileuploads WHERE id=?", store.DecodeUid(id))
+	err := a.db.Get(&fd, fileSelect+"FROM fileuploads WHERE "+where, args...)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -2518,7 +2927,68 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 	fd.User = encodeUidString(fd.User).String()
 
 	return &fd, nil
+}
+
+// FileUpdate updates fields of the file record.
+func (a *adapter) FileUpdate(fid string, update map[string]interface{}) error {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return t.ErrMalformed
+	}
 
+	cols, args := updateByMap(update)
+	args = append(args, store.DecodeUid(id))
+	_, err := a.db.Exec("UPDATE fileuploads SET "+strings.Join(cols, ",")+" WHERE id=?", args...)
+	return err
+}
+
+// FileUpdateProgress updates the record of a resumable upload in progress if the number of
+// received bytes is still equal to received.
+func (a *adapter) FileUpdateProgress(fid string, received int64, update map[string]interface{}) (bool, error) {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return false, t.ErrMalformed
+	}
+
+	cols, args := updateByMap(update)
+	args = append(args, store.DecodeUid(id), t.UploadStarted, received)
+	res, err := a.db.Exec("UPDATE fileuploads SET "+strings.Join(cols, ",")+" WHERE id=? AND status=? AND received=?",
+		args...)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+// FileLinkedTopics returns names of topics with messages which reference the file.
+func (a *adapter) FileLinkedTopics(fid string) ([]string, error) {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return nil, t.ErrMalformed
+	}
+
+	var topics []string
+	err := a.db.Select(&topics, "SELECT DISTINCT m.topic FROM filemsglinks AS fml "+
+		"JOIN messages AS m ON m.id=fml.msgid WHERE fml.fileid=?", store.DecodeUid(id))
+	return topics, err
+}
+
+// FileGetUsage returns the total size of files uploaded by the user or to the topic.
+func (a *adapter) FileGetUsage(user t.Uid, topic string) (int64, error) {
+	query := "SELECT COALESCE(SUM(size),0) FROM fileuploads WHERE status<>? AND "
+	args := []interface{}{t.UploadFailed}
+	if !user.IsZero() {
+		query += "userid=?"
+		args = append(args, store.DecodeUid(user))
+	} else {
+		query += "topic=?"
+		args = append(args, topic)
+	}
+
+	var total int64
+	err := a.db.Get(&total, query, args...)
+	return total, err
 }
 
 // FileDeleteUnused deletes file upload records.
@@ -2533,32 +3003,38 @@ func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, er
 		}
 	}()
 
-	query := "SELECT fu.id,fu.location FROM fileuploads AS fu LEFT JOIN filemsglinks AS fml ON fml.fileid=fu.id WHERE fml.id IS NULL "
+	query := "SELECT fu.id,fu.location,fu.variants,fu.hash FROM fileuploads AS fu " +
+		"LEFT JOIN filemsglinks AS fml ON fml.fileid=fu.id WHERE fml.id IS NULL "
 	var args []interface{}
 	if !olderThan.IsZero() {
 		query += "AND fu.updatedat<? "
 		args = append(args, olderThan)
 	}
 	if limit > 0 {
-		query += "LIMIT ?"
+		query += "LIMIT ? "
 		args = append(args, limit)
 	}
+	// Lock the records against concurrent FileStartDuplicate.
+	query += "FOR UPDATE"
 
 	rows, err := tx.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 
-	var locations []string
-	var ids []interface{}
+	var deleted []t.FileDef
+	var ids, hashes []interface{}
 	for rows.Next() {
 		var id int
-		var loc string
-		if err = rows.Scan(&id, &loc); err != nil {
+		var fd t.FileDef
+		if err = rows.Scan(&id, &fd.Location, &fd.Variants, &fd.Hash); err != nil {
 			break
 		}
-		locations = append(locations, loc)
+		deleted = append(deleted, fd)
 		ids = append(ids, id)
+		if fd.Hash != "" {
+			hashes = append(hashes, fd.Hash)
+		}
 	}
 	rows.Close()
 
@@ -2574,6 +3050,41 @@ func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, er
 		}
 	}
 
+	// Deduplicated uploads share the content. Find the content still used by the remaining records.
+	inUse := make(map[string]bool)
+	if len(hashes) > 0 {
+		// Locking read: sees the duplicates saved by FileStartDuplicate after the records were locked above.
+		query, hashes, _ = sqlx.In("SELECT DISTINCT location FROM fileuploads WHERE hash IN (?) LOCK IN SHARE MODE",
+			hashes)
+		if rows, err = tx.Query(query, hashes...); err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var loc string
+			if err = rows.Scan(&loc); err != nil {
+				break
+			}
+			inUse[loc] = true
+		}
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var locations []string
+	for i := range deleted {
+		fd := &deleted[i]
+		if inUse[fd.Location] {
+			continue
+		}
+		// Don't delete the same shared content twice.
+		inUse[fd.Location] = true
+		locations = append(locations, fd.Location)
+		// Resized copies are deleted together with the original.
+		locations = append(locations, fd.Variants.Locations()...)
+	}
+
 	return locations, tx.Commit()
 }
 
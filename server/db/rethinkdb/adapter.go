@@ -28,7 +28,7 @@ const (
 	defaultHost     = "localhost:28015"
 	defaultDatabase = "tinode"
 
-	adpVersion = 110
+	adpVersion = 115
 
 	adapterName = "rethinkdb"
 
@@ -236,6 +236,10 @@ func (a *adapter) CreateDb(reset bool) error {
 	if _, err := rdb.DB(a.dbName).Table("users").IndexCreate("Tags", rdb.IndexCreateOpts{Multi: true}).RunWrite(a.conn); err != nil {
 		return err
 	}
+	// Create secondary index on User.SuspendUntil for finding users with expired suspensions
+	if _, err := rdb.DB(a.dbName).Table("users").IndexCreate("SuspendUntil").RunWrite(a.conn); err != nil {
+		return err
+	}
 	// Create secondary index for User.Devices.<hash>.DeviceId to ensure ID uniqueness across users
 	if _, err := rdb.DB(a.dbName).Table("users").IndexCreateFunc("DeviceIds",
 		func(row rdb.Term) interface{} {
@@ -256,6 +260,11 @@ func (a *adapter) CreateDb(reset bool) error {
 		return err
 	}
 
+	// Refresh tokens. See types.RefreshToken.
+	if err := createRefreshTokensTable(a); err != nil {
+		return err
+	}
+
 	// Subscription to a topic. The primary key is a Topic:User string
 	if _, err := rdb.DB(a.dbName).TableCreate("subscriptions", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
 		return err
@@ -303,6 +312,11 @@ func (a *adapter) CreateDb(reset bool) error {
 		}).RunWrite(a.conn); err != nil {
 		return err
 	}
+	// Multi-index of files attached to messages to find topics which reference the file.
+	if _, err := rdb.DB(a.dbName).Table("messages").IndexCreate("Attachments",
+		rdb.IndexCreateOpts{Multi: true}).RunWrite(a.conn); err != nil {
+		return err
+	}
 	// Compound multi-index of soft-deleted messages: each message gets multiple compound index entries like
 	// [Topic, User1, DelId1], [Topic, User2, DelId2],...
 	if _, err := rdb.DB(a.dbName).Table("messages").IndexCreateFunc("Topic_DeletedFor",
@@ -347,6 +361,14 @@ func (a *adapter) CreateDb(reset bool) error {
 	if _, err := rdb.DB(a.dbName).Table("fileuploads").IndexCreate("UseCount").RunWrite(a.conn); err != nil {
 		return err
 	}
+	// A secondary index on fileuploads.Hash to be able to find duplicate uploads.
+	if _, err := rdb.DB(a.dbName).Table("fileuploads").IndexCreate("Hash").RunWrite(a.conn); err != nil {
+		return err
+	}
+	// A secondary index on fileuploads.Topic to be able to calculate storage used by the topic.
+	if _, err := rdb.DB(a.dbName).Table("fileuploads").IndexCreate("Topic").RunWrite(a.conn); err != nil {
+		return err
+	}
 
 	// Record current DB version.
 	if _, err := rdb.DB(a.dbName).Table("kvmeta").Insert(
@@ -409,6 +431,67 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 110 {
+		// Perform database upgrade from version 110 to version 111.
+
+		if err := createRefreshTokensTable(a); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 111); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 111 {
+		// Perform database upgrade from version 111 to version 112.
+
+		if _, err := rdb.DB(a.dbName).Table("users").IndexCreate("SuspendUntil").RunWrite(a.conn); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 112); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 112 {
+		// Perform database upgrade from version 112 to version 113.
+
+		if _, err := rdb.DB(a.dbName).Table("fileuploads").IndexCreate("Hash").RunWrite(a.conn); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 113); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 113 {
+		// Perform database upgrade from version 113 to version 114.
+
+		if _, err := rdb.DB(a.dbName).Table("fileuploads").IndexCreate("Topic").RunWrite(a.conn); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 114); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 114 {
+		// Perform database upgrade from version 114 to version 115.
+
+		if _, err := rdb.DB(a.dbName).Table("messages").IndexCreate("Attachments",
+			rdb.IndexCreateOpts{Multi: true}).RunWrite(a.conn); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 115); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -416,6 +499,24 @@ func (a *adapter) UpgradeDb() error {
 	return nil
 }
 
+// Create table for refresh tokens.
+func createRefreshTokensTable(a *adapter) error {
+	if _, err := rdb.DB(a.dbName).TableCreate("refreshtokens", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Secondary index on Chain to be able to revoke the whole chain at once.
+	if _, err := rdb.DB(a.dbName).Table("refreshtokens").IndexCreate("Chain").RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Secondary index on User to be able to delete all tokens of a user.
+	if _, err := rdb.DB(a.dbName).Table("refreshtokens").IndexCreate("User").RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Secondary index on Expires to be able to delete expired tokens.
+	_, err := rdb.DB(a.dbName).Table("refreshtokens").IndexCreate("Expires").RunWrite(a.conn)
+	return err
+}
+
 // Create system topic 'sys'.
 func createSystemTopic(a *adapter) error {
 	now := t.TimeNow()
@@ -576,6 +677,70 @@ func (a *adapter) AuthGetUniqueRecord(unique string) (t.Uid, auth.Level, []byte,
 	return t.ParseUid(record.Userid), record.AuthLvl, record.Secret, record.Expires, nil
 }
 
+// RefreshTokenAdd saves a new refresh token record.
+func (a *adapter) RefreshTokenAdd(rt *t.RefreshToken) error {
+	_, err := rdb.DB(a.dbName).Table("refreshtokens").Insert(rt).RunWrite(a.conn)
+	if err != nil {
+		if rdb.IsConflictErr(err) {
+			return t.ErrDuplicate
+		}
+		return err
+	}
+	return nil
+}
+
+// RefreshTokenGet returns a refresh token record by its ID.
+func (a *adapter) RefreshTokenGet(id string) (*t.RefreshToken, error) {
+	cursor, err := rdb.DB(a.dbName).Table("refreshtokens").Get(id).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return nil, nil
+	}
+
+	var rt t.RefreshToken
+	if err = cursor.One(&rt); err != nil {
+		return nil, err
+	}
+
+	return &rt, nil
+}
+
+// RefreshTokenUse marks the token as used. Returns false if the token has been used already.
+func (a *adapter) RefreshTokenUse(id string) (bool, error) {
+	// Update is atomic for a single document: the token cannot be used twice.
+	res, err := rdb.DB(a.dbName).Table("refreshtokens").Get(id).
+		Update(func(row rdb.Term) interface{} {
+			return rdb.Branch(row.Field("Used"), map[string]interface{}{}, map[string]interface{}{"Used": true})
+		}).RunWrite(a.conn)
+	if err != nil {
+		return false, err
+	}
+	return res.Replaced > 0, nil
+}
+
+// RefreshTokenDelChain deletes all tokens in the given chain.
+func (a *adapter) RefreshTokenDelChain(chain string) error {
+	_, err := rdb.DB(a.dbName).Table("refreshtokens").GetAllByIndex("Chain", chain).Delete().RunWrite(a.conn)
+	return err
+}
+
+// RefreshTokenDelAll deletes all refresh tokens of the given user.
+func (a *adapter) RefreshTokenDelAll(uid t.Uid) error {
+	_, err := rdb.DB(a.dbName).Table("refreshtokens").GetAllByIndex("User", uid.String()).Delete().RunWrite(a.conn)
+	return err
+}
+
+// RefreshTokenDelExpired deletes tokens which expired before the given time.
+func (a *adapter) RefreshTokenDelExpired(before time.Time) error {
+	_, err := rdb.DB(a.dbName).Table("refreshtokens").
+		Between(rdb.MinVal, before, rdb.BetweenOpts{Index: "Expires"}).Delete().RunWrite(a.conn)
+	return err
+}
+
 // UserGet fetches a single user by user id. If user is not found it returns (nil, nil)
 func (a *adapter) UserGet(uid t.Uid) (*t.User, error) {
 	cursor, err := rdb.DB(a.dbName).Table("users").GetAll(uid.String()).
@@ -693,27 +858,73 @@ func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
 		// And finally delete the user.
 		_, err = rdb.DB(a.dbName).Table("users").Get(uid.String()).Delete().RunWrite(a.conn)
 	} else {
-		// Disable user's subscriptions.
-		if err = a.SubsDelForUser(uid, false); err != nil {
-			return err
-		}
+		err = a.userDisable(uid, false)
+	}
+	return err
+}
 
-		// Disable subscriptions for topics where the user is the owner.
-		// Disable topics where the user is the owner.
-		now := t.TimeNow()
-		disable := map[string]interface{}{"DeletedAt": now, "UpdatedAt": now}
-		if _, err = rdb.DB(a.dbName).Table("topics").GetAllByIndex("Owner", uid.String()).ForEach(
-			func(topic rdb.Term) rdb.Term {
-				return rdb.Expr([]interface{}{
-					rdb.DB(a.dbName).Table("subscriptions").GetAllByIndex("Topic", topic.Field("Id")).Update(disable),
-					rdb.DB(a.dbName).Table("topics").Get(topic.Field("Id")).Update(disable),
-				})
-			}).RunWrite(a.conn); err != nil {
-			return err
-		}
+// UserDeleteDeferred marks user as pending deletion and disables user's subscriptions and topics.
+func (a *adapter) UserDeleteDeferred(uid t.Uid) error {
+	return a.userDisable(uid, true)
+}
+
+// userDisable soft-deletes the user, user's subscriptions, topics owned by the user and subscriptions to them.
+// All records are marked with the same timestamp so they can be restored together. Records which are
+// already soft-deleted are left unchanged. The user is updated first and user's deletion time is reused
+// if the user is already soft-deleted: if the operation is interrupted, it can be safely repeated.
+func (a *adapter) userDisable(uid t.Uid, pending bool) error {
+	cursor, err := rdb.DB(a.dbName).Table("users").Get(uid.String()).Run(a.conn)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return t.ErrNotFound
+	}
+
+	var user t.User
+	if err = cursor.One(&user); err != nil {
+		return err
+	}
+
+	now := t.TimeNow()
+	deletedAt := now
+	if user.DeletedAt != nil {
+		deletedAt = *user.DeletedAt
+	}
 
-		_, err = rdb.DB(a.dbName).Table("users").Get(uid.String()).Update(disable).RunWrite(a.conn)
+	// Disable user.
+	update := map[string]interface{}{"DeletedAt": deletedAt, "UpdatedAt": now}
+	if pending {
+		update["State"] = t.UserStateDeleted
+	}
+	if _, err = rdb.DB(a.dbName).Table("users").Get(uid.String()).Update(update).RunWrite(a.conn); err != nil {
+		return err
 	}
+
+	disable := map[string]interface{}{"DeletedAt": deletedAt, "UpdatedAt": now}
+
+	// Disable user's subscriptions.
+	if _, err = rdb.DB(a.dbName).Table("subscriptions").GetAllByIndex("User", uid.String()).
+		Filter(rdb.Row.HasFields("DeletedAt").Not()).
+		Update(disable).RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	// Disable subscriptions for topics where the user is the owner.
+	// Disable topics where the user is the owner.
+	_, err = rdb.DB(a.dbName).Table("topics").GetAllByIndex("Owner", uid.String()).ForEach(
+		func(topic rdb.Term) rdb.Term {
+			return rdb.Expr([]interface{}{
+				rdb.DB(a.dbName).Table("subscriptions").GetAllByIndex("Topic", topic.Field("Id")).
+					Filter(func(sub rdb.Term) rdb.Term { return sub.HasFields("DeletedAt").Not() }).
+					Update(disable),
+				rdb.DB(a.dbName).Table("topics").Get(topic.Field("Id")).Update(func(row rdb.Term) interface{} {
+					return rdb.Branch(row.HasFields("DeletedAt"), map[string]interface{}{}, disable)
+				}),
+			})
+		}).RunWrite(a.conn)
 	return err
 }
 
@@ -739,6 +950,110 @@ func (a *adapter) UserGetDisabled(since time.Time) ([]t.Uid, error) {
 	return uids, nil
 }
 
+// UserGetSuspended returns IDs of suspended users whose suspension expired before the given time.
+func (a *adapter) UserGetSuspended(expired time.Time) ([]t.Uid, error) {
+	cursor, err := rdb.DB(a.dbName).Table("users").
+		Between(rdb.MinVal, expired, rdb.BetweenOpts{Index: "SuspendUntil"}).
+		Filter(rdb.Row.Field("State").Eq(t.UserStateSuspended).And(rdb.Row.HasFields("DeletedAt").Not())).
+		Field("Id").Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var uids []t.Uid
+	var userId string
+	for cursor.Next(&userId) {
+		uids = append(uids, t.ParseUid(userId))
+	}
+
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	return uids, nil
+}
+
+// UserGetDeleted returns IDs of users pending deletion which were deleted before the given time.
+func (a *adapter) UserGetDeleted(expired time.Time) ([]t.Uid, error) {
+	cursor, err := rdb.DB(a.dbName).Table("users").
+		Between(rdb.MinVal, expired, rdb.BetweenOpts{Index: "DeletedAt"}).
+		Filter(rdb.Row.Field("State").Eq(t.UserStateDeleted)).
+		Field("Id").Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var uids []t.Uid
+	var userId string
+	for cursor.Next(&userId) {
+		uids = append(uids, t.ParseUid(userId))
+	}
+
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	return uids, nil
+}
+
+// UserUndelete restores user pending deletion together with subscriptions and topics disabled at the same time.
+func (a *adapter) UserUndelete(uid t.Uid, since time.Time) error {
+	cursor, err := rdb.DB(a.dbName).Table("users").Get(uid.String()).Run(a.conn)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return t.ErrNotFound
+	}
+
+	var user t.User
+	if err = cursor.One(&user); err != nil {
+		return err
+	}
+	if user.State != t.UserStateDeleted || user.DeletedAt == nil || user.DeletedAt.Before(since) {
+		return t.ErrNotFound
+	}
+
+	deletedAt := *user.DeletedAt
+	now := t.TimeNow()
+	enable := func(row rdb.Term) interface{} {
+		return row.Without("DeletedAt").Merge(map[string]interface{}{"UpdatedAt": now})
+	}
+
+	// Restore user's subscriptions.
+	if _, err = rdb.DB(a.dbName).Table("subscriptions").GetAllByIndex("User", uid.String()).
+		Filter(rdb.Row.Field("DeletedAt").Default(nil).Eq(deletedAt)).
+		Replace(enable).RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	// Restore topics where the user is the owner and subscriptions to them.
+	if _, err = rdb.DB(a.dbName).Table("topics").GetAllByIndex("Owner", uid.String()).
+		Filter(rdb.Row.Field("DeletedAt").Default(nil).Eq(deletedAt)).ForEach(
+		func(topic rdb.Term) rdb.Term {
+			return rdb.Expr([]interface{}{
+				rdb.DB(a.dbName).Table("subscriptions").GetAllByIndex("Topic", topic.Field("Id")).
+					Filter(func(sub rdb.Term) rdb.Term { return sub.Field("DeletedAt").Default(nil).Eq(deletedAt) }).
+					Replace(enable),
+				rdb.DB(a.dbName).Table("topics").Get(topic.Field("Id")).Replace(enable),
+			})
+		}).RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	// Restore user.
+	_, err = rdb.DB(a.dbName).Table("users").Get(uid.String()).
+		Replace(rdb.Row.Without("DeletedAt").Merge(map[string]interface{}{
+			"UpdatedAt": now,
+			"State":     t.UserStateNormal,
+		})).RunWrite(a.conn)
+	return err
+}
+
 // UserUpdate updates user object.
 func (a *adapter) UserUpdate(uid t.Uid, update map[string]interface{}) error {
 	_, err := rdb.DB(a.dbName).Table("users").Get(uid.String()).Update(update).RunWrite(a.conn)
@@ -1020,6 +1335,7 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 				sub.SetWith(uid2.UserId())
 				sub.SetDefaultAccess(usr.Access.Auth, usr.Access.Anon)
 				sub.SetLastSeenAndUA(usr.LastSeen, usr.UserAgent)
+				sub.SetState(usr.State)
 				subs = append(subs, sub)
 			}
 		}
@@ -1404,7 +1720,7 @@ func (a *adapter) FindUsers(uid t.Uid, req, opt []string) ([]t.Subscription, err
 	query := rdb.DB(a.dbName).
 		Table("users").
 		GetAllByIndex("Tags", allTags...).
-		Filter(rdb.Row.HasFields("DeletedAt").Not()).
+		Filter(rdb.Row.HasFields("DeletedAt").Not().And(rdb.Row.Field("State").Default(t.UserStateNormal).Ne(t.UserStateSuspended))).
 		Pluck("Id", "Access", "CreatedAt", "UpdatedAt", "Public", "Tags").
 		Group("Id").
 		Ungroup().
@@ -2066,6 +2382,21 @@ func (a *adapter) FileStartUpload(fd *t.FileDef) error {
 	return err
 }
 
+// FileStartDuplicate saves the record of a completed upload which shares the content with dup.
+// The dup record is touched first: FileDeleteUnused does not delete recently updated records, so
+// either dup is deleted before it's touched or it survives and keeps the content in use.
+func (a *adapter) FileStartDuplicate(fd *t.FileDef, dup string) (bool, error) {
+	res, err := rdb.DB(a.dbName).Table("fileuploads").Get(dup).
+		Update(map[string]interface{}{"UpdatedAt": t.TimeNow()}).RunWrite(a.conn)
+	if err != nil {
+		return false, err
+	}
+	if res.Replaced == 0 {
+		return false, nil
+	}
+	return true, a.FileStartUpload(fd)
+}
+
 // FileFinishUpload marks file upload as completed, successfully or otherwise
 func (a *adapter) FileFinishUpload(fid string, status int, size int64) (*t.FileDef, error) {
 	if _, err := rdb.DB(a.dbName).Table("fileuploads").Get(fid).
@@ -2101,6 +2432,99 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 
 }
 
+// FileGetAll fetches up to limit file records with IDs greater than after, ordered by ID.
+func (a *adapter) FileGetAll(after string, limit int) ([]t.FileDef, error) {
+	cursor, err := rdb.DB(a.dbName).Table("fileuploads").
+		Between(after, rdb.MaxVal, rdb.BetweenOpts{LeftBound: "open"}).
+		OrderBy(rdb.OrderByOpts{Index: "Id"}).Limit(limit).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var fds []t.FileDef
+	if err = cursor.All(&fds); err != nil {
+		return nil, err
+	}
+	return fds, nil
+}
+
+// FileGetByHash fetches a record of a completed upload with the given content hash.
+func (a *adapter) FileGetByHash(hash string) (*t.FileDef, error) {
+	cursor, err := rdb.DB(a.dbName).Table("fileuploads").GetAllByIndex("Hash", hash).
+		Filter(rdb.Row.Field("Status").Eq(t.UploadCompleted)).Limit(1).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return nil, nil
+	}
+
+	var fd t.FileDef
+	if err = cursor.One(&fd); err != nil {
+		if err == rdb.ErrEmptyResult {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &fd, nil
+}
+
+// FileUpdate updates fields of the file record.
+func (a *adapter) FileUpdate(fid string, update map[string]interface{}) error {
+	_, err := rdb.DB(a.dbName).Table("fileuploads").Get(fid).Update(update).RunWrite(a.conn)
+	return err
+}
+
+// FileUpdateProgress updates the record of a resumable upload in progress if the number of
+// received bytes is still equal to received.
+func (a *adapter) FileUpdateProgress(fid string, received int64, update map[string]interface{}) (bool, error) {
+	res, err := rdb.DB(a.dbName).Table("fileuploads").Get(fid).Update(func(row rdb.Term) interface{} {
+		return rdb.Branch(row.Field("Status").Eq(t.UploadStarted).And(row.Field("Received").Eq(received)),
+			update, map[string]interface{}{})
+	}).RunWrite(a.conn)
+	if err != nil {
+		return false, err
+	}
+	return res.Replaced > 0, nil
+}
+
+// FileLinkedTopics returns names of topics with messages which reference the file.
+func (a *adapter) FileLinkedTopics(fid string) ([]string, error) {
+	cursor, err := rdb.DB(a.dbName).Table("messages").GetAllByIndex("Attachments", fid).
+		Field("Topic").Distinct().Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var topics []string
+	err = cursor.All(&topics)
+	return topics, err
+}
+
+// FileGetUsage returns the total size of files uploaded by the user or to the topic.
+func (a *adapter) FileGetUsage(user t.Uid, topic string) (int64, error) {
+	var q rdb.Term
+	if !user.IsZero() {
+		q = rdb.DB(a.dbName).Table("fileuploads").GetAllByIndex("User", user.String())
+	} else {
+		q = rdb.DB(a.dbName).Table("fileuploads").GetAllByIndex("Topic", topic)
+	}
+	cursor, err := q.Filter(rdb.Row.Field("Status").Ne(t.UploadFailed)).Sum("Size").Run(a.conn)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+
+	var total int64
+	err = cursor.One(&total)
+	return total, err
+}
+
 // FileDeleteUnused deletes orphaned file uploads.
 func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, error) {
 	q := rdb.DB(a.dbName).Table("fileuploads").GetAllByIndex("UseCount", 0)
@@ -2111,25 +2535,77 @@ func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, er
 		q = q.Limit(limit)
 	}
 
-	cursor, err := q.Pluck("Location").Run(a.conn)
+	cursor, err := q.Pluck("Id", "Location", "Variants", "Hash").Run(a.conn)
 	if err != nil {
 		return nil, err
 	}
 	defer cursor.Close()
 
-	var locations []string
-	var loc map[string]string
-	for cursor.Next(&loc) {
-		locations = append(locations, loc["Location"])
+	var deleted []t.FileDef
+	var ids, hashes []interface{}
+	var fd t.FileDef
+	for cursor.Next(&fd) {
+		deleted = append(deleted, fd)
+		ids = append(ids, fd.Id)
+		if fd.Hash != "" {
+			hashes = append(hashes, fd.Hash)
+		}
+		fd = t.FileDef{}
 	}
 
 	if err = cursor.Err(); err != nil {
 		return nil, err
 	}
 
-	_, err = q.Delete().RunWrite(a.conn)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// The condition is checked again atomically in case the record was touched by FileStartDuplicate
+	// in the meantime. Such records remain and keep the shared content in use.
+	if _, err = rdb.DB(a.dbName).Table("fileuploads").GetAll(ids...).
+		Replace(func(row rdb.Term) rdb.Term {
+			unused := row.Field("UseCount").Eq(0)
+			if !olderThan.IsZero() {
+				unused = unused.And(row.Field("UpdatedAt").Lt(olderThan))
+			}
+			return rdb.Branch(unused, nil, row)
+		}).RunWrite(a.conn); err != nil {
+		return nil, err
+	}
+
+	// Deduplicated uploads share the content. Find the content still used by the remaining records.
+	inUse := make(map[string]bool)
+	if len(hashes) > 0 {
+		cursor, err := rdb.DB(a.dbName).Table("fileuploads").GetAllByIndex("Hash", hashes...).
+			Field("Location").Distinct().Run(a.conn)
+		if err != nil {
+			return nil, err
+		}
+		var remaining []string
+		err = cursor.All(&remaining)
+		cursor.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, loc := range remaining {
+			inUse[loc] = true
+		}
+	}
 
-	return locations, err
+	var locations []string
+	for i := range deleted {
+		fd := &deleted[i]
+		if inUse[fd.Location] {
+			continue
+		}
+		// Don't delete the same shared content twice.
+		inUse[fd.Location] = true
+		locations = append(locations, fd.Location)
+		// Resized copies are deleted together with the original.
+		locations = append(locations, fd.Variants.Locations()...)
+	}
+	return locations, nil
 }
 
 // Given a select query against 'messages' table, decrement corresponding use counter in 'fileuploads' table.
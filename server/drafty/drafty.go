@@ -123,6 +123,32 @@ func ToPlainText(content interface{}) (string, error) {
 	return forEach([]rune(txt), 0, textLen, spans), nil
 }
 
+// Mentions returns IDs of users mentioned in the Drafty content, i.e. values of the "MN" entities.
+// Plain strings and unrecognized content contain no mentions.
+func Mentions(content interface{}) []string {
+	drafty, ok := content.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	ent, _ := drafty["ent"].([]interface{})
+
+	var mentions []string
+	for i := range ent {
+		e, _ := ent[i].(map[string]interface{})
+		if e == nil {
+			continue
+		}
+		if tp, _ := e["tp"].(string); tp != "MN" {
+			continue
+		}
+		data, _ := e["data"].(map[string]interface{})
+		if val, _ := data["val"].(string); val != "" {
+			mentions = append(mentions, val)
+		}
+	}
+	return mentions
+}
+
 func forEach(line []rune, start, end int, spans []*span) string {
 	// Process ranges calling formatter for each range.
 	var result []string
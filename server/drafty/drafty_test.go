@@ -89,3 +89,46 @@ func TestToPlainText(t *testing.T) {
 		}
 	}
 }
+
+func TestMentions(t *testing.T) {
+	inputs := []string{
+		`"plain text @alice"`,
+		`{
+			"txt":"Hi @alice and @bob",
+			"fmt":[{"at":3,"len":6},{"at":14,"len":4,"key":1}],
+			"ent":[{"tp":"MN","data":{"val":"usrAAAAAAAAAAA"}},{"tp":"MN","data":{"val":"usrBBBBBBBBBBB"}}]
+		}`,
+		`{
+			"txt":"https://api.tinode.co/",
+			"fmt":[{"len":22}],
+			"ent":[{"tp":"LN","data":{"url":"https://api.tinode.co/"}}]
+		}`,
+		`{
+			"txt":"@nobody",
+			"fmt":[{"len":7}],
+			"ent":[{"tp":"MN","data":{}}]
+		}`,
+	}
+	expect := [][]string{
+		nil,
+		{"usrAAAAAAAAAAA", "usrBBBBBBBBBBB"},
+		nil,
+		nil,
+	}
+
+	for i := range inputs {
+		var val interface{}
+		json.Unmarshal([]byte(inputs[i]), &val)
+		res := Mentions(val)
+		if len(res) != len(expect[i]) {
+			t.Errorf("%d: got %v, expected %v", i, res, expect[i])
+			continue
+		}
+		for j := range res {
+			if res[j] != expect[i][j] {
+				t.Errorf("%d: got %v, expected %v", i, res, expect[i])
+				break
+			}
+		}
+	}
+}
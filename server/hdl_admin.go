@@ -0,0 +1,461 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Administrative REST API: user lookup, account suspension, forced logout,
+ *    password reset and topic moderation. Every request is recorded in the
+ *    audit log.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Maximum time to wait for a topic to respond to a request of an internal session.
+const internalRequestTimeout = 10 * time.Second
+
+// Configuration of the admin API.
+type adminConfig struct {
+	// Enable admin API.
+	Enabled bool `json:"enabled"`
+	// File to write audit records to. Records are written to the server log if the path is blank.
+	AuditLog string `json:"audit_log"`
+}
+
+// Logger of the audit records.
+var adminAudit *log.Logger
+
+// Counter of IDs of requests dispatched to internal sessions.
+var internalMsgSeq int64
+
+// adminInit initializes the audit logger.
+func adminInit(conf *adminConfig) error {
+	if conf.AuditLog == "" {
+		adminAudit = log.New(log.Writer(), "admin audit: ", log.Flags())
+		return nil
+	}
+
+	file, err := os.OpenFile(conf.AuditLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	adminAudit = log.New(file, "", 0)
+	return nil
+}
+
+// adminAuditRecord is a single line in the audit log.
+type adminAuditRecord struct {
+	Timestamp time.Time   `json:"ts"`
+	Actor     string      `json:"actor"`
+	Action    string      `json:"action"`
+	Target    string      `json:"target"`
+	Params    interface{} `json:"params,omitempty"`
+	Code      int         `json:"code"`
+}
+
+// serveAdmin handles requests to the admin API:
+//   GET users/{uid} or users?cred=meth:val - user lookup
+//   POST users/{uid}/suspend|unsuspend|logout|reset|restore|quota
+//   DELETE topics/{topic}
+//   GET topics/{topic}/subs
+//   PUT|DELETE topics/{topic}/subs/{uid}
+//   DELETE topics/{topic}/messages
+func serveAdmin(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+
+	var actor, action, target string
+	var params interface{}
+
+	writeHttpResponse := func(msg *ServerComMessage, err error) {
+		// Gorilla CompressHandler requires Content-Type to be set.
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+		if err != nil {
+			log.Println("admin:", action, target, err)
+		}
+		if actor != "" {
+			rec, _ := json.Marshal(&adminAuditRecord{
+				Timestamp: now,
+				Actor:     actor,
+				Action:    action,
+				Target:    target,
+				Params:    params,
+				Code:      msg.Ctrl.Code,
+			})
+			adminAudit.Println(string(rec))
+		}
+	}
+
+	// Check for API key presence
+	isValid, isRoot := checkAPIKey(getAPIKey(req))
+	if !isValid {
+		writeHttpResponse(ErrAPIKeyRequired(now), nil)
+		return
+	}
+
+	if isRoot {
+		actor = "apikey"
+	} else {
+		// Non-root API key: the request must be authenticated as root user.
+		uid, authLvl, challenge, err := authHttpRequest(req)
+		if err != nil {
+			writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+			return
+		}
+		if challenge != nil {
+			writeHttpResponse(InfoChallenge("", now, challenge), nil)
+			return
+		}
+		if uid.IsZero() {
+			writeHttpResponse(ErrAuthRequired("", "", now), nil)
+			return
+		}
+		actor = uid.UserId()
+		if authLvl != auth.LevelRoot {
+			action = "denied"
+			writeHttpResponse(ErrPermissionDenied("", "", now), nil)
+			return
+		}
+	}
+
+	// Split path like 'users/usrAbCd/suspend' into parts. The '<api_path>/v0/admin/' prefix is already removed.
+	path := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	target = path
+
+	var resp *ServerComMessage
+	var err error
+	switch parts[0] {
+	case "users":
+		action, resp, err = adminUsers(req, parts[1:], &params, now)
+	case "topics":
+		action, resp, err = adminTopics(req, parts[1:], &params, now)
+	default:
+		resp = ErrNotFound("", "", now)
+	}
+
+	if action == "" {
+		action = req.Method
+	}
+	writeHttpResponse(resp, err)
+}
+
+// adminUsers handles requests to users/...
+func adminUsers(req *http.Request, parts []string, params *interface{}, now time.Time) (string, *ServerComMessage, error) {
+	if len(parts) == 0 || parts[0] == "" {
+		// Lookup by credential: users?cred=email:alice@example.com
+		if req.Method != http.MethodGet {
+			return "", ErrOperationNotAllowed("", "", now), nil
+		}
+		cred := strings.SplitN(req.FormValue("cred"), ":", 2)
+		if len(cred) != 2 {
+			return "lookup", ErrMalformed("", "", now), nil
+		}
+		if vld := store.GetValidator(cred[0]); vld != nil {
+			var err error
+			if cred[1], err = vld.Normalize(cred[1]); err != nil {
+				return "lookup", decodeStoreError(err, "", "", now, nil), err
+			}
+		}
+		uid, err := store.Users.GetByCred(cred[0], cred[1])
+		if err != nil {
+			return "lookup", decodeStoreError(err, "", "", now, nil), err
+		}
+		if uid.IsZero() {
+			return "lookup", ErrNotFound("", "", now), nil
+		}
+		return "lookup", adminUserLookup(uid, now), nil
+	}
+
+	uid := types.ParseUserId(parts[0])
+	if uid.IsZero() {
+		return "", ErrMalformed("", "", now), nil
+	}
+
+	if len(parts) == 1 {
+		if req.Method != http.MethodGet {
+			return "", ErrOperationNotAllowed("", "", now), nil
+		}
+		return "lookup", adminUserLookup(uid, now), nil
+	}
+
+	action := parts[1]
+	if req.Method != http.MethodPost || len(parts) != 2 {
+		return action, ErrOperationNotAllowed("", "", now), nil
+	}
+
+	if action == "restore" {
+		// Restore account pending deletion. The user record is not accessible until restored.
+		if err := userUndelete(uid); err != nil {
+			return action, decodeStoreError(err, "", "", now, nil), err
+		}
+		return action, NoErr("", "", now), nil
+	}
+
+	user, err := store.Users.Get(uid)
+	if err != nil {
+		return action, decodeStoreError(err, "", "", now, nil), err
+	}
+	if user == nil {
+		return action, ErrUserNotFound("", "", now), nil
+	}
+
+	switch action {
+	case "suspend":
+		// The body is optional.
+		var body struct {
+			Reason string     `json:"reason"`
+			Until  *time.Time `json:"until"`
+		}
+		if err = json.NewDecoder(req.Body).Decode(&body); err != nil && err != io.EOF {
+			return action, ErrMalformed("", "", now), err
+		}
+		*params = body
+		err = userSuspend(uid, body.Reason, body.Until)
+	case "unsuspend":
+		err = userUnsuspend(uid)
+	case "quota":
+		// Upload quota in bytes: 0 to use the server default, negative for unlimited.
+		var body struct {
+			Quota *int64 `json:"quota"`
+		}
+		if err = json.NewDecoder(req.Body).Decode(&body); err != nil || body.Quota == nil {
+			return action, ErrMalformed("", "", now), err
+		}
+		*params = map[string]int64{"quota": *body.Quota}
+		err = store.Users.Update(uid, map[string]interface{}{"UploadQuota": *body.Quota})
+	case "logout":
+		userTerminateSessions(uid)
+	case "reset":
+		var body struct {
+			Scheme string `json:"scheme"`
+			Secret []byte `json:"secret"`
+		}
+		if err = json.NewDecoder(req.Body).Decode(&body); err != nil || body.Scheme == "" {
+			return action, ErrMalformed("", "", now), err
+		}
+		// Do not log the secret.
+		*params = map[string]string{"scheme": body.Scheme}
+		if err = updateUserAuth(&ClientComMessage{
+			Acc: &MsgClientAcc{Scheme: body.Scheme, Secret: body.Secret}}, user, nil); err != nil {
+			break
+		}
+		userTerminateSessions(uid)
+	default:
+		return action, ErrNotFound("", "", now), nil
+	}
+
+	if err != nil {
+		return action, decodeStoreError(err, "", "", now, nil), err
+	}
+	return action, NoErr("", "", now), nil
+}
+
+// adminUserLookup returns user's account, credentials and subscriptions.
+func adminUserLookup(uid types.Uid, now time.Time) *ServerComMessage {
+	user, err := store.Users.Get(uid)
+	if err != nil {
+		return decodeStoreError(err, "", "", now, nil)
+	}
+	if user == nil {
+		return ErrUserNotFound("", "", now)
+	}
+	creds, err := store.Users.GetAllCreds(uid, "", false)
+	if err != nil {
+		return decodeStoreError(err, "", "", now, nil)
+	}
+	subs, err := store.Users.GetTopics(uid, nil)
+	if err != nil {
+		return decodeStoreError(err, "", "", now, nil)
+	}
+	return NoErrParams("", "", now, map[string]interface{}{
+		"user":  user,
+		"creds": creds,
+		"subs":  subs,
+	})
+}
+
+// adminTopics handles requests to topics/...
+func adminTopics(req *http.Request, parts []string, params *interface{}, now time.Time) (string, *ServerComMessage, error) {
+	if len(parts) == 0 || parts[0] == "" {
+		return "", ErrMalformed("", "", now), nil
+	}
+
+	name := parts[0]
+	if types.GetTopicCat(name) != types.TopicCatGrp {
+		// Only group topics have owners who can be impersonated.
+		return "", ErrOperationNotAllowed("", name, now), nil
+	}
+
+	topic, err := store.Topics.Get(name)
+	if err != nil {
+		return "", decodeStoreError(err, "", name, now, nil), err
+	}
+	if topic == nil {
+		return "", ErrTopicNotFound("", name, now), nil
+	}
+	owner := types.ParseUid(topic.Owner)
+
+	switch {
+	case len(parts) == 1 && req.Method == http.MethodDelete:
+		resp := adminExec(owner, []*ClientComMessage{
+			{Del: &MsgClientDel{Topic: name, What: "topic", Hard: true}},
+		})
+		return "del-topic", resp, nil
+
+	case len(parts) == 2 && parts[1] == "subs" && req.Method == http.MethodGet:
+		subs, err := store.Topics.GetSubs(name, nil)
+		if err != nil {
+			return "get-subs", decodeStoreError(err, "", name, now, nil), err
+		}
+		return "get-subs", NoErrParams("", name, now, map[string]interface{}{"subs": subs}), nil
+
+	case len(parts) == 3 && parts[1] == "subs":
+		user := types.ParseUserId(parts[2])
+		if user.IsZero() {
+			return "", ErrMalformed("", name, now), nil
+		}
+		switch req.Method {
+		case http.MethodPut:
+			var body struct {
+				Mode string `json:"mode"`
+			}
+			if err = json.NewDecoder(req.Body).Decode(&body); err != nil || body.Mode == "" {
+				return "set-sub", ErrMalformed("", name, now), err
+			}
+			*params = body
+			resp := adminExec(owner, []*ClientComMessage{
+				{Set: &MsgClientSet{Topic: name, MsgSetQuery: MsgSetQuery{
+					Sub: &MsgSetSub{User: user.UserId(), Mode: body.Mode}}}},
+			})
+			return "set-sub", resp, nil
+		case http.MethodDelete:
+			resp := adminExec(owner, []*ClientComMessage{
+				{Sub: &MsgClientSub{Topic: name, Background: true}},
+				{Del: &MsgClientDel{Topic: name, What: "sub", User: user.UserId()}},
+			})
+			return "del-sub", resp, nil
+		}
+
+	case len(parts) == 2 && parts[1] == "messages" && req.Method == http.MethodDelete:
+		var body struct {
+			DelSeq []MsgDelRange `json:"delseq"`
+			Hard   bool          `json:"hard"`
+		}
+		if err = json.NewDecoder(req.Body).Decode(&body); err != nil || len(body.DelSeq) == 0 {
+			return "del-msg", ErrMalformed("", name, now), err
+		}
+		*params = body
+		resp := adminExec(owner, []*ClientComMessage{
+			{Sub: &MsgClientSub{Topic: name, Background: true}},
+			{Del: &MsgClientDel{Topic: name, What: "msg", DelSeq: body.DelSeq, Hard: body.Hard}},
+		})
+		return "del-msg", resp, nil
+	}
+
+	return "", ErrOperationNotAllowed("", name, now), nil
+}
+
+// adminExec executes client messages on behalf of the given user using an internal root session.
+// Messages are executed in order; execution stops at the first failure. Returns the {ctrl} response
+// to the last executed message.
+func adminExec(asUid types.Uid, msgs []*ClientComMessage) *ServerComMessage {
+	for _, msg := range msgs {
+		msg.from = asUid.UserId()
+		msg.authLvl = int(auth.LevelAuth)
+	}
+	resp, _ := execInternal(types.ZeroUid, auth.LevelRoot, msgs)
+	return resp
+}
+
+// execInternal executes client messages in a new internal session authenticated as the given
+// user. Messages are executed in order; execution stops at the first failure. Returns the {ctrl}
+// response to the last executed message and other messages received in response to it, like
+// {meta} and {data}.
+func execInternal(uid types.Uid, authLvl auth.Level, msgs []*ClientComMessage) (*ServerComMessage, []*ServerComMessage) {
+	sess, _ := globals.sessionStore.NewSession(nil, "")
+	sess.uid = uid
+	sess.authLvl = authLvl
+	sess.ver = parseVersion(currentVersion)
+	// Leave all topics and remove the session from the store.
+	defer sess.cleanUp(false)
+
+	var resp *ServerComMessage
+	var replies []*ServerComMessage
+	for _, msg := range msgs {
+		id := "int" + strconv.FormatInt(atomic.AddInt64(&internalMsgSeq, 1), 10)
+		switch {
+		case msg.Pub != nil:
+			msg.Pub.Id = id
+		case msg.Sub != nil:
+			msg.Sub.Id = id
+		case msg.Leave != nil:
+			msg.Leave.Id = id
+		case msg.Get != nil:
+			msg.Get.Id = id
+		case msg.Set != nil:
+			msg.Set.Id = id
+		case msg.Del != nil:
+			msg.Del.Id = id
+		}
+
+		sess.dispatch(msg)
+
+		var err error
+		if resp, replies, err = internalWaitCtrl(sess, id); err != nil {
+			log.Println("internal session: request failed", err, sess.sid)
+			return ErrUnknown(id, "", types.TimeNow()), nil
+		}
+		if resp.Ctrl.Code >= http.StatusBadRequest {
+			break
+		}
+	}
+	return resp, replies
+}
+
+// internalWaitCtrl reads output of the internal session until the {ctrl} message with the given ID
+// is received. Returns the {ctrl} and {meta} and {data} messages received before it. Other messages
+// are discarded.
+func internalWaitCtrl(sess *Session, id string) (*ServerComMessage, []*ServerComMessage, error) {
+	var replies []*ServerComMessage
+	timeout := time.After(internalRequestTimeout)
+	for {
+		select {
+		case raw := <-sess.send:
+			data, ok := raw.([]byte)
+			if !ok {
+				continue
+			}
+			var msg ServerComMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				return nil, nil, err
+			}
+			if msg.Ctrl != nil && msg.Ctrl.Id == id {
+				return &msg, replies, nil
+			}
+			if (msg.Meta != nil && msg.Meta.Id == id) || msg.Data != nil {
+				replies = append(replies, &msg)
+			}
+		case <-timeout:
+			return nil, nil, errors.New("timeout waiting for response to " + id)
+		}
+	}
+}
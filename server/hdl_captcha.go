@@ -0,0 +1,65 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Handler of CAPTCHA challenges. Issues challenges to be solved in {acc}
+ *    requests which create new accounts.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/tinode/chat/server/store/types"
+	"github.com/tinode/chat/server/validate/captcha"
+)
+
+// captchaServe issues a new challenge or renders an existing one in a different format:
+//
+//	GET <api_path>v0/captcha?fmt=png|wav[&id=<challenge ID>]
+//
+// The challenge is returned in ctrl.params: {"id": <challenge ID>, "mime": <MIME type>, "data": <base64 content>}.
+func captchaServe(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+
+	writeHttpResponse := func(msg *ServerComMessage, err error) {
+		// Gorilla CompressHandler requires Content-Type to be set.
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		// Challenges must not be reused.
+		wrt.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+		if err != nil {
+			log.Println("captcha serve", err)
+		}
+	}
+
+	// Check for API key presence
+	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+		writeHttpResponse(ErrAPIKeyRequired(now), nil)
+		return
+	}
+
+	if req.Method != http.MethodGet {
+		writeHttpResponse(ErrOperationNotAllowed("", "", now), nil)
+		return
+	}
+
+	query := req.URL.Query()
+	id, data, mime, err := captcha.Challenge(query.Get("id"), query.Get("fmt"))
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+
+	writeHttpResponse(NoErrParams("", "", now, map[string]interface{}{
+		"id":   id,
+		"mime": mime,
+		"data": data,
+	}), nil)
+}
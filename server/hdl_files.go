@@ -10,18 +10,47 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io"
+	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/media"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 )
 
+const (
+	// Uploaded files which are not attached to any message are deleted after this timeout.
+	unusedFileTimeout = time.Hour
+
+	// Version of tus protocol used by resumable uploads.
+	tusVersion = "1.0.0"
+)
+
+// IDs of resumable uploads currently receiving data at this node. Used to reject concurrent
+// writes to the same upload. Concurrent writes at different nodes are detected when the
+// progress is saved: only the first one is recorded.
+var resumableBusy = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
 func largeFileServe(wrt http.ResponseWriter, req *http.Request) {
 	now := types.TimeNow()
 	enc := json.NewEncoder(wrt)
@@ -37,25 +66,88 @@ func largeFileServe(wrt http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	// Check for API key presence
-	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
-		writeHttpResponse(ErrAPIKeyRequired(now), nil)
-		return
-	}
+	// Signed URLs are accepted without API key and authentication.
+	signed := globals.urlSigningKey != nil && media.IsSignedUrl(req.URL.String())
+	var uid types.Uid
+	var authLvl auth.Level
+	if signed {
+		if err := media.VerifySignedUrl(req.URL.String(), globals.urlSigningKey, now); err != nil {
+			writeHttpResponse(ErrPermissionDenied("", "", now), err)
+			return
+		}
+	} else {
+		// Check for API key presence
+		if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+			writeHttpResponse(ErrAPIKeyRequired(now), nil)
+			return
+		}
 
-	// Check authorization: either auth information or SID must be present
-	uid, challenge, err := authHttpRequest(req)
-	if err != nil {
-		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
-		return
+		// Check authorization: either auth information or SID must be present
+		var challenge []byte
+		var err error
+		uid, authLvl, challenge, err = authHttpRequest(req)
+		if err != nil {
+			writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+			return
+		}
+		if challenge != nil {
+			writeHttpResponse(InfoChallenge("", now, challenge), nil)
+			return
+		}
+		if uid.IsZero() {
+			// Not authenticated
+			writeHttpResponse(ErrAuthRequired("", "", now), nil)
+			return
+		}
 	}
-	if challenge != nil {
-		writeHttpResponse(InfoChallenge("", now, challenge), nil)
-		return
+
+	// Block download of files which are not completely uploaded or not scanned yet.
+	fid := mh.GetIdFromUrl(req.URL.String())
+	if !fid.IsZero() {
+		fd, err := store.Files.Get(fid.String())
+		if err != nil {
+			writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+			return
+		}
+		if fd == nil || fd.Status != types.UploadCompleted {
+			if fd != nil && fd.Status == types.UploadQuarantined {
+				writeHttpResponse(ErrPermissionDenied("", "", now), errors.New("file is not scanned yet"))
+			} else {
+				writeHttpResponse(ErrNotFound("", "", now), nil)
+			}
+			return
+		}
+
+		// Only the uploader and readers of topics where the file is attached may download it.
+		// Access to signed URLs was checked when the URL was signed.
+		if !signed && fd.User != uid.String() && authLvl != auth.LevelRoot {
+			allowed, err := store.Files.CanRead(fd.Id, uid)
+			if err != nil {
+				writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+				return
+			}
+			if !allowed {
+				writeHttpResponse(ErrPermissionDenied("", "", now), nil)
+				return
+			}
+		}
 	}
-	if uid.IsZero() {
-		// Not authenticated
-		writeHttpResponse(ErrAuthRequired("", "", now), nil)
+
+	// POST to the download URL requests a signed URL which can be used without authentication.
+	if req.Method == http.MethodPost {
+		if globals.urlSigningKey == nil {
+			writeHttpResponse(ErrNotImplemented("", "", now), nil)
+			return
+		}
+		if signed {
+			writeHttpResponse(ErrPermissionDenied("", "", now), errors.New("signed URL cannot be signed again"))
+			return
+		}
+		if fid.IsZero() {
+			writeHttpResponse(ErrNotFound("", "", now), nil)
+			return
+		}
+		largeFileSignUrl(wrt, req, now)
 		return
 	}
 
@@ -88,6 +180,28 @@ func largeFileServe(wrt http.ResponseWriter, req *http.Request) {
 	log.Println("media served OK")
 }
 
+// largeFileSignUrl responds with the signed version of the download URL.
+func largeFileSignUrl(wrt http.ResponseWriter, req *http.Request, now time.Time) {
+	msg := ErrUnknown("", "", now)
+	expires := now.Add(globals.signedUrlLifetime).Round(time.Second)
+	// Only the requested variant of the file is kept in the signed URL.
+	u := req.URL.Path
+	if variant := media.GetVariantFromUrl(req.URL.String()); variant != "" {
+		u += "?size=" + url.QueryEscape(variant)
+	}
+	signedUrl, err := media.SignUrl(u, globals.urlSigningKey, expires)
+	if err == nil {
+		msg = NoErrParams("", "", now, map[string]interface{}{"url": signedUrl, "expires": expires})
+	} else {
+		log.Println("media sign url:", err)
+	}
+
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+	wrt.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	wrt.WriteHeader(msg.Ctrl.Code)
+	json.NewEncoder(wrt).Encode(msg)
+}
+
 // largeFileUpload receives files from client over HTTP(S) and saves them to local file
 // system.
 func largeFileUpload(wrt http.ResponseWriter, req *http.Request) {
@@ -125,7 +239,7 @@ func largeFileUpload(wrt http.ResponseWriter, req *http.Request) {
 
 	msgID := req.FormValue("id")
 	// Check authorization: either auth information or SID must be present
-	uid, challenge, err := authHttpRequest(req)
+	uid, _, challenge, err := authHttpRequest(req)
 	if err != nil {
 		writeHttpResponse(decodeStoreError(err, msgID, "", now, nil), err)
 		return
@@ -154,7 +268,7 @@ func largeFileUpload(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	file, _, err := req.FormFile("file")
+	file, header, err := req.FormFile("file")
 	if err != nil {
 		if strings.Contains(err.Error(), "request body too large") {
 			writeHttpResponse(ErrTooLarge(msgID, "", now), err)
@@ -163,10 +277,18 @@ func largeFileUpload(wrt http.ResponseWriter, req *http.Request) {
 		}
 		return
 	}
+
+	topic, resp, err := largeFileCheckQuota(uid, req.FormValue("topic"), header.Size, msgID, now)
+	if resp != nil {
+		writeHttpResponse(resp, err)
+		return
+	}
+
 	fdef := types.FileDef{}
 	fdef.Id = store.GetUidString()
 	fdef.InitTimes()
 	fdef.User = uid.String()
+	fdef.Topic = topic
 
 	buff := make([]byte, 512)
 	if _, err = file.Read(buff); err != nil {
@@ -180,13 +302,498 @@ func largeFileUpload(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	url, err := mh.Upload(&fdef, file)
+	var src io.ReadSeeker = file
+	if globals.imageConfig != nil && media.IsProcessableImage(fdef.MimeType) {
+		if src, err = largeFileMakeVariants(mh, &fdef, file); err != nil {
+			writeHttpResponse(decodeStoreError(err, msgID, "", now, nil), err)
+			return
+		}
+	}
+
+	url, err := mh.Upload(&fdef, src)
 	if err != nil {
+		// Variants are not referenced by anything. Delete them.
+		if locations := fdef.Variants.Locations(); len(locations) > 0 {
+			mh.Delete(locations)
+		}
 		writeHttpResponse(decodeStoreError(err, msgID, "", now, nil), err)
 		return
 	}
 
-	writeHttpResponse(NoErrParams(msgID, "", now, map[string]string{"url": url}), nil)
+	// Duplicates of already scanned files are stored as completed.
+	if fdef.Status != types.UploadCompleted && store.GetMediaScanner() != nil {
+		if _, err = src.Seek(0, io.SeekStart); err != nil {
+			writeHttpResponse(ErrUnknown(msgID, "", now), err)
+			return
+		}
+		if resp, err := largeFileScan(mh, &fdef, src, msgID, now); resp != nil {
+			writeHttpResponse(resp, err)
+			return
+		}
+	}
+
+	params := map[string]interface{}{"url": url}
+	if len(fdef.Variants) > 0 {
+		variants := make(map[string]string, len(fdef.Variants))
+		for _, v := range fdef.Variants {
+			variants[v.Name] = url + "?size=" + v.Name
+		}
+		params["variants"] = variants
+	}
+	writeHttpResponse(NoErrParams(msgID, "", now, params), nil)
+}
+
+// largeFileScan scans the uploaded file for malware. Clean files are released from quarantine,
+// infected files are deleted. Returns the error response if the file is not clean.
+func largeFileScan(mh media.Handler, fdef *types.FileDef, content io.Reader, msgID string, now time.Time) (*ServerComMessage, error) {
+	threat, err := store.GetMediaScanner().Scan(content)
+	if err != nil {
+		// The file remains in quarantine until garbage collected.
+		return ErrUnknown(msgID, "", now), err
+	}
+
+	if threat != "" {
+		mh.Delete(append([]string{fdef.Location}, fdef.Variants.Locations()...))
+		if err = store.Files.SetScanned(fdef.Id, false); err != nil {
+			log.Println("media upload: failed to mark infected file", fdef.Id, err)
+		}
+		return ErrInfected(msgID, "", now), errors.New("malware '" + threat + "' detected in " + fdef.Id)
+	}
+
+	if err = store.Files.SetScanned(fdef.Id, true); err != nil {
+		return decodeStoreError(err, msgID, "", now, nil), err
+	}
+	return nil, nil
+}
+
+// largeFileCheckQuota checks if the user may upload size more bytes, optionally to the given topic.
+// Returns the name of the topic as stored in the database if the upload is allowed or the error
+// response otherwise. Concurrent uploads may exceed the quota slightly.
+func largeFileCheckQuota(uid types.Uid, topic string, size int64, msgID string, now time.Time) (string, *ServerComMessage, error) {
+	used, quota, err := userStorage(uid)
+	if err != nil {
+		return "", decodeStoreError(err, msgID, "", now, nil), err
+	}
+	if quota > 0 && used+size > quota {
+		return "", ErrQuotaExceeded(msgID, "", now, used, quota), nil
+	}
+
+	if topic == "" {
+		return "", nil, nil
+	}
+
+	// The user must be subscribed to the topic to upload files to it.
+	name := topic
+	if strings.HasPrefix(topic, "usr") {
+		name = uid.P2PName(types.ParseUserId(topic))
+	}
+	sub, err := store.Subs.Get(name, uid)
+	if err != nil {
+		return "", decodeStoreError(err, msgID, topic, now, nil), err
+	}
+	if sub == nil || sub.DeletedAt != nil {
+		return "", ErrPermissionDenied(msgID, topic, now), nil
+	}
+
+	if globals.topicUploadQuota > 0 {
+		used, err := store.Files.GetUsage(types.ZeroUid, name)
+		if err != nil {
+			return "", decodeStoreError(err, msgID, topic, now, nil), err
+		}
+		if used+size > globals.topicUploadQuota {
+			return "", ErrQuotaExceeded(msgID, topic, now, used, globals.topicUploadQuota), nil
+		}
+	}
+	return name, nil, nil
+}
+
+// attachmentsCheckQuota checks if files attached to a message fit into the upload quota of the topic.
+// Files uploaded without a topic are charged to the topic where they are attached first.
+func attachmentsCheckQuota(head map[string]interface{}, topic, msgID string, now time.Time) *ServerComMessage {
+	arr, ok := head["attachments"].([]interface{})
+	if !ok || len(arr) == 0 {
+		return nil
+	}
+	var urls []string
+	for _, val := range arr {
+		if url, ok := val.(string); ok {
+			urls = append(urls, url)
+		}
+	}
+
+	size, err := store.Files.GetUncharged(urls)
+	if err != nil {
+		return decodeStoreError(err, msgID, topic, now, nil)
+	}
+	if size == 0 {
+		return nil
+	}
+	used, err := store.Files.GetUsage(types.ZeroUid, topic)
+	if err != nil {
+		return decodeStoreError(err, msgID, topic, now, nil)
+	}
+	if used+size > globals.topicUploadQuota {
+		return ErrQuotaExceeded(msgID, topic, now, used, globals.topicUploadQuota)
+	}
+	return nil
+}
+
+// userStorage returns the total size of files uploaded by the user and the user's upload quota,
+// 0 if unlimited.
+func userStorage(uid types.Uid) (int64, int64, error) {
+	user, err := store.Users.Get(uid)
+	if err != nil {
+		return 0, 0, err
+	}
+	if user == nil {
+		return 0, 0, types.ErrUserNotFound
+	}
+
+	quota := globals.userUploadQuota
+	if user.UploadQuota != 0 {
+		// Set by the administrator.
+		quota = user.UploadQuota
+	}
+	if quota < 0 {
+		quota = 0
+	}
+
+	used, err := store.Files.GetUsage(uid, "")
+	return used, quota, err
+}
+
+// largeFileMakeVariants creates and saves resized copies of the uploaded image and links them
+// to the file record. Returns the image to upload in place of the original: the original
+// with metadata removed if requested. Images which cannot be processed are uploaded unchanged
+// unless metadata must be removed: then they are rejected with ErrPolicy.
+func largeFileMakeVariants(mh media.Handler, fdef *types.FileDef, file io.ReadSeeker) (io.ReadSeeker, error) {
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	original, variants, err := media.ProcessImage(data, fdef.MimeType, globals.imageConfig)
+	if err != nil {
+		log.Println("media upload: image not processed", err)
+		if globals.imageConfig.StripMetadata {
+			// Don't store the image with metadata which should have been removed.
+			return nil, types.ErrPolicy
+		}
+		return bytes.NewReader(data), nil
+	}
+
+	for i := range variants {
+		v := &variants[i]
+		fv := types.FileVariant{Name: v.Name, MimeType: v.MimeType, Width: v.Width, Height: v.Height}
+		if err = mh.UploadVariant(fdef, &fv, bytes.NewReader(v.Data)); err != nil {
+			if locations := fdef.Variants.Locations(); len(locations) > 0 {
+				mh.Delete(locations)
+			}
+			fdef.Variants = nil
+			return nil, err
+		}
+		fdef.Variants = append(fdef.Variants, fv)
+	}
+
+	return bytes.NewReader(original), nil
+}
+
+// largeFileResumable handles resumable uploads using tus protocol (https://tus.io/protocols/resumable-upload.html)
+// with 'creation', 'termination' and 'expiration' extensions:
+//   POST creates a new upload of the size given in Upload-Length header,
+//   HEAD reports the offset to resume the upload from,
+//   PATCH appends a chunk at Upload-Offset,
+//   DELETE cancels the upload.
+// The upload is finalised when the last byte is received. The response to the final PATCH
+// contains the {ctrl} message with the URL of the file.
+//
+// Resumable uploads are meant for large files. They are not resized: image processing requires
+// the whole image in memory. If image metadata must be stripped, images must be uploaded in
+// one request. Content of resumable uploads is not deduplicated because it's stored before
+// it's known, but its hash is saved on completion so later uploads of the same content reuse it.
+func largeFileResumable(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	mh := store.GetMediaHandler()
+
+	wrt.Header().Set("Tus-Resumable", tusVersion)
+	wrt.Header().Set("Cache-Control", "no-store")
+
+	writeHttpResponse := func(msg *ServerComMessage, err error) {
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+
+		if err != nil {
+			log.Println("media resumable upload:", msg.Ctrl.Code, msg.Ctrl.Text, "/", err)
+		}
+	}
+
+	method := req.Method
+	if override := req.Header.Get("X-HTTP-Method-Override"); override != "" {
+		method = override
+	}
+
+	if method == http.MethodOptions {
+		wrt.Header().Set("Tus-Version", tusVersion)
+		wrt.Header().Set("Tus-Extension", "creation,termination,expiration")
+		if globals.maxFileUploadSize > 0 {
+			wrt.Header().Set("Tus-Max-Size", strconv.FormatInt(globals.maxFileUploadSize, 10))
+		}
+		wrt.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if req.Header.Get("Tus-Resumable") != tusVersion {
+		wrt.Header().Set("Tus-Version", tusVersion)
+		writeHttpResponse(&ServerComMessage{Ctrl: &MsgServerCtrl{
+			Code:      http.StatusPreconditionFailed, // 412
+			Text:      "version not supported",
+			Timestamp: now}}, nil)
+		return
+	}
+
+	// Check for API key presence
+	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+		writeHttpResponse(ErrAPIKeyRequired(now), nil)
+		return
+	}
+
+	// Check authorization: either auth information or SID must be present
+	uid, _, challenge, err := authHttpRequest(req)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	if challenge != nil {
+		writeHttpResponse(InfoChallenge("", now, challenge), nil)
+		return
+	}
+	if uid.IsZero() {
+		// Not authenticated
+		writeHttpResponse(ErrAuthRequired("", "", now), nil)
+		return
+	}
+
+	if method == http.MethodPost {
+		size, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || size <= 0 {
+			writeHttpResponse(ErrMalformed("", "", now), errors.New("invalid Upload-Length"))
+			return
+		}
+		if globals.maxFileUploadSize > 0 && size > globals.maxFileUploadSize {
+			writeHttpResponse(ErrTooLarge("", "", now), nil)
+			return
+		}
+
+		meta := tusMetadata(req.Header.Get("Upload-Metadata"))
+		topic, resp, err := largeFileCheckQuota(uid, meta["topic"], size, "", now)
+		if resp != nil {
+			writeHttpResponse(resp, err)
+			return
+		}
+
+		fdef := types.FileDef{Size: size, Topic: topic}
+		fdef.Id = store.GetUidString()
+		fdef.InitTimes()
+		fdef.User = uid.String()
+		fdef.MimeType = meta["filetype"]
+		if fdef.MimeType != "" {
+			if _, _, err = mime.ParseMediaType(fdef.MimeType); err != nil {
+				writeHttpResponse(ErrMalformed("", "", now), err)
+				return
+			}
+			if resumableMustProcess(fdef.MimeType) {
+				writeHttpResponse(ErrPolicy("", "", now), errors.New("images must be uploaded in one request"))
+				return
+			}
+		}
+
+		if err = mh.UploadStart(&fdef); err != nil {
+			writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+			return
+		}
+
+		wrt.Header().Set("Location", strings.TrimSuffix(req.URL.Path, "/")+"/"+fdef.Id)
+		wrt.Header().Set("Upload-Expires", fdef.UpdatedAt.Add(unusedFileTimeout).Format(http.TimeFormat))
+		writeHttpResponse(NoErrCreated("", "", now), nil)
+		return
+	}
+
+	fid := path.Base(req.URL.Path)
+	fdef, err := store.Files.Get(fid)
+	if err == nil && (fdef == nil || fdef.Size == 0 ||
+		(fdef.Status != types.UploadStarted && fdef.Received != fdef.Size)) {
+		// Not a resumable upload: regular uploads don't know the size until completed
+		// and don't track received bytes.
+		err = types.ErrNotFound
+	}
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	if fdef.User != uid.String() {
+		writeHttpResponse(ErrPermissionDenied("", "", now), nil)
+		return
+	}
+	if fdef.Status == types.UploadFailed {
+		writeHttpResponse(ErrGone("", "", now), nil)
+		return
+	}
+
+	switch method {
+	case http.MethodHead:
+		wrt.Header().Set("Upload-Offset", strconv.FormatInt(fdef.Received, 10))
+		wrt.Header().Set("Upload-Length", strconv.FormatInt(fdef.Size, 10))
+		if fdef.Status == types.UploadStarted {
+			wrt.Header().Set("Upload-Expires", fdef.UpdatedAt.Add(unusedFileTimeout).Format(http.TimeFormat))
+		}
+		wrt.WriteHeader(http.StatusOK)
+
+	case http.MethodPatch:
+		if fdef.Status != types.UploadStarted {
+			writeHttpResponse(ErrOperationNotAllowed("", "", now), errors.New("upload already completed"))
+			return
+		}
+		if req.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			writeHttpResponse(ErrMalformed("", "", now), errors.New("invalid Content-Type"))
+			return
+		}
+
+		resumableBusy.Lock()
+		busy := resumableBusy.ids[fdef.Id]
+		resumableBusy.ids[fdef.Id] = true
+		resumableBusy.Unlock()
+		if busy {
+			writeHttpResponse(ErrLocked("", "", now), nil)
+			return
+		}
+		defer func() {
+			resumableBusy.Lock()
+			delete(resumableBusy.ids, fdef.Id)
+			resumableBusy.Unlock()
+		}()
+
+		// Re-read the record: another request could have written to the upload before the lock was taken.
+		if fdef, err = store.Files.Get(fid); err != nil || fdef == nil {
+			if err == nil {
+				err = types.ErrNotFound
+			}
+			writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+			return
+		}
+		if fdef.Status != types.UploadStarted {
+			writeHttpResponse(ErrOperationNotAllowed("", "", now), errors.New("upload already completed"))
+			return
+		}
+		if offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64); err != nil || offset != fdef.Received {
+			writeHttpResponse(ErrConflict("", "", now), errors.New("offset mismatch"))
+			return
+		}
+
+		var chunk io.Reader = req.Body
+		if fdef.MimeType == "" {
+			// Detect content type from the first chunk.
+			br := bufio.NewReaderSize(req.Body, 512)
+			if buff, _ := br.Peek(512); len(buff) > 0 {
+				fdef.MimeType = http.DetectContentType(buff)
+				if resumableMustProcess(fdef.MimeType) {
+					mh.UploadAbort(fdef)
+					writeHttpResponse(ErrPolicy("", "", now), errors.New("images must be uploaded in one request"))
+					return
+				}
+				if err = store.Files.Update(fdef.Id, map[string]interface{}{"MimeType": fdef.MimeType}); err != nil {
+					writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+					return
+				}
+			}
+			chunk = br
+		}
+
+		if _, err = mh.UploadChunk(fdef, chunk); err != nil {
+			// Some data may have been saved. The client will request the offset and resume.
+			writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+			return
+		}
+
+		wrt.Header().Set("Upload-Offset", strconv.FormatInt(fdef.Received, 10))
+		if fdef.Received < fdef.Size {
+			wrt.Header().Set("Upload-Expires", types.TimeNow().Add(unusedFileTimeout).Format(http.TimeFormat))
+			wrt.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		url, err := mh.UploadFinish(fdef)
+		if err != nil {
+			writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+			return
+		}
+
+		// Save the hash for deduplication of later uploads. Scan the file for malware at the same time.
+		content, err := mh.Open(fdef)
+		if err != nil {
+			writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+			return
+		}
+		hasher := sha256.New()
+		if store.GetMediaScanner() != nil {
+			resp, err := largeFileScan(mh, fdef, io.TeeReader(content, hasher), "", now)
+			if resp != nil {
+				content.Close()
+				writeHttpResponse(resp, err)
+				return
+			}
+			// The scanner may stop reading before the end.
+		}
+		_, err = io.Copy(hasher, content)
+		content.Close()
+		if err == nil {
+			err = store.Files.Update(fdef.Id, map[string]interface{}{"Hash": hex.EncodeToString(hasher.Sum(nil))})
+		}
+		if err != nil {
+			// Not fatal: the file is just not deduplicated.
+			log.Println("media resumable upload: failed to save hash", fdef.Id, err)
+		}
+		writeHttpResponse(NoErrParams("", "", now, map[string]string{"url": url}), nil)
+
+	case http.MethodDelete:
+		if fdef.Status != types.UploadStarted {
+			writeHttpResponse(ErrOperationNotAllowed("", "", now), errors.New("upload already completed"))
+			return
+		}
+		if err = mh.UploadAbort(fdef); err != nil {
+			writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+			return
+		}
+		wrt.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeHttpResponse(ErrOperationNotAllowed("", "", now), errors.New("method '"+method+"' not allowed"))
+	}
+}
+
+// resumableMustProcess checks if uploads of the given type must be processed which
+// resumable uploads do not support: images with metadata to be stripped.
+func resumableMustProcess(mimeType string) bool {
+	return globals.imageConfig != nil && globals.imageConfig.StripMetadata && media.IsProcessableImage(mimeType)
+}
+
+// tusMetadata parses Upload-Metadata header of the tus protocol: comma-separated pairs of
+// keys and base64-encoded values.
+func tusMetadata(header string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 {
+			continue
+		}
+		var val []byte
+		if len(parts) > 1 {
+			val, _ = base64.StdEncoding.DecodeString(parts[1])
+		}
+		meta[parts[0]] = string(val)
+	}
+	return meta
 }
 
 func largeFileRunGarbageCollection(period time.Duration, block int) chan<- bool {
@@ -197,7 +804,7 @@ func largeFileRunGarbageCollection(period time.Duration, block int) chan<- bool
 		for {
 			select {
 			case <-gcTimer:
-				if err := store.Files.DeleteUnused(time.Now().Add(-time.Hour), block); err != nil {
+				if err := store.Files.DeleteUnused(time.Now().Add(-unusedFileTimeout), block); err != nil {
 					log.Println("media gc:", err)
 				}
 			case <-stop:
@@ -0,0 +1,242 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Stateless REST API for bots and integrations: publishing and reading
+ *    messages, reading topic description and subscribers, managing
+ *    subscriptions. Each request is executed in a short-lived internal
+ *    session by the same handlers as websocket requests.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Configuration of the REST API.
+type restConfig struct {
+	// Enable REST API.
+	Enabled bool `json:"enabled"`
+}
+
+// serveRest handles requests to the REST API:
+//   GET topics/{topic} - topic description
+//   GET|POST topics/{topic}/messages - read messages, publish a message
+//   GET|POST|DELETE topics/{topic}/subs - list subscribers, subscribe, unsubscribe
+//   PUT|DELETE topics/{topic}/subs/{uid} - change or delete subscription of another user
+func serveRest(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+
+	writeHttpResponse := func(msg *ServerComMessage, err error) {
+		// Gorilla CompressHandler requires Content-Type to be set.
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+		if err != nil {
+			log.Println("rest:", req.Method, req.URL.Path, err)
+		}
+	}
+
+	// Check for API key presence
+	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+		writeHttpResponse(ErrAPIKeyRequired(now), nil)
+		return
+	}
+
+	// Check authorization: either auth information or SID must be present
+	uid, authLvl, challenge, err := authHttpRequest(req)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	if challenge != nil {
+		writeHttpResponse(InfoChallenge("", now, challenge), nil)
+		return
+	}
+	if uid.IsZero() {
+		// Not authenticated
+		writeHttpResponse(ErrAuthRequired("", "", now), nil)
+		return
+	}
+
+	// Split path like 'topics/grpAbCd/messages' into parts. The '<api_path>/v0/rest/' prefix is already removed.
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "topics" || !restTopicName(parts[1]) {
+		writeHttpResponse(ErrNotFound("", "", now), nil)
+		return
+	}
+	topic := parts[1]
+
+	msgs, resp, err := restRequest(req, topic, parts[2:], now)
+	if resp != nil {
+		writeHttpResponse(resp, err)
+		return
+	}
+
+	// Only the subscribe request may create a subscription. Other requests are allowed to
+	// existing subscribers only.
+	if !(len(parts) == 3 && parts[2] == "subs" && req.Method == http.MethodPost) {
+		subscribed, err := restSubscribed(uid, topic)
+		if err != nil {
+			writeHttpResponse(decodeStoreError(err, "", topic, now, nil), err)
+			return
+		}
+		if !subscribed {
+			writeHttpResponse(ErrPermissionDenied("", topic, now), nil)
+			return
+		}
+	}
+
+	// The topic must be attached to the session before it can be used. Subscribers are attached
+	// without changing the subscription.
+	msgs = append([]*ClientComMessage{{Sub: &MsgClientSub{Topic: topic, Background: true}}}, msgs...)
+	resp, replies := execInternal(uid, authLvl, msgs)
+	if resp.Ctrl.Code >= http.StatusBadRequest {
+		writeHttpResponse(resp, nil)
+		return
+	}
+
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+	wrt.WriteHeader(resp.Ctrl.Code)
+	switch {
+	case len(parts) == 3 && parts[2] == "messages" && req.Method == http.MethodGet:
+		// Messages are returned as an array of {data} followed by the {ctrl}.
+		enc.Encode(append(replies, resp))
+	case len(replies) > 0:
+		// {meta} response to {get}.
+		enc.Encode(replies[0])
+	default:
+		enc.Encode(resp)
+	}
+}
+
+// restTopicName checks if the topic can be accessed over REST API: group and p2p topics only.
+// P2P topics can be addressed by the user ID of the other party.
+func restTopicName(topic string) bool {
+	return strings.HasPrefix(topic, "grp") || strings.HasPrefix(topic, "p2p") || strings.HasPrefix(topic, "usr")
+}
+
+// restSubscribed checks if the user has an active subscription to the topic.
+func restSubscribed(uid types.Uid, topic string) (bool, error) {
+	if strings.HasPrefix(topic, "usr") {
+		other := types.ParseUserId(topic)
+		if other.IsZero() {
+			return false, nil
+		}
+		topic = uid.P2PName(other)
+	}
+
+	sub, err := store.Subs.Get(topic, uid)
+	if err != nil || sub == nil {
+		return false, err
+	}
+	return sub.DeletedAt == nil, nil
+}
+
+// restRequest converts the REST request to client messages. Returns a {ctrl} error if the request
+// is invalid.
+func restRequest(req *http.Request, topic string, parts []string, now time.Time) ([]*ClientComMessage, *ServerComMessage, error) {
+	switch {
+	case len(parts) == 0:
+		if req.Method == http.MethodGet {
+			return []*ClientComMessage{{Get: &MsgClientGet{Topic: topic, MsgGetQuery: MsgGetQuery{What: "desc"}}}}, nil, nil
+		}
+
+	case len(parts) == 1 && parts[0] == "messages":
+		switch req.Method {
+		case http.MethodGet:
+			opts, err := restGetOpts(req)
+			if err != nil {
+				return nil, ErrMalformed("", topic, now), err
+			}
+			return []*ClientComMessage{{Get: &MsgClientGet{Topic: topic,
+				MsgGetQuery: MsgGetQuery{What: "data", Data: opts}}}}, nil, nil
+		case http.MethodPost:
+			var body struct {
+				Head    map[string]interface{} `json:"head"`
+				Content interface{}            `json:"content"`
+			}
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Content == nil {
+				return nil, ErrMalformed("", topic, now), err
+			}
+			return []*ClientComMessage{{Pub: &MsgClientPub{Topic: topic, Head: body.Head,
+				Content: body.Content, NoEcho: true}}}, nil, nil
+		}
+
+	case len(parts) == 1 && parts[0] == "subs":
+		switch req.Method {
+		case http.MethodGet:
+			return []*ClientComMessage{{Get: &MsgClientGet{Topic: topic, MsgGetQuery: MsgGetQuery{What: "sub"}}}}, nil, nil
+		case http.MethodPost:
+			// Subscribe the current user, optionally requesting the access mode.
+			var body struct {
+				Mode string `json:"mode"`
+			}
+			if req.ContentLength != 0 {
+				if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+					return nil, ErrMalformed("", topic, now), err
+				}
+			}
+			// The subscription is created by the {sub} which precedes every request. The {set} updates the mode.
+			if body.Mode == "" {
+				return nil, nil, nil
+			}
+			return []*ClientComMessage{{Set: &MsgClientSet{Topic: topic, MsgSetQuery: MsgSetQuery{
+				Sub: &MsgSetSub{Mode: body.Mode}}}}}, nil, nil
+		case http.MethodDelete:
+			return []*ClientComMessage{{Leave: &MsgClientLeave{Topic: topic, Unsub: true}}}, nil, nil
+		}
+
+	case len(parts) == 2 && parts[0] == "subs":
+		user := types.ParseUserId(parts[1])
+		if user.IsZero() {
+			return nil, ErrMalformed("", topic, now), nil
+		}
+		switch req.Method {
+		case http.MethodPut:
+			var body struct {
+				Mode string `json:"mode"`
+			}
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				return nil, ErrMalformed("", topic, now), err
+			}
+			return []*ClientComMessage{{Set: &MsgClientSet{Topic: topic, MsgSetQuery: MsgSetQuery{
+				Sub: &MsgSetSub{User: user.UserId(), Mode: body.Mode}}}}}, nil, nil
+		case http.MethodDelete:
+			return []*ClientComMessage{{Del: &MsgClientDel{Topic: topic, What: "sub", User: user.UserId()}}}, nil, nil
+		}
+
+	default:
+		return nil, ErrNotFound("", topic, now), nil
+	}
+
+	return nil, ErrOperationNotAllowed("", topic, now), nil
+}
+
+// restGetOpts parses query parameters 'since', 'before' and 'limit' of the request for messages.
+func restGetOpts(req *http.Request) (*MsgGetOpts, error) {
+	var opts MsgGetOpts
+	var err error
+	for _, param := range []struct {
+		name string
+		val  *int
+	}{{"since", &opts.SinceId}, {"before", &opts.BeforeId}, {"limit", &opts.Limit}} {
+		if str := req.FormValue(param.name); str != "" {
+			if *param.val, err = strconv.Atoi(str); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &opts, nil
+}
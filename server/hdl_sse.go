@@ -0,0 +1,301 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Handler of Server-Sent Events clients: server to client messages are
+ *    streamed as events, client to server messages are sent in POST requests.
+ *    See also hdl_longpoll.go and hdl_websock.go.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Number of recently sent events kept for replaying to reconnecting clients.
+const sseReplayBufferSize = 256
+
+// sseEvent is a message sent to the client as an event.
+type sseEvent struct {
+	seq  int64
+	data []byte
+}
+
+// sseConn is the state of the SSE session which persists between reconnects.
+type sseConn struct {
+	lock sync.Mutex
+	// Sequential number of the last sent event.
+	seq int64
+	// Recently sent events, oldest first.
+	sent []sseEvent
+	// Closed to stop the currently attached event stream.
+	detach chan struct{}
+	// Closed when the currently attached event stream stops.
+	done chan struct{}
+}
+
+// attach makes the new event stream current. The previous stream, if any, is stopped. Returns
+// channels to signal the new stream to stop and to report that it has stopped.
+func (c *sseConn) attach() (chan struct{}, chan struct{}) {
+	c.lock.Lock()
+	prevDone := c.done
+	if c.detach != nil {
+		close(c.detach)
+	}
+	c.detach = make(chan struct{})
+	c.done = make(chan struct{})
+	detach, done := c.detach, c.done
+	c.lock.Unlock()
+
+	if prevDone != nil {
+		// Wait for the previous stream to stop so all events it has taken from the queue are
+		// recorded before the new stream replays them.
+		select {
+		case <-prevDone:
+		case <-time.After(writeWait):
+		}
+	}
+	return detach, done
+}
+
+// record assigns the next sequential number to the message and saves it for replaying.
+func (c *sseConn) record(data []byte) sseEvent {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.seq++
+	evt := sseEvent{seq: c.seq, data: data}
+	c.sent = append(c.sent, evt)
+	if len(c.sent) > sseReplayBufferSize {
+		c.sent = c.sent[len(c.sent)-sseReplayBufferSize:]
+	}
+	return evt
+}
+
+// since returns events sent after the one with the given sequential number. Returns false if some
+// of these events are no longer available.
+func (c *sseConn) since(seq int64) ([]sseEvent, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if seq > c.seq {
+		return nil, false
+	}
+	if seq == c.seq {
+		return nil, true
+	}
+	if len(c.sent) == 0 || c.sent[0].seq > seq+1 {
+		return nil, false
+	}
+	events := make([]sseEvent, 0, c.seq-seq)
+	return append(events, c.sent[len(c.sent)-int(c.seq-seq):]...), true
+}
+
+// sseWrite writes the event and flushes it to the client.
+func sseWrite(wrt http.ResponseWriter, sid string, evt sseEvent) error {
+	// JSON-encoded messages contain no line breaks and can be sent as a single data line.
+	if _, err := wrt.Write([]byte("id: " + sid + ":" + strconv.FormatInt(evt.seq, 10) + "\ndata: ")); err != nil {
+		return err
+	}
+	if _, err := wrt.Write(evt.data); err != nil {
+		return err
+	}
+	if _, err := wrt.Write([]byte("\n\n")); err != nil {
+		return err
+	}
+	wrt.(http.Flusher).Flush()
+	return nil
+}
+
+// sseLastEventId parses Last-Event-ID of the reconnecting client: session ID and sequential
+// number of the last received event.
+func sseLastEventId(req *http.Request) (string, int64) {
+	lastID := req.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		// Polyfills of EventSource may not be able to set headers.
+		lastID = req.FormValue("lastEventId")
+	}
+	parts := strings.SplitN(lastID, ":", 2)
+	if len(parts) != 2 {
+		return "", 0
+	}
+	seq, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || seq < 0 {
+		return "", 0
+	}
+	return parts[0], seq
+}
+
+// writeEvents streams messages from the session's queue to the client until the client
+// disconnects or another stream attaches to the session.
+func (sess *Session) writeEvents(wrt http.ResponseWriter, req *http.Request, replay []sseEvent,
+	detach, done chan struct{}) {
+	defer close(done)
+
+	for _, evt := range replay {
+		if err := sseWrite(wrt, sess.sid, evt); err != nil {
+			log.Println("sse: replay failed", sess.sid, err)
+			return
+		}
+	}
+
+	ping := time.NewTicker(pingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case msg, ok := <-sess.send:
+			if !ok {
+				return
+			}
+			if len(sess.send) > sendQueueLimit {
+				log.Println("sse: outbound queue limit exceeded", sess.sid)
+				return
+			}
+			// Events are recorded before sending: if sending fails, the client gets the event
+			// after reconnecting.
+			if err := sseWrite(wrt, sess.sid, sess.sse.record(msg.([]byte))); err != nil {
+				log.Println("sse: write failed", sess.sid, err)
+				return
+			}
+
+		case msg := <-sess.stop:
+			// Request to close the session. Make it unavailable.
+			globals.sessionStore.Delete(sess)
+			if msg != nil {
+				sseWrite(wrt, sess.sid, sess.sse.record(msg.([]byte)))
+			}
+			return
+
+		case topic := <-sess.detach:
+			// Request to detach the session from a topic.
+			sess.delSub(topic)
+
+		case <-ping.C:
+			// Keep the connection open through proxies and keep the session alive.
+			globals.sessionStore.Get(sess.sid)
+			if _, err := wrt.Write([]byte(":\n\n")); err != nil {
+				log.Println("sse: ping failed", sess.sid, err)
+				return
+			}
+			wrt.(http.Flusher).Flush()
+
+		case <-detach:
+			// Another stream attached to the session.
+			return
+
+		case <-req.Context().Done():
+			// HTTP request cancelled or connection lost.
+			return
+		}
+	}
+}
+
+// serveSSE handles Server-Sent Events clients:
+//  - GET opens the event stream. A new session is created unless the client is reconnecting with
+//    Last-Event-ID. The first event of a new session is a {ctrl} with the session ID.
+//  - POST with sid sends a client message to the session. Responses are delivered as events.
+func serveSSE(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+
+	if globals.tlsStrictMaxAge != "" {
+		wrt.Header().Set("Strict-Transport-Security", "max-age"+globals.tlsStrictMaxAge)
+	}
+	// Currently any domain is allowed to get data from the chat server
+	wrt.Header().Set("Access-Control-Allow-Origin", "*")
+	wrt.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	if req.Method == http.MethodOptions {
+		// CORS preflight request.
+		wrt.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		wrt.Header().Set("Access-Control-Allow-Headers", "Content-Type, Last-Event-ID, X-Tinode-APIKey")
+		wrt.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writeHttpResponse := func(code int, msg *ServerComMessage) {
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(code)
+		enc.Encode(msg)
+	}
+
+	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+		writeHttpResponse(http.StatusForbidden, ErrAPIKeyRequired(now))
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPost:
+		sess := globals.sessionStore.Get(req.FormValue("sid"))
+		if sess == nil || sess.proto != SSE {
+			writeHttpResponse(http.StatusForbidden, ErrSessionNotFound(now))
+			return
+		}
+		sess.remoteAddr = req.RemoteAddr
+		if code, err := sess.readOnce(wrt, req); err != nil {
+			log.Println("sse: readOnce failed", sess.sid, err)
+			if code == 0 {
+				code = http.StatusBadRequest
+			}
+			writeHttpResponse(code, ErrMalformed(req.FormValue("id"), "", now))
+			return
+		}
+		wrt.WriteHeader(http.StatusNoContent)
+
+	case http.MethodGet:
+		if _, ok := wrt.(http.Flusher); !ok {
+			writeHttpResponse(http.StatusNotImplemented, ErrNotImplemented("", "", now))
+			return
+		}
+
+		var sess *Session
+		var replay []sseEvent
+		var detach, done chan struct{}
+		if sid, seq := sseLastEventId(req); sid != "" {
+			// Reconnecting client.
+			if sess = globals.sessionStore.Get(sid); sess == nil || sess.proto != SSE {
+				// Any status other than 200 stops EventSource from reconnecting.
+				writeHttpResponse(http.StatusForbidden, ErrSessionNotFound(now))
+				return
+			}
+			detach, done = sess.sse.attach()
+			var ok bool
+			if replay, ok = sess.sse.since(seq); !ok {
+				close(done)
+				// Some messages are lost. The client must start a new session.
+				writeHttpResponse(http.StatusGone, ErrGone("", "", now))
+				return
+			}
+		} else {
+			var count int
+			sess, count = globals.sessionStore.NewSession(&sseConn{}, "")
+			log.Println("sse: session started", sess.sid, count)
+			detach, done = sess.sse.attach()
+			pkt := NoErrCreated(req.FormValue("id"), "", now)
+			pkt.Ctrl.Params = map[string]string{"sid": sess.sid}
+			data, _ := json.Marshal(pkt)
+			replay = []sseEvent{sess.sse.record(data)}
+		}
+		sess.remoteAddr = req.RemoteAddr
+
+		wrt.Header().Set("Content-Type", "text/event-stream")
+		// Disable buffering by nginx.
+		wrt.Header().Set("X-Accel-Buffering", "no")
+		wrt.WriteHeader(http.StatusOK)
+		sess.writeEvents(wrt, req, replay, detach, done)
+
+	default:
+		writeHttpResponse(http.StatusMethodNotAllowed, ErrOperationNotAllowed("", "", now))
+	}
+}
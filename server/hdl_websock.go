@@ -16,6 +16,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/tinode/chat/server/msgpack"
 )
 
 const (
@@ -29,6 +30,14 @@ const (
 	pingPeriod = (pongWait * 9) / 10
 )
 
+// Configuration of websocket compression (permessage-deflate).
+type wsCompressionConfig struct {
+	// Enable compression of websocket messages, if supported by the client.
+	Enabled bool `json:"enabled"`
+	// Compression level from 1 (best speed) to 9 (best compression). Default is 1.
+	Level int `json:"level"`
+}
+
 func (sess *Session) closeWS() {
 	if sess.proto == WEBSOCK {
 		sess.ws.Close()
@@ -51,7 +60,7 @@ func (sess *Session) readLoop() {
 
 	for {
 		// Read a ClientComMessage
-		_, raw, err := sess.ws.ReadMessage()
+		mt, raw, err := sess.ws.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure,
 				websocket.CloseNormalClosure) {
@@ -59,6 +68,19 @@ func (sess *Session) readLoop() {
 			}
 			return
 		}
+		if mt == websocket.BinaryMessage {
+			// Binary frames are accepted only after MessagePack encoding is negotiated.
+			if !sess.isMsgpack() {
+				log.Println("ws: unexpected binary message", sess.sid)
+				sess.queueOut(ErrMalformed("", "", time.Now().UTC().Round(time.Millisecond)))
+				continue
+			}
+			if raw, err = msgpack.ToJSON(raw); err != nil {
+				log.Println("ws: readLoop", sess.sid, err)
+				sess.queueOut(ErrMalformed("", "", time.Now().UTC().Round(time.Millisecond)))
+				continue
+			}
+		}
 		sess.dispatchRaw(raw)
 	}
 }
@@ -113,12 +135,17 @@ func (sess *Session) writeLoop() {
 }
 
 // Writes a message with the given message type (mt) and payload.
+// Messages serialized as MessagePack are always written as binary.
 func wsWrite(ws *websocket.Conn, mt int, msg interface{}) error {
 	var bits []byte
-	if msg != nil {
-		bits = msg.([]byte)
-	} else {
+	switch m := msg.(type) {
+	case nil:
 		bits = []byte{}
+	case msgpackFrame:
+		mt = websocket.BinaryMessage
+		bits = m
+	default:
+		bits = m.([]byte)
 	}
 	ws.SetWriteDeadline(time.Now().Add(writeWait))
 	return ws.WriteMessage(mt, bits)
@@ -157,6 +184,10 @@ func serveWebSocket(wrt http.ResponseWriter, req *http.Request) {
 		log.Println("ws: failed to Upgrade ", err)
 		return
 	}
+	if upgrader.EnableCompression {
+		// Has no effect if the client does not support compression.
+		ws.SetCompressionLevel(globals.wsCompressionLevel)
+	}
 
 	sess, count := globals.sessionStore.NewSession(ws, "")
 
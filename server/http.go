@@ -24,6 +24,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/tinode/chat/server/auth"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 )
@@ -311,25 +312,32 @@ func getHttpAuth(req *http.Request) (method, secret string) {
 	return
 }
 
-// Authenticate non-websocket HTTP request
-func authHttpRequest(req *http.Request) (types.Uid, []byte, error) {
+// Authenticate non-websocket HTTP request. Returns user ID, authentication level and
+// the challenge for multi-stage authentication.
+func authHttpRequest(req *http.Request) (types.Uid, auth.Level, []byte, error) {
 	var uid types.Uid
+	var authLvl auth.Level
 	if authMethod, secret := getHttpAuth(req); authMethod != "" {
 		decodedSecret := make([]byte, base64.StdEncoding.DecodedLen(len(secret)))
 		n, err := base64.StdEncoding.Decode(decodedSecret, []byte(secret))
 		if err != nil {
-			return uid, nil, types.ErrMalformed
+			return uid, authLvl, nil, types.ErrMalformed
 		}
 
 		if authhdl := store.GetLogicalAuthHandler(authMethod); authhdl != nil {
 			rec, challenge, err := authhdl.Authenticate(decodedSecret[:n])
 			if err != nil {
-				return uid, nil, err
+				return uid, authLvl, nil, err
 			}
 			if challenge != nil {
-				return uid, challenge, nil
+				return uid, authLvl, challenge, nil
 			}
-			uid = rec.Uid
+			if user, err := userSuspended(rec.Uid); err != nil {
+				return uid, authLvl, nil, err
+			} else if user != nil {
+				return uid, authLvl, nil, types.ErrPermissionDenied
+			}
+			uid, authLvl = rec.Uid, rec.AuthLevel
 		} else {
 			log.Println("fileUpload: auth data is present but handler is not found", authMethod)
 		}
@@ -337,8 +345,8 @@ func authHttpRequest(req *http.Request) (types.Uid, []byte, error) {
 		// Find the session, make sure it's appropriately authenticated.
 		sess := globals.sessionStore.Get(req.FormValue("sid"))
 		if sess != nil {
-			uid = sess.uid
+			uid, authLvl = sess.uid, sess.authLvl
 		}
 	}
-	return uid, nil, nil
+	return uid, authLvl, nil, nil
 }
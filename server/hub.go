@@ -695,6 +695,18 @@ func replyOfflineTopicSetSub(sess *Session, topic string, msg *ClientComMessage)
 		}
 	}
 
+	if msg.Set.Sub != nil && msg.Set.Sub.Mute != nil {
+		mute, err := parseMute(msg.Set.Sub.Mute, now)
+		if err != nil {
+			log.Println("replyOfflineTopicSetSub mute:", err)
+			sess.queueOut(ErrMalformed(msg.id, msg.topic, now))
+			return
+		}
+		for k, v := range mute {
+			update[k] = v
+		}
+	}
+
 	if len(update) > 0 {
 		err = store.Subs.Update(topic, asUid, update, true)
 		if err != nil {
@@ -702,11 +714,18 @@ func replyOfflineTopicSetSub(sess *Session, topic string, msg *ClientComMessage)
 			sess.queueOut(decodeStoreError(err, msg.id, msg.topic, now, nil))
 		} else {
 			var params interface{}
+			resp := make(map[string]interface{})
 			if update["ModeWant"] != nil {
-				params = map[string]interface{}{"acs": MsgAccessMode{
+				resp["acs"] = MsgAccessMode{
 					Given: sub.ModeGiven.String(),
 					Want:  sub.ModeWant.String(),
-					Mode:  (sub.ModeGiven & sub.ModeWant).String()}}
+					Mode:  (sub.ModeGiven & sub.ModeWant).String()}
+			}
+			if muted, ok := update["Muted"]; ok {
+				resp["mute"] = &MsgMute{Muted: muted.(bool), Until: update["MuteUntil"].(*time.Time)}
+			}
+			if len(resp) > 0 {
+				params = resp
 			}
 			sess.queueOut(NoErrParams(msg.id, msg.topic, now, params))
 		}
@@ -132,6 +132,9 @@ func initTopicMe(t *Topic, sreg *sessionJoin) error {
 	// Assign tags
 	t.tags = user.Tags
 
+	// Push notification settings
+	t.notify = user.Notify
+
 	if err = t.loadSubscribers(); err != nil {
 		return err
 	}
@@ -257,6 +260,8 @@ func initTopicP2P(t *Topic, sreg *sessionJoin) error {
 				delID:     subs[i].DelId,
 				recvID:    subs[i].RecvSeqId,
 				readID:    subs[i].ReadSeqId,
+				muted:     subs[i].Muted,
+				muteUntil: subs[i].MuteUntil,
 			}
 		}
 
@@ -437,6 +442,8 @@ func initTopicP2P(t *Topic, sreg *sessionJoin) error {
 		userData.delID = sub1.DelId
 		userData.readID = sub1.ReadSeqId
 		userData.recvID = sub1.RecvSeqId
+		userData.muted = sub1.Muted
+		userData.muteUntil = sub1.MuteUntil
 		t.perUser[userID1] = userData
 
 		t.perUser[userID2] = perUserData{
@@ -447,6 +454,8 @@ func initTopicP2P(t *Topic, sreg *sessionJoin) error {
 			delID:     sub2.DelId,
 			readID:    sub2.ReadSeqId,
 			recvID:    sub2.RecvSeqId,
+			muted:     sub2.Muted,
+			muteUntil: sub2.MuteUntil,
 		}
 	}
 
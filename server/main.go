@@ -11,6 +11,8 @@ package main
 //go:generate protoc --proto_path=../pbx --go_out=plugins=grpc:../pbx ../pbx/model.proto
 
 import (
+	"compress/flate"
+	"crypto/sha256"
 	"encoding/json"
 	"flag"
 	"log"
@@ -31,6 +33,7 @@ import (
 	"github.com/tinode/chat/server/auth"
 	_ "github.com/tinode/chat/server/auth/anon"
 	_ "github.com/tinode/chat/server/auth/basic"
+	_ "github.com/tinode/chat/server/auth/refresh"
 	_ "github.com/tinode/chat/server/auth/rest"
 	_ "github.com/tinode/chat/server/auth/token"
 
@@ -41,17 +44,23 @@ import (
 
 	// Push notifications
 	"github.com/tinode/chat/server/push"
+	_ "github.com/tinode/chat/server/push/apns"
 	_ "github.com/tinode/chat/server/push/fcm"
+	_ "github.com/tinode/chat/server/push/http"
 	_ "github.com/tinode/chat/server/push/stdout"
+	_ "github.com/tinode/chat/server/push/webpush"
 
 	"github.com/tinode/chat/server/store"
 
 	// Credential validators
+	_ "github.com/tinode/chat/server/validate/captcha"
 	_ "github.com/tinode/chat/server/validate/email"
 	_ "github.com/tinode/chat/server/validate/tel"
 	"google.golang.org/grpc"
 
 	// File upload handlers
+	"github.com/tinode/chat/server/media"
+	_ "github.com/tinode/chat/server/media/clamd"
 	_ "github.com/tinode/chat/server/media/fs"
 	_ "github.com/tinode/chat/server/media/s3"
 )
@@ -96,6 +105,12 @@ const (
 
 	// Local path to static content
 	defaultStaticPath = "static"
+
+	// Lifetime of signed download URLs.
+	defaultSignedUrlLifetime = time.Minute * 10
+
+	// How long the storage usage reported in {meta desc} of 'me' is cached.
+	storageUsageCacheTime = time.Minute
 )
 
 // Build version number defined by the compiler:
@@ -153,6 +168,8 @@ var globals struct {
 	tlsRedirectHTTP string
 	// Maximum message size allowed from peer.
 	maxMessageSize int64
+	// Compression level of websocket messages, if compression is enabled.
+	wsCompressionLevel int
 	// Maximum number of group topic subscribers.
 	maxSubscriberCount int
 	// Maximum number of indexable tags.
@@ -160,6 +177,26 @@ var globals struct {
 
 	// Maximum allowed upload size.
 	maxFileUploadSize int64
+	// Processing of uploaded images, nil if disabled.
+	imageConfig *media.ImageConfig
+	// Default maximum total size of files uploaded by one user, 0 if unlimited.
+	userUploadQuota int64
+	// Maximum total size of files uploaded to one topic, 0 if unlimited.
+	topicUploadQuota int64
+	// Key for signing download URLs, nil if signed URLs are disabled.
+	urlSigningKey []byte
+	// Lifetime of signed download URLs.
+	signedUrlLifetime time.Duration
+
+	// Period when a deleted account can be restored, 0 if accounts are deleted immediately.
+	accDeleteGracePeriod time.Duration
+
+	// Rate limits of client messages, nil if rate limiting is disabled.
+	rateLimits *rateLimitConfig
+	// Per-user token buckets for users mastered at this node.
+	userRateLimiter *rateLimiter
+	// Tokens of users mastered at other nodes, leased from the master nodes.
+	userRateLeases *rateLeases
 }
 
 type validatorConfig struct {
@@ -182,6 +219,21 @@ type mediaConfig struct {
 	GcBlockSize int `json:"gc_block_size"`
 	// Individual handler config params to pass to handlers unchanged.
 	Handlers map[string]json.RawMessage `json:"handlers"`
+	// Creation of resized variants of uploaded images.
+	Images *media.ImageConfig `json:"images"`
+	// Default maximum total size of files uploaded by one user. Can be changed for individual
+	// users through the admin API.
+	UserQuota int64 `json:"user_quota"`
+	// Maximum total size of files uploaded to one topic.
+	TopicQuota int64 `json:"topic_quota"`
+	// The name of the malware scanner of uploaded files, if any.
+	UseScanner string `json:"use_scanner"`
+	// Individual scanner config params to pass to scanners unchanged.
+	Scanners map[string]json.RawMessage `json:"scanners"`
+	// Key for signing download URLs, at least 32 bytes. Signed URLs are disabled if missing.
+	UrlSigningKey []byte `json:"url_signing_key"`
+	// Lifetime of signed download URLs in seconds.
+	SignedUrlLifetime int `json:"signed_url_lifetime"`
 }
 
 // Contentx of the configuration file
@@ -212,6 +264,8 @@ type configType struct {
 	// Maximum message size allowed from client. Intended to prevent malicious client from sending
 	// very large files inband (does not affect out of band uploads).
 	MaxMessageSize int `json:"max_message_size"`
+	// Compression of websocket messages.
+	WsCompression *wsCompressionConfig `json:"ws_compression"`
 	// Maximum number of group topic subscribers.
 	MaxSubscriberCount int `json:"max_subscriber_count"`
 	// Masked tags: tags immutable on User (mask), mutable on Topic only within the mask.
@@ -220,16 +274,23 @@ type configType struct {
 	MaxTagCount int `json:"max_tag_count"`
 	// URL path for exposing runtime stats. Disabled if the path is blank.
 	ExpvarPath string `json:"expvar"`
+	// Number of days a user can restore own deleted account by logging in. The account is purged afterwards.
+	// If 0, accounts are deleted immediately.
+	AccDeleteGracePeriod int `json:"acc_delete_grace_period"`
 
 	// Configs for subsystems
 	Cluster   json.RawMessage             `json:"cluster_config"`
 	Plugin    json.RawMessage             `json:"plugins"`
 	Store     json.RawMessage             `json:"store_config"`
 	Push      json.RawMessage             `json:"push"`
+	PushQueue json.RawMessage             `json:"push_queue"`
 	TLS       json.RawMessage             `json:"tls"`
 	Auth      map[string]json.RawMessage  `json:"auth_config"`
 	Validator map[string]*validatorConfig `json:"acc_validation"`
 	Media     *mediaConfig                `json:"media"`
+	Admin     *adminConfig                `json:"admin_config"`
+	Rest      *restConfig                 `json:"rest_config"`
+	RateLimit *rateLimitConfig            `json:"rate_limit"`
 }
 
 func main() {
@@ -448,6 +509,15 @@ func main() {
 	if globals.maxMessageSize <= 0 {
 		globals.maxMessageSize = defaultMaxMessageSize
 	}
+	// Websocket compression
+	if config.WsCompression != nil && config.WsCompression.Enabled {
+		upgrader.EnableCompression = true
+		globals.wsCompressionLevel = config.WsCompression.Level
+		if globals.wsCompressionLevel < flate.BestSpeed || globals.wsCompressionLevel > flate.BestCompression {
+			globals.wsCompressionLevel = flate.BestSpeed
+		}
+		log.Printf("Websocket compression enabled, level %d", globals.wsCompressionLevel)
+	}
 	// Maximum number of group topic subscribers
 	globals.maxSubscriberCount = config.MaxSubscriberCount
 	if globals.maxSubscriberCount <= 1 {
@@ -459,11 +529,29 @@ func main() {
 		globals.maxTagCount = defaultMaxTagCount
 	}
 
+	// Initialize rate limiting of client messages.
+	rateLimitInit(config.RateLimit)
+
 	if config.Media != nil {
 		if config.Media.UseHandler == "" {
 			config.Media = nil
 		} else {
 			globals.maxFileUploadSize = config.Media.MaxFileUploadSize
+			globals.userUploadQuota = config.Media.UserQuota
+			globals.topicUploadQuota = config.Media.TopicQuota
+			if len(config.Media.UrlSigningKey) > 0 {
+				if len(config.Media.UrlSigningKey) < sha256.Size {
+					log.Fatal("Key for signing download URLs is too short")
+				}
+				globals.urlSigningKey = config.Media.UrlSigningKey
+				globals.signedUrlLifetime = time.Second * time.Duration(config.Media.SignedUrlLifetime)
+				if globals.signedUrlLifetime <= 0 {
+					globals.signedUrlLifetime = defaultSignedUrlLifetime
+				}
+			}
+			if config.Media.Images != nil && (len(config.Media.Images.Variants) > 0 || config.Media.Images.StripMetadata) {
+				globals.imageConfig = config.Media.Images
+			}
 			if config.Media.Handlers != nil {
 				var conf string
 				if params := config.Media.Handlers[config.Media.UseHandler]; params != nil {
@@ -473,6 +561,16 @@ func main() {
 					log.Fatalf("Failed to init media handler '%s': %s", config.Media.UseHandler, err)
 				}
 			}
+			if config.Media.UseScanner != "" {
+				var conf string
+				if params := config.Media.Scanners[config.Media.UseScanner]; params != nil {
+					conf = string(params)
+				}
+				if err = store.UseMediaScanner(config.Media.UseScanner, conf); err != nil {
+					log.Fatalf("Failed to init malware scanner '%s': %s", config.Media.UseScanner, err)
+				}
+				log.Printf("Uploaded files are scanned with '%s'", config.Media.UseScanner)
+			}
 			if config.Media.GcPeriod > 0 && config.Media.GcBlockSize > 0 {
 				stopFilesGc := largeFileRunGarbageCollection(time.Second*time.Duration(config.Media.GcPeriod),
 					config.Media.GcBlockSize)
@@ -484,7 +582,24 @@ func main() {
 		}
 	}
 
-	err = push.Init(string(config.Push))
+	// Lift expired suspensions of user accounts.
+	stopSuspensionExpiration := userRunSuspensionExpiration(time.Minute)
+	defer func() {
+		stopSuspensionExpiration <- true
+		log.Println("Stopped suspension expiration")
+	}()
+
+	if config.AccDeleteGracePeriod > 0 {
+		globals.accDeleteGracePeriod = time.Hour * 24 * time.Duration(config.AccDeleteGracePeriod)
+		// Purge deleted accounts after the recovery period.
+		stopDeletionPurge := userRunDeletionPurge(time.Hour, globals.accDeleteGracePeriod)
+		defer func() {
+			stopDeletionPurge <- true
+			log.Println("Stopped account purge")
+		}()
+	}
+
+	err = push.Init(string(config.Push), string(config.PushQueue))
 	if err != nil {
 		log.Fatal("Failed to initialize push notifications:", err)
 	}
@@ -582,13 +697,38 @@ func main() {
 	mux.HandleFunc(config.ApiPath+"v0/channels", serveWebSocket)
 	// Handle long polling clients. Enable compression.
 	mux.Handle(config.ApiPath+"v0/channels/lp", gh.CompressHandler(http.HandlerFunc(serveLongPoll)))
+	// Handle Server-Sent Events clients. No compression: it buffers the event stream.
+	mux.HandleFunc(config.ApiPath+"v0/channels/sse", serveSSE)
 	if config.Media != nil {
 		// Handle uploads of large files.
 		mux.Handle(config.ApiPath+"v0/file/u/", gh.CompressHandler(http.HandlerFunc(largeFileUpload)))
 		// Serve large files.
 		mux.Handle(config.ApiPath+"v0/file/s/", gh.CompressHandler(http.HandlerFunc(largeFileServe)))
+		// Handle resumable uploads. Not compressed: tus clients rely on exact headers and status codes.
+		mux.HandleFunc(config.ApiPath+"v0/file/r/", largeFileResumable)
 		log.Println("Large media handling enabled", config.Media.UseHandler)
 	}
+	if _, ok := globals.validators["captcha"]; ok {
+		// Issue CAPTCHA challenges.
+		mux.Handle(config.ApiPath+"v0/captcha", gh.CompressHandler(http.HandlerFunc(captchaServe)))
+		log.Println("CAPTCHA challenges enabled")
+	}
+	if config.Admin != nil && config.Admin.Enabled {
+		if err = adminInit(config.Admin); err != nil {
+			log.Fatal("Failed to initialize admin API: ", err)
+		}
+		// Handle administrative requests.
+		mux.Handle(config.ApiPath+"v0/admin/", gh.CompressHandler(
+			http.StripPrefix(config.ApiPath+"v0/admin/", http.HandlerFunc(serveAdmin))))
+		log.Println("Admin API enabled")
+	}
+
+	if config.Rest != nil && config.Rest.Enabled {
+		// Handle REST requests of bots and integrations.
+		mux.Handle(config.ApiPath+"v0/rest/", gh.CompressHandler(
+			http.StripPrefix(config.ApiPath+"v0/rest/", http.HandlerFunc(serveRest))))
+		log.Println("REST API enabled")
+	}
 
 	if staticMountPoint != "/" {
 		// Serve json-formatted 404 for all other URLs
@@ -0,0 +1,164 @@
+// Package clamd implements github.com/tinode/chat/server/media.Scanner interface by sending uploaded
+// files for scanning to ClamAV daemon over a local socket.
+package clamd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+)
+
+const (
+	scannerName = "clamd"
+
+	defaultNetwork = "unix"
+	defaultAddress = "/var/run/clamav/clamd.ctl"
+	// Time to scan one file, seconds.
+	defaultTimeout = 60
+
+	// Size of chunks the file is sent in.
+	chunkSize = 64 * 1024
+)
+
+type configType struct {
+	// Type of the socket: "unix" or "tcp".
+	Network string `json:"network"`
+	// Path to the unix socket or host:port of the TCP socket.
+	Address string `json:"address"`
+	// Maximum time to scan one file in seconds.
+	Timeout int `json:"timeout"`
+}
+
+type scanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// Init initializes the scanner and checks that clamd is reachable.
+func (s *scanner) Init(jsconf string) error {
+	var config configType
+	if err := json.Unmarshal([]byte(jsconf), &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	s.network = config.Network
+	if s.network == "" {
+		s.network = defaultNetwork
+	}
+	s.address = config.Address
+	if s.address == "" {
+		s.address = defaultAddress
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	s.timeout = time.Duration(config.Timeout) * time.Second
+
+	reply, err := s.command("zPING\x00", nil)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return errors.New("clamd: unexpected reply to PING: " + reply)
+	}
+	return nil
+}
+
+// Scan sends the content to clamd with INSTREAM command. Returns the name of the detected threat
+// or an empty string if the content is clean.
+func (s *scanner) Scan(content io.Reader) (string, error) {
+	reply, err := s.command("zINSTREAM\x00", content)
+	if err != nil {
+		return "", err
+	}
+	return parseReply(reply)
+}
+
+// command sends the command to clamd followed by the optional content in INSTREAM format
+// and returns the reply.
+func (s *scanner) command(cmd string, content io.Reader) (string, error) {
+	conn, err := net.DialTimeout(s.network, s.address, s.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	if _, err = io.WriteString(conn, cmd); err != nil {
+		return "", err
+	}
+
+	if content != nil {
+		// clamd closes the connection if the stream is too large. Read the reply anyway: it
+		// explains the failure.
+		werr := writeStream(conn, content)
+		reply, err := readReply(conn)
+		if err != nil {
+			if werr != nil {
+				err = werr
+			}
+			return "", err
+		}
+		return reply, nil
+	}
+
+	return readReply(conn)
+}
+
+// writeStream writes the content as a sequence of chunks prefixed by 4-byte length in network
+// byte order, terminated by a zero-length chunk.
+func writeStream(w io.Writer, content io.Reader) error {
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, err := io.ReadFull(content, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, werr := w.Write(buf[:4+n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// readReply reads a null-terminated reply.
+func readReply(r io.Reader) (string, error) {
+	reply, err := bufio.NewReader(r).ReadString(0)
+	if err != nil && (err != io.EOF || reply == "") {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimRight(reply, "\x00")), nil
+}
+
+// parseReply parses the reply to INSTREAM: "stream: OK", "stream: <threat> FOUND" or "<message> ERROR".
+func parseReply(reply string) (string, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	case strings.HasSuffix(reply, " ERROR"):
+		return "", errors.New("clamd: " + strings.TrimSuffix(reply, " ERROR"))
+	}
+	return "", errors.New("clamd: unexpected reply: " + reply)
+}
+
+func init() {
+	store.RegisterMediaScanner(scannerName, &scanner{})
+}
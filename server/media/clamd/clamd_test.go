@@ -0,0 +1,194 @@
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// EICAR test signature: harmless string which antivirus software detects as a virus.
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// clamdStandIn is a minimal clamd which understands PING and INSTREAM commands and detects
+// only the EICAR test signature.
+type clamdStandIn struct {
+	listener net.Listener
+	dir      string
+	// Maximum size of the stream, like StreamMaxLength of clamd.
+	maxLength int
+}
+
+func newClamdStandIn(t *testing.T) *clamdStandIn {
+	dir, err := ioutil.TempDir("", "clamd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("unix", filepath.Join(dir, "clamd.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	srv := &clamdStandIn{listener: listener, dir: dir, maxLength: 1024 * 1024}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	return srv
+}
+
+func (srv *clamdStandIn) config() string {
+	return `{"network": "unix", "address": "` + srv.listener.Addr().String() + `", "timeout": 5}`
+}
+
+func (srv *clamdStandIn) close() {
+	srv.listener.Close()
+	os.RemoveAll(srv.dir)
+}
+
+func (srv *clamdStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+
+	rd := bufio.NewReader(conn)
+	reply := func(msg string) {
+		io.WriteString(conn, msg+"\x00")
+	}
+
+	cmd, err := rd.ReadString(0)
+	if err != nil {
+		return
+	}
+	switch strings.TrimRight(cmd, "\x00") {
+	case "zPING":
+		reply("PONG")
+	case "zINSTREAM":
+		var data bytes.Buffer
+		for {
+			var size uint32
+			if err := binary.Read(rd, binary.BigEndian, &size); err != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+			if data.Len()+int(size) > srv.maxLength {
+				reply("INSTREAM size limit exceeded. ERROR")
+				return
+			}
+			if _, err := io.CopyN(&data, rd, int64(size)); err != nil {
+				return
+			}
+		}
+		if bytes.Contains(data.Bytes(), []byte(eicar)) {
+			reply("stream: Eicar-Signature FOUND")
+		} else {
+			reply("stream: OK")
+		}
+	default:
+		reply("UNKNOWN COMMAND")
+	}
+}
+
+func initScanner(t *testing.T, srv *clamdStandIn) *scanner {
+	s := &scanner{}
+	if err := s.Init(srv.config()); err != nil {
+		t.Fatal("Init:", err)
+	}
+	return s
+}
+
+func TestScanClean(t *testing.T) {
+	srv := newClamdStandIn(t)
+	defer srv.close()
+	s := initScanner(t, srv)
+
+	// Larger than one chunk.
+	content := bytes.Repeat([]byte("harmless content "), chunkSize/8)
+	threat, err := s.Scan(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal("Scan:", err)
+	}
+	if threat != "" {
+		t.Error("clean content reported as infected:", threat)
+	}
+}
+
+func TestScanInfected(t *testing.T) {
+	srv := newClamdStandIn(t)
+	defer srv.close()
+	s := initScanner(t, srv)
+
+	threat, err := s.Scan(strings.NewReader(eicar))
+	if err != nil {
+		t.Fatal("Scan:", err)
+	}
+	if threat != "Eicar-Signature" {
+		t.Errorf("expected 'Eicar-Signature', got '%s'", threat)
+	}
+}
+
+func TestScanEmpty(t *testing.T) {
+	srv := newClamdStandIn(t)
+	defer srv.close()
+	s := initScanner(t, srv)
+
+	if threat, err := s.Scan(bytes.NewReader(nil)); err != nil || threat != "" {
+		t.Errorf("empty content: expected clean, got '%s', %v", threat, err)
+	}
+}
+
+func TestScanTooLarge(t *testing.T) {
+	srv := newClamdStandIn(t)
+	srv.maxLength = chunkSize
+	defer srv.close()
+	s := initScanner(t, srv)
+
+	threat, err := s.Scan(bytes.NewReader(make([]byte, 4*chunkSize)))
+	if err == nil {
+		t.Fatalf("expected error, got threat '%s'", threat)
+	}
+	if !strings.Contains(err.Error(), "size limit exceeded") {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestInitUnreachable(t *testing.T) {
+	srv := newClamdStandIn(t)
+	config := srv.config()
+	srv.close()
+
+	if err := (&scanner{}).Init(config); err == nil {
+		t.Error("Init succeeded with clamd not running")
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	cases := []struct {
+		reply  string
+		threat string
+		isErr  bool
+	}{
+		{"stream: OK", "", false},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND", "Win.Test.EICAR_HDB-1", false},
+		{"INSTREAM size limit exceeded. ERROR", "", true},
+		{"garbage", "", true},
+	}
+	for _, tc := range cases {
+		threat, err := parseReply(tc.reply)
+		if threat != tc.threat || (err != nil) != tc.isErr {
+			t.Errorf("%q: got '%s', %v", tc.reply, threat, err)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Encrypted file layout:
+//
+//	header: magic | key ID length (1 byte) | key ID padded to maxKeyIdLength | wrapped data key
+//	segments: nonce | AES-GCM encrypted segment of the file | authentication tag
+//
+// Each file is encrypted with a random data key. The data key is encrypted (wrapped) with the
+// master key identified by the key ID. The content is split into segments of segmentSize bytes
+// encrypted independently so any part of the file can be decrypted without reading the rest.
+// Index of the segment and the flag of the last segment are authenticated to prevent
+// reordering and truncation of segments.
+const (
+	fileMagic      = "TINOENC1"
+	maxKeyIdLength = 16
+	dataKeySize    = 32
+	// Nonce + data key + tag.
+	wrappedKeySize = 12 + dataKeySize + 16
+	headerSize     = len(fileMagic) + 1 + maxKeyIdLength + wrappedKeySize
+
+	segmentSize = 64 * 1024
+	// Nonce + tag.
+	segmentOverhead = 12 + 16
+	recordSize      = segmentSize + segmentOverhead
+)
+
+type encryptionConfig struct {
+	// Master keys: key ID -> base64-encoded 32 byte key. Retired keys must be kept to decrypt
+	// files which are still wrapped with them.
+	Keys map[string][]byte `json:"keys"`
+	// ID of the key to wrap data keys of new files with.
+	CurrentKey string `json:"current_key"`
+	// Re-wrap data keys of existing files with the current key at startup.
+	Rewrap bool `json:"rewrap"`
+}
+
+// keyring holds master keys.
+type keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+func newKeyring(config *encryptionConfig) (*keyring, error) {
+	kr := &keyring{current: config.CurrentKey, keys: make(map[string]cipher.AEAD)}
+	for id, key := range config.Keys {
+		if len(id) == 0 || len(id) > maxKeyIdLength {
+			return nil, errors.New("encryption key ID must be 1 to 16 bytes long")
+		}
+		if len(key) != 32 {
+			return nil, errors.New("encryption key '" + id + "' must be 32 bytes long")
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys[id] = aead
+	}
+	if kr.keys[kr.current] == nil {
+		return nil, errors.New("current encryption key not found")
+	}
+	return kr, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newHeader generates a random data key and returns the header of a new file with the data key
+// wrapped by the current master key.
+func (kr *keyring) newHeader() ([]byte, cipher.AEAD, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	header, err := kr.wrap(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, aead, nil
+}
+
+// wrap encrypts the data key with the current master key and returns the file header.
+func (kr *keyring) wrap(dataKey []byte) ([]byte, error) {
+	header := make([]byte, headerSize)
+	copy(header, fileMagic)
+	header[len(fileMagic)] = byte(len(kr.current))
+	copy(header[len(fileMagic)+1:], kr.current)
+
+	nonce := header[headerSize-wrappedKeySize : headerSize-wrappedKeySize+12]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// The key ID is authenticated.
+	header = kr.keys[kr.current].Seal(header[:headerSize-wrappedKeySize+12], nonce, dataKey, []byte(kr.current))
+	return header, nil
+}
+
+// unwrap parses the file header and decrypts the data key. Returns the data key and the ID of the master key.
+func (kr *keyring) unwrap(header []byte) ([]byte, string, error) {
+	idLen := int(header[len(fileMagic)])
+	if idLen == 0 || idLen > maxKeyIdLength {
+		return nil, "", errors.New("fs: malformed header of encrypted file")
+	}
+	id := string(header[len(fileMagic)+1 : len(fileMagic)+1+idLen])
+	master := kr.keys[id]
+	if master == nil {
+		return nil, id, errors.New("fs: unknown encryption key '" + id + "'")
+	}
+
+	wrapped := header[headerSize-wrappedKeySize:]
+	dataKey, err := master.Open(nil, wrapped[:12], wrapped[12:], []byte(id))
+	if err != nil {
+		return nil, id, errors.New("fs: failed to decrypt data key")
+	}
+	return dataKey, id, nil
+}
+
+// readHeader reads the header of the file and returns the cipher of the data key or nil if
+// the file is not encrypted.
+func (kr *keyring) readHeader(file io.ReaderAt) (cipher.AEAD, error) {
+	header := make([]byte, headerSize)
+	if _, err := file.ReadAt(header, 0); err != nil || !isEncrypted(header) {
+		// Files saved before encryption was enabled are stored in plain text.
+		return nil, nil
+	}
+	if kr == nil {
+		return nil, errors.New("fs: file is encrypted but encryption is not configured")
+	}
+
+	dataKey, _, err := kr.unwrap(header)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(dataKey)
+}
+
+func isEncrypted(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(fileMagic))
+}
+
+// segmentAD returns additional authenticated data of the segment.
+func segmentAD(index int64, last bool) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, uint64(index))
+	if last {
+		ad[8] = 1
+	}
+	return ad
+}
+
+// sealSegment encrypts the segment with a random nonce.
+func sealSegment(aead cipher.AEAD, index int64, last bool, plain []byte) ([]byte, error) {
+	record := make([]byte, 12, len(plain)+segmentOverhead)
+	if _, err := rand.Read(record); err != nil {
+		return nil, err
+	}
+	return aead.Seal(record, record, plain, segmentAD(index, last)), nil
+}
+
+// encryptWriter encrypts everything written to it and writes segments to the underlying file.
+// It must be closed to write the last segment.
+type encryptWriter struct {
+	file  *os.File
+	aead  cipher.AEAD
+	index int64
+	buf   []byte
+}
+
+// newEncryptWriter writes the header to the file and returns the writer.
+func (kr *keyring) newEncryptWriter(file *os.File) (*encryptWriter, error) {
+	header, aead, err := kr.newHeader()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{file: file, aead: aead, buf: make([]byte, 0, segmentSize+1)}, nil
+}
+
+// Write encrypts full segments. The last segment is kept in the buffer until Close because
+// it's not known if more data will follow.
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := segmentSize + 1 - len(ew.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		ew.buf = append(ew.buf, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(ew.buf) > segmentSize {
+			if err := ew.flush(ew.buf[:segmentSize], false); err != nil {
+				return written, err
+			}
+			ew.buf = append(ew.buf[:0], ew.buf[segmentSize:]...)
+		}
+	}
+	return written, nil
+}
+
+func (ew *encryptWriter) flush(plain []byte, last bool) error {
+	record, err := sealSegment(ew.aead, ew.index, last, plain)
+	if err != nil {
+		return err
+	}
+	ew.index++
+	_, err = ew.file.Write(record)
+	return err
+}
+
+// Close writes the last segment and closes the file.
+func (ew *encryptWriter) Close() error {
+	err := ew.flush(ew.buf, true)
+	if cerr := ew.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// decryptReader decrypts the file segment by segment. It implements media.ReadSeekCloser.
+type decryptReader struct {
+	file *os.File
+	aead cipher.AEAD
+	// Size of the decrypted file.
+	size     int64
+	segments int64
+	// Position in the decrypted file.
+	pos int64
+	// Index and decrypted content of the current segment.
+	index int64
+	plain []byte
+	// Buffer for reading encrypted segments.
+	record []byte
+}
+
+func newDecryptReader(file *os.File, aead cipher.AEAD) (*decryptReader, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	body := stat.Size() - int64(headerSize)
+	segments := (body + recordSize - 1) / recordSize
+	size := body - segments*segmentOverhead
+	if segments == 0 || size < 0 {
+		return nil, errors.New("fs: encrypted file is truncated")
+	}
+	return &decryptReader{
+		file:     file,
+		aead:     aead,
+		size:     size,
+		segments: segments,
+		index:    -1,
+		record:   make([]byte, recordSize),
+	}, nil
+}
+
+// Read decrypts data at the current position.
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	if dr.pos >= dr.size {
+		return 0, io.EOF
+	}
+
+	index := dr.pos / segmentSize
+	if index != dr.index {
+		n, err := dr.file.ReadAt(dr.record, int64(headerSize)+index*recordSize)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		record := dr.record[:n]
+		if len(record) < segmentOverhead {
+			return 0, errors.New("fs: encrypted file is truncated")
+		}
+		dr.plain, err = dr.aead.Open(dr.plain[:0], record[:12], record[12:], segmentAD(index, index == dr.segments-1))
+		if err != nil {
+			dr.index = -1
+			return 0, errors.New("fs: failed to decrypt file")
+		}
+		dr.index = index
+	}
+
+	n := copy(p, dr.plain[dr.pos-index*segmentSize:])
+	dr.pos += int64(n)
+	return n, nil
+}
+
+// Seek sets position in the decrypted file.
+func (dr *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += dr.pos
+	case io.SeekEnd:
+		offset += dr.size
+	default:
+		return 0, errors.New("fs: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("fs: negative position")
+	}
+	dr.pos = offset
+	return offset, nil
+}
+
+// Close closes the file.
+func (dr *decryptReader) Close() error {
+	return dr.file.Close()
+}
+
+// writeSegments encrypts the chunk of a resumable upload and writes it to the file at the position
+// of the received bytes. Only whole segments are accepted, except the last segment of the file.
+// The received count must be a multiple of the segment size. Returns the number of accepted bytes.
+func writeSegments(file *os.File, aead cipher.AEAD, received, size int64, chunk io.Reader) (int64, error) {
+	var accepted int64
+	plain := make([]byte, segmentSize)
+	chunk = io.LimitReader(chunk, size-received)
+	for received+accepted < size {
+		n, err := io.ReadFull(chunk, plain)
+		last := received+accepted+int64(n) == size
+		if n < segmentSize && !last {
+			// Partial segment: the client must send it again together with the rest.
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				err = nil
+			}
+			return accepted, err
+		}
+
+		index := (received + accepted) / segmentSize
+		record, serr := sealSegment(aead, index, last, plain[:n])
+		if serr != nil {
+			return accepted, serr
+		}
+		if _, serr = file.WriteAt(record, int64(headerSize)+index*recordSize); serr != nil {
+			return accepted, serr
+		}
+		accepted += int64(n)
+
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return accepted, err
+		}
+	}
+	return accepted, nil
+}
+
+// rewrapAll re-encrypts data keys of files in the directory which are wrapped with retired master keys.
+func (kr *keyring) rewrapAll(dir string) {
+	count := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		if ok, err := kr.rewrap(path); err != nil {
+			log.Println("fs: failed to rewrap data key", path, err)
+		} else if ok {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("fs: rewrapping data keys stopped", err)
+	}
+	log.Println("fs: rewrapped data keys of", count, "files")
+}
+
+// rewrap re-encrypts the data key of one file. The header is overwritten in place.
+func (kr *keyring) rewrap(path string) (bool, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header := make([]byte, headerSize)
+	if _, err = file.ReadAt(header, 0); err != nil || !isEncrypted(header) {
+		// Not encrypted.
+		return false, nil
+	}
+	dataKey, id, err := kr.unwrap(header)
+	if err != nil {
+		return false, err
+	}
+	if id == kr.current {
+		return false, nil
+	}
+	if header, err = kr.wrap(dataKey); err != nil {
+		return false, err
+	}
+	_, err = file.WriteAt(header, 0)
+	return err == nil, err
+}
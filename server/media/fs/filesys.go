@@ -1,6 +1,7 @@
-// Package fs implements github.com/tinode/chat/server/media interface by storing media objects in a single
-// directory in the file system.
-// This module won't perform well with tens of thousand of files because it stores all files in a single directory.
+// Package fs implements github.com/tinode/chat/server/media interface by storing media objects in the
+// file system. Files are stored either in a single directory or in nested subdirectories. A single
+// directory won't perform well with tens of thousand of files.
+// Files are optionally encrypted at rest with per-file data keys wrapped by a master key from the config.
 package fs
 
 import (
@@ -20,17 +21,30 @@ import (
 const (
 	defaultServeURL = "/v0/file/s/"
 	handlerName     = "fs"
+
+	defaultShardDepth = 2
+	defaultShardWidth = 2
 )
 
 type configType struct {
-	FileUploadDirectory string `json:"upload_dir"`
-	ServeURL            string `json:"serve_url"`
+	FileUploadDirectory string            `json:"upload_dir"`
+	ServeURL            string            `json:"serve_url"`
+	Encryption          *encryptionConfig `json:"encryption"`
+	// Placement of files in the upload directory: "flat" or "sharded".
+	Layout string `json:"layout"`
+	// Number of levels of subdirectories of the "sharded" layout.
+	ShardDepth int `json:"shard_depth"`
+	// Number of characters in names of subdirectories of the "sharded" layout.
+	ShardWidth int `json:"shard_width"`
 }
 
 type fshandler struct {
 	// In case of a cluster fileUploadLocation must be accessible to all cluster members.
 	fileUploadLocation string
 	serveURL           string
+	layout             layout
+	// Master keys for encryption of files at rest, nil if files are stored unencrypted.
+	keys *keyring
 }
 
 func (fh *fshandler) Init(jsconf string) error {
@@ -51,8 +65,24 @@ func (fh *fshandler) Init(jsconf string) error {
 		fh.serveURL = defaultServeURL
 	}
 
+	if fh.layout, err = newLayout(&config); err != nil {
+		return err
+	}
+
 	// Make sure the upload directory exists.
-	return os.MkdirAll(fh.fileUploadLocation, 0777)
+	if err = os.MkdirAll(fh.fileUploadLocation, 0777); err != nil {
+		return err
+	}
+
+	if config.Encryption != nil {
+		if fh.keys, err = newKeyring(config.Encryption); err != nil {
+			return err
+		}
+		if config.Encryption.Rewrap {
+			go fh.keys.rewrapAll(fh.fileUploadLocation)
+		}
+	}
+	return nil
 }
 
 // Redirect is used when one wants to serve files from a different external server.
@@ -63,14 +93,30 @@ func (fshandler) Redirect(method, url string) (string, error) {
 
 // Upload processes request for file upload. The file is given as io.Reader.
 func (fh *fshandler) Upload(fdef *types.FileDef, file io.ReadSeeker) (string, error) {
-	// FIXME: create two-three levels of nested directories. Serving from a single directory
-	// with tens of thousands of files in it will not perform well.
+	hash, err := media.ContentHash(file)
+	if err != nil {
+		return "", err
+	}
+
+	// Store identical files only once.
+	if dup, err := store.Files.GetByHash(hash); err != nil {
+		return "", err
+	} else if dup != nil {
+		if err = store.Files.LinkDuplicate(fdef, dup); err != nil {
+			return "", err
+		}
+		return fh.fileURL(fdef), nil
+	}
+	fdef.Hash = hash
 
 	// Generate a unique file name and attach it to path. Using base32 instead of base64 to avoid possible
 	// file name collisions on Windows due to case-insensitive file names there.
-	fdef.Location = filepath.Join(fh.fileUploadLocation, fdef.Uid().String32())
+	fdef.Location, err = fh.location(fdef.Uid().String32())
+	if err != nil {
+		return "", err
+	}
 
-	outfile, err := os.Create(fdef.Location)
+	outfile, err := fh.create(fdef.Location)
 	if err != nil {
 		log.Println("Upload: failed to create file", fdef.Location, err)
 		return "", err
@@ -84,7 +130,9 @@ func (fh *fshandler) Upload(fdef *types.FileDef, file io.ReadSeeker) (string, er
 	}
 
 	size, err := io.Copy(outfile, file)
-	outfile.Close()
+	if cerr := outfile.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
 		store.Files.FinishUpload(fdef.Id, false, 0)
 		os.Remove(fdef.Location)
@@ -97,13 +145,121 @@ func (fh *fshandler) Upload(fdef *types.FileDef, file io.ReadSeeker) (string, er
 		return "", err
 	}
 
-	fname := fdef.Id
-	ext, _ := mime.ExtensionsByType(fdef.MimeType)
-	if len(ext) > 0 {
-		fname += ext[0]
+	return fh.fileURL(fdef), nil
+}
+
+// UploadStart creates an empty file for the resumable upload.
+func (fh *fshandler) UploadStart(fdef *types.FileDef) error {
+	var err error
+	fdef.Location, err = fh.location(fdef.Uid().String32())
+	if err != nil {
+		return err
+	}
+
+	outfile, err := os.Create(fdef.Location)
+	if err != nil {
+		log.Println("UploadStart: failed to create file", fdef.Location, err)
+		return err
+	}
+	if fh.keys != nil {
+		// The header with the data key is written now, the content is encrypted as received.
+		header, _, err := fh.keys.newHeader()
+		if err == nil {
+			_, err = outfile.Write(header)
+		}
+		if err != nil {
+			outfile.Close()
+			os.Remove(fdef.Location)
+			return err
+		}
 	}
+	outfile.Close()
 
-	return fh.serveURL + fname, nil
+	if err = store.Files.StartUpload(fdef); err != nil {
+		os.Remove(fdef.Location)
+		log.Println("failed to create file record", fdef.Id, err)
+		return err
+	}
+	return nil
+}
+
+// UploadChunk writes the chunk to the file at the current offset. Everything written is accepted,
+// including partially received chunks, unless the file is encrypted. Encrypted files accept
+// data in whole segments of 64KB.
+func (fh *fshandler) UploadChunk(fdef *types.FileDef, chunk io.Reader) (int64, error) {
+	outfile, err := os.OpenFile(fdef.Location, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	aead, err := fh.keys.readHeader(outfile)
+	if err != nil {
+		outfile.Close()
+		return 0, err
+	}
+
+	var size int64
+	if aead != nil {
+		size, err = writeSegments(outfile, aead, fdef.Received, fdef.Size, chunk)
+	} else if _, err = outfile.Seek(fdef.Received, io.SeekStart); err == nil {
+		size, err = io.Copy(outfile, io.LimitReader(chunk, fdef.Size-fdef.Received))
+	}
+	outfile.Close()
+	if size > 0 {
+		fdef.Received += size
+		if uerr := store.Files.UpdateProgress(fdef.Id, fdef.Received-size,
+			map[string]interface{}{"Received": fdef.Received}); uerr != nil {
+			// The progress is lost or the upload was written concurrently.
+			// The client will have to resend the chunk.
+			return 0, uerr
+		}
+	}
+	return size, err
+}
+
+// UploadFinish marks the resumable upload as completed.
+func (fh *fshandler) UploadFinish(fdef *types.FileDef) (string, error) {
+	fd, err := store.Files.FinishUpload(fdef.Id, true, fdef.Received)
+	if err != nil {
+		return "", err
+	}
+	return fh.fileURL(fd), nil
+}
+
+// UploadAbort deletes the partially uploaded file.
+func (fh *fshandler) UploadAbort(fdef *types.FileDef) error {
+	os.Remove(fdef.Location)
+	_, err := store.Files.FinishUpload(fdef.Id, false, 0)
+	return err
+}
+
+// UploadVariant saves a resized copy of the file next to the original.
+func (fh *fshandler) UploadVariant(fdef *types.FileDef, variant *types.FileVariant, file io.ReadSeeker) error {
+	var err error
+	variant.Location, err = fh.location(fdef.Uid().String32() + "-" + variant.Name)
+	if err != nil {
+		return err
+	}
+
+	outfile, err := fh.create(variant.Location)
+	if err != nil {
+		log.Println("UploadVariant: failed to create file", variant.Location, err)
+		return err
+	}
+
+	variant.Size, err = io.Copy(outfile, file)
+	if cerr := outfile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(variant.Location)
+	}
+	return err
+}
+
+// Open opens the stored file for reading.
+func (fh *fshandler) Open(fdef *types.FileDef) (io.ReadCloser, error) {
+	return fh.open(fdef.Location)
 }
 
 // Download processes request for file download.
@@ -119,8 +275,9 @@ func (fh *fshandler) Download(url string) (*types.FileDef, media.ReadSeekCloser,
 		log.Println("Download: file not found", fid)
 		return nil, nil, err
 	}
+	fd = media.SelectVariant(fd, media.GetVariantFromUrl(url))
 
-	file, err := os.Open(fd.Location)
+	file, err := fh.open(fd.Location)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// If the file is not found, send 404 instead of the default 500
@@ -149,6 +306,63 @@ func (fh *fshandler) GetIdFromUrl(url string) types.Uid {
 	return media.GetIdFromUrl(url, fh.serveURL)
 }
 
+// create creates a new file which is encrypted if encryption is enabled.
+func (fh *fshandler) create(location string) (io.WriteCloser, error) {
+	file, err := os.Create(location)
+	if err != nil {
+		return nil, err
+	}
+	if fh.keys == nil {
+		return file, nil
+	}
+
+	ew, err := fh.keys.newEncryptWriter(file)
+	if err != nil {
+		file.Close()
+		os.Remove(location)
+		return nil, err
+	}
+	return ew, nil
+}
+
+// open opens the file for reading and decrypts it if it's encrypted.
+func (fh *fshandler) open(location string) (media.ReadSeekCloser, error) {
+	file, err := os.Open(location)
+	if os.IsNotExist(err) {
+		// The file may have been relocated after the record was read.
+		file, err = os.Open(fh.layout.path(filepath.Base(location)))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := fh.keys.readHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if aead == nil {
+		return file, nil
+	}
+
+	dr, err := newDecryptReader(file, aead)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return dr, nil
+}
+
+// fileURL returns the download URL of the file.
+func (fh *fshandler) fileURL(fdef *types.FileDef) string {
+	fname := fdef.Id
+	ext, _ := mime.ExtensionsByType(fdef.MimeType)
+	if len(ext) > 0 {
+		fname += ext[0]
+	}
+	return fh.serveURL + fname
+}
+
 // getFileRecord given file ID reads file record from the database.
 func (fh *fshandler) getFileRecord(fid types.Uid) (*types.FileDef, error) {
 	fd, err := store.Files.Get(fid.String())
@@ -0,0 +1,181 @@
+package fs
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Number of file records to process in one batch when relocating files.
+	relocateBatchSize = 100
+	// Time to wait before deleting relocated files: requests which fetched the record before
+	// it was updated may still need the old location.
+	relocateGracePeriod = time.Minute
+)
+
+// layout defines placement of files in the upload directory.
+type layout interface {
+	// path returns location of the file with the given name.
+	path(name string) string
+}
+
+// flatLayout stores all files in the upload directory.
+type flatLayout struct {
+	root string
+}
+
+func (l flatLayout) path(name string) string {
+	return filepath.Join(l.root, name)
+}
+
+// shardedLayout stores files in nested subdirectories named by prefixes of the file name, i.e.
+// file 'abcdefgh' is stored as 'ab/cd/abcdefgh' with depth 2 and width 2. File names are
+// derived from random-looking IDs so files are distributed evenly.
+type shardedLayout struct {
+	root string
+	// Number of levels of subdirectories.
+	depth int
+	// Number of characters in the name of a subdirectory.
+	width int
+}
+
+func (l shardedLayout) path(name string) string {
+	parts := []string{l.root}
+	for i := 0; i < l.depth && (i+1)*l.width <= len(name); i++ {
+		parts = append(parts, name[i*l.width:(i+1)*l.width])
+	}
+	return filepath.Join(append(parts, name)...)
+}
+
+// newLayout creates the layout of the upload directory from config.
+func newLayout(config *configType) (layout, error) {
+	switch config.Layout {
+	case "", "flat":
+		return flatLayout{root: config.FileUploadDirectory}, nil
+	case "sharded":
+		l := shardedLayout{root: config.FileUploadDirectory, depth: config.ShardDepth, width: config.ShardWidth}
+		if l.depth <= 0 {
+			l.depth = defaultShardDepth
+		}
+		if l.width <= 0 {
+			l.width = defaultShardWidth
+		}
+		return l, nil
+	}
+	return nil, errors.New("unknown layout '" + config.Layout + "'")
+}
+
+// location returns location of the file with the given name in the current layout and makes
+// sure the directory of the file exists.
+func (fh *fshandler) location(name string) (string, error) {
+	loc := fh.layout.path(name)
+	return loc, os.MkdirAll(filepath.Dir(loc), 0777)
+}
+
+// Relocate moves stored files to the current layout and updates file records. It's safe to
+// run while the server is serving files: files are hard-linked to the new location first and
+// the old locations are removed after all records are updated and the grace period expires.
+func (fh *fshandler) Relocate() error {
+	moved := make(map[string]bool)
+	if err := fh.relocateAll(moved); err != nil {
+		return err
+	}
+	if len(moved) == 0 {
+		log.Println("fs: all files are already in the current layout")
+		return nil
+	}
+
+	log.Println("fs: relocated", len(moved), "files, waiting before removing old locations")
+	time.Sleep(relocateGracePeriod)
+
+	// Duplicates of files created in the meantime may still point to old locations.
+	if err := fh.relocateAll(moved); err != nil {
+		return err
+	}
+
+	for loc := range moved {
+		if err := os.Remove(loc); err != nil && !os.IsNotExist(err) {
+			log.Println("fs: failed to remove relocated file", loc, err)
+		}
+	}
+	log.Println("fs: relocation completed")
+	return nil
+}
+
+// relocateAll relocates files of all file records. Old locations are added to moved.
+func (fh *fshandler) relocateAll(moved map[string]bool) error {
+	after := ""
+	for {
+		fds, err := store.Files.GetAll(after, relocateBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(fds) == 0 {
+			return nil
+		}
+
+		for i := range fds {
+			fd := &fds[i]
+			after = fd.Id
+			if fd.Status != types.UploadCompleted && fd.Status != types.UploadQuarantined {
+				// Files being uploaded are relocated on the next run, failed ones are removed by GC.
+				continue
+			}
+			if err = fh.relocateRecord(fd, moved); err != nil {
+				log.Println("fs: failed to relocate file", fd.Id, err)
+			}
+		}
+	}
+}
+
+// relocateRecord relocates the file and its variants and updates the record.
+func (fh *fshandler) relocateRecord(fd *types.FileDef, moved map[string]bool) error {
+	location, err := fh.relocateFile(fd.Location, moved)
+	if err != nil {
+		return err
+	}
+	changed := location != fd.Location
+
+	variants := make(types.FileVariants, len(fd.Variants))
+	copy(variants, fd.Variants)
+	for i := range variants {
+		loc, err := fh.relocateFile(variants[i].Location, moved)
+		if err != nil {
+			return err
+		}
+		changed = changed || loc != variants[i].Location
+		variants[i].Location = loc
+	}
+
+	if !changed {
+		return nil
+	}
+	update := map[string]interface{}{"Location": location}
+	if len(variants) > 0 {
+		update["Variants"] = variants
+	}
+	return store.Files.Update(fd.Id, update)
+}
+
+// relocateFile hard-links the file to its location in the current layout. Returns the new location.
+func (fh *fshandler) relocateFile(old string, moved map[string]bool) (string, error) {
+	loc, err := fh.location(filepath.Base(old))
+	if err != nil || loc == old {
+		return old, err
+	}
+
+	if err = os.Link(old, loc); err != nil && !os.IsExist(err) {
+		if _, serr := os.Stat(loc); !os.IsNotExist(err) || serr != nil {
+			return old, err
+		}
+		// Relocated earlier, the record was not updated.
+	}
+	moved[old] = true
+	return loc, nil
+}
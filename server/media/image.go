@@ -0,0 +1,390 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"runtime"
+	"sort"
+
+	// Register GIF decoder.
+	_ "image/gif"
+)
+
+const (
+	// Images larger than this are not processed to avoid exhausting memory, pixels. Processing
+	// keeps up to two RGBA copies of the image at 4 bytes per pixel, i.e. 128MB at this size.
+	defaultMaxPixels = 16000000
+	// Quality of JPEG variants.
+	defaultJPEGQuality = 85
+)
+
+// Limits the number of images processed at the same time, hence the memory used.
+var processingSlots = make(chan bool, runtime.NumCPU())
+
+// ImageConfig is the configuration of image processing.
+type ImageConfig struct {
+	// Variants to create: name of the variant -> max width and height in pixels. Variants
+	// are fetched by adding ?size=<name> to the download URL.
+	Variants map[string]int `json:"variants"`
+	// Remove EXIF and other metadata from uploaded images.
+	StripMetadata bool `json:"strip_metadata"`
+	// Don't process images larger than this number of pixels.
+	MaxPixels int `json:"max_pixels"`
+	// Quality of JPEG variants, 1-100.
+	JPEGQuality int `json:"jpeg_quality"`
+}
+
+// ImageVariant is a resized copy of the image.
+type ImageVariant struct {
+	Name     string
+	MimeType string
+	Width    int
+	Height   int
+	Data     []byte
+}
+
+// IsProcessableImage checks if the image of the given MIME type can be processed.
+func IsProcessableImage(mimeType string) bool {
+	return mimeType == "image/jpeg" || mimeType == "image/png" || mimeType == "image/gif"
+}
+
+// ProcessImage creates resized variants of the image honoring EXIF orientation. Variants
+// which would be larger than the original are skipped. If metadata stripping is enabled,
+// the original is returned without metadata, otherwise it's returned unchanged.
+func ProcessImage(data []byte, mimeType string, conf *ImageConfig) ([]byte, []ImageVariant, error) {
+	maxPixels := conf.MaxPixels
+	if maxPixels <= 0 {
+		maxPixels = defaultMaxPixels
+	}
+	quality := conf.JPEGQuality
+	if quality <= 0 || quality > 100 {
+		quality = defaultJPEGQuality
+	}
+
+	// Check the size before decoding the whole image.
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return nil, nil, errors.New("image too large to process")
+	}
+
+	processingSlots <- true
+	defer func() { <-processingSlots }()
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	orientation := 1
+	if mimeType == "image/jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	img := orient(toRGBA(src), orientation)
+
+	// Variants are created in the order of decreasing size for consistent results.
+	names := make([]string, 0, len(conf.Variants))
+	for name := range conf.Variants {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return conf.Variants[names[i]] > conf.Variants[names[j]] })
+
+	var variants []ImageVariant
+	bounds := img.Bounds()
+	for _, name := range names {
+		size := conf.Variants[name]
+		if size <= 0 || (bounds.Dx() <= size && bounds.Dy() <= size) {
+			continue
+		}
+		width, height := fitInto(bounds.Dx(), bounds.Dy(), size)
+		variant, err := encodeImage(resize(img, width, height), mimeType, quality)
+		if err != nil {
+			return nil, nil, err
+		}
+		variant.Name = name
+		variant.Width, variant.Height = width, height
+		variants = append(variants, *variant)
+	}
+
+	original := data
+	if conf.StripMetadata {
+		switch mimeType {
+		case "image/jpeg":
+			if orientation == 1 {
+				original, err = stripJPEG(data)
+			} else {
+				// Removing EXIF would lose the orientation. Rotate the image instead.
+				var enc *ImageVariant
+				if enc, err = encodeImage(img, mimeType, quality); err == nil {
+					original = enc.Data
+				}
+			}
+		case "image/png":
+			original, err = stripPNG(data)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return original, variants, nil
+}
+
+// fitInto scales the dimensions to fit into a square of the given size preserving the aspect ratio.
+func fitInto(width, height, size int) (int, int) {
+	if width >= height {
+		h := height * size / width
+		if h < 1 {
+			h = 1
+		}
+		return size, h
+	}
+	w := width * size / height
+	if w < 1 {
+		w = 1
+	}
+	return w, size
+}
+
+func encodeImage(img image.Image, mimeType string, quality int) (*ImageVariant, error) {
+	var buf bytes.Buffer
+	var err error
+	variant := &ImageVariant{}
+	if mimeType == "image/jpeg" {
+		variant.MimeType = "image/jpeg"
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	} else {
+		// PNG and GIF may be transparent. GIF variants are not animated.
+		variant.MimeType = "image/png"
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+	variant.Data = buf.Bytes()
+	return variant, nil
+}
+
+func toRGBA(src image.Image) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	return dst
+}
+
+// resize scales the image down by averaging source pixels covered by each destination pixel.
+// Colors are premultiplied by alpha so transparent pixels don't bleed into the result.
+func resize(src *image.RGBA, width, height int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+
+	// Horizontal pass: sw x sh -> width x sh. Intermediate values are scaled by 256 to keep precision.
+	tmp := make([]uint32, width*sh*4)
+	for x := 0; x < width; x++ {
+		x0, x1 := span(x, width, sw)
+		for y := 0; y < sh; y++ {
+			var acc [4]uint64
+			row := src.Pix[y*src.Stride:]
+			for sx := x0; sx < x1; sx++ {
+				p := row[sx*4 : sx*4+4]
+				acc[0] += uint64(p[0])
+				acc[1] += uint64(p[1])
+				acc[2] += uint64(p[2])
+				acc[3] += uint64(p[3])
+			}
+			n := uint64(x1 - x0)
+			i := (y*width + x) * 4
+			tmp[i] = uint32(acc[0] * 256 / n)
+			tmp[i+1] = uint32(acc[1] * 256 / n)
+			tmp[i+2] = uint32(acc[2] * 256 / n)
+			tmp[i+3] = uint32(acc[3] * 256 / n)
+		}
+	}
+
+	// Vertical pass: width x sh -> width x height.
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := span(y, height, sh)
+		n := uint64(y1 - y0)
+		for x := 0; x < width; x++ {
+			var acc [4]uint64
+			for sy := y0; sy < y1; sy++ {
+				i := (sy*width + x) * 4
+				acc[0] += uint64(tmp[i])
+				acc[1] += uint64(tmp[i+1])
+				acc[2] += uint64(tmp[i+2])
+				acc[3] += uint64(tmp[i+3])
+			}
+			p := dst.Pix[y*dst.Stride+x*4:]
+			p[0] = uint8(acc[0] / n / 256)
+			p[1] = uint8(acc[1] / n / 256)
+			p[2] = uint8(acc[2] / n / 256)
+			p[3] = uint8(acc[3] / n / 256)
+		}
+	}
+	return dst
+}
+
+// span returns the range of source pixels covered by the destination pixel.
+func span(i, dstLen, srcLen int) (int, int) {
+	from := i * srcLen / dstLen
+	to := (i + 1) * srcLen / dstLen
+	if to <= from {
+		to = from + 1
+	}
+	return from, to
+}
+
+// orient transforms the image according to the EXIF orientation tag so it's displayed upright.
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	// Orientations 5-8 swap width and height.
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored horizontally.
+				dx, dy = w-1-x, y
+			case 3: // Rotated 180.
+				dx, dy = w-1-x, h-1-y
+			case 4: // Mirrored vertically.
+				dx, dy = x, h-1-y
+			case 5: // Transposed.
+				dx, dy = y, x
+			case 6: // Rotated 90 clockwise.
+				dx, dy = h-1-y, x
+			case 7: // Transversed.
+				dx, dy = h-1-y, w-1-x
+			case 8: // Rotated 90 counterclockwise.
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4], src.Pix[y*src.Stride+x*4:y*src.Stride+x*4+4])
+		}
+	}
+	return dst
+}
+
+// jpegSegments calls fn for each marker segment of the JPEG header up to the start of the image data.
+// Returns the offset of the start of scan marker.
+func jpegSegments(data []byte, fn func(marker byte, segment []byte)) (int, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 0, errors.New("not a JPEG")
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return 0, errors.New("invalid JPEG marker")
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			// Fill byte.
+			pos++
+			continue
+		}
+		if marker == 0xDA {
+			// Start of scan: the rest is image data.
+			return pos, nil
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return 0, errors.New("invalid JPEG segment")
+		}
+		fn(marker, data[pos:pos+2+length])
+		pos += 2 + length
+	}
+	return 0, errors.New("unexpected end of JPEG")
+}
+
+// jpegOrientation reads the orientation tag from EXIF. Returns 1 (normal) if it's missing.
+func jpegOrientation(data []byte) int {
+	orientation := 1
+	jpegSegments(data, func(marker byte, segment []byte) {
+		if marker != 0xE1 || len(segment) < 18 || string(segment[4:10]) != "Exif\x00\x00" {
+			return
+		}
+		tiff := segment[10:]
+		var order binary.ByteOrder
+		switch string(tiff[:2]) {
+		case "II":
+			order = binary.LittleEndian
+		case "MM":
+			order = binary.BigEndian
+		default:
+			return
+		}
+		ifd := int(order.Uint32(tiff[4:]))
+		if ifd < 8 || ifd+2 > len(tiff) {
+			return
+		}
+		count := int(order.Uint16(tiff[ifd:]))
+		for i := 0; i < count; i++ {
+			entry := ifd + 2 + i*12
+			if entry+12 > len(tiff) {
+				return
+			}
+			// Tag 0x0112 of type SHORT.
+			if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+				orientation = int(order.Uint16(tiff[entry+8:]))
+				return
+			}
+		}
+	})
+	return orientation
+}
+
+// stripJPEG removes metadata segments: EXIF, XMP, IPTC, comments. Segments which affect
+// rendering, like JFIF, ICC profile and Adobe, are kept.
+func stripJPEG(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	sos, err := jpegSegments(data, func(marker byte, segment []byte) {
+		isMeta := marker == 0xFE || (marker >= 0xE1 && marker <= 0xEF && marker != 0xE2 && marker != 0xEE)
+		if !isMeta {
+			out = append(out, segment...)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(out, data[sos:]...), nil
+}
+
+// stripPNG removes textual metadata, EXIF and modification time chunks.
+func stripPNG(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if len(data) < len(signature) || string(data[:len(signature)]) != signature {
+		return nil, errors.New("not a PNG")
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, signature...)
+	pos := len(signature)
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) || end < pos {
+			return nil, errors.New("invalid PNG chunk")
+		}
+		switch string(data[pos+4 : pos+8]) {
+		case "tEXt", "zTXt", "iTXt", "eXIf", "tIME":
+		default:
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+	return out, nil
+}
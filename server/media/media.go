@@ -3,7 +3,10 @@
 package media
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
+	"net/url"
 	"path"
 	"strings"
 
@@ -29,6 +32,29 @@ type Handler interface {
 	// Upload processes request for file upload.
 	Upload(fdef *types.FileDef, file io.ReadSeeker) (string, error)
 
+	// UploadVariant saves a resized copy of the file before the file itself is uploaded.
+	// The handler assigns variant.Location. No database record is created for the variant.
+	UploadVariant(fdef *types.FileDef, variant *types.FileVariant, file io.ReadSeeker) error
+
+	// UploadStart begins a resumable upload of fdef.Size bytes: prepares the storage, assigns
+	// fdef.Location and creates the file record in UploadStarted state.
+	UploadStart(fdef *types.FileDef) error
+
+	// UploadChunk appends data to the resumable upload at fdef.Received offset. Returns the number
+	// of bytes accepted which may be fewer than provided if the storage requires data in blocks
+	// of certain size. Progress is saved in the file record.
+	UploadChunk(fdef *types.FileDef, chunk io.Reader) (int64, error)
+
+	// UploadFinish completes the resumable upload when all bytes are received. Returns the
+	// download URL of the file.
+	UploadFinish(fdef *types.FileDef) (string, error)
+
+	// UploadAbort cancels the resumable upload and releases partially uploaded data.
+	UploadAbort(fdef *types.FileDef) error
+
+	// Open opens the stored file for reading, e.g. to scan it for malware.
+	Open(fdef *types.FileDef) (io.ReadCloser, error)
+
 	// Download processes request for file download.
 	Download(url string) (*types.FileDef, ReadSeekCloser, error)
 
@@ -39,8 +65,27 @@ type Handler interface {
 	GetIdFromUrl(url string) types.Uid
 }
 
+// Relocator is implemented by media handlers which can move stored files after a change of
+// the storage layout.
+type Relocator interface {
+	// Relocate moves stored files to the current layout and updates file records.
+	Relocate() error
+}
+
+// Scanner is an interface which must be implemented by malware scanners of uploaded files.
+type Scanner interface {
+	// Init initializes the scanner.
+	Init(jsconf string) error
+
+	// Scan checks the content for malware. Returns the name of the detected threat or an empty
+	// string if the content is clean. Returns an error if the content could not be scanned.
+	Scan(content io.Reader) (string, error)
+}
+
 // GetIdFromUrl is a helper method for extracting file ID from a URL.
 func GetIdFromUrl(url string, serveUrl string) types.Uid {
+	// Strip query parameters, if any.
+	url = strings.SplitN(url, "?", 2)[0]
 	dir, fname := path.Split(path.Clean(url))
 
 	if dir != "" && dir != serveUrl {
@@ -49,3 +94,45 @@ func GetIdFromUrl(url string, serveUrl string) types.Uid {
 
 	return types.ParseUid(strings.Split(fname, ".")[0])
 }
+
+// ContentHash calculates hex-encoded SHA-256 hash of the file content used for deduplication
+// of uploads. The file is rewound to the start afterwards.
+func ContentHash(file io.ReadSeeker) (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// GetVariantFromUrl returns the name of the file variant requested in the 'size' query
+// parameter of the URL or an empty string if the original is requested.
+func GetVariantFromUrl(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	return parsed.Query().Get("size")
+}
+
+// SelectVariant returns the file record describing the named variant of the file. If the
+// variant does not exist, for instance the image was too small to resize, the original is returned.
+func SelectVariant(fd *types.FileDef, name string) *types.FileDef {
+	if name == "" {
+		return fd
+	}
+	for i := range fd.Variants {
+		if v := &fd.Variants[i]; v.Name == name {
+			variant := *fd
+			variant.MimeType = v.MimeType
+			variant.Size = v.Size
+			variant.Location = v.Location
+			variant.Variants = nil
+			return &variant
+		}
+	}
+	return fd
+}
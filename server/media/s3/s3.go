@@ -2,6 +2,7 @@
 package s3
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"io"
@@ -27,6 +28,13 @@ import (
 const (
 	defaultServeURL = "/v0/file/s/"
 	handlerName     = "s3"
+
+	// S3 requires all parts of a multipart upload except the last one to be at least 5MB.
+	minPartSize = 5 * 1024 * 1024
+	// Maximum number of parts in a multipart upload.
+	maxParts = 10000
+	// Maximum lifetime of a pre-signed S3 URL.
+	maxPresignLifetime = 7 * 24 * time.Hour
 )
 
 type awsconfig struct {
@@ -36,6 +44,9 @@ type awsconfig struct {
 	BucketName      string   `json:"bucket"`
 	CorsOrigins     []string `json:"cors_origins"`
 	ServeURL        string   `json:"serve_url"`
+	// Size of parts of resumable uploads in bytes, at least 5MB. Chunks of resumable
+	// uploads should be multiples of this size.
+	PartSize int64 `json:"part_size"`
 }
 
 type awshandler struct {
@@ -43,6 +54,14 @@ type awshandler struct {
 	conf awsconfig
 }
 
+// multipartState is the state of the resumable upload saved in FileDef.UploadState.
+type multipartState struct {
+	// ID of the S3 multipart upload.
+	UploadId string `json:"id"`
+	// ETags of the uploaded parts.
+	Parts []string `json:"parts"`
+}
+
 // readerCounter is a byte counter for bytes read through the io.Reader
 type readerCounter struct {
 	io.Reader
@@ -81,6 +100,10 @@ func (ah *awshandler) Init(jsconf string) error {
 		ah.conf.ServeURL = defaultServeURL
 	}
 
+	if ah.conf.PartSize < minPartSize {
+		ah.conf.PartSize = minPartSize
+	}
+
 	var sess *session.Session
 	if sess, err = session.NewSession(&aws.Config{
 		Region:      aws.String(ah.conf.Region),
@@ -139,30 +162,58 @@ func (ah *awshandler) Redirect(method, url string) (string, error) {
 		return "", err
 	}
 
+	fd = media.SelectVariant(fd, media.GetVariantFromUrl(url))
+
 	var req *request.Request
 	if method == "GET" {
 		req, _ = ah.svc.GetObjectRequest(&s3.GetObjectInput{
 			Bucket:              aws.String(ah.conf.BucketName),
-			Key:                 aws.String(fid.String32()),
+			Key:                 aws.String(fd.Location),
 			ResponseContentType: aws.String(fd.MimeType),
 		})
 	} else if method == "HEAD" {
 		req, _ = ah.svc.HeadObjectRequest(&s3.HeadObjectInput{
 			Bucket: aws.String(ah.conf.BucketName),
-			Key:    aws.String(fid.String32()),
+			Key:    aws.String(fd.Location),
 		})
 	}
 
 	if req != nil {
 		// Presign for 2 minutes.
-		return req.Presign(time.Minute * 2)
+		lifetime := time.Minute * 2
+		if media.IsSignedUrl(url) {
+			// The signed URL was already verified by the caller: the pre-signed S3 URL expires
+			// at the same time as the signed URL.
+			lifetime = time.Until(media.GetUrlExpiration(url))
+			if lifetime <= 0 {
+				return "", types.ErrPermissionDenied
+			}
+			if lifetime > maxPresignLifetime {
+				lifetime = maxPresignLifetime
+			}
+		}
+		return req.Presign(lifetime)
 	}
 	return "", nil
 }
 
 // Upload processes request for a file upload. The file is given as io.Reader.
 func (ah *awshandler) Upload(fdef *types.FileDef, file io.ReadSeeker) (string, error) {
-	var err error
+	hash, err := media.ContentHash(file)
+	if err != nil {
+		return "", err
+	}
+
+	// Store identical files only once.
+	if dup, err := store.Files.GetByHash(hash); err != nil {
+		return "", err
+	} else if dup != nil {
+		if err = store.Files.LinkDuplicate(fdef, dup); err != nil {
+			return "", err
+		}
+		return ah.fileURL(fdef), nil
+	}
+	fdef.Hash = hash
 
 	key := fdef.Uid().String32()
 	fdef.Location = key
@@ -196,15 +247,176 @@ func (ah *awshandler) Upload(fdef *types.FileDef, file io.ReadSeeker) (string, e
 		return "", err
 	}
 
-	fname := fdef.Id
-	ext, _ := mime.ExtensionsByType(fdef.MimeType)
-	if len(ext) > 0 {
-		fname += ext[0]
+	url := ah.fileURL(fdef)
+	log.Println("aws upload success ", url, "key", key, "id", fdef.Id)
+
+	return url, nil
+}
+
+// UploadVariant saves a resized copy of the file to the bucket next to the original.
+func (ah *awshandler) UploadVariant(fdef *types.FileDef, variant *types.FileVariant, file io.ReadSeeker) error {
+	variant.Location = fdef.Uid().String32() + "-" + variant.Name
+
+	uploader := s3manager.NewUploaderWithClient(ah.svc)
+	rc := readerCounter{reader: file}
+	_, err := uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(ah.conf.BucketName),
+		Key:         aws.String(variant.Location),
+		Body:        &rc,
+		ContentType: aws.String(variant.MimeType),
+	})
+	variant.Size = rc.count
+	return err
+}
+
+// UploadStart starts a multipart upload for the resumable upload.
+func (ah *awshandler) UploadStart(fdef *types.FileDef) error {
+	fdef.Location = fdef.Uid().String32()
+
+	out, err := ah.svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: aws.String(ah.conf.BucketName),
+		Key:    aws.String(fdef.Location),
+	})
+	if err != nil {
+		return err
 	}
 
-	log.Println("aws upload success ", fname, "key", key, "id", fdef.Id)
+	state, _ := json.Marshal(&multipartState{UploadId: aws.StringValue(out.UploadId)})
+	fdef.UploadState = string(state)
 
-	return ah.conf.ServeURL + fname, nil
+	if err = store.Files.StartUpload(fdef); err != nil {
+		ah.abortMultipart(fdef.Location, aws.StringValue(out.UploadId))
+		log.Println("failed to create file record", fdef.Id, err)
+		return err
+	}
+	return nil
+}
+
+// UploadChunk uploads the chunk as one or more parts of the multipart upload. Only complete
+// parts are accepted: the tail of the chunk shorter than the part size is discarded unless it's
+// the end of the file. The client is expected to resend the discarded bytes.
+func (ah *awshandler) UploadChunk(fdef *types.FileDef, chunk io.Reader) (int64, error) {
+	var state multipartState
+	if err := json.Unmarshal([]byte(fdef.UploadState), &state); err != nil {
+		return 0, err
+	}
+
+	partSize := ah.partSize(fdef.Size)
+	buf := make([]byte, partSize)
+	var accepted int64
+	for fdef.Received < fdef.Size {
+		want := fdef.Size - fdef.Received
+		if want > partSize {
+			want = partSize
+		}
+		n, err := io.ReadFull(chunk, buf[:want])
+		if int64(n) < want {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = nil
+			}
+			return accepted, err
+		}
+
+		out, err := ah.svc.UploadPart(&s3.UploadPartInput{
+			Bucket:     aws.String(ah.conf.BucketName),
+			Key:        aws.String(fdef.Location),
+			UploadId:   aws.String(state.UploadId),
+			PartNumber: aws.Int64(int64(len(state.Parts) + 1)),
+			Body:       bytes.NewReader(buf[:n]),
+		})
+		if err != nil {
+			return accepted, err
+		}
+
+		state.Parts = append(state.Parts, aws.StringValue(out.ETag))
+		data, _ := json.Marshal(&state)
+		if err = store.Files.UpdateProgress(fdef.Id, fdef.Received, map[string]interface{}{
+			"Received":    fdef.Received + want,
+			"UploadState": string(data),
+		}); err != nil {
+			return accepted, err
+		}
+		fdef.Received += want
+		fdef.UploadState = string(data)
+		accepted += want
+	}
+	return accepted, nil
+}
+
+// UploadFinish completes the multipart upload.
+func (ah *awshandler) UploadFinish(fdef *types.FileDef) (string, error) {
+	var state multipartState
+	if err := json.Unmarshal([]byte(fdef.UploadState), &state); err != nil {
+		return "", err
+	}
+
+	parts := make([]*s3.CompletedPart, len(state.Parts))
+	for i, etag := range state.Parts {
+		parts[i] = &s3.CompletedPart{ETag: aws.String(etag), PartNumber: aws.Int64(int64(i + 1))}
+	}
+	if _, err := ah.svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(ah.conf.BucketName),
+		Key:             aws.String(fdef.Location),
+		UploadId:        aws.String(state.UploadId),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	}); err != nil {
+		return "", err
+	}
+
+	fd, err := store.Files.FinishUpload(fdef.Id, true, fdef.Received)
+	if err != nil {
+		// Best effort. Error ignored.
+		ah.svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(ah.conf.BucketName),
+			Key:    aws.String(fdef.Location),
+		})
+		return "", err
+	}
+
+	return ah.fileURL(fd), nil
+}
+
+// UploadAbort aborts the multipart upload and deletes uploaded parts.
+func (ah *awshandler) UploadAbort(fdef *types.FileDef) error {
+	var state multipartState
+	if err := json.Unmarshal([]byte(fdef.UploadState), &state); err == nil {
+		ah.abortMultipart(fdef.Location, state.UploadId)
+	}
+	_, err := store.Files.FinishUpload(fdef.Id, false, 0)
+	return err
+}
+
+// abortMultipart aborts the multipart upload. Best effort, errors are logged.
+func (ah *awshandler) abortMultipart(key, uploadId string) {
+	if _, err := ah.svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(ah.conf.BucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	}); err != nil {
+		log.Println("s3: failed to abort multipart upload", key, err)
+	}
+}
+
+// partSize returns the size of parts of the multipart upload of the given size. Parts are
+// larger than configured if the file would not fit into the maximum number of parts otherwise.
+func (ah *awshandler) partSize(size int64) int64 {
+	partSize := ah.conf.PartSize
+	if min := (size + maxParts - 1) / maxParts; min > partSize {
+		partSize = min
+	}
+	return partSize
+}
+
+// Open starts downloading of the stored file from the bucket.
+func (ah *awshandler) Open(fdef *types.FileDef) (io.ReadCloser, error) {
+	out, err := ah.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(ah.conf.BucketName),
+		Key:    aws.String(fdef.Location),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
 }
 
 // Download processes request for file download.
@@ -234,6 +446,16 @@ func (ah *awshandler) GetIdFromUrl(url string) types.Uid {
 	return media.GetIdFromUrl(url, ah.conf.ServeURL)
 }
 
+// fileURL returns the download URL of the file.
+func (ah *awshandler) fileURL(fdef *types.FileDef) string {
+	fname := fdef.Id
+	ext, _ := mime.ExtensionsByType(fdef.MimeType)
+	if len(ext) > 0 {
+		fname += ext[0]
+	}
+	return ah.conf.ServeURL + fname
+}
+
 // getFileRecord given file ID reads file record from the database.
 func (ah *awshandler) getFileRecord(fid types.Uid) (*types.FileDef, error) {
 	fd, err := store.Files.Get(fid.String())
@@ -0,0 +1,88 @@
+package media
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Query parameters of signed download URLs.
+const (
+	// Expiration time of the URL, seconds since the epoch.
+	signedUrlExpires = "exp"
+	// Base64-encoded HMAC-SHA256 signature.
+	signedUrlSignature = "sig"
+)
+
+// signature calculates HMAC-SHA256 of the URL path, the requested variant and the expiration time.
+func signature(path, variant, expires string, key []byte) []byte {
+	hasher := hmac.New(sha256.New, key)
+	hasher.Write([]byte(path + "\n" + variant + "\n" + expires))
+	return hasher.Sum(nil)
+}
+
+// SignUrl adds expiration time and signature to the download URL so the file can be downloaded
+// without authentication until the URL expires.
+func SignUrl(u string, key []byte, expires time.Time) (string, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+
+	query := parsed.Query()
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	query.Set(signedUrlExpires, exp)
+	query.Set(signedUrlSignature, base64.RawURLEncoding.EncodeToString(
+		signature(parsed.Path, query.Get("size"), exp, key)))
+	parsed.RawQuery = query.Encode()
+	return parsed.String(), nil
+}
+
+// IsSignedUrl checks if the URL carries a signature.
+func IsSignedUrl(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	return parsed.Query().Get(signedUrlSignature) != ""
+}
+
+// VerifySignedUrl checks that the URL is signed with the key and is not expired.
+func VerifySignedUrl(u string, key []byte, now time.Time) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+
+	query := parsed.Query()
+	sig, err := base64.RawURLEncoding.DecodeString(query.Get(signedUrlSignature))
+	if err != nil {
+		return errors.New("malformed URL signature")
+	}
+	exp := query.Get(signedUrlExpires)
+	if !hmac.Equal(sig, signature(parsed.Path, query.Get("size"), exp, key)) {
+		return errors.New("invalid URL signature")
+	}
+	if expires := GetUrlExpiration(u); expires.IsZero() || !now.Before(expires) {
+		return errors.New("URL expired")
+	}
+	return nil
+}
+
+// GetUrlExpiration returns expiration time of the signed URL or zero time if the URL is not signed.
+// The signature is not verified.
+func GetUrlExpiration(u string) time.Time {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return time.Time{}
+	}
+	exp, err := strconv.ParseInt(parsed.Query().Get(signedUrlExpires), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(exp, 0).UTC()
+}
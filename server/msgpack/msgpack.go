@@ -0,0 +1,523 @@
+// Package msgpack converts messages between JSON and MessagePack (https://msgpack.org/).
+//
+// Messages are converted from JSON rather than encoded directly from Go values so the
+// MessagePack representation uses exactly the same field names, omission rules and custom
+// marshalers as JSON.
+package msgpack
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// Maximum nesting of arrays and maps accepted by ToJSON.
+const maxDepth = 64
+
+var errInvalidJSON = errors.New("msgpack: invalid JSON")
+var errTruncated = errors.New("msgpack: unexpected end of data")
+var errTooDeep = errors.New("msgpack: nesting too deep")
+
+// MessagePack type codes.
+const (
+	codeNil     = 0xc0
+	codeFalse   = 0xc2
+	codeTrue    = 0xc3
+	codeBin8    = 0xc4
+	codeBin16   = 0xc5
+	codeBin32   = 0xc6
+	codeFloat32 = 0xca
+	codeFloat64 = 0xcb
+	codeUint8   = 0xcc
+	codeUint16  = 0xcd
+	codeUint32  = 0xce
+	codeUint64  = 0xcf
+	codeInt8    = 0xd0
+	codeInt16   = 0xd1
+	codeInt32   = 0xd2
+	codeInt64   = 0xd3
+	codeStr8    = 0xd9
+	codeStr16   = 0xda
+	codeStr32   = 0xdb
+	codeArray16 = 0xdc
+	codeArray32 = 0xdd
+	codeMap16   = 0xde
+	codeMap32   = 0xdf
+)
+
+// FromJSON converts a JSON document to MessagePack. Integer numbers are encoded as integers,
+// all other numbers as 64-bit floats.
+func FromJSON(src []byte) ([]byte, error) {
+	enc := encoder{src: src, out: make([]byte, 0, len(src))}
+	if err := enc.value(); err != nil {
+		return nil, err
+	}
+	enc.skipSpace()
+	if enc.pos != len(src) {
+		return nil, errInvalidJSON
+	}
+	return enc.out, nil
+}
+
+// encoder converts JSON to MessagePack in a single pass.
+type encoder struct {
+	src []byte
+	pos int
+	out []byte
+}
+
+func (e *encoder) skipSpace() {
+	for e.pos < len(e.src) {
+		switch e.src[e.pos] {
+		case ' ', '\t', '\r', '\n':
+			e.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (e *encoder) value() error {
+	e.skipSpace()
+	if e.pos >= len(e.src) {
+		return errInvalidJSON
+	}
+
+	switch c := e.src[e.pos]; {
+	case c == '{':
+		return e.container('}', true)
+	case c == '[':
+		return e.container(']', false)
+	case c == '"':
+		str, err := e.string()
+		if err != nil {
+			return err
+		}
+		e.out = appendString(e.out, str)
+	case c == '-' || (c >= '0' && c <= '9'):
+		return e.number()
+	default:
+		return e.literal()
+	}
+	return nil
+}
+
+// container converts a JSON object or array. The number of elements is known only at the end,
+// so the header is inserted in front of the already converted elements.
+func (e *encoder) container(closing byte, isMap bool) error {
+	e.pos++
+	start := len(e.out)
+	count := 0
+
+	e.skipSpace()
+	if e.pos < len(e.src) && e.src[e.pos] == closing {
+		e.pos++
+	} else {
+		for {
+			if isMap {
+				e.skipSpace()
+				if e.pos >= len(e.src) || e.src[e.pos] != '"' {
+					return errInvalidJSON
+				}
+				key, err := e.string()
+				if err != nil {
+					return err
+				}
+				e.out = appendString(e.out, key)
+				e.skipSpace()
+				if e.pos >= len(e.src) || e.src[e.pos] != ':' {
+					return errInvalidJSON
+				}
+				e.pos++
+			}
+			if err := e.value(); err != nil {
+				return err
+			}
+			count++
+
+			e.skipSpace()
+			if e.pos >= len(e.src) {
+				return errInvalidJSON
+			}
+			if e.src[e.pos] == closing {
+				e.pos++
+				break
+			}
+			if e.src[e.pos] != ',' {
+				return errInvalidJSON
+			}
+			e.pos++
+		}
+	}
+
+	var header []byte
+	if isMap {
+		header = appendMapHeader(nil, count)
+	} else {
+		header = appendArrayHeader(nil, count)
+	}
+	e.out = append(e.out, header...)
+	copy(e.out[start+len(header):], e.out[start:len(e.out)-len(header)])
+	copy(e.out[start:], header)
+	return nil
+}
+
+// string parses a JSON string. The returned slice may point into the source.
+func (e *encoder) string() ([]byte, error) {
+	start := e.pos
+	escaped := false
+	for e.pos++; e.pos < len(e.src); e.pos++ {
+		switch e.src[e.pos] {
+		case '\\':
+			escaped = true
+			e.pos++
+		case '"':
+			e.pos++
+			if !escaped {
+				return e.src[start+1 : e.pos-1], nil
+			}
+			var str string
+			if err := json.Unmarshal(e.src[start:e.pos], &str); err != nil {
+				return nil, err
+			}
+			return []byte(str), nil
+		}
+	}
+	return nil, errInvalidJSON
+}
+
+func (e *encoder) number() error {
+	start := e.pos
+	isFloat := false
+	for ; e.pos < len(e.src); e.pos++ {
+		c := e.src[e.pos]
+		if c == '.' || c == 'e' || c == 'E' {
+			isFloat = true
+		} else if !(c == '-' || c == '+' || (c >= '0' && c <= '9')) {
+			break
+		}
+	}
+
+	num := string(e.src[start:e.pos])
+	if !isFloat {
+		if i, err := strconv.ParseInt(num, 10, 64); err == nil {
+			e.out = appendInt(e.out, i)
+			return nil
+		}
+		if u, err := strconv.ParseUint(num, 10, 64); err == nil {
+			e.out = appendUint(e.out, u)
+			return nil
+		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return errInvalidJSON
+	}
+	e.out = append(e.out, codeFloat64)
+	e.out = appendUint64(e.out, math.Float64bits(f))
+	return nil
+}
+
+func (e *encoder) literal() error {
+	for _, lit := range []struct {
+		text string
+		code byte
+	}{{"null", codeNil}, {"true", codeTrue}, {"false", codeFalse}} {
+		if end := e.pos + len(lit.text); end <= len(e.src) && string(e.src[e.pos:end]) == lit.text {
+			e.pos = end
+			e.out = append(e.out, lit.code)
+			return nil
+		}
+	}
+	return errInvalidJSON
+}
+
+func appendString(out, str []byte) []byte {
+	switch n := len(str); {
+	case n < 32:
+		out = append(out, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		out = append(out, codeStr8, byte(n))
+	case n <= math.MaxUint16:
+		out = appendUint16(append(out, codeStr16), uint16(n))
+	default:
+		out = appendUint32(append(out, codeStr32), uint32(n))
+	}
+	return append(out, str...)
+}
+
+func appendArrayHeader(out []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(out, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return appendUint16(append(out, codeArray16), uint16(n))
+	}
+	return appendUint32(append(out, codeArray32), uint32(n))
+}
+
+func appendMapHeader(out []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(out, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return appendUint16(append(out, codeMap16), uint16(n))
+	}
+	return appendUint32(append(out, codeMap32), uint32(n))
+}
+
+func appendInt(out []byte, i int64) []byte {
+	switch {
+	case i >= 0:
+		return appendUint(out, uint64(i))
+	case i >= -32:
+		return append(out, byte(i))
+	case i >= math.MinInt8:
+		return append(out, codeInt8, byte(i))
+	case i >= math.MinInt16:
+		return appendUint16(append(out, codeInt16), uint16(i))
+	case i >= math.MinInt32:
+		return appendUint32(append(out, codeInt32), uint32(i))
+	}
+	return appendUint64(append(out, codeInt64), uint64(i))
+}
+
+func appendUint(out []byte, u uint64) []byte {
+	switch {
+	case u < 128:
+		return append(out, byte(u))
+	case u <= math.MaxUint8:
+		return append(out, codeUint8, byte(u))
+	case u <= math.MaxUint16:
+		return appendUint16(append(out, codeUint16), uint16(u))
+	case u <= math.MaxUint32:
+		return appendUint32(append(out, codeUint32), uint32(u))
+	}
+	return appendUint64(append(out, codeUint64), u)
+}
+
+func appendUint16(out []byte, v uint16) []byte {
+	return append(out, byte(v>>8), byte(v))
+}
+
+func appendUint32(out []byte, v uint32) []byte {
+	return append(out, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(out []byte, v uint64) []byte {
+	return appendUint32(appendUint32(out, uint32(v>>32)), uint32(v))
+}
+
+// ToJSON converts a MessagePack document to JSON. Binary values are converted to base64-encoded
+// strings, the same way encoding/json represents []byte. Map keys must be strings. Extension
+// types are not supported.
+func ToJSON(src []byte) ([]byte, error) {
+	dec := decoder{src: src, out: make([]byte, 0, len(src)*2)}
+	if err := dec.value(0); err != nil {
+		return nil, err
+	}
+	if dec.pos != len(src) {
+		return nil, errors.New("msgpack: unexpected data after the value")
+	}
+	return dec.out, nil
+}
+
+// decoder converts MessagePack to JSON in a single pass.
+type decoder struct {
+	src []byte
+	pos int
+	out []byte
+}
+
+// next returns the next n bytes of the source.
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.src)-d.pos < n {
+		return nil, errTruncated
+	}
+	d.pos += n
+	return d.src[d.pos-n : d.pos], nil
+}
+
+// length reads the big-endian unsigned integer of the given size.
+func (d *decoder) length(size int) (int, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint64(n) > uint64(len(d.src)) {
+		// Every element takes at least one byte.
+		return 0, errTruncated
+	}
+	return int(n), nil
+}
+
+func (d *decoder) value(depth int) error {
+	b, err := d.next(1)
+	if err != nil {
+		return err
+	}
+
+	switch c := b[0]; {
+	case c <= 0x7f:
+		d.out = strconv.AppendUint(d.out, uint64(c), 10)
+	case c >= 0xe0:
+		d.out = strconv.AppendInt(d.out, int64(int8(c)), 10)
+	case c&0xf0 == 0x80:
+		return d.object(int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return d.array(int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		return d.string(int(c & 0x1f))
+	case c == codeNil:
+		d.out = append(d.out, "null"...)
+	case c == codeFalse:
+		d.out = append(d.out, "false"...)
+	case c == codeTrue:
+		d.out = append(d.out, "true"...)
+	case c == codeBin8 || c == codeBin16 || c == codeBin32:
+		n, err := d.length(1 << (c - codeBin8))
+		if err != nil {
+			return err
+		}
+		data, err := d.next(n)
+		if err != nil {
+			return err
+		}
+		d.out = append(d.out, '"')
+		d.out = append(d.out, base64.StdEncoding.EncodeToString(data)...)
+		d.out = append(d.out, '"')
+	case c == codeFloat32:
+		data, err := d.next(4)
+		if err != nil {
+			return err
+		}
+		return d.float(float64(math.Float32frombits(binary.BigEndian.Uint32(data))), 32)
+	case c == codeFloat64:
+		data, err := d.next(8)
+		if err != nil {
+			return err
+		}
+		return d.float(math.Float64frombits(binary.BigEndian.Uint64(data)), 64)
+	case c >= codeUint8 && c <= codeUint64:
+		data, err := d.next(1 << (c - codeUint8))
+		if err != nil {
+			return err
+		}
+		var u uint64
+		for _, x := range data {
+			u = u<<8 | uint64(x)
+		}
+		d.out = strconv.AppendUint(d.out, u, 10)
+	case c >= codeInt8 && c <= codeInt64:
+		data, err := d.next(1 << (c - codeInt8))
+		if err != nil {
+			return err
+		}
+		var i int64
+		switch len(data) {
+		case 1:
+			i = int64(int8(data[0]))
+		case 2:
+			i = int64(int16(binary.BigEndian.Uint16(data)))
+		case 4:
+			i = int64(int32(binary.BigEndian.Uint32(data)))
+		default:
+			i = int64(binary.BigEndian.Uint64(data))
+		}
+		d.out = strconv.AppendInt(d.out, i, 10)
+	case c == codeStr8 || c == codeStr16 || c == codeStr32:
+		n, err := d.length(1 << (c - codeStr8))
+		if err != nil {
+			return err
+		}
+		return d.string(n)
+	case c == codeArray16 || c == codeArray32:
+		n, err := d.length(2 << (c - codeArray16))
+		if err != nil {
+			return err
+		}
+		return d.array(n, depth)
+	case c == codeMap16 || c == codeMap32:
+		n, err := d.length(2 << (c - codeMap16))
+		if err != nil {
+			return err
+		}
+		return d.object(n, depth)
+	default:
+		return errors.New("msgpack: unsupported type 0x" + strconv.FormatUint(uint64(c), 16))
+	}
+	return nil
+}
+
+func (d *decoder) string(n int) error {
+	str, err := d.next(n)
+	if err != nil {
+		return err
+	}
+	quoted, _ := json.Marshal(string(str))
+	d.out = append(d.out, quoted...)
+	return nil
+}
+
+func (d *decoder) float(f float64, bits int) error {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return errors.New("msgpack: unsupported float value")
+	}
+	d.out = strconv.AppendFloat(d.out, f, 'g', -1, bits)
+	return nil
+}
+
+func (d *decoder) array(n, depth int) error {
+	if depth >= maxDepth {
+		return errTooDeep
+	}
+	d.out = append(d.out, '[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			d.out = append(d.out, ',')
+		}
+		if err := d.value(depth + 1); err != nil {
+			return err
+		}
+	}
+	d.out = append(d.out, ']')
+	return nil
+}
+
+func (d *decoder) object(n, depth int) error {
+	if depth >= maxDepth {
+		return errTooDeep
+	}
+	d.out = append(d.out, '{')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			d.out = append(d.out, ',')
+		}
+		// Keys must be strings.
+		if d.pos >= len(d.src) {
+			return errTruncated
+		}
+		if c := d.src[d.pos]; c&0xe0 != 0xa0 && (c < codeStr8 || c > codeStr32) {
+			return errors.New("msgpack: map key is not a string")
+		}
+		if err := d.value(depth + 1); err != nil {
+			return err
+		}
+		d.out = append(d.out, ':')
+		if err := d.value(depth + 1); err != nil {
+			return err
+		}
+	}
+	d.out = append(d.out, '}')
+	return nil
+}
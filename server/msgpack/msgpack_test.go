@@ -0,0 +1,130 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestFromJSON(t *testing.T) {
+	cases := []struct {
+		in  string
+		out []byte
+	}{
+		{`{"a":1}`, []byte{0x81, 0xa1, 'a', 0x01}},
+		{`[true, false, null]`, []byte{0x93, 0xc3, 0xc2, 0xc0}},
+		{`[]`, []byte{0x90}},
+		{`{}`, []byte{0x80}},
+		{`-1`, []byte{0xff}},
+		{`-33`, []byte{0xd0, 0xdf}},
+		{`300`, []byte{0xcd, 0x01, 0x2c}},
+		{`-70000`, []byte{0xd2, 0xff, 0xfe, 0xee, 0x90}},
+		{`18446744073709551615`, []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{`1.5`, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{`"<b>"`, []byte{0xa3, '<', 'b', '>'}},
+		{`{"k":[{"x":""}]}`, []byte{0x81, 0xa1, 'k', 0x91, 0x81, 0xa1, 'x', 0xa0}},
+	}
+
+	for _, tc := range cases {
+		out, err := FromJSON([]byte(tc.in))
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tc.in, err)
+			continue
+		}
+		if !bytes.Equal(out, tc.out) {
+			t.Errorf("%s: expected %x, got %x", tc.in, tc.out, out)
+		}
+	}
+}
+
+func TestFromJSONInvalid(t *testing.T) {
+	for _, in := range []string{``, `{`, `[1,]`, `{"a"}`, `{1:2}`, `"abc`, `nul`, `1 2`, `--1`} {
+		if _, err := FromJSON([]byte(in)); err == nil {
+			t.Errorf("%s: expected error", in)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	docs := []string{
+		`{"ctrl":{"id":"1","params":{"build":"mysql:v0.16","ver":"0.16"},"code":201,"text":"created","ts":"2020-06-01T10:00:00.123Z"}}`,
+		`{"data":{"topic":"grpAbCdEf","from":"usrQwErTy","ts":"2020-06-01T10:00:00Z","seq":123456,` +
+			`"content":{"txt":"мультибайтовый юникод \"quoted\"","fmt":[{"at":-1,"len":0,"key":0}],` +
+			`"ent":[{"tp":"IM","data":{"width":638,"height":213,"ratio":2.995305164319249}}]}}}`,
+		`[[],{},[null,true,false,-128,-32769,4294967296,1e100,0.1]]`,
+	}
+
+	for _, doc := range docs {
+		packed, err := FromJSON([]byte(doc))
+		if err != nil {
+			t.Errorf("%s: FromJSON failed: %s", doc, err)
+			continue
+		}
+		unpacked, err := ToJSON(packed)
+		if err != nil {
+			t.Errorf("%s: ToJSON failed: %s", doc, err)
+			continue
+		}
+
+		var expected, actual interface{}
+		json.Unmarshal([]byte(doc), &expected)
+		if err = json.Unmarshal(unpacked, &actual); err != nil {
+			t.Errorf("%s: invalid JSON '%s': %s", doc, unpacked, err)
+			continue
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("%s: round trip produced '%s'", doc, unpacked)
+		}
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	cases := []struct {
+		in  []byte
+		out string
+	}{
+		{[]byte{0x82, 0xa1, 'a', 0xca, 0x3f, 0xc0, 0, 0, 0xa1, 'b', 0xc4, 0x02, 0x01, 0x02}, `{"a":1.5,"b":"AQI="}`},
+		{[]byte{0xdc, 0x00, 0x02, 0xe0, 0xd3, 0x80, 0, 0, 0, 0, 0, 0, 0}, `[-32,-9223372036854775808]`},
+		{[]byte{0xd9, 0x03, '<', '"', '>'}, `"\u003c\"\u003e"`},
+	}
+
+	for _, tc := range cases {
+		out, err := ToJSON(tc.in)
+		if err != nil {
+			t.Errorf("%x: unexpected error %s", tc.in, err)
+			continue
+		}
+		if string(out) != tc.out {
+			t.Errorf("%x: expected '%s', got '%s'", tc.in, tc.out, out)
+		}
+	}
+}
+
+func TestToJSONInvalid(t *testing.T) {
+	deep := bytes.Repeat([]byte{0x91}, maxDepth+1)
+	cases := [][]byte{
+		// Empty input.
+		{},
+		// Truncated string.
+		{0xa3, 'a', 'b'},
+		// Array with fewer elements than declared.
+		{0xdd, 0xff, 0xff, 0xff, 0xff, 0x01},
+		// Non-string map key.
+		{0x81, 0x01, 0x02},
+		// Extension type.
+		{0xd4, 0x01, 0x00},
+		// NaN.
+		{0xcb, 0x7f, 0xf8, 0, 0, 0, 0, 0, 1},
+		// Trailing data.
+		{0xc0, 0xc0},
+		// Nesting too deep.
+		append(deep, 0xc0),
+	}
+
+	for _, in := range cases {
+		if _, err := ToJSON(in); err == nil {
+			t.Errorf("%x: expected error", in)
+		}
+	}
+}
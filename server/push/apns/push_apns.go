@@ -0,0 +1,363 @@
+// Package apns implements push notification plugin for Apple Push Notification service.
+// Notifications are sent to iOS devices directly over HTTP/2 using token-based (.p8 key) authentication,
+// without Firebase.
+package apns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+var handler Handler
+
+const (
+	// Size of the input channel buffer.
+	defaultBuffer = 32
+
+	productionHost = "https://api.push.apple.com"
+	sandboxHost    = "https://api.sandbox.push.apple.com"
+
+	// Timeout of requests to APNs.
+	requestTimeout = 30 * time.Second
+	// APNs rejects provider tokens older than one hour and refreshing them more often than
+	// every 20 minutes.
+	tokenRefreshInterval = 50 * time.Minute
+	// Max length of apns-collapse-id header.
+	maxCollapseIDLength = 64
+)
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input chan *push.Receipt
+	stop  chan bool
+
+	config *configType
+	key    *ecdsa.PrivateKey
+	client *http.Client
+	host   string
+
+	// Cached provider token.
+	tokenLock   sync.Mutex
+	token       string
+	tokenIssued time.Time
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	Buffer  int  `json:"buffer"`
+	// Authentication key downloaded from the Apple developer account: PEM-encoded contents or
+	// path to the .p8 file.
+	Key     string `json:"key"`
+	KeyFile string `json:"key_file"`
+	// 10-character ID of the key.
+	KeyID string `json:"key_id"`
+	// 10-character team ID.
+	TeamID string `json:"team_id"`
+	// Bundle ID of the app.
+	Topic string `json:"topic"`
+	// Use production APNs endpoint, otherwise sandbox (development) endpoint.
+	Production bool `json:"production"`
+	// Time in seconds before notification is discarded if undelivered. 0 means try once.
+	TimeToLive int `json:"time_to_live,omitempty"`
+	// Notification sound, "default" if missing.
+	Sound string `json:"sound,omitempty"`
+	// Title of the notification, like the name of the app in the user's language. The system
+	// shows the name of the app if missing.
+	Title string `json:"title,omitempty"`
+	// Show only the latest notification for each topic.
+	CollapseByTopic bool `json:"collapse_by_topic,omitempty"`
+}
+
+// Init initializes the push handler
+func (*Handler) Init(jsonconf string) error {
+
+	var config configType
+	err := json.Unmarshal([]byte(jsonconf), &config)
+	if err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return nil
+	}
+
+	keyPEM := []byte(config.Key)
+	if len(keyPEM) == 0 {
+		if config.KeyFile == "" {
+			return errors.New("missing authentication key")
+		}
+		if keyPEM, err = ioutil.ReadFile(config.KeyFile); err != nil {
+			return err
+		}
+	}
+	if handler.key, err = parseKey(keyPEM); err != nil {
+		return err
+	}
+	if config.KeyID == "" || config.TeamID == "" || config.Topic == "" {
+		return errors.New("key_id, team_id and topic are required")
+	}
+
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+	if config.Sound == "" {
+		config.Sound = "default"
+	}
+
+	handler.host = sandboxHost
+	if config.Production {
+		handler.host = productionHost
+	}
+
+	handler.config = &config
+	// APNs requires HTTP/2 which net/http negotiates automatically over TLS.
+	handler.client = &http.Client{Timeout: requestTimeout}
+	handler.input = make(chan *push.Receipt, config.Buffer)
+	handler.stop = make(chan bool, 1)
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				go sendNotifications(rcpt)
+			case <-handler.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// parseKey parses the PKCS#8 PEM-encoded P-256 key.
+func parseKey(keyPEM []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("invalid authentication key: not PEM-encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("invalid authentication key: " + err.Error())
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid authentication key: not an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+// providerToken returns a cached provider token or creates a new one.
+// If force is true, the token is recreated even if it's still fresh.
+func providerToken(force bool) (string, error) {
+	handler.tokenLock.Lock()
+	defer handler.tokenLock.Unlock()
+
+	now := time.Now()
+	if !force && handler.token != "" && now.Sub(handler.tokenIssued) < tokenRefreshInterval {
+		return handler.token, nil
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": handler.config.KeyID})
+	claims, _ := json.Marshal(map[string]interface{}{"iss": handler.config.TeamID, "iat": now.Unix()})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, handler.key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS uses fixed size concatenation of r and s rather than ASN.1.
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	handler.token = unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+	handler.tokenIssued = now
+	return handler.token, nil
+}
+
+func sendNotifications(rcpt *push.Receipt) {
+	defer rcpt.Done()
+
+	// Same fields as in FCM data messages so the app can handle both.
+	data, err := push.PayloadToData(&rcpt.Payload)
+	body := data["content"]
+	if err != nil || body == "" {
+		log.Println("apns push: could not parse payload or empty payload", err)
+		return
+	}
+
+	// List of UIDs for querying the database
+	uids := make([]t.Uid, 0, len(rcpt.To))
+	skipDevices := make(map[string]bool)
+	for uid, to := range rcpt.To {
+		uids = append(uids, uid)
+
+		// Some devices were online and received the message. Skip them.
+		for _, deviceID := range to.Devices {
+			skipDevices[deviceID] = true
+		}
+	}
+
+	devices, count, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		log.Println("apns push: db error", err)
+		return
+	}
+	if count == 0 {
+		return
+	}
+
+	// Recipients and devices which got the notification, to skip them when retrying.
+	done := make(map[t.Uid]bool)
+	delivered := make(map[t.Uid][]string)
+
+	for uid, devList := range devices {
+		// Payload is the same for all devices of the user: the badge is user's unread count.
+		alert := map[string]string{"body": body}
+		if handler.config.Title != "" {
+			alert["title"] = handler.config.Title
+		}
+		aps := map[string]interface{}{
+			"alert": alert,
+			"badge": rcpt.To[uid].Unread,
+			"sound": handler.config.Sound,
+			// Group notifications by topic.
+			"thread-id": rcpt.Payload.Topic,
+			// Let NotificationServiceExtension (if present) modify the notification.
+			"mutable-content": 1,
+		}
+		payload := map[string]interface{}{"aps": aps}
+		for k, v := range data {
+			payload[k] = v
+		}
+		msg, err := json.Marshal(payload)
+		if err != nil {
+			log.Println("apns push: failed to serialize payload", err)
+			return
+		}
+
+		for i := range devList {
+			d := &devList[i]
+			if d.Platform != push.PlatformAPNs || skipDevices[d.DeviceId] {
+				continue
+			}
+
+			status, reason, err := send(d.DeviceId, rcpt.Payload.Topic, msg)
+			if err != nil {
+				// Network errors. Stop sending this batch and retry the rest later.
+				log.Println("apns push:", err)
+				push.Retry("apns", rcpt.Undelivered(done, delivered))
+				return
+			}
+
+			switch {
+			case status == http.StatusOK:
+				delivered[uid] = append(delivered[uid], d.DeviceId)
+			case status == http.StatusGone || reason == "BadDeviceToken" || reason == "Unregistered":
+				// Token is no longer valid.
+				store.Devices.Delete(uid, d.DeviceId)
+				log.Println("apns push: invalid token", reason)
+			case status == http.StatusTooManyRequests || status >= 500:
+				// Transient errors. Stop sending this batch and retry the rest later.
+				log.Println("apns push: transient failure", status, reason)
+				push.Retry("apns", rcpt.Undelivered(done, delivered))
+				return
+			case status == http.StatusForbidden:
+				// Config errors.
+				log.Println("apns push: failed", reason)
+				return
+			default:
+				log.Println("apns push:", status, reason)
+			}
+		}
+		done[uid] = true
+	}
+}
+
+// send posts the notification to APNs. Returns HTTP status and the reason of failure.
+func send(deviceToken, topic string, msg []byte) (int, string, error) {
+	status, reason, err := post(deviceToken, topic, msg, false)
+	if err == nil && reason == "ExpiredProviderToken" {
+		// Clocks may be skewed, try once more with a new token.
+		status, reason, err = post(deviceToken, topic, msg, true)
+	}
+	return status, reason, err
+}
+
+func post(deviceToken, topic string, msg []byte, refreshToken bool) (int, string, error) {
+	token, err := providerToken(refreshToken)
+	if err != nil {
+		return 0, "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, handler.host+"/3/device/"+deviceToken, bytes.NewReader(msg))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("apns-topic", handler.config.Topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+	if handler.config.TimeToLive > 0 {
+		req.Header.Set("apns-expiration",
+			strconv.FormatInt(time.Now().Add(time.Duration(handler.config.TimeToLive)*time.Second).Unix(), 10))
+	}
+	if handler.config.CollapseByTopic && len(topic) <= maxCollapseIDLength {
+		req.Header.Set("apns-collapse-id", topic)
+	}
+
+	resp, err := handler.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return resp.StatusCode, "", nil
+	}
+
+	var result struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	return resp.StatusCode, result.Reason, nil
+}
+
+// IsReady checks if the push handler has been initialized.
+func (*Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (*Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Stop shuts down the handler
+func (*Handler) Stop() {
+	handler.stop <- true
+}
+
+func init() {
+	push.Register("apns", &handler)
+}
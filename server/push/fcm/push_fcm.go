@@ -7,13 +7,10 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
-	"strconv"
-	"time"
 
 	fbase "firebase.google.com/go"
 	fcm "firebase.google.com/go/messaging"
 
-	"github.com/tinode/chat/server/drafty"
 	"github.com/tinode/chat/server/push"
 	"github.com/tinode/chat/server/store"
 	t "github.com/tinode/chat/server/store/types"
@@ -104,41 +101,12 @@ func (Handler) Init(jsonconf string) error {
 	return nil
 }
 
-func payloadToData(pl *push.Payload) (map[string]string, error) {
-	if pl == nil {
-		return nil, nil
-	}
-
-	data := make(map[string]string)
-	var err error
-	data["topic"] = pl.Topic
-	// Must use "xfrom" because "from" is a reserved word.
-	// Google did not bother to document it anywhere.
-	data["xfrom"] = pl.From
-	data["ts"] = pl.Timestamp.Format(time.RFC3339Nano)
-	data["seq"] = strconv.Itoa(pl.SeqId)
-	data["mime"] = pl.ContentType
-	data["content"], err = drafty.ToPlainText(pl.Content)
-	if err != nil {
-		return nil, err
-	}
-
-	// Trim long strings to 80 runes.
-	// Check byte length first and don't waste time converting short strings.
-	if len(data["content"]) > 80 {
-		runes := []rune(data["content"])
-		if len(runes) > 80 {
-			data["content"] = string(runes[:80]) + "…"
-		}
-	}
-
-	return data, nil
-}
-
 func sendNotifications(rcpt *push.Receipt, config *configType) {
+	defer rcpt.Done()
+
 	ctx := context.Background()
 
-	data, _ := payloadToData(&rcpt.Payload)
+	data, _ := push.PayloadToData(&rcpt.Payload)
 	if data == nil || data["content"] == "" {
 		log.Println("fcm push: could not parse payload or empty payload")
 		return
@@ -167,9 +135,17 @@ func sendNotifications(rcpt *push.Receipt, config *configType) {
 		return
 	}
 
+	// Recipients and devices which got the notification, to skip them when retrying.
+	done := make(map[t.Uid]bool)
+	delivered := make(map[t.Uid][]string)
+
 	for uid, devList := range devices {
 		for i := range devList {
 			d := &devList[i]
+			// Web Push subscriptions and APNs tokens are not FCM tokens.
+			if d.Platform == push.PlatformWebPush || d.Platform == push.PlatformAPNs {
+				continue
+			}
 			if _, ok := skipDevices[d.DeviceId]; !ok && d.DeviceId != "" {
 				msg := fcm.Message{
 					Token: d.DeviceId,
@@ -235,8 +211,9 @@ func sendNotifications(rcpt *push.Receipt, config *configType) {
 						fcm.IsServerUnavailable(err) ||
 						fcm.IsInternal(err) ||
 						fcm.IsUnknown(err) {
-						// Transient errors. Stop sending this batch.
+						// Transient errors. Stop sending this batch and retry the rest later.
 						log.Println("fcm transient failure", err)
+						push.Retry("fcm", rcpt.Undelivered(done, delivered))
 						return
 					}
 
@@ -253,9 +230,12 @@ func sendNotifications(rcpt *push.Receipt, config *configType) {
 					} else {
 						log.Println("fcm push:", err)
 					}
+				} else {
+					delivered[uid] = append(delivered[uid], d.DeviceId)
 				}
 			}
 		}
+		done[uid] = true
 	}
 }
 
@@ -0,0 +1,338 @@
+// Package http implements push notification plugin which posts notifications as JSON to
+// configured HTTP endpoints (webhooks). It allows routing notifications through an external
+// notification service without writing a handler for it.
+package http
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	nethttp "net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/push"
+)
+
+var handler Handler
+
+const (
+	// Size of the input channel buffer.
+	defaultBuffer = 32
+	// How long to collect receipts before posting them, milliseconds.
+	defaultBatchWindow = 500
+	// Max number of receipts in one request.
+	defaultBatchSize = 100
+	// Timeout of one request, seconds.
+	defaultTimeout = 10
+	// Number of delivery attempts before the batch is written to dead-letter log.
+	defaultMaxAttempts = 5
+	// Delay before the first retry, seconds. It's doubled after each failed attempt.
+	defaultRetryBackoff = 1
+	// Maximum delay between retries.
+	maxRetryBackoff = 5 * time.Minute
+
+	// Header with HMAC-SHA256 signature of the request: "sha256=<hex digest>".
+	signatureHeader = "X-Tinode-Signature"
+	// Header with the Unix time when the request was signed. It's included in the signature.
+	timestampHeader = "X-Tinode-Timestamp"
+)
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input chan *push.Receipt
+	stop  chan bool
+	// Closed when the pending batch is flushed after stop.
+	done chan bool
+
+	config *configType
+	client *nethttp.Client
+
+	// Dead-letter log.
+	deadLetterLock sync.Mutex
+	deadLetter     *os.File
+}
+
+type endpointType struct {
+	// URL to POST notifications to.
+	URL string `json:"url"`
+	// Secret for signing requests. Requests are not signed if blank.
+	Secret string `json:"secret"`
+	// Additional request headers, like Authorization.
+	Headers map[string]string `json:"headers"`
+}
+
+type configType struct {
+	Enabled   bool           `json:"enabled"`
+	Buffer    int            `json:"buffer"`
+	Endpoints []endpointType `json:"endpoints"`
+	// Collect receipts for this many milliseconds and post them in one request.
+	BatchWindow int `json:"batch_window"`
+	// Post the batch as soon as it has this many receipts.
+	BatchSize int `json:"batch_size"`
+	// Request timeout in seconds.
+	Timeout int `json:"timeout"`
+	// Number of attempts to deliver the batch.
+	MaxAttempts int `json:"max_attempts"`
+	// Delay before the first retry in seconds.
+	RetryBackoff int `json:"retry_backoff"`
+	// File to append undeliverable batches to. Batches are written to the server log if missing.
+	DeadLetterLog string `json:"dead_letter_log"`
+}
+
+// Wire format of the receipt. Receipt.To is indexed by Uid which is not a string.
+type receipt struct {
+	To      map[string]push.Recipient `json:"to"`
+	Payload push.Payload              `json:"payload"`
+}
+
+// batch is the body of the request.
+type batch struct {
+	Receipts []receipt `json:"receipts"`
+}
+
+// Init initializes the push handler
+func (*Handler) Init(jsonconf string) error {
+
+	var config configType
+	err := json.Unmarshal([]byte(jsonconf), &config)
+	if err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return nil
+	}
+
+	if len(config.Endpoints) == 0 {
+		return errors.New("no endpoints configured")
+	}
+	for _, ep := range config.Endpoints {
+		if ep.URL == "" {
+			return errors.New("missing endpoint URL")
+		}
+	}
+
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+	if config.BatchWindow <= 0 {
+		config.BatchWindow = defaultBatchWindow
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	// The queue hands over no more than max_in_flight receipts until they are released, a larger batch
+	// would never fill up.
+	if max := push.MaxInFlight(); config.BatchSize > max {
+		log.Printf("http push: batch_size %d exceeds push queue max_in_flight, reduced to %d", config.BatchSize, max)
+		config.BatchSize = max
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultMaxAttempts
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = defaultRetryBackoff
+	}
+
+	if config.DeadLetterLog != "" {
+		handler.deadLetter, err = os.OpenFile(config.DeadLetterLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+		if err != nil {
+			return err
+		}
+	}
+
+	handler.config = &config
+	handler.client = &nethttp.Client{Timeout: time.Duration(config.Timeout) * time.Second}
+	handler.input = make(chan *push.Receipt, config.Buffer)
+	handler.stop = make(chan bool, 1)
+	handler.done = make(chan bool)
+
+	go batcher()
+
+	return nil
+}
+
+// batcher collects receipts into batches and hands them over for delivery.
+func batcher() {
+	var pending []receipt
+	// Receipts in the pending batch, released when the batch is handed over for delivery.
+	var received []*push.Receipt
+	// Timer is started when the first receipt of the batch arrives.
+	var timer *time.Timer
+	var timeout <-chan time.Time
+
+	flush := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, timeout = nil, nil
+		}
+		if len(pending) == 0 {
+			return
+		}
+		body, err := json.Marshal(&batch{Receipts: pending})
+		// The batch is owned by deliver from now on: it retries failed requests and
+		// writes undeliverable batches to the dead-letter log. Release the queue slots.
+		for _, rcpt := range received {
+			rcpt.Done()
+		}
+		pending, received = nil, nil
+		if err != nil {
+			log.Println("http push: failed to serialize batch", err)
+			return
+		}
+		for i := range handler.config.Endpoints {
+			go deliver(&handler.config.Endpoints[i], body)
+		}
+	}
+
+	for {
+		select {
+		case rcpt := <-handler.input:
+			pending = append(pending, toWire(rcpt))
+			received = append(received, rcpt)
+			if len(pending) >= handler.config.BatchSize {
+				flush()
+			} else if timer == nil {
+				timer = time.NewTimer(time.Duration(handler.config.BatchWindow) * time.Millisecond)
+				timeout = timer.C
+			}
+		case <-timeout:
+			timer, timeout = nil, nil
+			flush()
+		case <-handler.stop:
+			// Don't lose the pending batch. Retries of failed deliveries are abandoned.
+			flush()
+			close(handler.done)
+			return
+		}
+	}
+}
+
+func toWire(rcpt *push.Receipt) receipt {
+	to := make(map[string]push.Recipient, len(rcpt.To))
+	for uid, r := range rcpt.To {
+		to[uid.UserId()] = r
+	}
+	return receipt{To: to, Payload: rcpt.Payload}
+}
+
+// deliver posts the batch to the endpoint retrying failed attempts with exponential backoff.
+// Undeliverable batches are written to the dead-letter log.
+func deliver(ep *endpointType, body []byte) {
+	backoff := time.Duration(handler.config.RetryBackoff) * time.Second
+	var err error
+	attempt := 1
+	for ; attempt <= handler.config.MaxAttempts; attempt++ {
+		var retry bool
+		if retry, err = post(ep, body); err == nil {
+			return
+		}
+		if !retry {
+			break
+		}
+		if attempt < handler.config.MaxAttempts {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+		}
+	}
+	if attempt > handler.config.MaxAttempts {
+		attempt = handler.config.MaxAttempts
+	}
+	deadLetter(ep.URL, body, attempt, err)
+}
+
+// post sends one request. Returns an error if delivery failed and whether it's worth retrying.
+func post(ep *endpointType, body []byte) (bool, error) {
+	req, err := nethttp.NewRequest(nethttp.MethodPost, ep.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	for k, v := range ep.Headers {
+		req.Header.Set(k, v)
+	}
+	if ep.Secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(timestampHeader, ts)
+		req.Header.Set(signatureHeader, "sha256="+sign(ep.Secret, ts, body))
+	}
+
+	resp, err := handler.client.Do(req)
+	if err != nil {
+		// Network errors are transient.
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = errors.New("endpoint responded with " + resp.Status)
+	// Server errors, throttling and timeouts are transient, other client errors are not.
+	return resp.StatusCode >= 500 || resp.StatusCode == nethttp.StatusTooManyRequests ||
+		resp.StatusCode == nethttp.StatusRequestTimeout, err
+}
+
+// sign calculates HMAC-SHA256 of the timestamp and the body: hex(HMAC(secret, timestamp + "." + body)).
+func sign(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetter records the undeliverable batch.
+func deadLetter(url string, body []byte, attempts int, err error) {
+	rec, _ := json.Marshal(map[string]interface{}{
+		"ts":       time.Now().UTC().Format(time.RFC3339),
+		"url":      url,
+		"attempts": attempts,
+		"error":    err.Error(),
+		"body":     json.RawMessage(body),
+	})
+
+	if handler.deadLetter == nil {
+		log.Println("http push: undeliverable batch", string(rec))
+		return
+	}
+
+	handler.deadLetterLock.Lock()
+	defer handler.deadLetterLock.Unlock()
+	if _, werr := handler.deadLetter.Write(append(rec, '\n')); werr != nil {
+		log.Println("http push: failed to write dead-letter log", werr, string(rec))
+	}
+}
+
+// IsReady checks if the push handler has been initialized.
+func (*Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (*Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Stop shuts down the handler
+func (*Handler) Stop() {
+	handler.stop <- true
+	<-handler.done
+}
+
+func init() {
+	push.Register("http", &handler)
+}
@@ -4,8 +4,10 @@ package push
 import (
 	"encoding/json"
 	"errors"
+	"strconv"
 	"time"
 
+	"github.com/tinode/chat/server/drafty"
 	t "github.com/tinode/chat/server/store/types"
 )
 
@@ -17,6 +19,10 @@ type Recipient struct {
 	Devices []string `json:"devices,omitempty"`
 	// Unread count to include in the push
 	Unread int `json:"unread"`
+	// The recipient muted the topic.
+	Muted bool `json:"-"`
+	// The recipient is mentioned in the message.
+	Mentioned bool `json:"-"`
 }
 
 // Receipt is the push payload with a list of recipients.
@@ -25,6 +31,39 @@ type Receipt struct {
 	To map[t.Uid]Recipient `json:"to"`
 	// Actual content to be delivered to the client
 	Payload Payload `json:"payload"`
+	// Number of failed delivery attempts so far.
+	Attempts int `json:"-"`
+
+	// Called by Done.
+	done func()
+}
+
+// Done must be called by the handler when it's finished with the receipt: the notification was
+// delivered, abandoned or scheduled for retry by Retry. The queue keeps the receipt saved until then.
+func (r *Receipt) Done() {
+	if r.done != nil {
+		r.done()
+	}
+}
+
+// Undelivered creates a receipt for retrying delivery after a transient failure. Recipients
+// in done are excluded, devices in delivered are added to the list of devices to skip.
+func (r *Receipt) Undelivered(done map[t.Uid]bool, delivered map[t.Uid][]string) *Receipt {
+	retry := &Receipt{
+		To:       make(map[t.Uid]Recipient),
+		Payload:  r.Payload,
+		Attempts: r.Attempts,
+	}
+	for uid, to := range r.To {
+		if done[uid] {
+			continue
+		}
+		if len(delivered[uid]) > 0 {
+			to.Devices = append(append([]string{}, to.Devices...), delivered[uid]...)
+		}
+		retry.To[uid] = to
+	}
+	return retry
 }
 
 // Payload is content of the push.
@@ -43,6 +82,48 @@ type Payload struct {
 	Content interface{} `json:"content,omitempty"`
 }
 
+// PayloadToData converts the payload to the custom data of a notification. The same fields are
+// sent by all handlers so the client can handle notifications from any of them. The content is
+// converted to plain text and trimmed to 80 characters.
+func PayloadToData(pl *Payload) (map[string]string, error) {
+	if pl == nil {
+		return nil, nil
+	}
+
+	data := make(map[string]string)
+	var err error
+	data["topic"] = pl.Topic
+	// Must use "xfrom" because "from" is a reserved word in FCM.
+	// Google did not bother to document it anywhere.
+	data["xfrom"] = pl.From
+	data["ts"] = pl.Timestamp.Format(time.RFC3339Nano)
+	data["seq"] = strconv.Itoa(pl.SeqId)
+	data["mime"] = pl.ContentType
+	data["content"], err = drafty.ToPlainText(pl.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	// Trim long strings to 80 runes.
+	// Check byte length first and don't waste time converting short strings.
+	if len(data["content"]) > 80 {
+		runes := []rune(data["content"])
+		if len(runes) > 80 {
+			data["content"] = string(runes[:80]) + "…"
+		}
+	}
+
+	return data, nil
+}
+
+// Platforms of devices which are not registration tokens issued by FCM.
+const (
+	// Web Push subscription.
+	PlatformWebPush = "webpush"
+	// APNs device token.
+	PlatformAPNs = "apns"
+)
+
 // Handler is an interface which must be implemented by handlers.
 type Handler interface {
 	// Init initializes the handler.
@@ -52,7 +133,7 @@ type Handler interface {
 	IsReady() bool
 
 	// Push returns a channel that the server will use to send messages to.
-	// The message will be dropped if the channel blocks.
+	// The handler must call Receipt.Done when it's finished with each received message.
 	Push() chan<- *Receipt
 
 	// Stop terminates the handler's worker and stops sending pushes.
@@ -81,14 +162,19 @@ func Register(name string, hnd Handler) {
 	handlers[name] = hnd
 }
 
-// Init initializes registered handlers.
-func Init(jsconfig string) error {
+// Init initializes registered handlers and the queues which feed them.
+func Init(jsconfig, jsqueue string) error {
 	var config []configType
 
 	if err := json.Unmarshal([]byte(jsconfig), &config); err != nil {
 		return errors.New("failed to parse config: " + err.Error())
 	}
 
+	// Queue config is parsed first: handlers may need to know the limits of their queues.
+	if err := parseQueueConfig(jsqueue); err != nil {
+		return err
+	}
+
 	for _, cc := range config {
 		if hnd := handlers[cc.Name]; hnd != nil {
 			if err := hnd.Init(string(cc.Config)); err != nil {
@@ -97,30 +183,25 @@ func Init(jsconfig string) error {
 		}
 	}
 
-	return nil
+	return startQueues()
 }
 
 // Push a single message
 func Push(msg *Receipt) {
-	if handlers == nil {
-		return
-	}
-
-	for _, hnd := range handlers {
-		if !hnd.IsReady() {
-			continue
-		}
-
-		// Push without delay or skip
-		select {
-		case hnd.Push() <- msg:
-		default:
+	for _, q := range queues {
+		// Enqueue without delay or count as dropped if the queue is full.
+		if !q.add(msg, 0) {
+			statDropped.Add(1)
 		}
 	}
 }
 
 // Stop all pushes
 func Stop() {
+	for _, q := range queues {
+		q.shutdown()
+	}
+
 	if handlers == nil {
 		return
 	}
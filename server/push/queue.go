@@ -0,0 +1,453 @@
+package push
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	t "github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Max number of receipts waiting for each handler.
+	defaultQueueSize = 8192
+	// Max number of receipts processed by each handler concurrently.
+	defaultMaxInFlight = 64
+	// Number of delivery attempts before the receipt is abandoned.
+	defaultMaxAttempts = 5
+	// Delay before the first retry, seconds. It's doubled after each failed attempt.
+	defaultRetryBackoff = 5
+	// Maximum delay between retries.
+	maxRetryBackoff = 10 * time.Minute
+)
+
+// Push queue metrics.
+var (
+	// Number of receipts currently in queues, including those waiting for retry.
+	statQueued = expvar.NewInt("PushQueued")
+	// Number of receipts handed over to handlers.
+	statSent = expvar.NewInt("PushSent")
+	// Number of receipts rejected because the queue was full.
+	statDropped = expvar.NewInt("PushDropped")
+	// Number of receipts abandoned after exhausting delivery attempts.
+	statFailed = expvar.NewInt("PushFailed")
+)
+
+type queueConfigType struct {
+	// Directory where queued receipts are saved to survive restarts. Queues are kept
+	// in memory only if blank.
+	Dir string `json:"dir"`
+	// Max number of receipts waiting for each handler.
+	MaxSize int `json:"max_size"`
+	// Max number of receipts processed by each handler concurrently.
+	MaxInFlight int `json:"max_in_flight"`
+	// Number of delivery attempts before the receipt is abandoned.
+	MaxAttempts int `json:"max_attempts"`
+	// Delay before the first retry in seconds.
+	RetryBackoff int `json:"retry_backoff"`
+}
+
+// queue is a bounded, optionally persistent, queue of receipts for one handler.
+type queue struct {
+	name   string
+	hnd    Handler
+	config *queueConfigType
+	// Directory with saved receipts of this handler.
+	dir string
+
+	lock sync.Mutex
+	// Receipts ready for delivery.
+	ready *list.List
+	// Number of receipts waiting for retry.
+	delayed int
+	stopped bool
+
+	// Notifies dispatcher that a receipt is ready.
+	signal chan bool
+	// Receipts to be saved to disk.
+	unsaved chan *entry
+	// Slots for receipts processed by the handler.
+	inFlight chan bool
+	stop     chan bool
+	done     chan bool
+	saved    chan bool
+}
+
+// entry is a receipt in the queue.
+type entry struct {
+	rcpt *Receipt
+	// Name of the file with the saved receipt, blank if not saved (yet).
+	file string
+	// The handler is finished with the receipt.
+	acked bool
+}
+
+// storedReceipt is the receipt as saved to disk. Receipt.To is indexed by Uid which is not a string.
+type storedReceipt struct {
+	Attempts int                  `json:"attempts"`
+	To       map[string]Recipient `json:"to"`
+	Payload  Payload              `json:"payload"`
+}
+
+var queues map[string]*queue
+
+var queueConfig *queueConfigType
+
+// Sequence number to make file names unique.
+var fileSeq uint64
+
+// parseQueueConfig parses queue config and fills in the defaults.
+func parseQueueConfig(jsconfig string) error {
+	var config queueConfigType
+	if jsconfig != "" {
+		if err := json.Unmarshal([]byte(jsconfig), &config); err != nil {
+			return errors.New("failed to parse queue config: " + err.Error())
+		}
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = defaultQueueSize
+	}
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = defaultMaxInFlight
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultMaxAttempts
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = defaultRetryBackoff
+	}
+	queueConfig = &config
+	return nil
+}
+
+// MaxInFlight returns the max number of receipts each handler may be processing at the same time:
+// receipts handed over to the handler until it calls Receipt.Done.
+func MaxInFlight() int {
+	if queueConfig == nil {
+		return defaultMaxInFlight
+	}
+	return queueConfig.MaxInFlight
+}
+
+// startQueues creates queues for ready handlers and loads saved receipts.
+func startQueues() error {
+	config := queueConfig
+	queues = make(map[string]*queue)
+	for name, hnd := range handlers {
+		if !hnd.IsReady() {
+			continue
+		}
+
+		q := &queue{
+			name:     name,
+			hnd:      hnd,
+			config:   config,
+			ready:    list.New(),
+			signal:   make(chan bool, 1),
+			inFlight: make(chan bool, config.MaxInFlight),
+			stop:     make(chan bool),
+			done:     make(chan bool),
+			saved:    make(chan bool),
+		}
+		if config.Dir != "" {
+			q.dir = filepath.Join(config.Dir, name)
+			if err := os.MkdirAll(q.dir, 0700); err != nil {
+				return err
+			}
+			if err := q.load(); err != nil {
+				return err
+			}
+			q.unsaved = make(chan *entry, config.MaxSize)
+			go q.persist()
+		} else {
+			close(q.saved)
+		}
+		queues[name] = q
+		go q.dispatch()
+	}
+	return nil
+}
+
+// load reads receipts saved before the restart.
+func (q *queue) load() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	// File names start with the timestamp, so sorting restores the order.
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		file := filepath.Join(q.dir, fi.Name())
+		rcpt, err := readReceipt(file)
+		if err != nil || q.ready.Len() >= q.config.MaxSize {
+			if err != nil {
+				log.Println("push queue: failed to load receipt", file, err)
+			}
+			statDropped.Add(1)
+			os.Remove(file)
+			continue
+		}
+		q.ready.PushBack(&entry{rcpt: rcpt, file: file})
+		statQueued.Add(1)
+	}
+
+	if q.ready.Len() > 0 {
+		log.Printf("push queue: loaded %d receipts for '%s'", q.ready.Len(), q.name)
+		q.signal <- true
+	}
+	return nil
+}
+
+// add appends the receipt to the queue. If delay is not zero, the receipt becomes ready
+// for delivery after the delay.
+func (q *queue) add(rcpt *Receipt, delay time.Duration) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.stopped || q.ready.Len()+q.delayed >= q.config.MaxSize {
+		return false
+	}
+
+	e := &entry{rcpt: rcpt}
+	if q.unsaved != nil {
+		// Save in background to avoid blocking the caller on disk I/O.
+		select {
+		case q.unsaved <- e:
+		default:
+			// Still deliver it, just not durably.
+			log.Println("push queue: too many receipts to save", q.name)
+		}
+	}
+	statQueued.Add(1)
+
+	if delay <= 0 {
+		q.ready.PushBack(e)
+		q.notify()
+		return true
+	}
+
+	q.delayed++
+	time.AfterFunc(delay, func() {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+
+		q.delayed--
+		if q.stopped {
+			// The receipt remains saved and will be loaded after restart.
+			statQueued.Add(-1)
+			return
+		}
+		q.ready.PushBack(e)
+		q.notify()
+	})
+	return true
+}
+
+// notify wakes up the dispatcher. Must be called with the lock held.
+func (q *queue) notify() {
+	select {
+	case q.signal <- true:
+	default:
+	}
+}
+
+// dispatch hands over receipts to the handler one by one. It blocks when the handler
+// is busy or is processing too many receipts instead of dropping receipts.
+func (q *queue) dispatch() {
+	defer close(q.done)
+
+	for {
+		q.lock.Lock()
+		front := q.ready.Front()
+		if front != nil {
+			q.ready.Remove(front)
+		}
+		q.lock.Unlock()
+
+		if front == nil {
+			select {
+			case <-q.signal:
+				continue
+			case <-q.stop:
+				return
+			}
+		}
+
+		e := front.Value.(*entry)
+		select {
+		case q.inFlight <- true:
+		case <-q.stop:
+			// The entry remains saved.
+			statQueued.Add(-1)
+			return
+		}
+
+		// The same receipt may be queued for several handlers, use a copy.
+		rcpt := *e.rcpt
+		rcpt.done = func() { q.ack(e) }
+		select {
+		case q.hnd.Push() <- &rcpt:
+			statSent.Add(1)
+			statQueued.Add(-1)
+		case <-q.stop:
+			<-q.inFlight
+			statQueued.Add(-1)
+			return
+		}
+	}
+}
+
+// ack is called when the handler is finished with the receipt. It releases the slot and deletes
+// the saved receipt.
+func (q *queue) ack(e *entry) {
+	q.lock.Lock()
+	if e.acked {
+		q.lock.Unlock()
+		return
+	}
+	e.acked = true
+	file := e.file
+	q.lock.Unlock()
+
+	<-q.inFlight
+	if file != "" {
+		os.Remove(file)
+	}
+}
+
+// persist saves receipts to disk until the queue is stopped.
+func (q *queue) persist() {
+	defer close(q.saved)
+
+	for e := range q.unsaved {
+		q.lock.Lock()
+		acked := e.acked
+		q.lock.Unlock()
+		if acked {
+			// Already processed, no need to save.
+			continue
+		}
+
+		file, err := q.save(e.rcpt)
+		if err != nil {
+			log.Println("push queue: failed to save receipt", q.name, err)
+			continue
+		}
+
+		q.lock.Lock()
+		if e.acked {
+			q.lock.Unlock()
+			os.Remove(file)
+			continue
+		}
+		e.file = file
+		q.lock.Unlock()
+	}
+}
+
+// shutdown stops the dispatcher. Receipts which are still queued remain saved.
+func (q *queue) shutdown() {
+	q.lock.Lock()
+	q.stopped = true
+	statQueued.Add(-int64(q.ready.Len()))
+	if q.unsaved != nil {
+		// Save what's pending.
+		close(q.unsaved)
+	}
+	q.lock.Unlock()
+
+	close(q.stop)
+	<-q.done
+	<-q.saved
+}
+
+// save writes the receipt to a new file in the queue directory.
+func (q *queue) save(rcpt *Receipt) (string, error) {
+	stored := storedReceipt{
+		Attempts: rcpt.Attempts,
+		To:       make(map[string]Recipient, len(rcpt.To)),
+		Payload:  rcpt.Payload,
+	}
+	for uid, r := range rcpt.To {
+		stored.To[uid.String()] = r
+	}
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return "", err
+	}
+
+	name := strconv.FormatInt(time.Now().UnixNano(), 10) + "-" +
+		strconv.FormatUint(atomic.AddUint64(&fileSeq, 1), 10)
+	file := filepath.Join(q.dir, name+".json")
+	// Write to a temp file first so a crash does not leave a partially written receipt.
+	tmp := filepath.Join(q.dir, name+".tmp")
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return "", err
+	}
+	return file, os.Rename(tmp, file)
+}
+
+func readReceipt(file string) (*Receipt, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var stored storedReceipt
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	rcpt := &Receipt{
+		Attempts: stored.Attempts,
+		To:       make(map[t.Uid]Recipient, len(stored.To)),
+		Payload:  stored.Payload,
+	}
+	for id, r := range stored.To {
+		uid := t.ParseUid(id)
+		if uid.IsZero() {
+			return nil, errors.New("invalid recipient " + id)
+		}
+		rcpt.To[uid] = r
+	}
+	return rcpt, nil
+}
+
+// Retry schedules redelivery of the receipt to the handler after a transient failure.
+// The receipt should list only the recipients which did not receive the notification. Devices
+// which received it should be listed in Recipient.Devices to be skipped. The receipt is
+// abandoned when it runs out of delivery attempts.
+func Retry(name string, rcpt *Receipt) {
+	q := queues[name]
+	if q == nil || len(rcpt.To) == 0 {
+		return
+	}
+
+	rcpt.Attempts++
+	if rcpt.Attempts >= q.config.MaxAttempts {
+		statFailed.Add(1)
+		log.Printf("push queue: '%s' failed to deliver after %d attempts, topic %s", name, rcpt.Attempts, rcpt.Payload.Topic)
+		return
+	}
+
+	delay := time.Duration(q.config.RetryBackoff) * time.Second << uint(rcpt.Attempts-1)
+	if delay > maxRetryBackoff || delay <= 0 {
+		delay = maxRetryBackoff
+	}
+	if !q.add(rcpt, delay) {
+		statDropped.Add(1)
+	}
+}
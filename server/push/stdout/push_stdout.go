@@ -59,6 +59,7 @@ func (stdoutPush) Init(jsonconf string) error {
 			select {
 			case msg := <-handler.input:
 				fmt.Fprintln(os.Stdout, msg)
+				msg.Done()
 			case <-handler.stop:
 				return
 			}
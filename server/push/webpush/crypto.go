@@ -0,0 +1,196 @@
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	// Record size of the encrypted content. The entire payload is sent as a single record.
+	recordSize = 4096
+	// Size of the salt in the aes128gcm header.
+	saltSize = 16
+	// Size of the uncompressed P-256 public key.
+	publicKeySize = 65
+	// Size of the AES-GCM authentication tag.
+	tagSize = 16
+	// Max size of the plaintext which fits into one record: the record must accommodate
+	// the padding delimiter and the authentication tag.
+	maxPlaintextSize = recordSize - tagSize - 1
+)
+
+// subscription is the PushSubscription object created by the browser, as returned by PushSubscription.toJSON().
+type subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		// User agent's public key, base64url-encoded uncompressed P-256 point.
+		P256dh string `json:"p256dh"`
+		// Authentication secret, base64url-encoded.
+		Auth string `json:"auth"`
+	} `json:"keys"`
+}
+
+// parseSubscription parses and validates the subscription stored as the device ID.
+func parseSubscription(deviceID string) (*subscription, []byte, []byte, error) {
+	var sub subscription
+	if err := json.Unmarshal([]byte(deviceID), &sub); err != nil {
+		return nil, nil, nil, err
+	}
+	if !strings.HasPrefix(sub.Endpoint, "https://") {
+		return nil, nil, nil, errors.New("invalid subscription endpoint")
+	}
+	uaPublic, err := decodeBase64(sub.Keys.P256dh)
+	if err != nil || len(uaPublic) != publicKeySize {
+		return nil, nil, nil, errors.New("invalid subscription key")
+	}
+	authSecret, err := decodeBase64(sub.Keys.Auth)
+	if err != nil || len(authSecret) == 0 {
+		return nil, nil, nil, errors.New("invalid subscription auth secret")
+	}
+	return &sub, uaPublic, authSecret, nil
+}
+
+// decodeBase64 decodes base64url string with or without padding. Browsers are inconsistent.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	s = strings.NewReplacer("+", "-", "/", "_").Replace(s)
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// hkdf implements HKDF-SHA-256 (RFC 5869) for output lengths up to 32 bytes.
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	prk := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:length]
+}
+
+// encrypt encrypts the plaintext for the user agent as described in RFC 8291 using
+// aes128gcm content coding (RFC 8188).
+func encrypt(plaintext, uaPublic, authSecret []byte) ([]byte, error) {
+	if len(plaintext) > maxPlaintextSize {
+		return nil, errors.New("payload too large")
+	}
+
+	curve := ecdh.P256()
+	uaKey, err := curve.NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ephemeral application server key pair, a new one for every message.
+	asKey, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asKey.PublicKey().Bytes()
+
+	ecdhSecret, err := asKey.ECDH(uaKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// IKM = HKDF(auth_secret, ecdh_secret, "WebPush: info" || 0x00 || ua_public || as_public, 32)
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+
+	salt := make([]byte, saltSize)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Header: salt || rs || idlen || keyid, where keyid is the application server public key.
+	body := make([]byte, saltSize+4+1, saltSize+4+1+publicKeySize+len(plaintext)+1+tagSize)
+	copy(body, salt)
+	binary.BigEndian.PutUint32(body[saltSize:], recordSize)
+	body[saltSize+4] = publicKeySize
+	body = append(body, asPublic...)
+
+	// The only record is the last one: plaintext is followed by the 0x02 delimiter.
+	record := append(append([]byte{}, plaintext...), 2)
+	return gcm.Seal(body, nonce, record, nil), nil
+}
+
+// vapidKeys is the application server's key pair for VAPID (RFC 8292).
+type vapidKeys struct {
+	private *ecdsa.PrivateKey
+	// Uncompressed public key, base64url-encoded, as sent in the "k" parameter.
+	public string
+}
+
+// parseVapidKeys creates VAPID keys from the base64url-encoded private key (32 bytes) and
+// checks that it matches the public key.
+func parseVapidKeys(privateKey, publicKey string) (*vapidKeys, error) {
+	d, err := decodeBase64(privateKey)
+	if err != nil || len(d) != 32 {
+		return nil, errors.New("invalid VAPID private key")
+	}
+
+	curve := elliptic.P256()
+	priv := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	priv.PublicKey.Curve = curve
+	priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(d)
+
+	public := base64.RawURLEncoding.EncodeToString(elliptic.Marshal(curve, priv.X, priv.Y))
+	if pub, err := decodeBase64(publicKey); err != nil || base64.RawURLEncoding.EncodeToString(pub) != public {
+		return nil, errors.New("VAPID public key does not match the private key")
+	}
+
+	return &vapidKeys{private: priv, public: public}, nil
+}
+
+// token creates a signed JWT for the push service at the given origin.
+func (k *vapidKeys) token(audience, subject string, expires time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"exp": expires.Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, k.private, hash[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS uses fixed size concatenation of r and s rather than ASN.1.
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
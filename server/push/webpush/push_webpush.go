@@ -0,0 +1,281 @@
+// Package webpush implements push notification plugin for Web Push protocol (RFC 8030).
+// Notifications are sent directly to the browser's push service, encrypted as described in RFC 8291
+// and authenticated with VAPID (RFC 8292).
+package webpush
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+var handler Handler
+
+const (
+	// Size of the input channel buffer.
+	defaultBuffer = 32
+	// Time to live of the notification at the push service, seconds.
+	defaultTimeToLive = 3600
+	// Timeout of requests to push services.
+	requestTimeout = 30 * time.Second
+	// Lifetime of VAPID tokens. Must not exceed 24 hours.
+	tokenLifetime = 12 * time.Hour
+)
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input chan *push.Receipt
+	stop  chan bool
+
+	config *configType
+	keys   *vapidKeys
+	client *http.Client
+
+	// Cached VAPID tokens indexed by push service origin.
+	tokensLock sync.Mutex
+	tokens     map[string]*vapidToken
+}
+
+type vapidToken struct {
+	value   string
+	expires time.Time
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	Buffer  int  `json:"buffer"`
+	// VAPID key pair, base64url-encoded: raw 32 byte private key and uncompressed public key.
+	// The public key is used by the client as applicationServerKey when subscribing.
+	VapidPublicKey  string `json:"vapid_public_key"`
+	VapidPrivateKey string `json:"vapid_private_key"`
+	// Contact information of the server operator, "mailto:" or "https:" URL.
+	Subject string `json:"subject"`
+	// How long the push service should keep undelivered notifications, seconds.
+	TimeToLive int `json:"time_to_live,omitempty"`
+	// Urgency of notifications: "very-low", "low", "normal", "high".
+	Urgency string `json:"urgency,omitempty"`
+}
+
+// Init initializes the push handler
+func (*Handler) Init(jsonconf string) error {
+
+	var config configType
+	err := json.Unmarshal([]byte(jsonconf), &config)
+	if err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return nil
+	}
+
+	if config.VapidPrivateKey == "" || config.VapidPublicKey == "" {
+		return errors.New("missing VAPID keys")
+	}
+	if handler.keys, err = parseVapidKeys(config.VapidPrivateKey, config.VapidPublicKey); err != nil {
+		return err
+	}
+	if config.Subject == "" {
+		return errors.New("missing VAPID subject")
+	}
+
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+	if config.TimeToLive <= 0 {
+		config.TimeToLive = defaultTimeToLive
+	}
+
+	handler.config = &config
+	handler.client = &http.Client{Timeout: requestTimeout}
+	handler.tokens = make(map[string]*vapidToken)
+	handler.input = make(chan *push.Receipt, config.Buffer)
+	handler.stop = make(chan bool, 1)
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				go sendNotifications(rcpt)
+			case <-handler.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// payloadToData serializes the payload of the notification. Returns nil if the content is empty.
+func payloadToData(pl *push.Payload) ([]byte, error) {
+	data, err := push.PayloadToData(pl)
+	if err != nil || data["content"] == "" {
+		return nil, err
+	}
+	// Same fields as in FCM data messages so the service worker can handle both.
+	return json.Marshal(data)
+}
+
+func sendNotifications(rcpt *push.Receipt) {
+	defer rcpt.Done()
+
+	data, err := payloadToData(&rcpt.Payload)
+	if err != nil || data == nil {
+		log.Println("webpush: could not parse payload or empty payload", err)
+		return
+	}
+
+	// List of UIDs for querying the database
+	uids := make([]t.Uid, 0, len(rcpt.To))
+	skipDevices := make(map[string]bool)
+	for uid, to := range rcpt.To {
+		uids = append(uids, uid)
+
+		// Some devices were online and received the message. Skip them.
+		for _, deviceID := range to.Devices {
+			skipDevices[deviceID] = true
+		}
+	}
+
+	devices, count, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		log.Println("webpush: db error", err)
+		return
+	}
+	if count == 0 {
+		return
+	}
+
+	// Recipients and devices which got the notification, to skip them when retrying.
+	done := make(map[t.Uid]bool)
+	delivered := make(map[t.Uid][]string)
+
+	for uid, devList := range devices {
+		for i := range devList {
+			d := &devList[i]
+			if d.Platform != push.PlatformWebPush || skipDevices[d.DeviceId] {
+				continue
+			}
+
+			sub, uaPublic, authSecret, err := parseSubscription(d.DeviceId)
+			if err != nil {
+				// Garbage instead of a subscription. It will never work.
+				store.Devices.Delete(uid, d.DeviceId)
+				log.Println("webpush: invalid subscription", err)
+				continue
+			}
+
+			status, err := send(sub.Endpoint, data, uaPublic, authSecret)
+			if err != nil {
+				log.Println("webpush:", err)
+				continue
+			}
+
+			switch {
+			case status == http.StatusNotFound || status == http.StatusGone:
+				// Subscription expired or was cancelled by the user.
+				store.Devices.Delete(uid, d.DeviceId)
+				log.Println("webpush: subscription expired", uid.UserId())
+			case status == http.StatusTooManyRequests || status >= 500:
+				// Transient errors. Stop sending this batch and retry the rest later.
+				log.Println("webpush: transient failure", status)
+				push.Retry("webpush", rcpt.Undelivered(done, delivered))
+				return
+			case status >= 300:
+				log.Println("webpush: failed", status)
+			default:
+				delivered[uid] = append(delivered[uid], d.DeviceId)
+			}
+		}
+		done[uid] = true
+	}
+}
+
+// send encrypts the payload and posts it to the push service. Returns HTTP status code.
+func send(endpoint string, data, uaPublic, authSecret []byte) (int, error) {
+	body, err := encrypt(data, uaPublic, authSecret)
+	if err != nil {
+		return 0, err
+	}
+
+	token, err := getToken(endpoint)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(handler.config.TimeToLive))
+	if handler.config.Urgency != "" {
+		req.Header.Set("Urgency", handler.config.Urgency)
+	}
+	req.Header.Set("Authorization", "vapid t="+token+", k="+handler.keys.public)
+
+	resp, err := handler.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+// getToken returns a cached VAPID token for the origin of the endpoint or creates a new one.
+func getToken(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	audience := u.Scheme + "://" + u.Host
+
+	handler.tokensLock.Lock()
+	defer handler.tokensLock.Unlock()
+
+	now := time.Now()
+	// Refresh tokens well before they expire.
+	if tok := handler.tokens[audience]; tok != nil && tok.expires.After(now.Add(tokenLifetime/2)) {
+		return tok.value, nil
+	}
+
+	expires := now.Add(tokenLifetime)
+	value, err := handler.keys.token(audience, handler.config.Subject, expires)
+	if err != nil {
+		return "", err
+	}
+	handler.tokens[audience] = &vapidToken{value: value, expires: expires}
+	return value, nil
+}
+
+// IsReady checks if the push handler has been initialized.
+func (*Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (*Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Stop shuts down the handler
+func (*Handler) Stop() {
+	handler.stop <- true
+}
+
+func init() {
+	push.Register("webpush", &handler)
+}
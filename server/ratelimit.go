@@ -0,0 +1,326 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Token bucket rate limiting of client messages, per session and per user.
+ *    Per-user buckets are kept at the user's master node in the cluster. Other nodes
+ *    lease tokens from the master in batches.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// How often to remove idle user buckets and leases.
+const rateLimitGcPeriod = time.Minute
+
+// Tokens are leased from the master node in batches of this fraction of the burst size.
+const rateLimitLeaseFraction = 4
+
+// Types of messages which can be rate limited.
+var rateLimitedMessages = []string{"pub", "sub", "get", "set", "note", "acc", "login"}
+
+// rateLimitRule is a configuration of a single token bucket.
+type rateLimitRule struct {
+	// Number of tokens added to the bucket per second.
+	Rate float64 `json:"rate"`
+	// Maximum number of tokens in the bucket, i.e. the size of the allowed burst.
+	Burst int `json:"burst"`
+}
+
+// rateLimitConfig is the configuration of rate limits indexed by message type, i.e. "pub".
+type rateLimitConfig struct {
+	// Limits applied to each session individually.
+	Session map[string]*rateLimitRule `json:"session"`
+	// Limits applied to each user across all user's sessions on all cluster nodes.
+	User map[string]*rateLimitRule `json:"user"`
+}
+
+// tokenBucket is a state of a single token bucket.
+type tokenBucket struct {
+	// Number of available tokens.
+	tokens float64
+	// Time when the number of tokens was last updated.
+	updated time.Time
+	// Time when the bucket becomes full and can be discarded.
+	full time.Time
+}
+
+// rateLimiter is a collection of token buckets indexed by an arbitrary key.
+type rateLimiter struct {
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// take consumes up to count whole tokens from the bucket. Returns the number of consumed tokens
+// and, if none were available, the time to wait until a token becomes available.
+func (rl *rateLimiter) take(key string, rule *rateLimitRule, count int, now time.Time) (int, time.Duration) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	b := rl.refill(key, rule, now)
+	taken := int(math.Min(float64(count), math.Floor(b.tokens)))
+	if taken <= 0 {
+		return 0, b.wait(rule)
+	}
+	b.tokens -= float64(taken)
+	b.full = now.Add(time.Duration((float64(rule.Burst) - b.tokens) / rule.Rate * float64(time.Second)))
+
+	return taken, 0
+}
+
+// peek returns the time to wait until a token becomes available, zero if it's available now.
+// The token is not consumed.
+func (rl *rateLimiter) peek(key string, rule *rateLimitRule, now time.Time) time.Duration {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if b := rl.buckets[key]; b != nil {
+		return rl.refill(key, rule, now).wait(rule)
+	}
+	return 0
+}
+
+// refill adds tokens accumulated since the last update. Creates a full bucket if it does not exist.
+func (rl *rateLimiter) refill(key string, rule *rateLimitRule, now time.Time) *tokenBucket {
+	b := rl.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(rule.Burst), full: now}
+		rl.buckets[key] = b
+	} else if now.After(b.updated) {
+		b.tokens = math.Min(float64(rule.Burst), b.tokens+now.Sub(b.updated).Seconds()*rule.Rate)
+	}
+	b.updated = now
+	return b
+}
+
+// wait returns the time to wait until a token becomes available.
+func (b *tokenBucket) wait(rule *rateLimitRule) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rule.Rate * float64(time.Second))
+}
+
+// expire removes buckets which are full: they are indistinguishable from the new ones.
+func (rl *rateLimiter) expire(now time.Time) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	for key, b := range rl.buckets {
+		if b.full.Before(now) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// rateLease is a batch of tokens leased from the user's master node.
+type rateLease struct {
+	// Number of tokens left.
+	tokens int
+	// The master node refused to grant tokens until this time.
+	retry time.Time
+	// Time when the lease was last used.
+	updated time.Time
+}
+
+// rateLeases is a collection of leases indexed by an arbitrary key.
+type rateLeases struct {
+	lock   sync.Mutex
+	leases map[string]*rateLease
+}
+
+func newRateLeases() *rateLeases {
+	return &rateLeases{leases: make(map[string]*rateLease)}
+}
+
+// take consumes a leased token. If no tokens are left, calls fetch to lease up to size more.
+// Refusals are cached: fetch is not called again until the returned wait time passes.
+// Returns zero if the token was available or the time to wait otherwise.
+func (rl *rateLeases) take(key string, size int, now time.Time,
+	fetch func(count int) (int, time.Duration, error)) (time.Duration, error) {
+
+	rl.lock.Lock()
+	l := rl.leases[key]
+	if l == nil {
+		l = &rateLease{}
+		rl.leases[key] = l
+	}
+	l.updated = now
+	if l.tokens > 0 {
+		l.tokens--
+		rl.lock.Unlock()
+		return 0, nil
+	}
+	if now.Before(l.retry) {
+		rl.lock.Unlock()
+		return l.retry.Sub(now), nil
+	}
+	rl.lock.Unlock()
+
+	// Don't hold the lock while waiting for the master node.
+	granted, wait, err := fetch(size)
+	if err != nil {
+		return 0, err
+	}
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if granted <= 0 {
+		l.retry = now.Add(wait)
+		return wait, nil
+	}
+	l.tokens += granted - 1
+	return 0, nil
+}
+
+// expire removes leases which were not used for the given time. Unused leased tokens are lost.
+func (rl *rateLeases) expire(olderThan time.Time) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	for key, l := range rl.leases {
+		if l.updated.Before(olderThan) {
+			delete(rl.leases, key)
+		}
+	}
+}
+
+// rateLimitInit validates the configuration and starts the limiter of per-user requests.
+func rateLimitInit(conf *rateLimitConfig) {
+	if conf == nil {
+		return
+	}
+
+	// Remove invalid rules and fix the burst size.
+	validate := func(rules map[string]*rateLimitRule) map[string]*rateLimitRule {
+		valid := make(map[string]*rateLimitRule)
+		for what, rule := range rules {
+			if rule == nil || rule.Rate <= 0 {
+				continue
+			}
+			if rule.Burst < 1 {
+				rule.Burst = int(math.Max(1, math.Ceil(rule.Rate)))
+			}
+			valid[what] = rule
+		}
+		if len(valid) == 0 {
+			return nil
+		}
+		return valid
+	}
+
+	conf.Session = validate(conf.Session)
+	conf.User = validate(conf.User)
+	if conf.Session == nil && conf.User == nil {
+		return
+	}
+
+	globals.rateLimits = conf
+	if conf.User != nil {
+		globals.userRateLimiter = newRateLimiter()
+		globals.userRateLeases = newRateLeases()
+		go func() {
+			for range time.Tick(rateLimitGcPeriod) {
+				now := time.Now()
+				globals.userRateLimiter.expire(now)
+				globals.userRateLeases.expire(now.Add(-rateLimitGcPeriod))
+			}
+		}()
+	}
+
+	for _, what := range rateLimitedMessages {
+		statsRegisterInt("RateLimited" + strings.Title(what))
+	}
+
+	log.Printf("Rate limits enabled: %d per session, %d per user", len(conf.Session), len(conf.User))
+}
+
+// rateLimitUser consumes a token from the user's bucket. The bucket is kept at the user's master node,
+// other nodes use tokens leased from the master. Returns zero if the request is allowed, or the time
+// to wait otherwise.
+func rateLimitUser(uid types.Uid, what string, now time.Time) time.Duration {
+	rule := globals.rateLimits.User[what]
+	if rule == nil {
+		return 0
+	}
+
+	if globals.cluster.isRemoteTopic(uid.UserId()) {
+		size := rule.Burst / rateLimitLeaseFraction
+		if size < 1 {
+			size = 1
+		}
+		retryAfter, err := globals.userRateLeases.take(what+":"+uid.UserId(), size, now,
+			func(count int) (int, time.Duration, error) {
+				return globals.cluster.routeRateLimit(uid, what, count)
+			})
+		if err != nil {
+			// Do not block the user if the master node is unavailable.
+			log.Println("rate limit: failed to query master node", err)
+			return 0
+		}
+		return retryAfter
+	}
+
+	_, retryAfter := rateLimitUserLocal(uid, what, 1, now)
+	return retryAfter
+}
+
+// rateLimitUserLocal consumes up to count tokens from the user's bucket kept at the current node.
+// Returns the number of consumed tokens and the time to wait if none were available.
+func rateLimitUserLocal(uid types.Uid, what string, count int, now time.Time) (int, time.Duration) {
+	if globals.rateLimits == nil {
+		return count, 0
+	}
+	rule := globals.rateLimits.User[what]
+	if rule == nil {
+		return count, 0
+	}
+	return globals.userRateLimiter.take(what+":"+uid.UserId(), rule, count, now)
+}
+
+// rateLimit checks if the message is within the session's and user's rate limits.
+// Returns zero if the message is allowed, or the time to wait otherwise.
+func (s *Session) rateLimit(msg *ClientComMessage, what string) time.Duration {
+	// Messages forwarded by other cluster nodes were checked at the originating node.
+	// Internal sessions and root users are not limited.
+	if globals.rateLimits == nil || s.proto == CLUSTER || s.proto == NONE || s.authLvl == auth.LevelRoot {
+		return 0
+	}
+
+	now := time.Now()
+	// The session's token is consumed only if the user's limit is not exceeded too.
+	rule := globals.rateLimits.Session[what]
+	if rule != nil {
+		if wait := s.limiter.peek(what, rule, now); wait > 0 {
+			return wait
+		}
+	}
+
+	if msg.from != "" {
+		if wait := rateLimitUser(types.ParseUserId(msg.from), what, now); wait > 0 {
+			return wait
+		}
+	}
+
+	if rule != nil {
+		// Both limits allow the message, consume the session's token.
+		s.limiter.take(what, rule, 1, now)
+	}
+	return 0
+}
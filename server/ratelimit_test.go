@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestTokenBucket(t *testing.T) {
+	rl := newRateLimiter()
+	rule := &rateLimitRule{Rate: 2, Burst: 3}
+	now := time.Now()
+
+	// Full burst is available at once.
+	for i := 0; i < 3; i++ {
+		if taken, wait := rl.take("pub", rule, 1, now); taken != 1 || wait != 0 {
+			t.Fatalf("token %d: expected to be taken, got %d, wait %s", i, taken, wait)
+		}
+	}
+	if taken, wait := rl.take("pub", rule, 1, now); taken != 0 || wait != 500*time.Millisecond {
+		t.Errorf("empty bucket: expected wait 500ms, got %d, wait %s", taken, wait)
+	}
+
+	// Tokens are added at the rate.
+	now = now.Add(250 * time.Millisecond)
+	if wait := rl.peek("pub", rule, now); wait != 250*time.Millisecond {
+		t.Errorf("half token: expected wait 250ms, got %s", wait)
+	}
+	now = now.Add(250 * time.Millisecond)
+	if taken, _ := rl.take("pub", rule, 1, now); taken != 1 {
+		t.Errorf("refilled bucket: expected token to be taken")
+	}
+
+	// Buckets are independent.
+	if taken, _ := rl.take("get", rule, 1, now); taken != 1 {
+		t.Errorf("other bucket: expected token to be taken")
+	}
+
+	// The bucket does not grow beyond the burst size.
+	now = now.Add(time.Hour)
+	if taken, _ := rl.take("pub", rule, 10, now); taken != 3 {
+		t.Errorf("full bucket: expected 3 tokens, got %d", taken)
+	}
+}
+
+func TestTokenBucketPeek(t *testing.T) {
+	rl := newRateLimiter()
+	rule := &rateLimitRule{Rate: 1, Burst: 1}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if wait := rl.peek("pub", rule, now); wait != 0 {
+			t.Fatalf("peek %d: expected no wait, got %s", i, wait)
+		}
+	}
+	rl.take("pub", rule, 1, now)
+	if wait := rl.peek("pub", rule, now); wait != time.Second {
+		t.Errorf("expected wait 1s, got %s", wait)
+	}
+}
+
+func TestTokenBucketExpire(t *testing.T) {
+	rl := newRateLimiter()
+	rule := &rateLimitRule{Rate: 1, Burst: 2}
+	now := time.Now()
+
+	rl.take("pub", rule, 2, now)
+	rl.take("get", rule, 1, now)
+
+	rl.expire(now.Add(1500 * time.Millisecond))
+	if _, ok := rl.buckets["get"]; ok {
+		t.Errorf("full bucket 'get' not expired")
+	}
+	if _, ok := rl.buckets["pub"]; !ok {
+		t.Errorf("bucket 'pub' expired before it's full")
+	}
+}
+
+func TestRateLeases(t *testing.T) {
+	rl := newRateLeases()
+	now := time.Now()
+
+	var calls, granted int
+	var retry time.Duration
+	fetch := func(count int) (int, time.Duration, error) {
+		calls++
+		if count != 3 {
+			t.Errorf("expected request for 3 tokens, got %d", count)
+		}
+		return granted, retry, nil
+	}
+
+	// Leased tokens are used without asking the master.
+	granted = 3
+	for i := 0; i < 3; i++ {
+		if wait, _ := rl.take("pub", 3, now, fetch); wait != 0 {
+			t.Errorf("token %d: expected no wait, got %s", i, wait)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 call to master, got %d", calls)
+	}
+
+	// Refusal is cached.
+	granted, retry = 0, time.Second
+	if wait, _ := rl.take("pub", 3, now, fetch); wait != time.Second {
+		t.Errorf("expected wait 1s, got %s", wait)
+	}
+	if wait, _ := rl.take("pub", 3, now.Add(400*time.Millisecond), fetch); wait != 600*time.Millisecond {
+		t.Errorf("expected cached wait 600ms, got %s", wait)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls to master, got %d", calls)
+	}
+
+	// Retried after the wait.
+	granted = 1
+	if wait, _ := rl.take("pub", 3, now.Add(time.Second), fetch); wait != 0 || calls != 3 {
+		t.Errorf("expected no wait after retry, got %s, calls %d", wait, calls)
+	}
+
+	// Errors are reported.
+	if _, err := rl.take("get", 3, now, func(int) (int, time.Duration, error) {
+		return 0, 0, errors.New("unavailable")
+	}); err == nil {
+		t.Errorf("expected error")
+	}
+
+	rl.expire(now.Add(time.Millisecond))
+	if _, ok := rl.leases["get"]; ok {
+		t.Errorf("idle lease not expired")
+	}
+	if _, ok := rl.leases["pub"]; !ok {
+		t.Errorf("lease expired while in use")
+	}
+}
+
+func TestSessionRateLimit(t *testing.T) {
+	defer func(limits *rateLimitConfig, limiter *rateLimiter) {
+		globals.rateLimits, globals.userRateLimiter = limits, limiter
+	}(globals.rateLimits, globals.userRateLimiter)
+
+	globals.rateLimits = &rateLimitConfig{
+		Session: map[string]*rateLimitRule{"pub": {Rate: 0.001, Burst: 1}},
+		User:    map[string]*rateLimitRule{"pub": {Rate: 0.001, Burst: 2}},
+	}
+	globals.userRateLimiter = newRateLimiter()
+
+	newSession := func() *Session {
+		return &Session{proto: WEBSOCK, limiter: newRateLimiter()}
+	}
+	msg := &ClientComMessage{from: types.Uid(1).UserId()}
+	s1, s2, s3 := newSession(), newSession(), newSession()
+
+	if wait := s1.rateLimit(msg, "pub"); wait != 0 {
+		t.Fatalf("first message: expected no wait, got %s", wait)
+	}
+	// Session limit is exceeded.
+	if wait := s1.rateLimit(msg, "pub"); wait == 0 {
+		t.Errorf("session limit: expected wait")
+	}
+	if wait := s2.rateLimit(msg, "pub"); wait != 0 {
+		t.Errorf("other session: expected no wait, got %s", wait)
+	}
+	// User limit is exceeded: the token of the session is not consumed.
+	if wait := s3.rateLimit(msg, "pub"); wait == 0 {
+		t.Errorf("user limit: expected wait")
+	}
+	if wait := s3.limiter.peek("pub", globals.rateLimits.Session["pub"], time.Now()); wait != 0 {
+		t.Errorf("session token consumed when user limit is exceeded")
+	}
+
+	// Other messages and other users are not limited.
+	if wait := s1.rateLimit(msg, "get"); wait != 0 {
+		t.Errorf("message not limited: expected no wait, got %s", wait)
+	}
+	if wait := s3.rateLimit(&ClientComMessage{from: types.Uid(2).UserId()}, "pub"); wait != 0 {
+		t.Errorf("other user: expected no wait, got %s", wait)
+	}
+}
@@ -16,11 +16,14 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/tinode/chat/pbx"
 	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/msgpack"
+	"github.com/tinode/chat/server/push"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 )
@@ -32,8 +35,20 @@ const (
 	LPOLL
 	GRPC
 	CLUSTER
+	SSE
 )
 
+// Wire encoding of messages, negotiated in {hi}
+const (
+	// JSON in websocket text frames, the default
+	encodingJSON = "json"
+	// MessagePack in websocket binary frames
+	encodingMsgpack = "msgpack"
+)
+
+// msgpackFrame is a message serialized as MessagePack. It's sent in a binary websocket frame.
+type msgpackFrame []byte
+
 // Wait time before abandoning the outbound send operation.
 // Timeout is rather long to make sure it's longer than Linux preeption time:
 // https://elixir.bootlin.com/linux/latest/source/kernel/sched/fair.c#L38
@@ -55,15 +70,18 @@ type RemoteSubscription struct {
 // Session represents a single WS connection or a long polling session. A user may have multiple
 // sessions.
 type Session struct {
-	// protocol - NONE (unset), WEBSOCK, LPOLL, CLUSTER, GRPC
+	// protocol - NONE (unset), WEBSOCK, LPOLL, CLUSTER, GRPC, SSE
 	proto int
 
 	// Websocket. Set only for websocket sessions
 	ws *websocket.Conn
 
-	// Pointer to session's record in sessionStore. Set only for Long Poll sessions
+	// Pointer to session's record in sessionStore. Set only for Long Poll and SSE sessions
 	lpTracker *list.Element
 
+	// State of Server-Sent Events session. Set only for SSE sessions
+	sse *sseConn
+
 	// gRPC handle. Set only for gRPC clients
 	grpcnode pbx.Node_MessageLoopServer
 
@@ -79,10 +97,16 @@ type Session struct {
 	// Protocol version of the client: ((major & 0xff) << 8) | (minor & 0xff)
 	ver int
 
+	// 1 if MessagePack wire encoding is negotiated, 0 for JSON. MessagePack is used by websocket only.
+	// Set once in {hi} and read by other goroutines, access atomically.
+	msgpackEnc int32
+
 	// Device ID of the client
 	deviceID string
 	// Platform: web, ios, android
 	platf string
+	// Push service which issued the device ID: fcm, apns, webpush
+	pushSvc string
 	// Human language of the client
 	lang string
 
@@ -124,6 +148,9 @@ type Session struct {
 	// Session ID
 	sid string
 
+	// Token buckets for rate limiting of client messages, indexed by message type.
+	limiter *rateLimiter
+
 	// Needed for long polling and grpc.
 	lock sync.Mutex
 }
@@ -214,9 +241,9 @@ func (s *Session) queueOut(msg *ServerComMessage) bool {
 	return true
 }
 
-// queueOutBytes attempts to send a ServerComMessage already serialized to []byte.
+// queueOutBytes attempts to send a ServerComMessage already serialized to []byte or msgpackFrame.
 // If the send buffer is full, timeout is `sendTimeout`.
-func (s *Session) queueOutBytes(data []byte) bool {
+func (s *Session) queueOutBytes(data interface{}) bool {
 	if s == nil {
 		return true
 	}
@@ -230,6 +257,12 @@ func (s *Session) queueOutBytes(data []byte) bool {
 	return true
 }
 
+// isTransient checks if the session has no persistent connection and expires when inactive:
+// long polling and SSE sessions.
+func (s *Session) isTransient() bool {
+	return s.proto == LPOLL || s.proto == SSE
+}
+
 func (s *Session) cleanUp(expired bool) {
 	if !expired {
 		globals.sessionStore.Delete(s)
@@ -292,6 +325,8 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 
 	var handler func(*ClientComMessage)
 	var uaRefresh bool
+	// Message type for rate limiting.
+	var what string
 
 	// Check if s.ver is defined
 	checkVers := func(m *ClientComMessage, handler func(*ClientComMessage)) func(*ClientComMessage) {
@@ -320,12 +355,14 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 	switch {
 	case msg.Pub != nil:
 		handler = checkVers(msg, checkUser(msg, s.publish))
+		what = "pub"
 		msg.id = msg.Pub.Id
 		msg.topic = msg.Pub.Topic
 		uaRefresh = true
 
 	case msg.Sub != nil:
 		handler = checkVers(msg, checkUser(msg, s.subscribe))
+		what = "sub"
 		msg.id = msg.Sub.Id
 		msg.topic = msg.Sub.Topic
 		uaRefresh = true
@@ -341,16 +378,19 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 
 	case msg.Login != nil:
 		handler = checkVers(msg, s.login)
+		what = "login"
 		msg.id = msg.Login.Id
 
 	case msg.Get != nil:
 		handler = checkVers(msg, checkUser(msg, s.get))
+		what = "get"
 		msg.id = msg.Get.Id
 		msg.topic = msg.Get.Topic
 		uaRefresh = true
 
 	case msg.Set != nil:
 		handler = checkVers(msg, checkUser(msg, s.set))
+		what = "set"
 		msg.id = msg.Set.Id
 		msg.topic = msg.Set.Topic
 		uaRefresh = true
@@ -362,10 +402,12 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 
 	case msg.Acc != nil:
 		handler = checkVers(msg, s.acc)
+		what = "acc"
 		msg.id = msg.Acc.Id
 
 	case msg.Note != nil:
 		handler = s.note
+		what = "note"
 		msg.topic = msg.Note.Topic
 		uaRefresh = true
 
@@ -383,6 +425,18 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 		return
 	}
 
+	if what != "" {
+		if retryAfter := s.rateLimit(msg, what); retryAfter > 0 {
+			statsInc("RateLimited"+strings.Title(what), 1)
+			log.Println("s.dispatch: rate limit exceeded", what, s.sid)
+			if msg.Note == nil {
+				// {note} messages are not acknowledged, drop them silently.
+				s.queueOut(ErrTooManyRequests(msg.id, msg.topic, msg.timestamp, retryAfter))
+			}
+			return
+		}
+	}
+
 	handler(msg)
 
 	// Notify 'me' topic that this session is currently active
@@ -491,6 +545,16 @@ func (s *Session) publish(msg *ClientComMessage) {
 		return
 	}
 
+	// Attached files uploaded without a topic will be charged to this topic.
+	if globals.topicUploadQuota > 0 && msg.Pub.Head != nil && store.GetMediaHandler() != nil {
+		if resp := attachmentsCheckQuota(msg.Pub.Head, expanded, msg.id, msg.timestamp); resp != nil {
+			// Report the topic name as sent by the client.
+			resp.Ctrl.Topic = msg.topic
+			s.queueOut(resp)
+			return
+		}
+	}
+
 	// Add "sender" header if the message is sent on behalf of another user.
 	if msg.from != s.uid.UserId() {
 		if msg.Pub.Head == nil {
@@ -545,6 +609,14 @@ func (s *Session) hello(msg *ClientComMessage) {
 	var params map[string]interface{}
 	var deviceIDUpdate bool
 
+	switch msg.Hi.Push {
+	case "", "fcm", push.PlatformAPNs, push.PlatformWebPush:
+	default:
+		log.Println("s.hello:", "unknown push service", msg.Hi.Push, s.sid)
+		s.queueOut(ErrMalformed(msg.id, "", msg.timestamp))
+		return
+	}
+
 	if s.ver == 0 {
 		s.ver = parseVersion(msg.Hi.Version)
 		if s.ver == 0 {
@@ -569,6 +641,26 @@ func (s *Session) hello(msg *ClientComMessage) {
 			"maxFileUploadSize":  globals.maxFileUploadSize,
 		}
 
+		// Encoding cannot be changed later either.
+		switch msg.Hi.Encoding {
+		case "", encodingJSON:
+		case encodingMsgpack:
+			if s.proto != WEBSOCK {
+				s.ver = 0
+				s.queueOut(ErrNotImplemented(msg.id, "", msg.timestamp))
+				log.Println("s.hello:", "msgpack is supported by websocket only", s.sid)
+				return
+			}
+			// The response to this {hi} is already MessagePack-encoded.
+			atomic.StoreInt32(&s.msgpackEnc, 1)
+			params["enc"] = encodingMsgpack
+		default:
+			s.ver = 0
+			s.queueOut(ErrNotImplemented(msg.id, "", msg.timestamp))
+			log.Println("s.hello:", "unsupported encoding", msg.Hi.Encoding, s.sid)
+			return
+		}
+
 		// Set ua & platform in the beginning of the session.
 		// Don't change them later.
 		s.userAgent = msg.Hi.UserAgent
@@ -576,7 +668,8 @@ func (s *Session) hello(msg *ClientComMessage) {
 		if s.platf == "" {
 			s.platf = platformFromUA(msg.Hi.UserAgent)
 		}
-	} else if msg.Hi.Version == "" || parseVersion(msg.Hi.Version) == s.ver {
+	} else if (msg.Hi.Version == "" || parseVersion(msg.Hi.Version) == s.ver) &&
+		(msg.Hi.Encoding == "" || msg.Hi.Encoding == s.encoding()) {
 		// Save changed device ID+Lang or delete earlier specified device ID.
 		// Platform cannot be changed.
 		if !s.uid.IsZero() {
@@ -588,7 +681,7 @@ func (s *Session) hello(msg *ClientComMessage) {
 				deviceIDUpdate = true
 				err = store.Devices.Update(s.uid, s.deviceID, &types.DeviceDef{
 					DeviceId: msg.Hi.DeviceID,
-					Platform: s.platf,
+					Platform: devicePlatform(msg.Hi.DeviceID, msg.Hi.Push, s.platf),
 					LastSeen: msg.timestamp,
 					Lang:     msg.Hi.Lang,
 				})
@@ -601,9 +694,9 @@ func (s *Session) hello(msg *ClientComMessage) {
 			}
 		}
 	} else {
-		// Version cannot be changed mid-session.
+		// Version and encoding cannot be changed mid-session.
 		s.queueOut(ErrCommandOutOfSequence(msg.id, "", msg.timestamp))
-		log.Println("s.hello:", "version cannot be changed", s.sid)
+		log.Println("s.hello:", "version or encoding cannot be changed", s.sid)
 		return
 	}
 
@@ -611,12 +704,13 @@ func (s *Session) hello(msg *ClientComMessage) {
 		msg.Hi.DeviceID = ""
 	}
 	s.deviceID = msg.Hi.DeviceID
+	s.pushSvc = msg.Hi.Push
 	s.lang = msg.Hi.Lang
 
 	var httpStatus int
 	var httpStatusText string
-	if s.proto == LPOLL || deviceIDUpdate {
-		// In case of long polling StatusCreated was reported earlier.
+	if s.proto == LPOLL || s.proto == SSE || deviceIDUpdate {
+		// In case of long polling and SSE StatusCreated was reported earlier.
 		// In case of deviceID update just report success.
 		httpStatus = http.StatusOK
 		httpStatusText = "ok"
@@ -703,6 +797,33 @@ func (s *Session) login(msg *ClientComMessage) {
 		return
 	}
 
+	user, err := userSuspended(rec.Uid)
+	if err == types.ErrUserNotFound && msg.Login.Scheme != "token" && msg.Login.Scheme != "refresh" {
+		// The account may be pending deletion. Logging in with credentials restores it.
+		if err = userUndelete(rec.Uid); err == nil {
+			log.Println("s.login: deleted account restored", rec.Uid.UserId(), s.sid)
+		} else if err == types.ErrNotFound {
+			err = types.ErrUserNotFound
+		}
+	}
+	if err != nil {
+		s.queueOut(decodeStoreError(err, msg.id, "", msg.timestamp, nil))
+		return
+	} else if user != nil {
+		log.Println("s.login: account suspended", rec.Uid.UserId(), s.sid)
+		reply := ErrPermissionDenied(msg.id, "", msg.timestamp)
+		params := map[string]interface{}{"what": "suspended"}
+		if user.SuspendReason != "" {
+			params["reason"] = user.SuspendReason
+		}
+		if user.SuspendUntil != nil {
+			params["until"] = user.SuspendUntil
+		}
+		reply.Ctrl.Params = params
+		s.queueOut(reply)
+		return
+	}
+
 	var missing []string
 	if rec.Features&auth.FeatureValidated == 0 && len(globals.authValidators[rec.AuthLevel]) > 0 {
 		var validated []string
@@ -716,7 +837,7 @@ func (s *Session) login(msg *ClientComMessage) {
 		log.Println("s.login: failed to validate credentials:", err, s.sid)
 		s.queueOut(decodeStoreError(err, msg.id, "", msg.timestamp, nil))
 	} else {
-		s.queueOut(s.onLogin(msg.id, msg.timestamp, rec, missing))
+		s.queueOut(s.onLogin(msg.id, msg.timestamp, rec, missing, msg.Login.Scheme))
 	}
 }
 
@@ -739,6 +860,11 @@ func (s *Session) authSecretReset(params []byte) error {
 	if validator == nil {
 		return types.ErrUnsupported
 	}
+	// Credentials are stored normalized, i.e. phone numbers in E.164 format.
+	credValue, err := validator.Normalize(credValue)
+	if err != nil {
+		return err
+	}
 	uid, err := store.Users.GetByCred(credMethod, credValue)
 	if err != nil {
 		return err
@@ -761,7 +887,8 @@ func (s *Session) authSecretReset(params []byte) error {
 }
 
 // onLogin performs steps after successful authentication.
-func (s *Session) onLogin(msgID string, timestamp time.Time, rec *auth.Rec, missing []string) *ServerComMessage {
+func (s *Session) onLogin(msgID string, timestamp time.Time, rec *auth.Rec, missing []string,
+	scheme string) *ServerComMessage {
 
 	var reply *ServerComMessage
 	var params map[string]interface{}
@@ -795,7 +922,7 @@ func (s *Session) onLogin(msgID string, timestamp time.Time, rec *auth.Rec, miss
 		if s.deviceID != "" {
 			if err := store.Devices.Update(rec.Uid, "", &types.DeviceDef{
 				DeviceId: s.deviceID,
-				Platform: s.platf,
+				Platform: devicePlatform(s.deviceID, s.pushSvc, s.platf),
 				LastSeen: timestamp,
 				Lang:     s.lang,
 			}); err != nil {
@@ -809,6 +936,19 @@ func (s *Session) onLogin(msgID string, timestamp time.Time, rec *auth.Rec, miss
 	rec.Features = features
 	params["token"], params["expires"], _ = store.GetLogicalAuthHandler("token").GenSecret(rec)
 
+	// Issue a refresh token if the session is authenticated by anything but the access token.
+	// Logging in by access token does not start a new chain of refresh tokens.
+	if !s.uid.IsZero() && store.GetLogicalAuthHandler(scheme) != store.GetLogicalAuthHandler("token") {
+		if hdl := store.GetLogicalAuthHandler("refresh"); hdl != nil {
+			refresh, expires, err := hdl.GenSecret(rec)
+			if err == nil {
+				params["refresh"], params["refresh_expires"] = refresh, expires
+			} else if err != types.ErrUnsupported {
+				log.Println("s.onLogin: failed to issue refresh token", err, s.sid)
+			}
+		}
+	}
+
 	reply.Ctrl.Params = params
 	return reply
 }
@@ -1032,5 +1172,24 @@ func (s *Session) serialize(msg *ServerComMessage) interface{} {
 		return pbServSerialize(msg)
 	}
 	out, _ := json.Marshal(msg)
+	if s.isMsgpack() {
+		// The frame type is chosen here: messages serialized before the encoding
+		// was negotiated are sent as JSON.
+		packed, _ := msgpack.FromJSON(out)
+		return msgpackFrame(packed)
+	}
 	return out
 }
+
+// isMsgpack checks if the session uses MessagePack wire encoding.
+func (s *Session) isMsgpack() bool {
+	return atomic.LoadInt32(&s.msgpackEnc) == 1
+}
+
+// encoding returns the name of the session's wire encoding.
+func (s *Session) encoding() string {
+	if s.isMsgpack() {
+		return encodingMsgpack
+	}
+	return encodingJSON
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+	"time"
+)
+
+// Typical messages sent to clients.
+func benchmarkMessages() []struct {
+	name string
+	msg  *ServerComMessage
+} {
+	ts := time.Date(2020, time.June, 1, 10, 0, 0, 123000000, time.UTC)
+	subs := make([]MsgTopicSub, 20)
+	for i := range subs {
+		subs[i] = MsgTopicSub{
+			UpdatedAt: &ts,
+			Online:    i%2 == 0,
+			Acs:       MsgAccessMode{Want: "JRWPS", Given: "JRWPS", Mode: "JRWPS"},
+			ReadSeqId: 120 + i,
+			RecvSeqId: 125 + i,
+			Public:    map[string]interface{}{"fn": "Alice Johnson"},
+			User:      "usrAbCdEfGhIjK",
+		}
+	}
+
+	return []struct {
+		name string
+		msg  *ServerComMessage
+	}{
+		{"ctrl", &ServerComMessage{Ctrl: &MsgServerCtrl{Id: "112345", Topic: "grpAbCdEfGhIjK", Code: 200, Text: "ok",
+			Params: map[string]interface{}{"what": "data"}, Timestamp: ts}}},
+		{"pres", &ServerComMessage{Pres: &MsgServerPres{Topic: "me", Src: "usrAbCdEfGhIjK", What: "msg", SeqId: 123}}},
+		{"data", &ServerComMessage{Data: &MsgServerData{Topic: "grpAbCdEfGhIjK", From: "usrAbCdEfGhIjK", Timestamp: ts,
+			SeqId: 123, Content: map[string]interface{}{
+				"txt": "Hey, check out this picture https://tinode.co/",
+				"fmt": []interface{}{
+					map[string]interface{}{"at": 0, "len": 3, "tp": "ST"},
+					map[string]interface{}{"at": 28, "len": 18, "key": 0},
+					map[string]interface{}{"at": -1, "len": 0, "key": 1},
+				},
+				"ent": []interface{}{
+					map[string]interface{}{"tp": "LN", "data": map[string]interface{}{"url": "https://tinode.co/"}},
+					map[string]interface{}{"tp": "IM", "data": map[string]interface{}{"mime": "image/jpeg",
+						"name": "roses.jpg", "width": 638, "height": 213, "size": 38992,
+						"ref": "/v0/file/s/abcdefghijkl.jpg"}},
+				},
+			}}}},
+		{"meta", &ServerComMessage{Meta: &MsgServerMeta{Id: "112346", Topic: "grpAbCdEfGhIjK", Timestamp: &ts, Sub: subs}}},
+	}
+}
+
+// benchmarkSerialize reports CPU cost of serializing messages in the given encoding and the
+// number of bytes on the wire, optionally with permessage-deflate.
+func benchmarkSerialize(b *testing.B, encoding string, compressionLevel int) {
+	sess := &Session{proto: WEBSOCK}
+	if encoding == encodingMsgpack {
+		sess.msgpackEnc = 1
+	}
+	var buf bytes.Buffer
+	var zw *flate.Writer
+	if compressionLevel != 0 {
+		zw, _ = flate.NewWriter(&buf, compressionLevel)
+	}
+
+	for _, bm := range benchmarkMessages() {
+		msg := bm.msg
+		b.Run(bm.name, func(b *testing.B) {
+			var size int
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var out []byte
+				switch frame := sess.serialize(msg).(type) {
+				case msgpackFrame:
+					out = frame
+				case []byte:
+					out = frame
+				}
+				size = len(out)
+				if zw != nil {
+					// Compressed the same way as permessage-deflate without context takeover:
+					// each message separately, the trailing 4 bytes of the flush marker are not sent.
+					buf.Reset()
+					zw.Reset(&buf)
+					zw.Write(out)
+					zw.Flush()
+					size = buf.Len() - 4
+				}
+			}
+			b.ReportMetric(float64(size), "wire-bytes/op")
+		})
+	}
+}
+
+func BenchmarkSerializeJSON(b *testing.B) {
+	benchmarkSerialize(b, encodingJSON, 0)
+}
+
+func BenchmarkSerializeMsgpack(b *testing.B) {
+	benchmarkSerialize(b, encodingMsgpack, 0)
+}
+
+func BenchmarkSerializeJSONDeflate(b *testing.B) {
+	benchmarkSerialize(b, encodingJSON, flate.BestSpeed)
+}
+
+func BenchmarkSerializeMsgpackDeflate(b *testing.B) {
+	benchmarkSerialize(b, encodingMsgpack, flate.BestSpeed)
+}
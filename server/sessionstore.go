@@ -48,6 +48,9 @@ func (ss *SessionStore) NewSession(conn interface{}, sid string) (*Session, int)
 	case http.ResponseWriter:
 		s.proto = LPOLL
 		// no need to store c for long polling, it changes with every request
+	case *sseConn:
+		s.proto = SSE
+		s.sse = c
 	case *ClusterNode:
 		s.proto = CLUSTER
 		s.clnode = c
@@ -58,14 +61,16 @@ func (ss *SessionStore) NewSession(conn interface{}, sid string) (*Session, int)
 		s.proto = NONE
 	}
 
-	if s.proto != NONE {
-		s.subs = make(map[string]*Subscription)
-		s.send = make(chan interface{}, sendQueueLimit+32) // buffered
-		s.stop = make(chan interface{}, 1)                 // Buffered by 1 just to make it non-blocking
-		s.detach = make(chan string, 64)                   // buffered
-		if globals.cluster != nil {
-			s.remoteSubs = make(map[string]*RemoteSubscription)
-		}
+	// Sessions without a network connection (NONE) are used internally, i.e. by the admin API.
+	s.subs = make(map[string]*Subscription)
+	s.send = make(chan interface{}, sendQueueLimit+32) // buffered
+	s.stop = make(chan interface{}, 1)                 // Buffered by 1 just to make it non-blocking
+	s.detach = make(chan string, 64)                   // buffered
+	if globals.cluster != nil {
+		s.remoteSubs = make(map[string]*RemoteSubscription)
+	}
+	if globals.rateLimits != nil {
+		s.limiter = newRateLimiter()
 	}
 
 	s.lastTouched = time.Now()
@@ -78,8 +83,8 @@ func (ss *SessionStore) NewSession(conn interface{}, sid string) (*Session, int)
 	ss.sessCache[s.sid] = &s
 	count := len(ss.sessCache)
 	var expired []*Session
-	if s.proto == LPOLL {
-		// Only LP sessions need to be sorted by last active
+	if s.isTransient() {
+		// Only LP and SSE sessions need to be sorted by last active
 		s.lpTracker = ss.lru.PushFront(&s)
 
 		// Remove expired sessions
@@ -116,7 +121,7 @@ func (ss *SessionStore) Get(sid string) *Session {
 	defer ss.lock.Unlock()
 
 	if sess := ss.sessCache[sid]; sess != nil {
-		if sess.proto == LPOLL {
+		if sess.isTransient() {
 			ss.lru.MoveToFront(sess.lpTracker)
 			sess.lastTouched = time.Now()
 		}
@@ -133,7 +138,7 @@ func (ss *SessionStore) Delete(s *Session) {
 	defer ss.lock.Unlock()
 
 	delete(ss.sessCache, s.sid)
-	if s.proto == LPOLL {
+	if s.isTransient() {
 		ss.lru.Remove(s.lpTracker)
 	}
 
@@ -166,7 +171,7 @@ func (ss *SessionStore) EvictUser(uid types.Uid, skipSid string) {
 		if s.uid == uid && s.stop != nil && s.sid != skipSid {
 			s.stop <- s.serialize(evicted)
 			delete(ss.sessCache, s.sid)
-			if s.proto == LPOLL {
+			if s.isTransient() {
 				ss.lru.Remove(s.lpTracker)
 			}
 		}
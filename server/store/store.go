@@ -16,6 +16,7 @@ import (
 
 var adp adapter.Adapter
 var mediaHandler media.Handler
+var mediaScanner media.Scanner
 
 // Unique ID generator
 var uGen types.UidGenerator
@@ -290,11 +291,31 @@ func (UsersObjMapper) Delete(id types.Uid, hard bool) error {
 	return adp.UserDelete(id, hard)
 }
 
+// DeleteDeferred disables user account and marks it as pending deletion.
+func (UsersObjMapper) DeleteDeferred(id types.Uid) error {
+	return adp.UserDeleteDeferred(id)
+}
+
 // GetDisabled returns user IDs which were disabled (soft-deleted) since specifid time.
 func (UsersObjMapper) GetDisabled(since time.Time) ([]types.Uid, error) {
 	return adp.UserGetDisabled(since)
 }
 
+// GetSuspended returns IDs of suspended users whose suspension expired before the given time.
+func (UsersObjMapper) GetSuspended(expired time.Time) ([]types.Uid, error) {
+	return adp.UserGetSuspended(expired)
+}
+
+// GetDeleted returns IDs of users pending deletion which were deleted before the given time.
+func (UsersObjMapper) GetDeleted(expired time.Time) ([]types.Uid, error) {
+	return adp.UserGetDeleted(expired)
+}
+
+// Undelete restores user pending deletion if the user was deleted since the given time.
+func (UsersObjMapper) Undelete(id types.Uid, since time.Time) error {
+	return adp.UserUndelete(id, since)
+}
+
 // UpdateLastSeen updates LastSeen and UserAgent.
 func (UsersObjMapper) UpdateLastSeen(uid types.Uid, userAgent string, when time.Time) error {
 	return adp.UserUpdate(uid, map[string]interface{}{"LastSeen": when, "UserAgent": userAgent})
@@ -522,15 +543,33 @@ func (MessagesObjMapper) Save(msg *types.Message, readBySender bool) error {
 	}
 
 	// Check if the message has attachments. If so, link earlier uploaded files to message.
+	// Only files the sender can read are linked: otherwise anyone who learned the URL of a file
+	// could gain access to it by attaching it to a message in own topic.
 	var attachments []string
+	// Files uploaded without a topic. They are charged to the topic where they are attached first.
+	var uncharged []string
 	if header, ok := msg.Head["attachments"]; ok {
+		var urls []interface{}
 		// The header is typed as []interface{}, convert to []string
 		if arr, ok := header.([]interface{}); ok {
+			from := types.ParseUid(msg.From)
 			for _, val := range arr {
 				if url, ok := val.(string); ok {
 					// Convert attachment URLs to file IDs.
 					if fid := mediaHandler.GetIdFromUrl(url); !fid.IsZero() {
-						attachments = append(attachments, fid.String())
+						fd, err := adp.FileGet(fid.String())
+						if err != nil {
+							return err
+						}
+						if ok, err := canReadFile(fd, from); err != nil {
+							return err
+						} else if ok {
+							attachments = append(attachments, fd.Id)
+							urls = append(urls, url)
+							if fd.Topic == "" {
+								uncharged = append(uncharged, fd.Id)
+							}
+						}
 					}
 				}
 			}
@@ -538,6 +577,8 @@ func (MessagesObjMapper) Save(msg *types.Message, readBySender bool) error {
 
 		if len(attachments) == 0 {
 			delete(msg.Head, "attachments")
+		} else {
+			msg.Head["attachments"] = urls
 		}
 	}
 
@@ -560,7 +601,15 @@ func (MessagesObjMapper) Save(msg *types.Message, readBySender bool) error {
 	}
 
 	if len(attachments) > 0 {
-		return adp.MessageAttachments(msg.Uid(), attachments)
+		if err = adp.MessageAttachments(msg.Uid(), attachments); err != nil {
+			return err
+		}
+	}
+
+	for _, fid := range uncharged {
+		if err = adp.FileUpdate(fid, map[string]interface{}{"Topic": msg.Topic}); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -832,6 +881,38 @@ func UseMediaHandler(name, config string) error {
 	return mediaHandler.Init(config)
 }
 
+// Registered malware scanners of uploaded files.
+var fileScanners map[string]media.Scanner
+
+// RegisterMediaScanner saves reference to a malware scanner of uploaded files.
+func RegisterMediaScanner(name string, scanner media.Scanner) {
+	if fileScanners == nil {
+		fileScanners = make(map[string]media.Scanner)
+	}
+
+	if scanner == nil {
+		panic("RegisterMediaScanner: scanner is nil")
+	}
+	if _, dup := fileScanners[name]; dup {
+		panic("RegisterMediaScanner: called twice for scanner " + name)
+	}
+	fileScanners[name] = scanner
+}
+
+// GetMediaScanner returns the malware scanner or nil if uploads are not scanned.
+func GetMediaScanner() media.Scanner {
+	return mediaScanner
+}
+
+// UseMediaScanner enables scanning of uploads with the specified scanner.
+func UseMediaScanner(name, config string) error {
+	mediaScanner = fileScanners[name]
+	if mediaScanner == nil {
+		panic("UseMediaScanner: unknown scanner '" + name + "'")
+	}
+	return mediaScanner.Init(config)
+}
+
 // FileMapper is a struct to map methods used for file handling.
 type FileMapper struct{}
 
@@ -844,11 +925,14 @@ func (FileMapper) StartUpload(fd *types.FileDef) error {
 	return adp.FileStartUpload(fd)
 }
 
-// FinishUpload marks started upload as successfully finished.
+// FinishUpload marks started upload as successfully finished. If uploads are scanned for malware,
+// successfully uploaded files are quarantined until scanned.
 func (FileMapper) FinishUpload(fid string, success bool, size int64) (*types.FileDef, error) {
 	status := types.UploadCompleted
 	if !success {
 		status = types.UploadFailed
+	} else if mediaScanner != nil {
+		status = types.UploadQuarantined
 	}
 	return adp.FileFinishUpload(fid, status, size)
 }
@@ -858,6 +942,130 @@ func (FileMapper) Get(fid string) (*types.FileDef, error) {
 	return adp.FileGet(fid)
 }
 
+// GetByHash fetches a record of a completed upload with the given content hash.
+// Returns nil if no such upload exists.
+func (FileMapper) GetByHash(hash string) (*types.FileDef, error) {
+	return adp.FileGetByHash(hash)
+}
+
+// GetAll fetches up to limit file records with IDs greater than after. Pass the ID of the last
+// returned record as after to fetch the next batch.
+func (FileMapper) GetAll(after string, limit int) ([]types.FileDef, error) {
+	return adp.FileGetAll(after, limit)
+}
+
+// LinkDuplicate creates a completed file record which shares the stored content with an earlier
+// upload dup of the same content. Resized copies already saved for fd are deleted and the copies
+// of dup are used instead. Returns ErrNotFound if dup was deleted in the meantime.
+func (FileMapper) LinkDuplicate(fd, dup *types.FileDef) error {
+	if locations := fd.Variants.Locations(); len(locations) > 0 {
+		GetMediaHandler().Delete(locations)
+	}
+
+	fd.Status = types.UploadCompleted
+	fd.Location = dup.Location
+	fd.Variants = dup.Variants
+	fd.Size = dup.Size
+	fd.Hash = dup.Hash
+
+	// The original could have been garbage collected together with the shared content.
+	ok, err := adp.FileStartDuplicate(fd, dup.Id)
+	if err == nil && !ok {
+		err = types.ErrNotFound
+	}
+	return err
+}
+
+// SetScanned releases the file from quarantine if it's clean or marks the upload as failed otherwise.
+func (FileMapper) SetScanned(fid string, clean bool) error {
+	status := types.UploadCompleted
+	if !clean {
+		status = types.UploadFailed
+	}
+	return adp.FileUpdate(fid, map[string]interface{}{"Status": status, "UpdatedAt": types.TimeNow()})
+}
+
+// Update updates the file record, i.e. records progress of a resumable upload.
+func (FileMapper) Update(fid string, update map[string]interface{}) error {
+	update["UpdatedAt"] = types.TimeNow()
+	return adp.FileUpdate(fid, update)
+}
+
+// UpdateProgress records progress of a resumable upload. The record is updated only if the upload is
+// in progress and the number of received bytes has not changed since it was read, otherwise
+// ErrConflict is returned.
+func (FileMapper) UpdateProgress(fid string, received int64, update map[string]interface{}) error {
+	update["UpdatedAt"] = types.TimeNow()
+	ok, err := adp.FileUpdateProgress(fid, received, update)
+	if err == nil && !ok {
+		err = types.ErrConflict
+	}
+	return err
+}
+
+// CanRead checks if the user has uploaded the file or has R access to any of the topics with
+// messages which have the file attached.
+func (FileMapper) CanRead(fid string, user types.Uid) (bool, error) {
+	if user.IsZero() {
+		return false, nil
+	}
+
+	fd, err := adp.FileGet(fid)
+	if err != nil {
+		return false, err
+	}
+	return canReadFile(fd, user)
+}
+
+func canReadFile(fd *types.FileDef, user types.Uid) (bool, error) {
+	if fd == nil || user.IsZero() {
+		return false, nil
+	}
+	if fd.User == user.String() {
+		return true, nil
+	}
+
+	topics, err := adp.FileLinkedTopics(fd.Id)
+	if err != nil {
+		return false, err
+	}
+	for _, topic := range topics {
+		sub, err := adp.SubscriptionGet(topic, user)
+		if err != nil {
+			return false, err
+		}
+		if sub != nil && sub.DeletedAt == nil && (sub.ModeGiven & sub.ModeWant).IsReader() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetUncharged returns the total size of files referenced by the attachment URLs which were uploaded
+// without a topic. Such files are charged to the topic where they are attached first.
+func (FileMapper) GetUncharged(urls []string) (int64, error) {
+	var size int64
+	for _, url := range urls {
+		fid := mediaHandler.GetIdFromUrl(url)
+		if fid.IsZero() {
+			continue
+		}
+		fd, err := adp.FileGet(fid.String())
+		if err != nil {
+			return 0, err
+		}
+		if fd != nil && fd.Topic == "" {
+			size += fd.Size
+		}
+	}
+	return size, nil
+}
+
+// GetUsage returns the total size of files uploaded by the user, or to the topic if the user is zero.
+func (FileMapper) GetUsage(user types.Uid, topic string) (int64, error) {
+	return adp.FileGetUsage(user, topic)
+}
+
 // DeleteUnused removes unused attachments.
 func (FileMapper) DeleteUnused(olderThan time.Time, limit int) error {
 	toDel, err := adp.FileDeleteUnused(olderThan, limit)
@@ -869,3 +1077,40 @@ func (FileMapper) DeleteUnused(olderThan time.Time, limit int) error {
 	}
 	return nil
 }
+
+// RefreshTokenMapper is a struct to map methods used for handling refresh tokens.
+type RefreshTokenMapper struct{}
+
+// RefreshTokens is an instance of RefreshTokenMapper to map methods to.
+var RefreshTokens RefreshTokenMapper
+
+// Add saves a new refresh token record.
+func (RefreshTokenMapper) Add(rt *types.RefreshToken) error {
+	rt.CreatedAt = types.TimeNow()
+	return adp.RefreshTokenAdd(rt)
+}
+
+// Get fetches a refresh token record by token ID.
+func (RefreshTokenMapper) Get(id string) (*types.RefreshToken, error) {
+	return adp.RefreshTokenGet(id)
+}
+
+// Use marks the token as used. Returns false if the token has been used before.
+func (RefreshTokenMapper) Use(id string) (bool, error) {
+	return adp.RefreshTokenUse(id)
+}
+
+// RevokeChain deletes all tokens in the given chain.
+func (RefreshTokenMapper) RevokeChain(chain string) error {
+	return adp.RefreshTokenDelChain(chain)
+}
+
+// RevokeAll deletes all refresh tokens of the given user.
+func (RefreshTokenMapper) RevokeAll(uid types.Uid) error {
+	return adp.RefreshTokenDelAll(uid)
+}
+
+// DeleteExpired removes tokens which expired before the given time.
+func (RefreshTokenMapper) DeleteExpired(before time.Time) error {
+	return adp.RefreshTokenDelExpired(before)
+}
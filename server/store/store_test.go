@@ -0,0 +1,130 @@
+package store
+
+import (
+	"strings"
+	"testing"
+
+	adapter "github.com/tinode/chat/server/db"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// mockAdapter implements adapter methods used by message saving. Other methods panic.
+type mockAdapter struct {
+	adapter.Adapter
+
+	files map[string]*types.FileDef
+	// File ID -> topics with messages which have the file attached.
+	links map[string][]string
+	// Topic -> user -> subscription.
+	subs map[string]map[types.Uid]*types.Subscription
+}
+
+func (a *mockAdapter) TopicUpdateOnMessage(topic string, msg *types.Message) error {
+	return nil
+}
+
+func (a *mockAdapter) MessageSave(msg *types.Message) error {
+	return nil
+}
+
+func (a *mockAdapter) MessageAttachments(msgId types.Uid, fids []string) error {
+	for _, fid := range fids {
+		a.links[fid] = append(a.links[fid], "attached")
+	}
+	return nil
+}
+
+func (a *mockAdapter) FileUpdate(fid string, update map[string]interface{}) error {
+	if topic, ok := update["Topic"]; ok {
+		a.files[fid].Topic = topic.(string)
+	}
+	return nil
+}
+
+func (a *mockAdapter) FileGet(fid string) (*types.FileDef, error) {
+	return a.files[fid], nil
+}
+
+func (a *mockAdapter) FileLinkedTopics(fid string) ([]string, error) {
+	return a.links[fid], nil
+}
+
+func (a *mockAdapter) SubscriptionGet(topic string, user types.Uid) (*types.Subscription, error) {
+	return a.subs[topic][user], nil
+}
+
+// mockMediaHandler extracts file ID from URLs like '/v0/file/s/<fid>'.
+type mockMediaHandler struct {
+	media.Handler
+}
+
+func (mockMediaHandler) GetIdFromUrl(url string) types.Uid {
+	return types.ParseUid(strings.TrimPrefix(url, "/v0/file/s/"))
+}
+
+func TestMessageAttachments(t *testing.T) {
+	if err := uGen.Init(1, []byte("0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+
+	owner, reader, stranger := types.Uid(1), types.Uid(2), types.Uid(3)
+	// Uploaded by owner, not attached anywhere.
+	private := types.Uid(100).String()
+	// Uploaded by owner, attached in a topic readable by reader.
+	shared := types.Uid(101).String()
+
+	mock := &mockAdapter{
+		files: map[string]*types.FileDef{
+			private: {ObjHeader: types.ObjHeader{Id: private}, User: owner.String()},
+			shared:  {ObjHeader: types.ObjHeader{Id: shared}, User: owner.String()},
+		},
+		links: map[string][]string{shared: {"grpShared"}},
+		subs: map[string]map[types.Uid]*types.Subscription{
+			"grpShared": {reader: {ModeWant: types.ModeCPublic, ModeGiven: types.ModeCPublic}},
+		},
+	}
+	adp, mediaHandler = mock, mockMediaHandler{}
+
+	cases := []struct {
+		from     types.Uid
+		fid      string
+		attached bool
+	}{
+		{owner, private, true},
+		{owner, shared, true},
+		{reader, shared, true},
+		{reader, private, false},
+		{stranger, private, false},
+		{stranger, shared, false},
+		{types.ZeroUid, private, false},
+	}
+
+	for _, tc := range cases {
+		delete(mock.links, private)
+		mock.links[shared] = []string{"grpShared"}
+		mock.files[private].Topic = ""
+		mock.files[shared].Topic = "grpShared"
+
+		msg := &types.Message{Topic: "grpOwn", From: tc.from.String(),
+			Head: map[string]interface{}{"attachments": []interface{}{"/v0/file/s/" + tc.fid}}}
+		if err := Messages.Save(msg, false); err != nil {
+			t.Fatal(err)
+		}
+
+		_, inHead := msg.Head["attachments"]
+		linked := len(mock.links[tc.fid]) > 0 && mock.links[tc.fid][len(mock.links[tc.fid])-1] == "attached"
+		if inHead != tc.attached || linked != tc.attached {
+			t.Errorf("user %d, file %s: expected attached=%v, got head=%v, linked=%v",
+				tc.from, tc.fid, tc.attached, inHead, linked)
+		}
+		// Files uploaded without a topic are charged to the topic where they are attached.
+		if tc.fid == private && (mock.files[private].Topic == "grpOwn") != tc.attached {
+			t.Errorf("user %d, file %s: expected charged=%v, got topic '%s'",
+				tc.from, tc.fid, tc.attached, mock.files[private].Topic)
+		}
+		if mock.files[shared].Topic != "grpShared" {
+			t.Errorf("user %d: file %s charged to '%s'", tc.from, shared, mock.files[shared].Topic)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -48,6 +49,8 @@ const (
 	ErrPermissionDenied = StoreError("denied")
 	// ErrInvalidResponse means the client's response does not match server's expectation.
 	ErrInvalidResponse = StoreError("invalid response")
+	// ErrConflict means the object was changed concurrently.
+	ErrConflict = StoreError("conflict")
 )
 
 // Uid is a database-specific record id, suitable to be used as a primary key.
@@ -372,11 +375,26 @@ func (ss StringSlice) Value() (driver.Value, error) {
 	return json.Marshal(ss)
 }
 
+// User account states.
+const (
+	// UserStateNormal is the default state of a user account.
+	UserStateNormal = 0
+	// UserStateSuspended means the account is suspended by the administrator and cannot be used.
+	UserStateSuspended = 1
+	// UserStateDeleted means the account is deleted by the user and will be purged after the recovery period.
+	UserStateDeleted = 2
+)
+
 // User is a representation of a DB-stored user record.
 type User struct {
 	ObjHeader `bson:",inline"`
 
+	// Account state: normal, suspended.
 	State int
+	// Reason why the account was suspended.
+	SuspendReason string
+	// Time when the suspension expires, nil if the suspension does not expire.
+	SuspendUntil *time.Time
 
 	// Default access to user for P2P topics (used as default modeGiven)
 	Access DefaultAccess
@@ -394,6 +412,13 @@ type User struct {
 	// 'users' as well as indexed in 'tagunique'
 	Tags StringSlice
 
+	// Preferences of push notifications: do-not-disturb and quiet hours.
+	Notify *NotifySettings
+
+	// Maximum total size of files uploaded by the user in bytes set by the administrator:
+	// 0 means the server default, negative means unlimited.
+	UploadQuota int64
+
 	// Info on known devices, used for push notifications
 	Devices map[string]*DeviceDef `bson:"__devices,skip,omitempty"`
 	// Same for mongodb scheme. Ignore in other db backends if its not suitable.
@@ -662,6 +687,139 @@ func (da DefaultAccess) Value() (driver.Value, error) {
 	return json.Marshal(da)
 }
 
+// NotifySettings are user's preferences of push notifications.
+type NotifySettings struct {
+	// Do not disturb: no notifications until this time.
+	DndUntil *time.Time `json:"dnd,omitempty"`
+	// Recurring periods when notifications are not sent.
+	Quiet []QuietHours `json:"quiet,omitempty"`
+	// IANA time zone of the quiet hours, like "Europe/Berlin". UTC if blank.
+	TimeZone string `json:"tz,omitempty"`
+	// Notify about mentions of the user even if notifications are muted or not disturbed.
+	Mentions bool `json:"mentions,omitempty"`
+}
+
+// QuietHours is a daily period when notifications are not sent.
+type QuietHours struct {
+	// Days of week when the period starts, 0 is Sunday. Every day if empty.
+	Days []int `json:"days,omitempty"`
+	// Start and end of the period as "HH:MM". If End is earlier than Start, the period ends
+	// the next day.
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// Time zones of quiet hours loaded so far: name -> *time.Location. Loading a time zone reads
+// and parses the tz database file, it's too expensive to do for every notification.
+var locations sync.Map
+
+// loadLocation is a cached version of time.LoadLocation.
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight.
+func parseClock(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Validate checks that the time zone and quiet hours are well-formed.
+func (ns *NotifySettings) Validate() error {
+	if _, err := loadLocation(ns.TimeZone); err != nil {
+		return err
+	}
+	for _, q := range ns.Quiet {
+		if _, err := parseClock(q.Start); err != nil {
+			return err
+		}
+		if _, err := parseClock(q.End); err != nil {
+			return err
+		}
+		for _, d := range q.Days {
+			if d < 0 || d > 6 {
+				return errors.New("invalid day of week")
+			}
+		}
+	}
+	return nil
+}
+
+// IsQuiet checks if notifications should not be sent at the given time: do-not-disturb
+// is on or the time falls within quiet hours.
+func (ns *NotifySettings) IsQuiet(now time.Time) bool {
+	if ns == nil {
+		return false
+	}
+	if ns.DndUntil != nil && now.Before(*ns.DndUntil) {
+		return true
+	}
+	if len(ns.Quiet) == 0 {
+		return false
+	}
+
+	loc, err := loadLocation(ns.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	now = now.In(loc)
+	minute := now.Hour()*60 + now.Minute()
+	today := int(now.Weekday())
+	yesterday := (today + 6) % 7
+
+	startsOn := func(q *QuietHours, day int) bool {
+		if len(q.Days) == 0 {
+			return true
+		}
+		for _, d := range q.Days {
+			if d == day {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := range ns.Quiet {
+		q := &ns.Quiet[i]
+		start, err1 := parseClock(q.Start)
+		end, err2 := parseClock(q.End)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		if start <= end {
+			if minute >= start && minute < end && startsOn(q, today) {
+				return true
+			}
+		} else if (minute >= start && startsOn(q, today)) || (minute < end && startsOn(q, yesterday)) {
+			// The period spans midnight.
+			return true
+		}
+	}
+	return false
+}
+
+// Scan is an implementation of Scanner interface so the value can be read from SQL DBs
+// It assumes the value is serialized and stored as JSON
+func (ns *NotifySettings) Scan(val interface{}) error {
+	return json.Unmarshal(val.([]byte), ns)
+}
+
+// Value implements sql's driver.Valuer interface.
+func (ns NotifySettings) Value() (driver.Value, error) {
+	return json.Marshal(ns)
+}
+
 // Credential hold data needed to validate and check validity of a credential like email or phone.
 type Credential struct {
 	ObjHeader `bson:",inline"`
@@ -702,6 +860,10 @@ type Subscription struct {
 	ModeGiven AccessMode
 	// User's private data associated with the subscription to topic
 	Private interface{}
+	// Push notifications from the topic are muted.
+	Muted bool
+	// Time when the mute expires, nil if the topic is muted indefinitely.
+	MuteUntil *time.Time
 
 	// Deserialized ephemeral values
 
@@ -716,6 +878,8 @@ type Subscription struct {
 	lastSeen time.Time
 	// user agent string of the last online access
 	userAgent string
+	// P2P only. State of the other user's account: normal or suspended
+	state int
 
 	// P2P only. ID of the other user
 	with string
@@ -779,6 +943,16 @@ func (s *Subscription) GetUserAgent() string {
 	return s.userAgent
 }
 
+// GetState returns state of the other user's account in P2P subscriptions.
+func (s *Subscription) GetState() int {
+	return s.state
+}
+
+// SetState sets state of the other user's account in P2P subscriptions.
+func (s *Subscription) SetState(state int) {
+	s.state = state
+}
+
 // SetLastSeenAndUA updates lastSeen time and userAgent.
 func (s *Subscription) SetLastSeenAndUA(when *time.Time, ua string) {
 	if when != nil {
@@ -1074,6 +1248,9 @@ const (
 	UploadCompleted
 	// UploadFailed indicates that the upload has failed.
 	UploadFailed
+	// UploadQuarantined indicates that the upload has completed but the file cannot be downloaded
+	// until it passes the malware scan.
+	UploadQuarantined
 )
 
 // FileDef is a stored record of a file upload
@@ -1089,4 +1266,77 @@ type FileDef struct {
 	Size int64
 	// Internal file location, i.e. path on disk or an S3 blob address.
 	Location string
+	// Resized copies of the image, such as thumbnails.
+	Variants FileVariants
+	// Hex-encoded SHA-256 hash of the content. Records with the same hash share the stored
+	// content and variants.
+	Hash string
+	// Name of the topic the file was uploaded to, if provided by the client.
+	Topic string
+
+	// Resumable uploads only: number of bytes received so far while the upload is in
+	// UploadStarted state. Size is the declared size of the file.
+	Received int64
+	// Resumable uploads only: handler-specific state of the partial upload, like ID of the
+	// S3 multipart upload.
+	UploadState string
+}
+
+// FileVariant is a resized copy of an uploaded image stored together with the original.
+type FileVariant struct {
+	// Name of the variant, i.e. "thumb".
+	Name     string `json:"name"`
+	MimeType string `json:"mime"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Size     int64  `json:"size"`
+	// Internal location of the variant, like FileDef.Location.
+	Location string `json:"loc"`
+}
+
+// FileVariants is a list of variants of an uploaded file.
+type FileVariants []FileVariant
+
+// Scan implements sql.Scanner interface.
+func (fv *FileVariants) Scan(val interface{}) error {
+	if val == nil {
+		*fv = nil
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), fv)
+}
+
+// Value implements sql's driver.Valuer interface.
+func (fv FileVariants) Value() (driver.Value, error) {
+	if fv == nil {
+		return nil, nil
+	}
+	return json.Marshal(fv)
+}
+
+// Locations returns internal locations of all variants.
+func (fv FileVariants) Locations() []string {
+	var locations []string
+	for i := range fv {
+		locations = append(locations, fv[i].Location)
+	}
+	return locations
+}
+
+// RefreshToken is a server-side record of a single-use refresh token.
+type RefreshToken struct {
+	// Hash of the token. The token itself is never stored.
+	Id        string `bson:"_id"`
+	CreatedAt time.Time
+	// Chain of tokens this token belongs to. Tokens obtained by rotation share the chain.
+	Chain string
+	// User who owns the token.
+	User string
+	// Authentication level and feature bits to use for the access token.
+	AuthLvl  int
+	Features int
+	// Time when the token expires.
+	Expires time.Time
+	// The token was already exchanged for a new one.
+	Used bool
 }
@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/drafty"
 	"github.com/tinode/chat/server/push"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
@@ -61,6 +62,13 @@ type Topic struct {
 	// Last published userAgent ('me' topic only)
 	userAgent string
 
+	// User's push notification settings ('me' topic only)
+	notify *types.NotifySettings
+
+	// Cached storage usage and the time when it was fetched ('me' topic only)
+	storage        *MsgStorage
+	storageFetched time.Time
+
 	// User ID of the topic owner/creator. Could be zero.
 	owner types.Uid
 
@@ -123,12 +131,21 @@ type perUserData struct {
 	modeWant  types.AccessMode
 	modeGiven types.AccessMode
 
+	// Push notifications are muted, optionally until the given time.
+	muted     bool
+	muteUntil *time.Time
+
 	// P2P only:
 	public    interface{}
 	topicName string
 	deleted   bool
 }
 
+// isMuted checks if push notifications are muted at the given time.
+func (pud *perUserData) isMuted(now time.Time) bool {
+	return pud.muted && (pud.muteUntil == nil || pud.muteUntil.After(now))
+}
+
 // perSubsData holds user's (on 'me' topic) cache of subscription data
 type perSubsData struct {
 	// The other user's/topic's online status as seen by this user.
@@ -699,7 +716,9 @@ func (t *Topic) loadSubscribers() error {
 			recvID:    sub.RecvSeqId,
 			private:   sub.Private,
 			modeWant:  sub.ModeWant,
-			modeGiven: sub.ModeGiven}
+			modeGiven: sub.ModeGiven,
+			muted:     sub.Muted,
+			muteUntil: sub.MuteUntil}
 
 		if (sub.ModeGiven & sub.ModeWant).IsOwner() {
 			t.owner = uid
@@ -1422,10 +1441,35 @@ func (t *Topic) replyGetDesc(sess *Session, asUid types.Uid, id string, opts *Ms
 		if t.cat == types.TopicCatGrp && (pud.modeGiven & pud.modeWant).IsPresencer() {
 			desc.Online = t.isOnline()
 		}
+		if t.cat == types.TopicCatP2P {
+			// Let the user know if the other user is suspended.
+			if user, err := store.Users.Get(types.ParseUserId(pud.topicName)); err == nil && user != nil &&
+				user.State == types.UserStateSuspended {
+				desc.State = userStateSuspended
+			}
+		}
 		if ifUpdated {
 			desc.Private = pud.private
 		}
 
+		if t.cat == types.TopicCatMe {
+			desc.Notify = t.notify
+			if store.GetMediaHandler() != nil {
+				// Storage usage is expensive to compute, it's cached for a short time.
+				if t.storage == nil || now.Sub(t.storageFetched) > storageUsageCacheTime {
+					if used, quota, err := userStorage(asUid); err == nil {
+						t.storage = &MsgStorage{Used: used, Quota: quota}
+						t.storageFetched = now
+					} else {
+						log.Println("topic: failed to get storage usage", asUid, err)
+					}
+				}
+				desc.Storage = t.storage
+			}
+		} else {
+			desc.Mute = muteState(pud.muted, pud.muteUntil, now)
+		}
+
 		// Don't report message IDs to users without Read access.
 		if (pud.modeGiven & pud.modeWant).IsReader() {
 			desc.SeqId = t.lastID
@@ -1496,6 +1540,18 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, set *MsgClientSet)
 		return nil
 	}
 
+	assignNotify := func(upd map[string]interface{}, notify *types.NotifySettings) error {
+		if err := notify.Validate(); err != nil {
+			return err
+		}
+		if notify.DndUntil == nil && len(notify.Quiet) == 0 && notify.TimeZone == "" && !notify.Mentions {
+			// Empty object clears the settings.
+			notify = nil
+		}
+		upd["Notify"] = notify
+		return nil
+	}
+
 	assignGenericValues := func(upd map[string]interface{}, what string, dst, src interface{}) (changed bool) {
 		if dst, changed = mergeInterfaces(dst, src); changed {
 			upd[what] = dst
@@ -1519,6 +1575,12 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, set *MsgClientSet)
 			// Update current user
 			err = assignAccess(core, set.Desc.DefaultAcs)
 			sendCommon = assignGenericValues(core, "Public", t.public, set.Desc.Public)
+			if err == nil && set.Desc.Notify != nil {
+				// Notification settings are private to the user: let user's other sessions know.
+				if err = assignNotify(core, set.Desc.Notify); err == nil {
+					sendPriv = true
+				}
+			}
 		case types.TopicCatFnd:
 			// set.Desc.DefaultAcs is ignored.
 			// Do not send presence if fnd.Public has changed.
@@ -1546,7 +1608,9 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, set *MsgClientSet)
 			return err
 		}
 
-		sendPriv = assignGenericValues(sub, "Private", t.perUser[asUid].private, set.Desc.Private)
+		if assignGenericValues(sub, "Private", t.perUser[asUid].private, set.Desc.Private) {
+			sendPriv = true
+		}
 	}
 
 	if len(core) > 0 {
@@ -1582,6 +1646,11 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, set *MsgClientSet)
 		if public, ok := core["Public"]; ok {
 			t.public = public
 		}
+		if notify, ok := core["Notify"]; ok {
+			t.notify = notify.(*types.NotifySettings)
+			// Push notifications are filtered using the settings cached by the user's object.
+			usersNotifyChanged(asUid)
+		}
 	} else if t.cat == types.TopicCatFnd {
 		// Assign per-session fnd.Public.
 		t.fndSetPublic(sess, core["Public"])
@@ -1763,6 +1832,9 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 				if with != "" {
 					mts.Topic = with
 					mts.Online = t.perSubs[with].online && !deleted && presencer
+					if sub.GetState() == types.UserStateSuspended {
+						mts.State = userStateSuspended
+					}
 				} else {
 					mts.Topic = sub.Topic
 					mts.Online = t.perSubs[sub.Topic].online && !deleted && presencer
@@ -1849,6 +1921,11 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 				if t.cat == types.TopicCatFnd {
 					mts.Private = sub.Private
 				}
+
+				// State of notifications is reported for user's own subscriptions only.
+				if t.cat == types.TopicCatMe || (uid == asUid && t.cat != types.TopicCatFnd) {
+					mts.Mute = muteState(sub.Muted, sub.MuteUntil, now)
+				}
 			}
 
 			meta.Sub = append(meta.Sub, mts)
@@ -1885,11 +1962,19 @@ func (t *Topic) replySetSub(h *Hub, sess *Session, pkt *ClientComMessage) error
 		target = asUid
 	}
 
+	if set.Sub.Mute != nil && target != asUid {
+		// Users can mute only their own subscriptions.
+		sess.queueOut(ErrPermissionDenied(pkt.id, toriginal, now))
+		return errors.New("attempt to mute someone else's subscription")
+	}
+
 	var err error
 	var changed bool
 	if target == asUid {
-		// Request new subscription or modify own subscription
-		changed, err = t.requestSub(h, sess, asUid, asLvl, pkt.id, set.Sub.Mode, nil, false)
+		if set.Sub.Mode != "" || set.Sub.Mute == nil {
+			// Request new subscription or modify own subscription
+			changed, err = t.requestSub(h, sess, asUid, asLvl, pkt.id, set.Sub.Mode, nil, false)
+		}
 	} else {
 		// Request to approve/change someone's subscription
 		changed, err = t.approveSub(h, sess, asUid, target, set)
@@ -1898,14 +1983,32 @@ func (t *Topic) replySetSub(h *Hub, sess *Session, pkt *ClientComMessage) error
 		return err
 	}
 
+	var muted bool
+	if set.Sub.Mute != nil {
+		if muted, err = t.muteSub(sess, asUid, pkt.id, set.Sub.Mute); err != nil {
+			return err
+		}
+	}
+
 	var resp *ServerComMessage
-	if changed {
-		// Report resulting access mode.
+	if changed || muted {
 		pud := t.perUser[target]
-		params := map[string]interface{}{"acs": MsgAccessMode{
-			Given: pud.modeGiven.String(),
-			Want:  pud.modeWant.String(),
-			Mode:  (pud.modeGiven & pud.modeWant).String()}}
+		params := map[string]interface{}{}
+		if changed {
+			// Report resulting access mode.
+			params["acs"] = MsgAccessMode{
+				Given: pud.modeGiven.String(),
+				Want:  pud.modeWant.String(),
+				Mode:  (pud.modeGiven & pud.modeWant).String()}
+		}
+		if muted {
+			// Report resulting state of notifications.
+			if mute := muteState(pud.muted, pud.muteUntil, now); mute != nil {
+				params["mute"] = mute
+			} else {
+				params["mute"] = &MsgMute{}
+			}
+		}
 		if target != asUid {
 			params["user"] = target.UserId()
 		}
@@ -1919,6 +2022,36 @@ func (t *Topic) replySetSub(h *Hub, sess *Session, pkt *ClientComMessage) error
 	return nil
 }
 
+// muteSub mutes or unmutes push notifications of user's own subscription.
+// Returns true if the subscription was updated.
+func (t *Topic) muteSub(sess *Session, asUid types.Uid, pktID string, mute *MsgMute) (bool, error) {
+	now := types.TimeNow()
+	toriginal := t.original(asUid)
+
+	pud, ok := t.perUser[asUid]
+	if !ok || pud.deleted {
+		sess.queueOut(ErrNotFound(pktID, toriginal, now))
+		return false, errors.New("subscription not found")
+	}
+
+	update, err := parseMute(mute, now)
+	if err != nil {
+		sess.queueOut(ErrMalformed(pktID, toriginal, now))
+		return false, err
+	}
+
+	if err = store.Subs.Update(t.name, asUid, update, true); err != nil {
+		sess.queueOut(ErrUnknown(pktID, toriginal, now))
+		return false, err
+	}
+
+	pud.muted = update["Muted"].(bool)
+	pud.muteUntil = update["MuteUntil"].(*time.Time)
+	t.perUser[asUid] = pud
+
+	return true, nil
+}
+
 // replyGetData is a response to a get.data request - load a list of stored messages, send them to session as {data}
 // response goes to a single session rather than all sessions in a topic
 func (t *Topic) replyGetData(sess *Session, asUid types.Uid, id string, req *MsgGetOpts) error {
@@ -2558,13 +2691,23 @@ func (t *Topic) makePushReceipt(fromUid types.Uid, data *MsgServerData) *push.Re
 			SeqId:     data.SeqId,
 			Content:   data.Content}}
 
-	for uid := range t.perUser {
+	mentioned := make(map[string]bool)
+	for _, id := range drafty.Mentions(data.Content) {
+		mentioned[id] = true
+	}
+
+	now := types.TimeNow()
+	for uid, pud := range t.perUser {
 		// Send only to those who have notifications enabled, exclude the originating user.
 		if uid != fromUid &&
-			(t.perUser[uid].modeWant & t.perUser[uid].modeGiven).IsPresencer() &&
-			!t.perUser[uid].deleted {
+			(pud.modeWant & pud.modeGiven).IsPresencer() &&
+			!pud.deleted {
 
-			receipt.To[uid] = push.Recipient{}
+			// Muted recipients are filtered out later by the user's notification settings.
+			receipt.To[uid] = push.Recipient{
+				Muted:     pud.isMuted(now),
+				Mentioned: mentioned[uid.UserId()],
+			}
 		}
 	}
 	if len(receipt.To) > 0 {
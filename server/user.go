@@ -57,7 +57,7 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 	for i := range creds {
 		cr := &creds[i]
 		vld := store.GetValidator(cr.Method)
-		if err := vld.PreCheck(cr.Value, cr.Params); err != nil {
+		if err := vld.PreCheck(cr.Value, cr.Params, cr.Response); err != nil {
 			log.Println("create user: failed credential pre-check", cr, err, s.sid)
 			s.queueOut(decodeStoreError(err, msg.Acc.Id, "", msg.timestamp,
 				map[string]interface{}{"what": cr.Method}))
@@ -143,7 +143,7 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 	if msg.Acc.Login {
 		// Process user's login request.
 		_, missing := stringSliceDelta(globals.authValidators[rec.AuthLevel], validated)
-		reply = s.onLogin(msg.id, msg.timestamp, rec, missing)
+		reply = s.onLogin(msg.id, msg.timestamp, rec, missing, msg.Acc.Scheme)
 	} else {
 		// Not using the new account for logging in.
 		reply = NoErrCreated(msg.id, "", msg.timestamp)
@@ -475,11 +475,21 @@ func replyDelUser(s *Session, msg *ClientComMessage) {
 		log.Println("replyDelUser: illegal attempt to delete another user", msg.Del.User, s.sid)
 	}
 
+	// Users deleting their own accounts can restore them within the recovery period.
+	deferred := globals.accDeleteGracePeriod > 0 && uid == s.uid
+
 	if reply == nil {
-		// Disable all authenticators
 		authnames := store.GetAuthNames()
+		if deferred {
+			// Keep authentication records so the user can log in to restore the account,
+			// just invalidate issued tokens.
+			authnames = []string{"token", "refresh"}
+		}
+		// Disable all authenticators
 		for _, name := range authnames {
-			if err := store.GetAuthHandler(name).DelRecords(uid); err != nil {
+			if hdl := store.GetAuthHandler(name); hdl == nil {
+				continue
+			} else if err := hdl.DelRecords(uid); err != nil {
 				// This could be completely benign, i.e. authenticator exists but not used.
 				log.Println("replyDelUser: failed to delete auth record", uid.UserId(), name, err, s.sid)
 			}
@@ -511,8 +521,14 @@ func replyDelUser(s *Session, msg *ClientComMessage) {
 			log.Println("replyDelUser: failed to send notifications to owned topics", err, s.sid)
 		}
 
-		// Delete user's records from the database.
-		if err := store.Users.Delete(uid, msg.Del.Hard); err != nil {
+		// Delete user's records from the database or mark them for deletion.
+		var err error
+		if deferred {
+			err = userDeleteDeferred(uid)
+		} else {
+			err = store.Users.Delete(uid, msg.Del.Hard)
+		}
+		if err != nil {
 			reply = decodeStoreError(err, msg.id, "", msg.timestamp, nil)
 			log.Println("replyDelUser: failed to delete user", err, s.sid)
 		} else {
@@ -528,6 +544,187 @@ func replyDelUser(s *Session, msg *ClientComMessage) {
 	}
 }
 
+// Value of the "state" field of topic description and subscription when the other user of a p2p topic is suspended.
+const userStateSuspended = "susp"
+
+// userSuspended checks if the user account is suspended by the administrator. Returns the user record
+// if the account is suspended, nil otherwise. Expired suspension is lifted.
+func userSuspended(uid types.Uid) (*types.User, error) {
+	user, err := store.Users.Get(uid)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, types.ErrUserNotFound
+	}
+	if user.State != types.UserStateSuspended {
+		return nil, nil
+	}
+	if user.SuspendUntil != nil && user.SuspendUntil.Before(time.Now()) {
+		// The suspension has expired but has not been lifted yet.
+		return nil, userUnsuspend(uid)
+	}
+	return user, nil
+}
+
+// userSuspend suspends user account: the user cannot log in, all user's sessions are terminated.
+// If 'until' is not nil, the suspension is lifted automatically at that time.
+func userSuspend(uid types.Uid, reason string, until *time.Time) error {
+	if err := store.Users.Update(uid, map[string]interface{}{
+		"State":         types.UserStateSuspended,
+		"SuspendReason": reason,
+		"SuspendUntil":  until,
+	}); err != nil {
+		return err
+	}
+
+	userTerminateSessions(uid)
+	userStateChanged(uid)
+	return nil
+}
+
+// userUnsuspend lifts the suspension of the user account.
+func userUnsuspend(uid types.Uid) error {
+	if err := store.Users.Update(uid, map[string]interface{}{
+		"State":         types.UserStateNormal,
+		"SuspendReason": "",
+		"SuspendUntil":  (*time.Time)(nil),
+	}); err != nil {
+		return err
+	}
+
+	userStateChanged(uid)
+	return nil
+}
+
+// userTerminateSessions revokes refresh tokens of the user and terminates all user's sessions
+// on all cluster nodes.
+func userTerminateSessions(uid types.Uid) {
+	if hdl := store.GetAuthHandler("refresh"); hdl != nil {
+		if err := hdl.DelRecords(uid); err != nil {
+			log.Println("failed to revoke refresh tokens", uid.UserId(), err)
+		}
+	}
+	globals.sessionStore.EvictUser(uid, "")
+	globals.cluster.evictUser(uid)
+}
+
+// userStateChanged notifies users of interest that the state of user's account has changed,
+// so they can refresh user's description.
+func userStateChanged(uid types.Uid) {
+	if uoi, err := store.Users.GetSubs(uid, nil); err == nil {
+		presUsersOfInterestOffline(uid, uoi, "upd")
+	} else {
+		log.Println("failed to send notifications to users", uid.UserId(), err)
+	}
+}
+
+// userRunSuspensionExpiration periodically lifts expired suspensions of users mastered at this node.
+func userRunSuspensionExpiration(period time.Duration) chan<- bool {
+	// Unbuffered stop channel. Whoever stops it must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		timer := time.Tick(period)
+		for {
+			select {
+			case <-timer:
+				uids, err := store.Users.GetSuspended(time.Now())
+				if err != nil {
+					log.Println("suspension expiration:", err)
+					continue
+				}
+				for _, uid := range uids {
+					if globals.cluster.isRemoteTopic(uid.UserId()) {
+						// The suspension will be lifted by the user's master node.
+						continue
+					}
+					if err := userUnsuspend(uid); err != nil {
+						log.Println("suspension expiration:", uid.UserId(), err)
+					}
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
+
+// userDeleteDeferred disables user account and marks it for deletion. The account is purged
+// when the recovery period expires.
+func userDeleteDeferred(uid types.Uid) error {
+	return store.Users.DeleteDeferred(uid)
+}
+
+// userUndelete restores the account pending deletion if the recovery period has not expired yet.
+// Returns types.ErrNotFound if there is no such account.
+func userUndelete(uid types.Uid) error {
+	if globals.accDeleteGracePeriod <= 0 {
+		return types.ErrNotFound
+	}
+	if err := store.Users.Undelete(uid, time.Now().Add(-globals.accDeleteGracePeriod)); err != nil {
+		return err
+	}
+
+	userStateChanged(uid)
+	return nil
+}
+
+// userPurge permanently deletes the account pending deletion together with user's subscriptions,
+// topics owned by the user and messages in them.
+func userPurge(uid types.Uid) error {
+	for _, name := range store.GetAuthNames() {
+		if err := store.GetAuthHandler(name).DelRecords(uid); err != nil {
+			// This could be completely benign, i.e. authenticator exists but not used.
+			log.Println("account purge: failed to delete auth record", uid.UserId(), name, err)
+		}
+	}
+	return store.Users.Delete(uid, true)
+}
+
+// userRunDeletionPurge periodically purges accounts of users mastered at this node
+// which were deleted more than 'grace' ago.
+func userRunDeletionPurge(period, grace time.Duration) chan<- bool {
+	// Unbuffered stop channel. Whoever stops it must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		timer := time.Tick(period)
+		for {
+			select {
+			case <-timer:
+				uids, err := store.Users.GetDeleted(time.Now().Add(-grace))
+				if err != nil {
+					log.Println("account purge:", err)
+					continue
+				}
+				purged := 0
+				for _, uid := range uids {
+					if globals.cluster.isRemoteTopic(uid.UserId()) {
+						// The account will be purged by the user's master node.
+						continue
+					}
+					if err := userPurge(uid); err != nil {
+						log.Println("account purge:", uid.UserId(), err)
+					} else {
+						purged++
+					}
+				}
+				if purged > 0 && store.GetMediaHandler() != nil {
+					// Delete files which were attached only to messages in the purged topics.
+					if err := store.Files.DeleteUnused(time.Now().Add(-time.Hour), 0); err != nil {
+						log.Println("account purge: failed to delete files", err)
+					}
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
+
 // UserCacheReq contains data which mutates one or more user cache entries.
 type UserCacheReq struct {
 	// Name of the node sending this request in case of cluster. Not set otherwise.
@@ -545,11 +742,17 @@ type UserCacheReq struct {
 
 	// Optional push notification
 	PushRcpt *push.Receipt
+
+	// Push notification settings of the user (UserId is set) have changed.
+	NotifyChanged bool
 }
 
 type userCacheEntry struct {
 	unread int
 	topics int
+	// Push notification settings, valid if notifyLoaded is true.
+	notify       *types.NotifySettings
+	notifyLoaded bool
 }
 
 var usersCache map[types.Uid]userCacheEntry
@@ -587,6 +790,24 @@ func usersUpdateUnread(uid types.Uid, val int, inc bool) {
 	}
 }
 
+// Invalidate cached push notification settings of the user.
+func usersNotifyChanged(uid types.Uid) {
+	if globals.usersUpdate == nil {
+		return
+	}
+
+	upd := &UserCacheReq{UserId: uid, NotifyChanged: true}
+	if globals.cluster.isRemoteTopic(uid.UserId()) {
+		// Send request to remote node which owns the user.
+		globals.cluster.routeUserReq(upd)
+	} else {
+		select {
+		case globals.usersUpdate <- upd:
+		default:
+		}
+	}
+}
+
 // Process push notification.
 func usersPush(rcpt *push.Receipt) {
 	if globals.usersUpdate == nil {
@@ -728,6 +949,40 @@ func userUpdater() {
 		return uce.unread
 	}
 
+	// Returns push notification settings of the recipients. Settings missing from the cache are
+	// loaded in one query.
+	notifyLoader := func(rcpt map[types.Uid]push.Recipient) map[types.Uid]*types.NotifySettings {
+		settings := make(map[types.Uid]*types.NotifySettings, len(rcpt))
+		var missing []types.Uid
+		for uid := range rcpt {
+			if uce, ok := usersCache[uid]; ok && uce.notifyLoaded {
+				settings[uid] = uce.notify
+			} else {
+				missing = append(missing, uid)
+			}
+		}
+		if len(missing) == 0 {
+			return settings
+		}
+
+		users, err := store.Users.GetAll(missing...)
+		if err != nil {
+			log.Println("users: failed to load notification settings", err)
+			return settings
+		}
+		for i := range users {
+			uid := users[i].Uid()
+			settings[uid] = users[i].Notify
+			// Users who are not in cache are not added to it: the entry would never be evicted.
+			if uce, ok := usersCache[uid]; ok {
+				uce.notify = users[i].Notify
+				uce.notifyLoaded = true
+				usersCache[uid] = uce
+			}
+		}
+		return settings
+	}
+
 	for upd := range globals.usersUpdate {
 		if globals.shuttingDown {
 			// If shutdown is in progress we don't care to process anything.
@@ -744,6 +999,8 @@ func userUpdater() {
 
 		// Request to send push notifications.
 		if upd.PushRcpt != nil {
+			now := types.TimeNow()
+			notifySettings := notifyLoader(upd.PushRcpt.To)
 			for uid, rcptTo := range upd.PushRcpt.To {
 				// Handle update
 				unread := unreadUpdater(uid, 1, true)
@@ -751,9 +1008,28 @@ func userUpdater() {
 					rcptTo.Unread = unread
 					upd.PushRcpt.To[uid] = rcptTo
 				}
+
+				// Skip users who muted the topic or don't want to be disturbed now,
+				// unless they asked to be notified about mentions.
+				notify := notifySettings[uid]
+				if (rcptTo.Muted || notify.IsQuiet(now)) && !(rcptTo.Mentioned && notify != nil && notify.Mentions) {
+					delete(upd.PushRcpt.To, uid)
+				}
+			}
+
+			if len(upd.PushRcpt.To) > 0 {
+				push.Push(upd.PushRcpt)
 			}
+			continue
+		}
 
-			push.Push(upd.PushRcpt)
+		// Notification settings have changed, reload them when needed.
+		if upd.NotifyChanged {
+			if uce, ok := usersCache[upd.UserId]; ok {
+				uce.notify = nil
+				uce.notifyLoaded = false
+				usersCache[upd.UserId] = uce
+			}
 			continue
 		}
 
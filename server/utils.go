@@ -20,6 +20,7 @@ import (
 	"unicode/utf8"
 
 	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/push"
 	"github.com/tinode/chat/server/store/types"
 
 	"golang.org/x/crypto/acme/autocert"
@@ -274,6 +275,8 @@ func decodeStoreError(err error, id, topic string, timestamp time.Time,
 			errmsg = ErrNotFound(id, topic, timestamp)
 		case types.ErrInvalidResponse:
 			errmsg = ErrInvalidResponse(id, topic, timestamp)
+		case types.ErrConflict:
+			errmsg = ErrConflict(id, topic, timestamp)
 		default:
 			errmsg = ErrUnknown(id, topic, timestamp)
 		}
@@ -338,6 +341,25 @@ func parseTopicAccess(acs *MsgDefaultAcsMode, defAuth, defAnon types.AccessMode)
 	return
 }
 
+// Parse request to mute or unmute push notifications. Returns subscription fields to update.
+func parseMute(mute *MsgMute, now time.Time) (map[string]interface{}, error) {
+	if !mute.Muted {
+		return map[string]interface{}{"Muted": false, "MuteUntil": (*time.Time)(nil)}, nil
+	}
+	if mute.Until != nil && !mute.Until.After(now) {
+		return nil, errors.New("mute expiration time is in the past")
+	}
+	return map[string]interface{}{"Muted": true, "MuteUntil": mute.Until}, nil
+}
+
+// Convert state of push notifications of the subscription to wire format. Returns nil if not muted.
+func muteState(muted bool, until *time.Time, now time.Time) *MsgMute {
+	if !muted || (until != nil && !until.After(now)) {
+		return nil
+	}
+	return &MsgMute{Muted: true, Until: until}
+}
+
 // Parses version in the following formats:
 //  1.2 | 1.2abc | 1.2.3 | 1.2.3abc
 // The major and minor parts must be valid, the trailer is ignored if missing or unparceable.
@@ -596,6 +618,19 @@ func platformFromUA(ua string) string {
 	return ""
 }
 
+// Platform to save with the device ID. APNs tokens and Web Push subscriptions are delivered
+// by different handlers than FCM tokens of the same client, the client reports the push
+// service which issued the device ID. Web Push subscriptions are JSON objects.
+func devicePlatform(deviceID, pushSvc, platf string) string {
+	if pushSvc == push.PlatformAPNs || pushSvc == push.PlatformWebPush {
+		return pushSvc
+	}
+	if strings.HasPrefix(deviceID, "{") {
+		return push.PlatformWebPush
+	}
+	return platf
+}
+
 func parseTLSConfig(tlsEnabled bool, jsconfig json.RawMessage) (*tls.Config, error) {
 	type tlsAutocertConfig struct {
 		// Domains to support by autocert
@@ -0,0 +1,124 @@
+package captcha
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+const (
+	// Audio is 8 bit mono PCM.
+	sampleRate = 8000
+	// Duration of one beep in samples.
+	beepLength = sampleRate / 5
+	// Duration of a distracting chirp in samples.
+	chirpLength = sampleRate / 20
+	// Minimum silence between beeps in samples.
+	beepSilence = sampleRate / 10
+	// Silence between digits in samples.
+	digitSilence = sampleRate
+	// Silence at the start and at the end in samples.
+	leadSilence = sampleRate / 2
+	// Amplitude of the background noise. Beeps and chirps have random amplitude
+	// between minLevel and maxLevel.
+	noiseLevel = 24
+	minLevel   = 50
+	maxLevel   = 100
+)
+
+// renderAudio encodes the answer as a WAV file. Each digit is a series of long beeps: one beep for 1,
+// two beeps for 2 and so on, ten beeps for 0. To make automatic recognition harder, beeps have random
+// pitch, loudness and spacing, the audio is noisy, and short chirps of similar pitch and loudness
+// are mixed in between the beeps. The listener must count the long beeps only.
+//
+// Audio challenges are still easier to solve automatically than image challenges.
+func renderAudio(answer string) ([]byte, error) {
+	var samples []byte
+
+	silence := func(n int) {
+		for i := 0; i < n; i++ {
+			samples = append(samples, sample(0))
+		}
+	}
+
+	tone := func(length int) {
+		freq := float64(400 + randInt(600))
+		// Pitch slides up or down a little.
+		slide := float64(randInt(201)-100) / float64(length)
+		level := float64(minLevel + randInt(maxLevel-minLevel+1))
+		for j := 0; j < length; j++ {
+			// Fade in and out to avoid clicks.
+			env := math.Sin(math.Pi * float64(j) / float64(length))
+			f := freq + slide*float64(j)
+			samples = append(samples, sample(level*env*math.Sin(2*math.Pi*f*float64(j)/sampleRate)))
+		}
+	}
+
+	// pause is a silence of random length with optional distracting chirps.
+	pause := func(n int) {
+		silence(n/2 + randInt(n/2))
+		for c := randInt(3); c > 0; c-- {
+			tone(chirpLength)
+			silence(beepSilence/2 + randInt(beepSilence))
+		}
+	}
+
+	silence(leadSilence)
+	for i, ch := range answer {
+		if i > 0 {
+			pause(digitSilence)
+		}
+		beeps := int(ch - '0')
+		if beeps == 0 {
+			beeps = 10
+		}
+		for b := 0; b < beeps; b++ {
+			if b > 0 {
+				pause(beepSilence * 2)
+			}
+			tone(beepLength)
+		}
+	}
+	silence(leadSilence)
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("RIFF")
+	binary.Write(buf, binary.LittleEndian, uint32(36+len(samples)))
+	buf.WriteString("WAVE")
+
+	buf.WriteString("fmt ")
+	binary.Write(buf, binary.LittleEndian, struct {
+		Size          uint32
+		Format        uint16
+		Channels      uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+	}{
+		Size:          16,
+		Format:        1, // PCM
+		Channels:      1,
+		SampleRate:    sampleRate,
+		ByteRate:      sampleRate,
+		BlockAlign:    1,
+		BitsPerSample: 8,
+	})
+
+	buf.WriteString("data")
+	binary.Write(buf, binary.LittleEndian, uint32(len(samples)))
+	buf.Write(samples)
+
+	return buf.Bytes(), nil
+}
+
+// sample converts the signal value to an unsigned 8 bit sample adding random noise.
+func sample(v float64) byte {
+	s := 128 + int(v) + randInt(2*noiseLevel+1) - noiseLevel
+	if s < 0 {
+		s = 0
+	} else if s > 255 {
+		s = 255
+	}
+	return byte(s)
+}
@@ -0,0 +1,141 @@
+package captcha
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/rand"
+)
+
+const (
+	// Size of a glyph in font pixels.
+	glyphWidth  = 5
+	glyphHeight = 7
+	// Size of one font pixel in image pixels.
+	glyphScale = 5
+	// Space between glyphs in image pixels.
+	glyphGap = 8
+	// Padding around the text.
+	imagePadding = 16
+)
+
+// 5x7 bitmap font for digits, one row per byte, the highest of the five low bits is the leftmost pixel.
+var digitGlyphs = [10][glyphHeight]byte{
+	{0x0E, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0E}, // 0
+	{0x04, 0x0C, 0x04, 0x04, 0x04, 0x04, 0x0E}, // 1
+	{0x0E, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1F}, // 2
+	{0x1F, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0E}, // 3
+	{0x02, 0x06, 0x0A, 0x12, 0x1F, 0x02, 0x02}, // 4
+	{0x1F, 0x10, 0x1E, 0x01, 0x01, 0x11, 0x0E}, // 5
+	{0x06, 0x08, 0x10, 0x1E, 0x11, 0x11, 0x0E}, // 6
+	{0x1F, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08}, // 7
+	{0x0E, 0x11, 0x11, 0x0E, 0x11, 0x11, 0x0E}, // 8
+	{0x0E, 0x11, 0x11, 0x0F, 0x01, 0x02, 0x0C}, // 9
+}
+
+// randInt returns a random number in [0, max). Distortions need not be cryptographically random,
+// only the answer does.
+func randInt(max int) int {
+	return rand.Intn(max)
+}
+
+// renderImage draws the answer as a distorted PNG image.
+func renderImage(answer string) ([]byte, error) {
+	width := imagePadding*2 + len(answer)*(glyphWidth*glyphScale+glyphGap) - glyphGap
+	height := imagePadding*2 + glyphHeight*glyphScale
+
+	// Draw the text undistorted first.
+	text := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range text.Pix {
+		text.Pix[i] = 0xFF
+	}
+	for i, ch := range answer {
+		glyph := digitGlyphs[ch-'0']
+		// Shift every glyph up or down randomly.
+		x0 := imagePadding + i*(glyphWidth*glyphScale+glyphGap) + randInt(5) - 2
+		y0 := imagePadding + randInt(glyphScale*2+1) - glyphScale
+		for row := 0; row < glyphHeight; row++ {
+			for col := 0; col < glyphWidth; col++ {
+				if glyph[row]&(1<<uint(glyphWidth-1-col)) == 0 {
+					continue
+				}
+				for dy := 0; dy < glyphScale; dy++ {
+					for dx := 0; dx < glyphScale; dx++ {
+						text.SetGray(x0+col*glyphScale+dx, y0+row*glyphScale+dy, color.Gray{})
+					}
+				}
+			}
+		}
+	}
+
+	// Warp the text along sine waves in both directions.
+	ampX, ampY := 2+float64(randInt(3)), 3+float64(randInt(3))
+	periodX, periodY := 20+float64(randInt(20)), 40+float64(randInt(40))
+	phaseX, phaseY := float64(randInt(628))/100, float64(randInt(628))/100
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	ink := color.RGBA{R: uint8(randInt(80)), G: uint8(randInt(80)), B: uint8(80 + randInt(100)), A: 0xFF}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			sx := x + int(ampX*math.Sin(float64(y)/periodX*2*math.Pi+phaseX))
+			sy := y + int(ampY*math.Sin(float64(x)/periodY*2*math.Pi+phaseY))
+			if image.Pt(sx, sy).In(text.Rect) && text.GrayAt(sx, sy).Y == 0 {
+				img.Set(x, y, ink)
+			} else {
+				img.Set(x, y, color.RGBA{R: 0xF0, G: 0xF0, B: 0xF0, A: 0xFF})
+			}
+		}
+	}
+
+	// Add noise: random dots and lines across the text.
+	for i := 0; i < width*height/20; i++ {
+		c := uint8(randInt(200))
+		img.Set(randInt(width), randInt(height), color.RGBA{R: c, G: c, B: c, A: 0xFF})
+	}
+	for i := 0; i < 4; i++ {
+		drawLine(img, randInt(width/4), randInt(height), width-1-randInt(width/4), randInt(height), ink)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// drawLine draws a two pixel wide line using Bresenham's algorithm.
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.Color) {
+	dx, dy := x1-x0, y1-y0
+	if dx < 0 {
+		dx = -dx
+	}
+	if dy < 0 {
+		dy = -dy
+	}
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	err := dx - dy
+	for {
+		img.Set(x0, y0, c)
+		img.Set(x0, y0+1, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * err
+		if e2 > -dy {
+			err -= dy
+			x0 += sx
+		}
+		if e2 < dx {
+			err += dx
+			y0 += sy
+		}
+	}
+}
@@ -0,0 +1,334 @@
+// Package captcha implements a CAPTCHA credential validator. Challenges are generated server-side
+// as images or audio and must be solved in the same request which adds the credential, i.e.
+// in the {acc} which creates an account. The answer is checked before the account is created.
+//
+// The challenge ID is the answer and the expiration time encrypted with the server key, so no state
+// is kept between issuing the challenge and checking the answer, and any cluster node can check it.
+// A solved challenge is saved as a confirmed credential. Confirmed credentials are unique, so the
+// challenge cannot be solved again on any node or after a restart.
+package captcha
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// Validator configuration.
+type validator struct {
+	// Key for encrypting challenge IDs, 16, 24 or 32 bytes, base64-encoded. Must be the same on all
+	// cluster nodes. A random key is generated if missing.
+	Key []byte `json:"key"`
+	// Number of digits in the challenge.
+	Length int `json:"length"`
+	// Challenge lifetime in seconds.
+	ExpiresIn int `json:"expires_in"`
+	// Number of failed answers before the challenge is rejected.
+	MaxRetries int `json:"max_retries"`
+	// Allow audio challenges. Audio challenges are easier to solve automatically than
+	// image challenges. Enable them only if required for accessibility.
+	Audio bool `json:"audio"`
+
+	aead cipher.AEAD
+
+	// Number of attempts to answer each challenge, indexed by challenge ID.
+	// Counts are kept in memory of each node.
+	attemptsLock sync.Mutex
+	attempts     map[string]*attempt
+}
+
+// attempt is a record of attempts to answer a challenge.
+type attempt struct {
+	count   int
+	expires time.Time
+}
+
+const (
+	validatorName = "captcha"
+
+	defaultLength     = 6
+	maxLength         = 10
+	defaultExpiresIn  = 300
+	defaultMaxRetries = 3
+
+	// Formats of challenges.
+	FormatImage = "png"
+	FormatAudio = "wav"
+)
+
+// The registered instance of the validator.
+var handler validator
+
+// Init: initialize validator.
+func (v *validator) Init(jsonconf string) error {
+	var err error
+	if err = json.Unmarshal([]byte(jsonconf), v); err != nil {
+		return err
+	}
+
+	if len(v.Key) == 0 {
+		log.Println("captcha: key is not configured, using a random key; challenges are valid on this node only")
+		v.Key = make([]byte, 32)
+		if _, err = rand.Read(v.Key); err != nil {
+			return err
+		}
+	}
+	block, err := aes.NewCipher(v.Key)
+	if err != nil {
+		return errors.New("captcha: invalid key: " + err.Error())
+	}
+	if v.aead, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+
+	if v.Length <= 0 {
+		v.Length = defaultLength
+	} else if v.Length > maxLength {
+		v.Length = maxLength
+	}
+	if v.ExpiresIn <= 0 {
+		v.ExpiresIn = defaultExpiresIn
+	}
+	if v.MaxRetries <= 0 {
+		v.MaxRetries = defaultMaxRetries
+	}
+
+	v.attempts = make(map[string]*attempt)
+	go func() {
+		for range time.Tick(time.Duration(v.ExpiresIn) * time.Second) {
+			v.expireAttempts()
+		}
+	}()
+
+	return nil
+}
+
+// PreCheck checks the answer to the challenge before the account is created.
+// The challenge remains valid until the credential is saved by Request.
+func (v *validator) PreCheck(cred string, params interface{}, resp string) error {
+	if resp == "" {
+		return t.ErrCredentials
+	}
+	return v.verify(cred, resp, false)
+}
+
+// Request checks the answer to the challenge and saves the credential as validated.
+// The challenge must be answered in the same request.
+func (v *validator) Request(user t.Uid, cred, lang, resp string, tmpToken []byte) (bool, error) {
+	if resp == "" {
+		return false, t.ErrCredentials
+	}
+
+	if err := v.verify(cred, resp, true); err != nil {
+		return false, err
+	}
+
+	isNew, err := store.Users.UpsertCred(&t.Credential{
+		User:   user.String(),
+		Method: validatorName,
+		Value:  cred,
+		Resp:   resp})
+	if err != nil {
+		return false, err
+	}
+
+	return isNew, store.Users.ConfirmCred(user, validatorName)
+}
+
+// Normalize returns the challenge ID unchanged.
+func (*validator) Normalize(cred string) (string, error) {
+	return cred, nil
+}
+
+// ResetSecret is not supported: CAPTCHA cannot be used to deliver messages.
+func (*validator) ResetSecret(cred, scheme, lang string, tmpToken []byte) error {
+	return t.ErrUnsupported
+}
+
+// Check checks the answer to the challenge of an unconfirmed credential.
+func (v *validator) Check(user t.Uid, resp string) (string, error) {
+	cred, err := store.Users.GetActiveCred(user, validatorName)
+	if err != nil {
+		return "", err
+	}
+
+	if cred == nil {
+		// Request to validate non-existent credential.
+		return "", t.ErrNotFound
+	}
+
+	if resp == "" {
+		return "", t.ErrCredentials
+	}
+
+	if err = v.verify(cred.Value, resp, true); err != nil {
+		if err == t.ErrCredentials {
+			// Invalid response, increment fail counter, ignore possible error.
+			store.Users.FailCred(user, validatorName)
+		}
+		return "", err
+	}
+
+	return cred.Value, store.Users.ConfirmCred(user, validatorName)
+}
+
+// Delete deletes user's records.
+func (*validator) Delete(user t.Uid) error {
+	return store.Users.DelCred(user, validatorName, "")
+}
+
+// Remove deactivates or removes user's credential.
+func (*validator) Remove(user t.Uid, value string) error {
+	return store.Users.DelCred(user, validatorName, value)
+}
+
+// newID generates a random answer and encrypts it into a challenge ID.
+func (v *validator) newID() (string, error) {
+	answer := make([]byte, v.Length)
+	for i := range answer {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		answer[i] = byte('0' + n.Int64())
+	}
+
+	// Plaintext is [8:expires][answer].
+	plain := make([]byte, 8, 8+len(answer))
+	binary.BigEndian.PutUint64(plain, uint64(time.Now().Add(time.Duration(v.ExpiresIn)*time.Second).Unix()))
+	plain = append(plain, answer...)
+
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(v.aead.Seal(nonce, nonce, plain, nil)), nil
+}
+
+// decodeID decrypts the challenge ID and returns the answer and the expiration time.
+func (v *validator) decodeID(id string) (string, time.Time, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil || len(sealed) < v.aead.NonceSize() {
+		return "", time.Time{}, t.ErrMalformed
+	}
+
+	nonceSize := v.aead.NonceSize()
+	plain, err := v.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil || len(plain) <= 8 {
+		return "", time.Time{}, t.ErrMalformed
+	}
+
+	return string(plain[8:]), time.Unix(int64(binary.BigEndian.Uint64(plain[:8])), 0), nil
+}
+
+// verify checks the answer to the challenge. If solved is true, the challenge cannot be answered again
+// on this node. Other nodes reject it once the credential is confirmed.
+func (v *validator) verify(id, resp string, solved bool) error {
+	answer, expires, err := v.decodeID(id)
+	if err != nil {
+		return err
+	}
+	if time.Now().After(expires) {
+		return t.ErrExpired
+	}
+
+	// Check if the challenge is already solved on any node.
+	if uid, err := store.Users.GetByCred(validatorName, id); err != nil {
+		return err
+	} else if !uid.IsZero() {
+		return t.ErrPolicy
+	}
+
+	v.attemptsLock.Lock()
+	defer v.attemptsLock.Unlock()
+
+	att := v.attempts[id]
+	if att == nil {
+		att = &attempt{expires: expires}
+		v.attempts[id] = att
+	}
+	if att.count >= v.MaxRetries {
+		// Too many failed attempts or the challenge is already solved.
+		return t.ErrPolicy
+	}
+
+	// Ignore spaces which the user may enter between digits.
+	if strings.Replace(resp, " ", "", -1) != answer {
+		att.count++
+		return t.ErrCredentials
+	}
+
+	if solved {
+		// The challenge cannot be reused.
+		att.count = v.MaxRetries
+	}
+	return nil
+}
+
+// expireAttempts removes records of expired challenges.
+func (v *validator) expireAttempts() {
+	now := time.Now()
+
+	v.attemptsLock.Lock()
+	defer v.attemptsLock.Unlock()
+
+	for id, att := range v.attempts {
+		if att.expires.Before(now) {
+			delete(v.attempts, id)
+		}
+	}
+}
+
+// Challenge creates a new challenge if id is blank or renders an existing one in the given format
+// (FormatImage or FormatAudio). Returns the challenge ID, the content and its MIME type.
+func Challenge(id, format string) (string, []byte, string, error) {
+	if handler.aead == nil {
+		return "", nil, "", errors.New("captcha: validator is not initialized")
+	}
+
+	var err error
+	if id == "" {
+		if id, err = handler.newID(); err != nil {
+			return "", nil, "", err
+		}
+	}
+
+	answer, expires, err := handler.decodeID(id)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if time.Now().After(expires) {
+		return "", nil, "", t.ErrExpired
+	}
+
+	switch format {
+	case FormatImage, "":
+		data, err := renderImage(answer)
+		return id, data, "image/png", err
+	case FormatAudio:
+		if !handler.Audio {
+			return "", nil, "", t.ErrUnsupported
+		}
+		data, err := renderAudio(answer)
+		return id, data, "audio/wav", err
+	default:
+		return "", nil, "", t.ErrMalformed
+	}
+}
+
+func init() {
+	store.RegisterValidator(validatorName, &handler)
+}
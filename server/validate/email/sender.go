@@ -0,0 +1,243 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// SMTP connection security modes.
+const (
+	// Use STARTTLS if the server supports it.
+	tlsModeOpportunistic = ""
+	// Require STARTTLS.
+	tlsModeStartTLS = "starttls"
+	// Implicit TLS, usually on port 465.
+	tlsModeImplicit = "tls"
+)
+
+const (
+	// Number of messages which can wait for delivery.
+	defaultQueueSize = 1024
+	// Number of delivery attempts before the message is dropped.
+	defaultSendAttempts = 5
+	// Delay before the first retry. It's doubled after each failed attempt.
+	defaultRetryBackoff = 10 * time.Second
+	// Maximum delay between retries.
+	maxRetryBackoff = 30 * time.Minute
+	// Timeout of the entire SMTP session.
+	smtpTimeout = time.Minute
+)
+
+// message is an email waiting for delivery.
+type message struct {
+	to      string
+	subject string
+	// Plain text and HTML bodies. Either one may be blank.
+	plain string
+	html  string
+	// Number of delivery attempts made so far.
+	attempts int
+}
+
+// startSender starts the goroutine which delivers queued messages.
+func (v *validator) startSender() {
+	v.queue = make(chan *message, v.QueueSize)
+	go func() {
+		for msg := range v.queue {
+			v.deliver(msg)
+		}
+	}()
+}
+
+// enqueue schedules the message for delivery without blocking the caller.
+func (v *validator) enqueue(msg *message) {
+	select {
+	case v.queue <- msg:
+	default:
+		log.Println("email: queue full, message dropped", msg.to)
+	}
+}
+
+// deliver attempts to send the message. Failed deliveries are retried with exponential backoff
+// unless the failure is permanent.
+func (v *validator) deliver(msg *message) {
+	msg.attempts++
+	err := v.send(msg.to, v.compose(msg))
+	if err == nil {
+		return
+	}
+
+	if isPermanentError(err) || msg.attempts >= v.SendAttempts {
+		log.Println("email: failed to deliver message", msg.to, msg.attempts, err)
+		return
+	}
+
+	delay := v.retryBackoff << uint(msg.attempts-1)
+	if delay > maxRetryBackoff || delay <= 0 {
+		delay = maxRetryBackoff
+	}
+	log.Println("email: delivery failed, will retry", msg.to, delay, err)
+	time.AfterFunc(delay, func() { v.enqueue(msg) })
+}
+
+// isPermanentError checks if the SMTP server rejected the message permanently (5xx response).
+func isPermanentError(err error) bool {
+	var smtpErr *textproto.Error
+	return errors.As(err, &smtpErr) && smtpErr.Code >= 500
+}
+
+// compose creates an RFC 5322 message. If both plain text and HTML bodies are present,
+// the message is multipart/alternative.
+func (v *validator) compose(msg *message) []byte {
+	buf := new(bytes.Buffer)
+
+	header := func(key, value string) {
+		buf.WriteString(key + ": " + value + "\r\n")
+	}
+
+	header("From", v.SendFrom)
+	header("To", msg.to)
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", "<"+randomString()+"@"+v.senderDomain+">")
+	header("MIME-Version", "1.0")
+
+	writePart := func(wrt io.Writer, body string) {
+		qp := quotedprintable.NewWriter(wrt)
+		qp.Write([]byte(body))
+		qp.Close()
+	}
+
+	if msg.plain == "" || msg.html == "" {
+		contentType := "text/html; charset=UTF-8"
+		body := msg.html
+		if body == "" {
+			contentType = "text/plain; charset=UTF-8"
+			body = msg.plain
+		}
+		header("Content-Type", contentType)
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		writePart(buf, body)
+		return buf.Bytes()
+	}
+
+	parts := new(bytes.Buffer)
+	mpw := multipart.NewWriter(parts)
+	header("Content-Type", "multipart/alternative; boundary=\""+mpw.Boundary()+"\"")
+	buf.WriteString("\r\n")
+
+	// The preferred alternative goes last.
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=UTF-8", msg.plain},
+		{"text/html; charset=UTF-8", msg.html},
+	} {
+		pw, _ := mpw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		writePart(pw, part.body)
+	}
+	mpw.Close()
+	buf.Write(parts.Bytes())
+
+	return buf.Bytes()
+}
+
+// send delivers the message to the SMTP server. The connection is protected by TLS according
+// to the configured mode.
+//
+// See here how to send email from Amazon SES:
+// https://docs.aws.amazon.com/sdk-for-go/api/service/ses/#example_SES_SendEmail_shared00
+// -
+// Here are instructions for Google cloud:
+// https://cloud.google.com/appengine/docs/standard/go/mail/sending-receiving-with-mail-api
+func (v *validator) send(to string, data []byte) error {
+	addr := net.JoinHostPort(v.SMTPAddr, v.SMTPPort)
+	tlsConf := &tls.Config{ServerName: v.SMTPAddr, InsecureSkipVerify: v.InsecureSkipVerify}
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+
+	var conn net.Conn
+	var err error
+	if v.TLSMode == tlsModeImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConf)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c, err := smtp.NewClient(conn, v.SMTPAddr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if v.TLSMode != tlsModeImplicit {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err = c.StartTLS(tlsConf); err != nil {
+				return err
+			}
+		} else if v.TLSMode == tlsModeStartTLS {
+			return errors.New("smtp: server does not support STARTTLS")
+		}
+	}
+
+	if v.auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err = c.Auth(v.auth); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = c.Mail(v.senderEmail); err != nil {
+		return err
+	}
+	if err = c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// randomString generates a random string for use in Message-ID.
+func randomString() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// domainOf returns the domain part of an email address.
+func domainOf(addr string) string {
+	if at := strings.LastIndex(addr, "@"); at >= 0 {
+		return addr[at+1:]
+	}
+	return "localhost"
+}
@@ -0,0 +1,462 @@
+package email
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpStandIn is a minimal SMTP server which accepts messages and reports them over a channel.
+type smtpStandIn struct {
+	listener net.Listener
+	tlsConf  *tls.Config
+	// Advertise and support STARTTLS.
+	startTLS bool
+	// Required AUTH PLAIN credentials, if any.
+	login, password string
+	// Number of initial transactions to reject with the given code.
+	failCount int
+	failCode  string
+
+	received chan *mail.Message
+	attempts chan struct{}
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	return &smtpStandIn{
+		tlsConf:  &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}},
+		received: make(chan *mail.Message, 10),
+		attempts: make(chan struct{}, 10),
+	}
+}
+
+// start starts accepting connections. The stand-in must be configured before it's started.
+func (srv *smtpStandIn) start(t *testing.T, implicitTLS bool) {
+	var err error
+	if implicitTLS {
+		srv.listener, err = tls.Listen("tcp", "127.0.0.1:0", srv.tlsConf)
+	} else {
+		srv.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := srv.listener.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+}
+
+func (srv *smtpStandIn) port() string {
+	_, port, _ := net.SplitHostPort(srv.listener.Addr().String())
+	return port
+}
+
+func (srv *smtpStandIn) close() {
+	srv.listener.Close()
+}
+
+func (srv *smtpStandIn) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+
+	rd := bufio.NewReader(conn)
+	reply := func(line string) {
+		io.WriteString(conn, line+"\r\n")
+	}
+	_, secure := conn.(*tls.Conn)
+	authenticated := srv.login == ""
+
+	reply("220 localhost ESMTP stand-in")
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch cmd {
+		case "EHLO", "HELO":
+			ext := []string{"250-localhost"}
+			if srv.startTLS && !secure {
+				ext = append(ext, "250-STARTTLS")
+			}
+			if srv.login != "" {
+				ext = append(ext, "250-AUTH PLAIN")
+			}
+			ext = append(ext, "250 8BITMIME")
+			reply(strings.Join(ext, "\r\n"))
+		case "STARTTLS":
+			reply("220 ready to start TLS")
+			tlsConn := tls.Server(conn, srv.tlsConf)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, rd, secure = tlsConn, bufio.NewReader(tlsConn), true
+		case "AUTH":
+			parts := strings.Fields(line)
+			if len(parts) != 3 || parts[1] != "PLAIN" {
+				reply("504 unsupported")
+				continue
+			}
+			creds, _ := base64.StdEncoding.DecodeString(parts[2])
+			if string(creds) == "\x00"+srv.login+"\x00"+srv.password {
+				authenticated = true
+				reply("235 authenticated")
+			} else {
+				reply("535 authentication failed")
+			}
+		case "MAIL":
+			srv.attempts <- struct{}{}
+			if !authenticated {
+				reply("530 authentication required")
+			} else if srv.failCount > 0 {
+				srv.failCount--
+				reply(srv.failCode + " try again")
+			} else {
+				reply("250 ok")
+			}
+		case "RCPT":
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := rd.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			msg, err := mail.ReadMessage(strings.NewReader(data.String()))
+			if err != nil {
+				reply("554 malformed message")
+				continue
+			}
+			srv.received <- msg
+			reply("250 accepted")
+		case "RSET", "NOOP":
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+// selfSignedCert generates a certificate for 127.0.0.1.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templ := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, templ, templ, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeTemplates creates default and localized templates in a temporary directory.
+func writeTemplates(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "email-templ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"reset.templ": `{{define "body_plain"}}Reset {{.Scheme}}: {{.HostUrl}}#reset?token={{.Token}}{{end}}` +
+			`{{define "body_html"}}<p>Reset <a href="{{.HostUrl}}#reset?token={{.Token}}">{{.Scheme}}</a></p>{{end}}`,
+		"reset.ru.templ": `{{define "subject"}}Сброс пароля{{end}}` +
+			`{{define "body_plain"}}Сброс {{.Scheme}}{{end}}{{define "body_html"}}<p>Сброс {{.Scheme}}</p>{{end}}`,
+		"validation.templ": `<p>Code {{.Code}}</p>`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func newTestValidator(t *testing.T, dir string, conf map[string]interface{}) *validator {
+	config := map[string]interface{}{
+		"host_url":              "http://localhost:6060/",
+		"smtp_server":           "127.0.0.1",
+		"sender":                "\"Tinode\" <noreply@example.com>",
+		"validation_body_templ": filepath.Join(dir, "validation.templ"),
+		"validation_subject":    "Confirm email",
+		"reset_body_templ":      filepath.Join(dir, "reset.templ"),
+		"reset_subject":         "Reset password",
+		"insecure_skip_verify":  true,
+	}
+	for key, val := range conf {
+		config[key] = val
+	}
+	jsonconf, _ := json.Marshal(config)
+
+	v := &validator{}
+	if err := v.Init(string(jsonconf)); err != nil {
+		t.Fatal(err)
+	}
+	// Retry quickly.
+	v.retryBackoff = 10 * time.Millisecond
+	return v
+}
+
+func waitMessage(t *testing.T, srv *smtpStandIn) *mail.Message {
+	select {
+	case msg := <-srv.received:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not delivered")
+	}
+	return nil
+}
+
+// readParts returns bodies of a multipart message indexed by content type.
+func readParts(t *testing.T, msg *mail.Message) map[string]string {
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("expected multipart/alternative, got %s", mediaType)
+	}
+
+	parts := make(map[string]string)
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(quotedprintable.NewReader(part))
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		parts[contentType] = string(body)
+	}
+	return parts
+}
+
+func TestMultipartDelivery(t *testing.T) {
+	dir := writeTemplates(t)
+	defer os.RemoveAll(dir)
+
+	srv := newSMTPStandIn(t)
+	srv.start(t, false)
+	defer srv.close()
+
+	v := newTestValidator(t, dir, map[string]interface{}{"smtp_port": srv.port()})
+	if err := v.ResetSecret("alice@example.com", "basic", "en-US", []byte("token")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := waitMessage(t, srv)
+	if to := msg.Header.Get("To"); to != "alice@example.com" {
+		t.Error("wrong recipient", to)
+	}
+	if subj := msg.Header.Get("Subject"); subj != "Reset password" {
+		t.Error("wrong subject", subj)
+	}
+
+	parts := readParts(t, msg)
+	if !strings.HasPrefix(parts["text/plain"], "Reset basic: http://localhost:6060/#reset?token=") {
+		t.Error("wrong plain text body", parts["text/plain"])
+	}
+	if !strings.Contains(parts["text/html"], "<a href=\"http://localhost:6060/#reset?token=") {
+		t.Error("wrong HTML body", parts["text/html"])
+	}
+}
+
+func TestLocalizedTemplates(t *testing.T) {
+	dir := writeTemplates(t)
+	defer os.RemoveAll(dir)
+
+	lt, err := loadTemplates(filepath.Join(dir, "reset.templ"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]interface{}{"Scheme": "basic", "Token": "abc", "HostUrl": "http://localhost/"}
+
+	for lang, expected := range map[string]string{
+		"ru":    "Сброс basic",
+		"ru-RU": "Сброс basic",
+		"ru_RU": "Сброс basic",
+		"fr":    "Reset basic: http://localhost/#reset?token=abc",
+		"":      "Reset basic: http://localhost/#reset?token=abc",
+	} {
+		msg, err := lt.execute(lang, "Default subject", "bob@example.com", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.plain != expected {
+			t.Errorf("lang '%s': expected '%s', got '%s'", lang, expected, msg.plain)
+		}
+		if strings.HasPrefix(lang, "ru") && msg.subject != "Сброс пароля" {
+			t.Errorf("lang '%s': expected localized subject, got '%s'", lang, msg.subject)
+		} else if !strings.HasPrefix(lang, "ru") && msg.subject != "Default subject" {
+			t.Errorf("lang '%s': expected default subject, got '%s'", lang, msg.subject)
+		}
+	}
+
+	// Template without sub-templates is an HTML body.
+	lt, err = loadTemplates(filepath.Join(dir, "validation.templ"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := lt.execute("en", "Confirm", "bob@example.com", map[string]interface{}{"Code": "123456"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.html != "<p>Code 123456</p>" || msg.plain != "" {
+		t.Errorf("legacy template rendered incorrectly: '%s' '%s'", msg.html, msg.plain)
+	}
+}
+
+func TestRetryTransientFailure(t *testing.T) {
+	dir := writeTemplates(t)
+	defer os.RemoveAll(dir)
+
+	srv := newSMTPStandIn(t)
+	srv.failCount, srv.failCode = 2, "451"
+	srv.start(t, false)
+	defer srv.close()
+
+	v := newTestValidator(t, dir, map[string]interface{}{"smtp_port": srv.port(), "send_attempts": 3})
+	if err := v.ResetSecret("alice@example.com", "basic", "", []byte("token")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitMessage(t, srv)
+	if attempts := len(srv.attempts); attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestNoRetryPermanentFailure(t *testing.T) {
+	dir := writeTemplates(t)
+	defer os.RemoveAll(dir)
+
+	srv := newSMTPStandIn(t)
+	srv.failCount, srv.failCode = 1, "550"
+	srv.start(t, false)
+	defer srv.close()
+
+	v := newTestValidator(t, dir, map[string]interface{}{"smtp_port": srv.port()})
+	if err := v.ResetSecret("alice@example.com", "basic", "", []byte("token")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-srv.received:
+		t.Fatal("permanently rejected message must not be retried")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if attempts := len(srv.attempts); attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	dir := writeTemplates(t)
+	defer os.RemoveAll(dir)
+
+	srv := newSMTPStandIn(t)
+	srv.startTLS = true
+	srv.login, srv.password = "noreply@example.com", "secret"
+	srv.start(t, false)
+	defer srv.close()
+
+	v := newTestValidator(t, dir, map[string]interface{}{
+		"smtp_port":       srv.port(),
+		"smtp_tls":        "starttls",
+		"sender_password": "secret",
+	})
+	if err := v.ResetSecret("alice@example.com", "basic", "", []byte("token")); err != nil {
+		t.Fatal(err)
+	}
+	waitMessage(t, srv)
+}
+
+func TestStartTLSRequired(t *testing.T) {
+	dir := writeTemplates(t)
+	defer os.RemoveAll(dir)
+
+	srv := newSMTPStandIn(t)
+	srv.start(t, false)
+	defer srv.close()
+
+	v := newTestValidator(t, dir, map[string]interface{}{"smtp_port": srv.port(), "smtp_tls": "starttls"})
+	msg, err := v.resetTempl.execute("", "Reset", "alice@example.com", map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = v.send(msg.to, v.compose(msg)); err == nil {
+		t.Fatal("delivery must fail when the server does not support STARTTLS")
+	}
+}
+
+func TestImplicitTLS(t *testing.T) {
+	dir := writeTemplates(t)
+	defer os.RemoveAll(dir)
+
+	srv := newSMTPStandIn(t)
+	srv.login, srv.password = "mailer", "secret"
+	srv.start(t, true)
+	defer srv.close()
+
+	v := newTestValidator(t, dir, map[string]interface{}{
+		"smtp_port":       srv.port(),
+		"smtp_tls":        "tls",
+		"login":           "mailer",
+		"sender_password": "secret",
+	})
+	if err := v.ResetSecret("alice@example.com", "basic", "ru", []byte("token")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := waitMessage(t, srv)
+	dec := new(mime.WordDecoder)
+	if subj, _ := dec.DecodeHeader(msg.Header.Get("Subject")); subj != "Сброс пароля" {
+		t.Error("wrong subject", subj)
+	}
+}
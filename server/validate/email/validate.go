@@ -8,19 +8,18 @@ import (
 	"encoding/json"
 	"errors"
 	ht "html/template"
-	"log"
 	"math/rand"
 	"net/mail"
 	"net/smtp"
 	"net/url"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
+	tt "text/template"
 	"time"
 
 	"github.com/tinode/chat/server/store"
 	t "github.com/tinode/chat/server/store/types"
+	"github.com/tinode/chat/server/validate"
 )
 
 // Validator configuration.
@@ -38,11 +37,25 @@ type validator struct {
 	SMTPAddr            string   `json:"smtp_server"`
 	SMTPPort            string   `json:"smtp_port"`
 	Domains             []string `json:"domains"`
-
-	htmlValidationTempl *ht.Template
-	htmlResetTempl      *ht.Template
-	auth                smtp.Auth
-	senderEmail         string
+	// Connection security: "" to use STARTTLS when available, "starttls" to require it,
+	// "tls" for implicit TLS.
+	TLSMode string `json:"smtp_tls"`
+	// Do not verify server's certificate. Use for testing only.
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+	// Maximum number of messages waiting for delivery.
+	QueueSize int `json:"queue_size"`
+	// Number of delivery attempts before a message is dropped.
+	SendAttempts int `json:"send_attempts"`
+	// Delay in seconds before the first retry, doubled after each failed attempt.
+	RetryBackoff int `json:"retry_backoff"`
+
+	validationTempl localizedTempl
+	resetTempl      localizedTempl
+	auth            smtp.Auth
+	senderEmail     string
+	senderDomain    string
+	queue           chan *message
+	retryBackoff    time.Duration
 }
 
 const (
@@ -59,6 +72,83 @@ const (
 	maxCodeValue = 1000000
 )
 
+// mailTempl is a template of an email message. The template may define "subject", "body_plain"
+// and "body_html" sub-templates. A template without any of the body sub-templates is treated as
+// an HTML body.
+type mailTempl struct {
+	// Template of the subject and the plain text body.
+	text *tt.Template
+	// Template of the HTML body.
+	html *ht.Template
+}
+
+// localizedTempl is a set of message templates indexed by language code.
+type localizedTempl struct {
+	validate.Localized
+}
+
+// parseMailTempl parses the template file as both text and HTML template.
+func parseMailTempl(path string) (*mailTempl, error) {
+	var mt mailTempl
+	var err error
+	if mt.text, err = tt.ParseFiles(path); err != nil {
+		return nil, err
+	}
+	if mt.html, err = ht.ParseFiles(path); err != nil {
+		return nil, err
+	}
+	return &mt, nil
+}
+
+// loadTemplates parses the template file and its localized versions.
+func loadTemplates(path string) (localizedTempl, error) {
+	loc, err := validate.LoadLocalized(path, func(file string) (interface{}, error) {
+		return parseMailTempl(file)
+	})
+	return localizedTempl{loc}, err
+}
+
+// execute renders the message for the given language like "es-MX" falling back to "es",
+// then to default. The subject is taken from the template if defined there.
+func (lt localizedTempl) execute(lang, subject, to string, data interface{}) (*message, error) {
+	templ := lt.Get(lang).(*mailTempl)
+
+	msg := &message{to: to, subject: subject}
+	buf := new(bytes.Buffer)
+	if templ.text.Lookup("subject") != nil {
+		if err := templ.text.ExecuteTemplate(buf, "subject", data); err != nil {
+			return nil, err
+		}
+		msg.subject = strings.TrimSpace(buf.String())
+		buf.Reset()
+	}
+
+	if templ.text.Lookup("body_plain") == nil && templ.html.Lookup("body_html") == nil {
+		// Legacy template: the entire template is the HTML body.
+		if err := templ.html.Execute(buf, data); err != nil {
+			return nil, err
+		}
+		msg.html = buf.String()
+		return msg, nil
+	}
+
+	if templ.text.Lookup("body_plain") != nil {
+		if err := templ.text.ExecuteTemplate(buf, "body_plain", data); err != nil {
+			return nil, err
+		}
+		msg.plain = strings.TrimSpace(buf.String())
+		buf.Reset()
+	}
+	if templ.html.Lookup("body_html") != nil {
+		if err := templ.html.ExecuteTemplate(buf, "body_html", data); err != nil {
+			return nil, err
+		}
+		msg.html = strings.TrimSpace(buf.String())
+	}
+
+	return msg, nil
+}
+
 // Init: initialize validator.
 func (v *validator) Init(jsonconf string) error {
 	var err error
@@ -71,36 +161,28 @@ func (v *validator) Init(jsonconf string) error {
 		return err
 	}
 	v.senderEmail = sender.Address
+	v.senderDomain = domainOf(sender.Address)
 
 	// Check if login is provided explicitly. Otherwise parse Sender and use that as login for authentication.
-	if v.Login != "" {
-		v.auth = smtp.PlainAuth("", v.Login, v.SenderPassword, v.SMTPAddr)
-	} else {
-		// SendFrom could be an RFC 5322 address of the form "John Doe <jdoe@example.com>". Parse it.
-		v.auth = smtp.PlainAuth("", v.senderEmail, v.SenderPassword, v.SMTPAddr)
-	}
-
-	// If a relative path is provided, try to resolve it relative to the exec file location,
-	// not whatever directory the user is in.
-	if !filepath.IsAbs(v.ValidationTemplFile) {
-		basepath, err := os.Executable()
-		if err == nil {
-			v.ValidationTemplFile = filepath.Join(filepath.Dir(basepath), v.ValidationTemplFile)
+	if v.SenderPassword != "" {
+		if v.Login != "" {
+			v.auth = smtp.PlainAuth("", v.Login, v.SenderPassword, v.SMTPAddr)
+		} else {
+			// SendFrom could be an RFC 5322 address of the form "John Doe <jdoe@example.com>". Parse it.
+			v.auth = smtp.PlainAuth("", v.senderEmail, v.SenderPassword, v.SMTPAddr)
 		}
 	}
-	if !filepath.IsAbs(v.ResetTemplFile) {
-		basepath, err := os.Executable()
-		if err == nil {
-			v.ResetTemplFile = filepath.Join(filepath.Dir(basepath), v.ResetTemplFile)
-		}
+
+	switch v.TLSMode {
+	case tlsModeOpportunistic, tlsModeStartTLS, tlsModeImplicit:
+	default:
+		return errors.New("invalid smtp_tls mode '" + v.TLSMode + "'")
 	}
 
-	v.htmlValidationTempl, err = ht.ParseFiles(v.ValidationTemplFile)
-	if err != nil {
+	if v.validationTempl, err = loadTemplates(v.ValidationTemplFile); err != nil {
 		return err
 	}
-	v.htmlResetTempl, err = ht.ParseFiles(v.ResetTemplFile)
-	if err != nil {
+	if v.resetTempl, err = loadTemplates(v.ResetTemplFile); err != nil {
 		return err
 	}
 
@@ -131,12 +213,24 @@ func (v *validator) Init(jsonconf string) error {
 	if v.SMTPPort == "" {
 		v.SMTPPort = defaultPort
 	}
+	if v.QueueSize <= 0 {
+		v.QueueSize = defaultQueueSize
+	}
+	if v.SendAttempts <= 0 {
+		v.SendAttempts = defaultSendAttempts
+	}
+	v.retryBackoff = defaultRetryBackoff
+	if v.RetryBackoff > 0 {
+		v.retryBackoff = time.Duration(v.RetryBackoff) * time.Second
+	}
+
+	v.startSender()
 
 	return nil
 }
 
 // PreCheck validates the credential and parameters without sending an email.
-func (v *validator) PreCheck(cred string, params interface{}) error {
+func (v *validator) PreCheck(cred string, params interface{}, resp string) error {
 	if len(cred) > maxEmailLength {
 		return t.ErrMalformed
 	}
@@ -191,11 +285,11 @@ func (v *validator) Request(user t.Uid, email, lang, resp string, tmpToken []byt
 	resp = strconv.FormatInt(int64(rand.Intn(maxCodeValue)), 10)
 	resp = strings.Repeat("0", codeLength-len(resp)) + resp
 
-	body := new(bytes.Buffer)
-	if err := v.htmlValidationTempl.Execute(body, map[string]interface{}{
+	msg, err := v.validationTempl.execute(lang, v.ValidationSubject, email, map[string]interface{}{
 		"Token":   string(token),
 		"Code":    resp,
-		"HostUrl": v.HostUrl}); err != nil {
+		"HostUrl": v.HostUrl})
+	if err != nil {
 		return false, err
 	}
 
@@ -209,12 +303,17 @@ func (v *validator) Request(user t.Uid, email, lang, resp string, tmpToken []byt
 		return false, err
 	}
 
-	// Send email without blocking. Email sending may take long time.
-	go v.send(email, v.ValidationSubject, string(body.Bytes()))
+	// Queue the email for delivery. Email sending may take long time.
+	v.enqueue(msg)
 
 	return isNew, nil
 }
 
+// Normalize converts the email to lowercase.
+func (v *validator) Normalize(cred string) (string, error) {
+	return strings.ToLower(cred), nil
+}
+
 // ResetSecret sends a message with instructions for resetting an authentication secret.
 func (v *validator) ResetSecret(email, scheme, lang string, tmpToken []byte) error {
 	// Normalize email to make sure Unicode case collisions don't lead to security problems.
@@ -222,16 +321,16 @@ func (v *validator) ResetSecret(email, scheme, lang string, tmpToken []byte) err
 
 	token := make([]byte, base64.URLEncoding.EncodedLen(len(tmpToken)))
 	base64.URLEncoding.Encode(token, tmpToken)
-	body := new(bytes.Buffer)
-	if err := v.htmlResetTempl.Execute(body, map[string]interface{}{
+	msg, err := v.resetTempl.execute(lang, v.ResetSubject, email, map[string]interface{}{
 		"Token":   string(token),
 		"Scheme":  scheme,
-		"HostUrl": v.HostUrl}); err != nil {
+		"HostUrl": v.HostUrl})
+	if err != nil {
 		return err
 	}
 
-	// Send email without blocking. Email sending may take long time.
-	go v.send(email, v.ResetSubject, string(body.Bytes()))
+	// Queue the email for delivery. Email sending may take long time.
+	v.enqueue(msg)
 
 	return nil
 }
@@ -279,28 +378,6 @@ func (v *validator) Remove(user t.Uid, value string) error {
 	return store.Users.DelCred(user, validatorName, value)
 }
 
-// This is a basic SMTP sender which connects to a server using login/password.
-// -
-// See here how to send email from Amazon SES:
-// https://docs.aws.amazon.com/sdk-for-go/api/service/ses/#example_SES_SendEmail_shared00
-// -
-// Here are instructions for Google cloud:
-// https://cloud.google.com/appengine/docs/standard/go/mail/sending-receiving-with-mail-api
-func (v *validator) send(to, subj, body string) error {
-	err := smtp.SendMail(v.SMTPAddr+":"+v.SMTPPort, v.auth, v.senderEmail, []string{to},
-		[]byte("From: "+v.SendFrom+
-			"\nTo: "+to+
-			"\nSubject: "+subj+
-			"\nMIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n"+
-			body))
-
-	if err != nil {
-		log.Println("SMTP error", to, err)
-	}
-
-	return err
-}
-
 func init() {
 	store.RegisterValidator(validatorName, &validator{})
 }
@@ -0,0 +1,58 @@
+package validate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Localized is a set of localized versions of a resource, like a message template, indexed by
+// lowercase language code. The default version has key "".
+type Localized map[string]interface{}
+
+// LoadLocalized parses the file and its localized versions with the provided parse function.
+// Localized versions are found by adding the language code before the extension,
+// i.e. email-validation-body.ru.templ.
+func LoadLocalized(path string, parse func(path string) (interface{}, error)) (Localized, error) {
+	// If a relative path is provided, try to resolve it relative to the exec file location,
+	// not whatever directory the user is in.
+	if !filepath.IsAbs(path) {
+		basepath, err := os.Executable()
+		if err == nil {
+			path = filepath.Join(filepath.Dir(basepath), path)
+		}
+	}
+
+	def, err := parse(path)
+	if err != nil {
+		return nil, err
+	}
+	loc := Localized{"": def}
+
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	localized, err := filepath.Glob(base + ".*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range localized {
+		lang := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(file, base+"."), ext))
+		if loc[lang], err = parse(file); err != nil {
+			return nil, err
+		}
+	}
+
+	return loc, nil
+}
+
+// Get returns the version for the given language like "es-MX" falling back to "es", then to default.
+func (loc Localized) Get(lang string) interface{} {
+	lang = strings.ToLower(strings.Replace(lang, "_", "-", -1))
+	if val, ok := loc[lang]; ok {
+		return val
+	}
+	if val, ok := loc[strings.SplitN(lang, "-", 2)[0]]; ok {
+		return val
+	}
+	return loc[""]
+}
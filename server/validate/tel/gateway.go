@@ -0,0 +1,193 @@
+package tel
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Gateway is an interface which must be implemented by SMS delivery services.
+type Gateway interface {
+	// Init initializes the gateway.
+	Init(jsonconf json.RawMessage) error
+
+	// Send delivers a text message to the given phone number in E.164 format.
+	Send(to, body string) error
+}
+
+var gateways = make(map[string]Gateway)
+
+// RegisterGateway makes an SMS gateway available by the provided name.
+// If RegisterGateway is called twice with the same name or if gateway is nil, it panics.
+func RegisterGateway(name string, gw Gateway) {
+	if gw == nil {
+		panic("RegisterGateway: gateway is nil")
+	}
+	if _, dup := gateways[name]; dup {
+		panic("RegisterGateway: called twice for gateway " + name)
+	}
+	gateways[name] = gw
+}
+
+// Default timeout of HTTP requests to SMS provider.
+const defaultHttpTimeout = 10 * time.Second
+
+// httpGateway sends SMS through an HTTP API of an SMS provider. The request is described by
+// a template, so most providers can be used without writing any code.
+type httpGateway struct {
+	// Endpoint of the provider's API.
+	Url string `json:"url"`
+	// HTTP method, default POST.
+	Method string `json:"method"`
+	// Additional request headers, i.e. API keys.
+	Headers map[string]string `json:"headers"`
+	// Optional login and password for HTTP basic authentication.
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	// Content-Type of the request, default "application/json".
+	ContentType string `json:"content_type"`
+	// Template of the request body. Fields {{.To}} and {{.Body}} are available, {{json .Body}}
+	// produces a quoted JSON string.
+	BodyTempl string `json:"body_templ"`
+	// Request timeout in seconds.
+	Timeout int `json:"timeout"`
+
+	bodyTempl *template.Template
+	client    *http.Client
+}
+
+// Init parses the config and the request template.
+func (gw *httpGateway) Init(jsonconf json.RawMessage) error {
+	if err := json.Unmarshal(jsonconf, gw); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if gw.Url == "" {
+		return errors.New("missing url")
+	}
+	if gw.Method == "" {
+		gw.Method = http.MethodPost
+	}
+	if gw.ContentType == "" {
+		gw.ContentType = "application/json"
+	}
+	if gw.BodyTempl == "" {
+		gw.BodyTempl = `{"to":{{json .To}},"body":{{json .Body}}}`
+	}
+
+	var err error
+	gw.bodyTempl, err = template.New("body").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(gw.BodyTempl)
+	if err != nil {
+		return err
+	}
+
+	timeout := defaultHttpTimeout
+	if gw.Timeout > 0 {
+		timeout = time.Duration(gw.Timeout) * time.Second
+	}
+	gw.client = &http.Client{Timeout: timeout}
+
+	return nil
+}
+
+// Send makes a request to the provider. Any 2xx response is considered a success.
+func (gw *httpGateway) Send(to, body string) error {
+	buf := new(bytes.Buffer)
+	if err := gw.bodyTempl.Execute(buf, map[string]string{"To": to, "Body": body}); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(gw.Method, gw.Url, buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", gw.ContentType)
+	for key, val := range gw.Headers {
+		req.Header.Set(key, val)
+	}
+	if gw.Login != "" {
+		req.SetBasicAuth(gw.Login, gw.Password)
+	}
+
+	resp, err := gw.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		text, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("SMS provider responded with %d: %s", resp.StatusCode, text)
+	}
+	// Drain the body so the connection can be reused.
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return nil
+}
+
+// fileGateway does not send anything, it writes messages to a file or STDOUT as JSON lines.
+// Useful for testing and debugging.
+type fileGateway struct {
+	// Path to the file to append messages to. Blank or "-" means STDOUT.
+	Path string `json:"path"`
+
+	lock sync.Mutex
+	out  io.Writer
+}
+
+// Init opens the output file.
+func (gw *fileGateway) Init(jsonconf json.RawMessage) error {
+	if len(jsonconf) > 0 {
+		if err := json.Unmarshal(jsonconf, gw); err != nil {
+			return errors.New("failed to parse config: " + err.Error())
+		}
+	}
+
+	if gw.Path == "" || gw.Path == "-" {
+		gw.out = os.Stdout
+		return nil
+	}
+
+	file, err := os.OpenFile(gw.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	gw.out = file
+	return nil
+}
+
+// Send writes the message to the output.
+func (gw *fileGateway) Send(to, body string) error {
+	line, err := json.Marshal(map[string]interface{}{
+		"ts":   time.Now().UTC().Round(time.Millisecond),
+		"to":   to,
+		"body": body,
+	})
+	if err != nil {
+		return err
+	}
+
+	gw.lock.Lock()
+	defer gw.lock.Unlock()
+
+	_, err = gw.out.Write(append(line, '\n'))
+	return err
+}
+
+func init() {
+	RegisterGateway("http", &httpGateway{})
+	RegisterGateway("file", &fileGateway{})
+}
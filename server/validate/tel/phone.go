@@ -0,0 +1,136 @@
+package tel
+
+import (
+	"strings"
+
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// Maximum length of an E.164 number excluding the leading '+'.
+const maxE164Length = 15
+
+// Minimum length of an E.164 number excluding the leading '+'. Shorter numbers are not used
+// for mobile phones anywhere.
+const minE164Length = 8
+
+// countryRule describes the numbering plan of a country.
+type countryRule struct {
+	// Country calling code.
+	code string
+	// National trunk prefix which is dropped when the number is converted to international format.
+	trunk string
+	// Allowed lengths of the national significant number, i.e. the number without the country code
+	// and the trunk prefix.
+	minLen, maxLen int
+}
+
+// Numbering plans of some countries indexed by ISO 3166-1 alpha-2 country code.
+// Numbers of other countries are checked against generic E.164 rules only.
+var countryRules = map[string]*countryRule{
+	"AR": {code: "54", trunk: "0", minLen: 10, maxLen: 11},
+	"AU": {code: "61", trunk: "0", minLen: 9, maxLen: 9},
+	"BR": {code: "55", trunk: "0", minLen: 10, maxLen: 11},
+	"CA": {code: "1", trunk: "1", minLen: 10, maxLen: 10},
+	"CN": {code: "86", trunk: "0", minLen: 9, maxLen: 11},
+	"DE": {code: "49", trunk: "0", minLen: 6, maxLen: 13},
+	"ES": {code: "34", minLen: 9, maxLen: 9},
+	"FR": {code: "33", trunk: "0", minLen: 9, maxLen: 9},
+	"GB": {code: "44", trunk: "0", minLen: 9, maxLen: 10},
+	"ID": {code: "62", trunk: "0", minLen: 8, maxLen: 12},
+	"IN": {code: "91", trunk: "0", minLen: 10, maxLen: 10},
+	"IT": {code: "39", minLen: 6, maxLen: 11},
+	"JP": {code: "81", trunk: "0", minLen: 9, maxLen: 10},
+	"KR": {code: "82", trunk: "0", minLen: 8, maxLen: 10},
+	"MX": {code: "52", minLen: 10, maxLen: 10},
+	"NL": {code: "31", trunk: "0", minLen: 9, maxLen: 9},
+	"PL": {code: "48", minLen: 9, maxLen: 9},
+	"RU": {code: "7", trunk: "8", minLen: 10, maxLen: 10},
+	"TR": {code: "90", trunk: "0", minLen: 10, maxLen: 10},
+	"UA": {code: "380", trunk: "0", minLen: 9, maxLen: 9},
+	"US": {code: "1", trunk: "1", minLen: 10, maxLen: 10},
+}
+
+// Numbering plans indexed by country calling code. Countries which share the calling code
+// (i.e. US and CA) have identical rules.
+var codeRules map[string]*countryRule
+
+func init() {
+	codeRules = make(map[string]*countryRule, len(countryRules))
+	for _, rule := range countryRules {
+		codeRules[rule.code] = rule
+	}
+}
+
+// normalizePhone converts a phone number to E.164 format, i.e. "+18003287448". Numbers without the
+// international prefix ('+' or "00") are treated as national numbers of the defaultCountry.
+// Returns the normalized number and the country calling code.
+func normalizePhone(raw, defaultCountry string) (string, string, error) {
+	var digits strings.Builder
+	intl := false
+	for i, r := range strings.TrimSpace(raw) {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+			intl = true
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+			// Visual separators are ignored.
+		default:
+			return "", "", t.ErrMalformed
+		}
+	}
+
+	num := digits.String()
+	if !intl && strings.HasPrefix(num, "00") {
+		intl = true
+		num = num[2:]
+	}
+
+	if intl {
+		// Find the country by the longest known calling code. Calling codes are prefix-free.
+		for l := 1; l <= 3 && l < len(num); l++ {
+			if rule := codeRules[num[:l]]; rule != nil {
+				// Numbers are sometimes written like +44 (0)20..., drop the trunk prefix.
+				national, ok := rule.national(num[l:], rule.trunk == "0")
+				if !ok {
+					return "", "", t.ErrMalformed
+				}
+				return "+" + rule.code + national, rule.code, nil
+			}
+		}
+
+		// Unknown country, check generic rules only.
+		if len(num) < minE164Length || len(num) > maxE164Length || num[0] == '0' {
+			return "", "", t.ErrMalformed
+		}
+		return "+" + num, "", nil
+	}
+
+	rule := countryRules[defaultCountry]
+	if rule == nil {
+		// Country is unknown: the number must be in international format.
+		return "", "", t.ErrMalformed
+	}
+	national, ok := rule.national(num, true)
+	if !ok {
+		return "", "", t.ErrMalformed
+	}
+	return "+" + rule.code + national, rule.code, nil
+}
+
+// national validates the national significant number optionally removing the trunk prefix.
+func (rule *countryRule) national(num string, dropTrunk bool) (string, bool) {
+	valid := func(n string) bool {
+		return len(n) >= rule.minLen && len(n) <= rule.maxLen && len(rule.code)+len(n) <= maxE164Length
+	}
+
+	// The trunk prefix is removed only if the rest of the number is valid: in some countries
+	// (i.e. Russia) the national number may start with the same digit as the trunk prefix.
+	if dropTrunk && rule.trunk != "" && strings.HasPrefix(num, rule.trunk) && valid(num[len(rule.trunk):]) {
+		return num[len(rule.trunk):], true
+	}
+	if !valid(num) || num[0] == '0' && rule.trunk == "0" {
+		return "", false
+	}
+	return num, true
+}
@@ -0,0 +1,75 @@
+package tel
+
+import (
+	"testing"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	cases := []struct {
+		raw, country string
+		phone, code  string
+	}{
+		// International format with visual separators.
+		{"+1 (800) 328-7448", "", "+18003287448", "1"},
+		{" +49 30 1234567 ", "US", "+49301234567", "49"},
+		// International prefix "00".
+		{"0044 20 7946 0958", "", "+442079460958", "44"},
+		// Trunk prefix written in the international number.
+		{"+44 (0)20 7946 0958", "", "+442079460958", "44"},
+		// National numbers.
+		{"800.328.7448", "US", "+18003287448", "1"},
+		{"1 800 328 7448", "US", "+18003287448", "1"},
+		{"020 7946 0958", "GB", "+442079460958", "44"},
+		{"8 916 123-45-67", "RU", "+79161234567", "7"},
+		{"916 123 45 67", "RU", "+79161234567", "7"},
+		// National number starts with the same digit as the trunk prefix.
+		{"+7 800 123 45 67", "", "+78001234567", "7"},
+		{"8 800 123 45 67", "RU", "+78001234567", "7"},
+		// Country without a numbering plan: generic rules only.
+		{"+358 40 1234567", "", "+358401234567", ""},
+	}
+
+	for _, tc := range cases {
+		phone, code, err := normalizePhone(tc.raw, tc.country)
+		if err != nil {
+			t.Errorf("'%s' (%s): unexpected error %s", tc.raw, tc.country, err)
+			continue
+		}
+		if phone != tc.phone || code != tc.code {
+			t.Errorf("'%s' (%s): expected '%s' (%s), got '%s' (%s)", tc.raw, tc.country,
+				tc.phone, tc.code, phone, code)
+		}
+	}
+}
+
+func TestNormalizePhoneInvalid(t *testing.T) {
+	cases := []struct {
+		raw, country string
+	}{
+		// Empty.
+		{"", "US"},
+		// Letters.
+		{"+1 800 CALL-NOW", ""},
+		// Misplaced '+'.
+		{"1+8003287448", "US"},
+		// Too short for the country.
+		{"555-1234", "US"},
+		{"+1234", ""},
+		// Too long for the country.
+		{"+39 12345678901234", ""},
+		// National number of unknown or missing country.
+		{"800 328 7448", ""},
+		{"800 328 7448", "XX"},
+		// Calling codes don't start with 0.
+		{"+0012345678", ""},
+		// Generic rules: too short and too long.
+		{"+358 401", ""},
+		{"+358 4012345678901", ""},
+	}
+
+	for _, tc := range cases {
+		if phone, _, err := normalizePhone(tc.raw, tc.country); err == nil {
+			t.Errorf("'%s' (%s): expected error, got '%s'", tc.raw, tc.country, phone)
+		}
+	}
+}
@@ -1,48 +1,254 @@
+// This phone validator sends confirmation codes by SMS through a pluggable gateway.
+
 package tel
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
 	"github.com/tinode/chat/server/store"
 	t "github.com/tinode/chat/server/store/types"
+	"github.com/tinode/chat/server/validate"
 )
 
-const validatorName = "tel"
-
-// Empty placeholder struct.
+// Validator configuration.
 type validator struct {
+	// Address of the host where the Tinode server is running, used in reset instructions.
+	HostUrl string `json:"host_url"`
+	// Templates of the messages. Localized templates are looked up by adding the language code
+	// before the extension, i.e. sms-validation.es.templ.
+	ValidationTemplFile string `json:"validation_templ"`
+	ResetTemplFile      string `json:"reset_templ"`
+	// ISO 3166-1 country code to use for numbers in national format.
+	DefaultCountry string `json:"default_country"`
+	// Optional list of countries where phone numbers are accepted.
+	Countries []string `json:"countries"`
+	// Number of digits in the confirmation code.
+	CodeLength int `json:"code_length"`
+	// Lifetime of the confirmation code in seconds.
+	CodeExpiresIn int    `json:"code_expires_in"`
 	DebugResponse string `json:"debug_response"`
 	MaxRetries    int    `json:"max_retries"`
+	// Name of the SMS gateway and its configuration.
+	Gateway       string          `json:"gateway"`
+	GatewayConfig json.RawMessage `json:"gateway_config"`
+
+	validationTempl localizedTempl
+	resetTempl      localizedTempl
+	gateway         Gateway
+	// Allowed country calling codes, nil if any country is allowed.
+	callingCodes map[string]bool
+}
+
+const (
+	validatorName = "tel"
+
+	maxRetries        = 4
+	defaultCodeLength = 6
+	maxCodeLength     = 10
+	defaultExpiresIn  = 15 * 60
+
+	// Maximum length of the phone number as entered by the user, with separators.
+	maxPhoneLength = 32
+)
+
+// localizedTempl is a set of message templates indexed by language code.
+type localizedTempl struct {
+	validate.Localized
+}
+
+// loadTemplates parses the template file and its localized versions.
+func loadTemplates(path string) (localizedTempl, error) {
+	loc, err := validate.LoadLocalized(path, func(file string) (interface{}, error) {
+		return template.ParseFiles(file)
+	})
+	return localizedTempl{loc}, err
+}
+
+// execute renders the template for the given language like "es-MX" falling back to "es",
+// then to default.
+func (lt localizedTempl) execute(lang string, data interface{}) (string, error) {
+	body := new(bytes.Buffer)
+	if err := lt.Get(lang).(*template.Template).Execute(body, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(body.String()), nil
 }
 
-// Init is a noop.
+// Init: initialize validator.
 func (v *validator) Init(jsonconf string) error {
-	// Implement: Parse config and initialize SMS service.
+	var err error
+	if err = json.Unmarshal([]byte(jsonconf), v); err != nil {
+		return err
+	}
+
+	v.DefaultCountry = strings.ToUpper(v.DefaultCountry)
+	if v.DefaultCountry != "" && countryRules[v.DefaultCountry] == nil {
+		return errors.New("unknown default_country " + v.DefaultCountry)
+	}
+	if len(v.Countries) > 0 {
+		v.callingCodes = make(map[string]bool)
+		for _, country := range v.Countries {
+			rule := countryRules[strings.ToUpper(country)]
+			if rule == nil {
+				return errors.New("unknown country " + country)
+			}
+			v.callingCodes[rule.code] = true
+		}
+	}
+
+	if v.validationTempl, err = loadTemplates(v.ValidationTemplFile); err != nil {
+		return err
+	}
+	if v.resetTempl, err = loadTemplates(v.ResetTemplFile); err != nil {
+		return err
+	}
 
-	v.MaxRetries = 1000
-	v.DebugResponse = "123456"
+	if v.gateway = gateways[v.Gateway]; v.gateway == nil {
+		return errors.New("unknown SMS gateway '" + v.Gateway + "'")
+	}
+	if err = v.gateway.Init(v.GatewayConfig); err != nil {
+		return errors.New("failed to initialize SMS gateway '" + v.Gateway + "': " + err.Error())
+	}
+
+	if v.CodeLength <= 0 {
+		v.CodeLength = defaultCodeLength
+	} else if v.CodeLength > maxCodeLength {
+		v.CodeLength = maxCodeLength
+	}
+	if v.CodeExpiresIn <= 0 {
+		v.CodeExpiresIn = defaultExpiresIn
+	}
+	if v.MaxRetries == 0 {
+		v.MaxRetries = maxRetries
+	}
 
 	return nil
 }
 
-// PreCheck validates the credential and parameters without sending an SMS or making the call.
-func (*validator) PreCheck(cred string, params interface{}) error {
-	// TODO: Check phone format. Format phone for E.164
-	// TODO: Check phone uniqueness
+// normalize converts the phone number to E.164 format and checks if the country is allowed.
+func (v *validator) normalize(phone string) (string, error) {
+	if len(phone) > maxPhoneLength {
+		return "", t.ErrMalformed
+	}
+
+	phone, code, err := normalizePhone(phone, v.DefaultCountry)
+	if err != nil {
+		return "", err
+	}
+	if v.callingCodes != nil && !v.callingCodes[code] {
+		return "", t.ErrPolicy
+	}
+
+	return phone, nil
+}
+
+// checkUnique checks if the phone number is not already validated by another user.
+func checkUnique(user t.Uid, phone string) error {
+	uid, err := store.Users.GetByCred(validatorName, phone)
+	if err != nil {
+		return err
+	}
+	if !uid.IsZero() && uid != user {
+		return t.ErrDuplicate
+	}
 	return nil
 }
 
-// Request sends a request for confirmation to the user: makes a record in DB  and nothing else.
-func (*validator) Request(user t.Uid, cred, lang, resp string, tmpToken []byte) (bool, error) {
-	// TODO: actually send a validation SMS or make a call to the provided `cred` here.
-	return true, nil
+// PreCheck validates the credential and parameters without sending an SMS or making the call.
+func (v *validator) PreCheck(cred string, params interface{}, resp string) error {
+	phone, err := v.normalize(cred)
+	if err != nil {
+		return err
+	}
+
+	return checkUnique(t.ZeroUid, phone)
+}
+
+// Request sends a validation SMS with the confirmation code to the user and saves the expected
+// response in DB.
+func (v *validator) Request(user t.Uid, cred, lang, resp string, tmpToken []byte) (bool, error) {
+	// Phone validator cannot accept an immediate response.
+	if resp != "" {
+		return false, t.ErrFailed
+	}
+
+	phone, err := v.normalize(cred)
+	if err != nil {
+		return false, err
+	}
+	if err = checkUnique(user, phone); err != nil {
+		return false, err
+	}
+
+	code, err := v.generateCode()
+	if err != nil {
+		return false, err
+	}
+
+	body, err := v.validationTempl.execute(lang, map[string]interface{}{
+		"Code":    code,
+		"HostUrl": v.HostUrl})
+	if err != nil {
+		return false, err
+	}
+
+	// Create or update validation record in DB. Expiration time is stored together with the code.
+	expires := time.Now().Add(time.Duration(v.CodeExpiresIn) * time.Second)
+	isNew, err := store.Users.UpsertCred(&t.Credential{
+		User:   user.String(),
+		Method: validatorName,
+		Value:  phone,
+		Resp:   code + ":" + strconv.FormatInt(expires.Unix(), 10)})
+	if err != nil {
+		return false, err
+	}
+
+	// Send SMS without blocking. Gateway may take long time to respond.
+	go v.send(phone, body)
+
+	return isNew, nil
+}
+
+// Normalize converts the phone number to E.164 format.
+func (v *validator) Normalize(cred string) (string, error) {
+	return v.normalize(cred)
 }
 
 // ResetSecret sends a message with instructions for resetting an authentication secret.
-func (*validator) ResetSecret(cred, scheme, lang string, tmpToken []byte) error {
-	// TODO: send SMS with rest instructions.
+func (v *validator) ResetSecret(cred, scheme, lang string, tmpToken []byte) error {
+	phone, err := v.normalize(cred)
+	if err != nil {
+		return err
+	}
+
+	token := make([]byte, base64.URLEncoding.EncodedLen(len(tmpToken)))
+	base64.URLEncoding.Encode(token, tmpToken)
+	body, err := v.resetTempl.execute(lang, map[string]interface{}{
+		"Token":   string(token),
+		"Scheme":  scheme,
+		"HostUrl": v.HostUrl})
+	if err != nil {
+		return err
+	}
+
+	// Send SMS without blocking. Gateway may take long time to respond.
+	go v.send(phone, body)
+
 	return nil
 }
 
 // Check checks validity of user's response.
+// Returns the value of validated credential on success.
 func (v *validator) Check(user t.Uid, resp string) (string, error) {
 	cred, err := store.Users.GetActiveCred(user, validatorName)
 	if err != nil {
@@ -63,7 +269,18 @@ func (v *validator) Check(user t.Uid, resp string) (string, error) {
 	}
 
 	// Comparing with dummy response too.
-	if cred.Resp == resp || v.DebugResponse == resp {
+	if v.DebugResponse != "" && v.DebugResponse == resp {
+		return cred.Value, store.Users.ConfirmCred(user, validatorName)
+	}
+
+	// Expected response is stored as "code:expiration-time".
+	parts := strings.SplitN(cred.Resp, ":", 2)
+	if len(parts) == 2 {
+		if expires, err := strconv.ParseInt(parts[1], 10, 64); err != nil || time.Now().Unix() > expires {
+			return "", t.ErrExpired
+		}
+	}
+	if parts[0] == resp {
 		// Valid response, save confirmation.
 		return cred.Value, store.Users.ConfirmCred(user, validatorName)
 	}
@@ -74,19 +291,38 @@ func (v *validator) Check(user t.Uid, resp string) (string, error) {
 	return "", t.ErrCredentials
 }
 
-// Delete deletes user's records. Returns deleted credentials.
+// Delete deletes user's records.
 func (*validator) Delete(user t.Uid) error {
 	return store.Users.DelCred(user, validatorName, "")
 }
 
-// Remove or disable the given record
-func (*validator) Remove(user t.Uid, value string) error {
+// Remove deactivates or removes user's credential.
+func (v *validator) Remove(user t.Uid, value string) error {
+	// Credentials are stored normalized.
+	if phone, err := v.normalize(value); err == nil {
+		value = phone
+	}
 	return store.Users.DelCred(user, validatorName, value)
 }
 
-// Implement sending a text message
-func (*validator) send(to, body string) error {
-	return nil
+// generateCode generates a random numeric code of configured length.
+func (v *validator) generateCode() (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(v.CodeLength)), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	code := n.String()
+	return strings.Repeat("0", v.CodeLength-len(code)) + code, nil
+}
+
+// send delivers a text message through the configured gateway.
+func (v *validator) send(to, body string) error {
+	err := v.gateway.Send(to, body)
+	if err != nil {
+		log.Println("SMS error", to, err)
+	}
+	return err
 }
 
 func init() {
@@ -11,8 +11,12 @@ type Validator interface {
 	Init(jsonconf string) error
 
 	// PreCheck pre-validates the credential without sending an actual request for validation:
-	// check uniqueness (if appropriate), format, etc
-	PreCheck(cred string, params interface{}) error
+	// check uniqueness (if appropriate), format, etc. Called before the user account is created.
+	//   cred: credential being validated, such as email or phone.
+	//   params: optional method-specific parameters.
+	//   resp: optional response if user already has it (i.e. captcha/recaptcha). Validators which
+	//     check responses immediately must reject an invalid response here, before the account is created.
+	PreCheck(cred string, params interface{}, resp string) error
 
 	// Request sends a request for confirmation to the user. Returns true if it's a new credential,
 	// false if it re-sent request for an existing unconfirmed credential.
@@ -23,6 +27,10 @@ type Validator interface {
 	//   tmpToken: temporary authentication token to include in the request.
 	Request(user t.Uid, cred, lang, resp string, tmpToken []byte) (bool, error)
 
+	// Normalize converts the credential to the form in which it's stored, such as lowercase email
+	// or E.164 phone number. Returns an error if the credential is invalid.
+	Normalize(cred string) (string, error)
+
 	// ResetSecret sends a message with instructions for resetting an authentication secret.
 	//   cred: address to use for the message.
 	//   scheme: authentication scheme being reset.
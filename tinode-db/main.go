@@ -16,11 +16,18 @@ import (
 	_ "github.com/tinode/chat/server/db/mongodb"
 	_ "github.com/tinode/chat/server/db/mysql"
 	_ "github.com/tinode/chat/server/db/rethinkdb"
+	"github.com/tinode/chat/server/media"
+	_ "github.com/tinode/chat/server/media/fs"
 	"github.com/tinode/chat/server/store"
 )
 
 type configType struct {
 	StoreConfig json.RawMessage `json:"store_config"`
+	// Media section of the server config, used for relocating uploaded files.
+	Media *struct {
+		UseHandler string                     `json:"use_handler"`
+		Handlers   map[string]json.RawMessage `json:"handlers"`
+	} `json:"media"`
 }
 
 type vCardy struct {
@@ -170,6 +177,7 @@ func main() {
 	var upgrade = flag.Bool("upgrade", false, "perform database version upgrade")
 	var datafile = flag.String("data", "", "name of file with sample data to load")
 	var conffile = flag.String("config", "./tinode.conf", "config of the database connection")
+	var relocate = flag.Bool("relocate_media", false, "move uploaded files to the layout set in media config")
 
 	flag.Parse()
 
@@ -214,6 +222,9 @@ func main() {
 		} else {
 			log.Fatal("Failed to init DB adapter:", err)
 		}
+	} else if *relocate {
+		relocateMedia(&config)
+		return
 	} else if *reset {
 		log.Println("Database reset requested")
 	} else {
@@ -238,3 +249,25 @@ func main() {
 
 	genDb(&data)
 }
+
+// relocateMedia moves uploaded files to the storage layout configured in the media handler config.
+func relocateMedia(config *configType) {
+	if config.Media == nil || config.Media.UseHandler == "" {
+		log.Fatal("Media handler is not configured")
+	}
+	var conf string
+	if params := config.Media.Handlers[config.Media.UseHandler]; params != nil {
+		conf = string(params)
+	}
+	if err := store.UseMediaHandler(config.Media.UseHandler, conf); err != nil {
+		log.Fatal("Failed to init media handler:", err)
+	}
+
+	relocator, ok := store.GetMediaHandler().(media.Relocator)
+	if !ok {
+		log.Fatalf("Media handler '%s' does not support relocation", config.Media.UseHandler)
+	}
+	if err := relocator.Relocate(); err != nil {
+		log.Fatal("Failed to relocate media:", err)
+	}
+}